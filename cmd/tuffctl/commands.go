@@ -0,0 +1,783 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/uf2"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/client"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/configtext"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/hidusage"
+)
+
+// ctl runs commands against one connected pad.
+type ctl struct {
+	ctx     context.Context
+	client  *client.Client
+	out     io.Writer
+	json    bool
+	timeout time.Duration
+	port    string // -port; empty to search
+}
+
+// dispatch runs the command named by args[0].
+func (c *ctl) dispatch(args []string) error {
+	// Commands that may not need a connected pad
+	switch args[0] {
+	case "discover":
+		return c.discover()
+	case "lint":
+		return c.lint(args[1:])
+	}
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "ping":
+		return c.ping(args[1:])
+	case "version":
+		return c.version()
+	case "device-config":
+		return c.deviceConfig(args[1:])
+	case "profile":
+		return c.profile(args[1:])
+	case "stats":
+		return c.stats()
+	case "unlock":
+		return c.unlock(args[1:])
+	case "factory-reset":
+		return c.factoryReset(args[1:])
+	case "update":
+		return c.update(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q (try help)", args[0])
+	}
+}
+
+// print writes v as JSON in -json mode, or calls text otherwise.
+func (c *ctl) print(v any, text func(w io.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text(c.out)
+	return nil
+}
+
+func (c *ctl) discover() error {
+	pads, err := findPads(c.ctx, c.timeout)
+	if err != nil {
+		return err
+	}
+	if pads == nil {
+		pads = []padInfo{}
+	}
+	return c.print(pads, func(w io.Writer) {
+		if len(pads) == 0 {
+			fmt.Fprintln(w, "no Tuffpads found")
+		}
+		for _, p := range pads {
+			fmt.Fprintf(w, "%s  %s  serial %s  board %s\n",
+				p.Port, p.Identity.Firmware, p.Identity.Serial, p.Identity.Board)
+		}
+	})
+}
+
+func (c *ctl) ping(args []string) error {
+	payload := []byte("tuffctl")
+	if len(args) > 0 {
+		payload = []byte(args[0])
+	}
+
+	start := time.Now()
+	if err := c.client.Ping(c.ctx, payload); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	result := struct {
+		Echo   string  `json:"echo"`
+		TimeMs float64 `json:"time_ms"`
+	}{string(payload), float64(elapsed.Microseconds()) / 1000}
+	return c.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "pong %q in %.1f ms\n", result.Echo, result.TimeMs)
+	})
+}
+
+func (c *ctl) version() error {
+	id, err := c.client.GetVersion(c.ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(id, func(w io.Writer) {
+		fmt.Fprintf(w, "firmware  %s\n", id.Firmware)
+		fmt.Fprintf(w, "commit    %s\n", id.Commit)
+		fmt.Fprintf(w, "built     %s\n", id.BuildDate)
+		fmt.Fprintf(w, "board     %s\n", id.Board)
+		fmt.Fprintf(w, "config    v%d\n", id.ConfigVersion)
+		if id.Serial != "" {
+			fmt.Fprintf(w, "serial    %s\n", id.Serial)
+		}
+	})
+}
+
+// deviceConfigJSON is the JSON form of config.DeviceConfig.
+type deviceConfigJSON struct {
+	Version       uint16 `json:"version"`
+	Flags         uint32 `json:"flags"`
+	Locked        bool   `json:"locked"`
+	ActiveProfile uint8  `json:"active_profile"`
+	Brightness    uint8  `json:"brightness"`
+	DebounceMs    uint8  `json:"debounce_ms"`
+	HistoryDepth  uint8  `json:"history_depth"` // 0 default, 255 off
+}
+
+func (c *ctl) deviceConfig(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: device-config get|set|history|restore")
+	}
+
+	switch args[0] {
+	case "get":
+		cfg, err := c.client.GetDeviceConfig(c.ctx)
+		if err != nil {
+			return err
+		}
+		return c.printDeviceConfig(cfg)
+
+	case "set":
+		fs := flag.NewFlagSet("device-config set", flag.ContinueOnError)
+		active := fs.Uint("active", 0, "active profile slot")
+		brightness := fs.Uint("brightness", 0, "LED brightness (0-255)")
+		debounce := fs.Uint("debounce", 0, "input debounce time in ms")
+		flags := fs.Uint("flags", 0, "global feature flags")
+		history := fs.String("history", "", "earlier versions kept per record: 1-16, off or default")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		// Start from the stored config; a fresh pad has none yet
+		cfg, err := c.client.GetDeviceConfig(c.ctx)
+		if errors.Is(err, client.ErrNotFound) {
+			cfg, err = &config.DeviceConfig{Version: config.CurrentVersion}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rangeErr error
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "active":
+				rangeErr = errors.Join(rangeErr, checkByte("active", *active))
+				cfg.ActiveProfile = uint8(*active)
+			case "brightness":
+				rangeErr = errors.Join(rangeErr, checkByte("brightness", *brightness))
+				cfg.Brightness = uint8(*brightness)
+			case "debounce":
+				rangeErr = errors.Join(rangeErr, checkByte("debounce", *debounce))
+				cfg.DebounceMs = uint8(*debounce)
+			case "flags":
+				cfg.Flags = uint32(*flags)
+			case "history":
+				depth, err := parseHistoryDepth(*history)
+				rangeErr = errors.Join(rangeErr, err)
+				cfg.HistoryDepth = depth
+			}
+		})
+		if rangeErr != nil {
+			return rangeErr
+		}
+		if ps := cfg.Validate(); ps != nil {
+			return ps
+		}
+
+		if err := c.client.SetDeviceConfig(c.ctx, cfg); err != nil {
+			return err
+		}
+		return c.printDeviceConfig(cfg)
+
+	case "history":
+		gens, err := c.client.DeviceHistory(c.ctx)
+		if err != nil {
+			return err
+		}
+		return c.printHistory(gens)
+
+	case "restore":
+		if len(args) > 2 {
+			return errors.New("usage: device-config restore [generation]")
+		}
+		gen, err := pickGeneration(args[1:], func() ([]client.Generation, error) {
+			return c.client.DeviceHistory(c.ctx)
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.client.RestoreDevice(c.ctx, gen); err != nil {
+			return err
+		}
+		cfg, err := c.client.GetDeviceConfig(c.ctx)
+		if err != nil {
+			return err
+		}
+		return c.printDeviceConfig(cfg)
+
+	default:
+		return fmt.Errorf("unknown device-config command %q", args[0])
+	}
+}
+
+func checkByte(name string, v uint) error {
+	if v > 255 {
+		return fmt.Errorf("%s must be 0-255", name)
+	}
+	return nil
+}
+
+func (c *ctl) printDeviceConfig(cfg *config.DeviceConfig) error {
+	v := deviceConfigJSON{
+		Version:       cfg.Version,
+		Flags:         cfg.Flags,
+		Locked:        cfg.Locked(),
+		ActiveProfile: cfg.ActiveProfile,
+		Brightness:    cfg.Brightness,
+		DebounceMs:    cfg.DebounceMs,
+		HistoryDepth:  cfg.HistoryDepth,
+	}
+	return c.print(v, func(w io.Writer) {
+		fmt.Fprintf(w, "active profile  %d\n", v.ActiveProfile)
+		fmt.Fprintf(w, "brightness      %d\n", v.Brightness)
+		fmt.Fprintf(w, "debounce        %d ms\n", v.DebounceMs)
+		fmt.Fprintf(w, "history         %s\n", formatHistoryDepth(v.HistoryDepth))
+		fmt.Fprintf(w, "flags           0x%08X\n", v.Flags)
+		fmt.Fprintf(w, "locked          %v\n", v.Locked)
+	})
+}
+
+// parseHistoryDepth parses the -history flag of device-config set.
+func parseHistoryDepth(s string) (uint8, error) {
+	switch s {
+	case "default":
+		return config.HistoryDefault, nil
+	case "off":
+		return config.HistoryOff, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || n < 1 || n > uint64(config.MaxHistoryDepth) {
+		return 0, fmt.Errorf("history: %q is not 1-%d, off or default", s, config.MaxHistoryDepth)
+	}
+	return uint8(n), nil
+}
+
+func formatHistoryDepth(depth uint8) string {
+	switch depth {
+	case config.HistoryDefault:
+		return "default"
+	case config.HistoryOff:
+		return "off"
+	default:
+		return strconv.Itoa(int(depth))
+	}
+}
+
+// profileJSON is the JSON form of config.Profile.
+type profileJSON struct {
+	Slot       uint8               `json:"slot"`
+	Version    uint16              `json:"version"`
+	Name       string              `json:"name"`
+	Flags      uint32              `json:"flags"`
+	RGBColor   uint32              `json:"rgb_color"`
+	RGBPattern uint8               `json:"rgb_pattern"`
+	Bindings   []config.KeyBinding `json:"bindings"`
+}
+
+func (c *ctl) profile(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: profile list|get|set|delete|history|restore")
+	}
+
+	switch args[0] {
+	case "list":
+		return c.listProfiles()
+
+	case "get":
+		fs := flag.NewFlagSet("profile get", flag.ContinueOnError)
+		output := fs.String("o", "", "save the profile to this file (.toml for text, otherwise binary)")
+		slot, err := parseSlotArgs(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		return c.getProfile(slot, *output)
+
+	case "set":
+		if len(args) != 3 {
+			return errors.New("usage: profile set <slot> <file>")
+		}
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return err
+		}
+		p, err := readProfile(args[2])
+		if err != nil {
+			return err
+		}
+		if err := c.client.SetProfile(c.ctx, slot, p); err != nil {
+			return err
+		}
+		return c.print(map[string]any{"slot": slot, "saved": true}, func(w io.Writer) {
+			fmt.Fprintf(w, "saved profile %q to slot %d\n", p.GetName(), slot)
+		})
+
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("usage: profile delete <slot>")
+		}
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return err
+		}
+		if err := c.client.DeleteProfile(c.ctx, slot); err != nil {
+			return err
+		}
+		return c.print(map[string]any{"slot": slot, "deleted": true}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted slot %d\n", slot)
+		})
+
+	case "history":
+		if len(args) != 2 {
+			return errors.New("usage: profile history <slot>")
+		}
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return err
+		}
+		gens, err := c.client.ProfileHistory(c.ctx, slot)
+		if err != nil {
+			return err
+		}
+		return c.printHistory(gens)
+
+	case "restore":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("usage: profile restore <slot> [generation]")
+		}
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return err
+		}
+		gen, err := pickGeneration(args[2:], func() ([]client.Generation, error) {
+			return c.client.ProfileHistory(c.ctx, slot)
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.client.RestoreProfile(c.ctx, slot, gen); err != nil {
+			return err
+		}
+		return c.print(map[string]any{"slot": slot, "restored": gen}, func(w io.Writer) {
+			fmt.Fprintf(w, "restored generation %d to slot %d\n", gen, slot)
+		})
+
+	default:
+		return fmt.Errorf("unknown profile command %q", args[0])
+	}
+}
+
+func (c *ctl) printHistory(gens []client.Generation) error {
+	return c.print(gens, func(w io.Writer) {
+		if len(gens) == 0 {
+			fmt.Fprintln(w, "no history")
+		}
+		for _, g := range gens {
+			switch {
+			case g.Unreadable:
+				fmt.Fprintf(w, "%6d  (unreadable)\n", g.Generation)
+			case g.Name != "" || g.BindingCount != 0:
+				fmt.Fprintf(w, "%6d  %-16s %2d bindings\n", g.Generation, g.Name, g.BindingCount)
+			default:
+				fmt.Fprintf(w, "%6d\n", g.Generation)
+			}
+		}
+	})
+}
+
+// pickGeneration parses an optional generation argument. Without one it
+// returns the newest generation, undoing the last change.
+func pickGeneration(args []string, list func() ([]client.Generation, error)) (uint32, error) {
+	if len(args) == 1 {
+		gen, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid generation %q", args[0])
+		}
+		return uint32(gen), nil
+	}
+	gens, err := list()
+	if err != nil {
+		return 0, err
+	}
+	if len(gens) == 0 {
+		return 0, errors.New("no earlier version to restore")
+	}
+	return gens[0].Generation, nil
+}
+
+func (c *ctl) listProfiles() error {
+	entries, err := c.client.ListProfiles(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.print(entries, func(w io.Writer) {
+		if len(entries) == 0 {
+			fmt.Fprintln(w, "no profiles")
+		}
+		for _, e := range entries {
+			marker := " "
+			if e.Active {
+				marker = "*"
+			}
+			switch {
+			case e.Corrupted:
+				fmt.Fprintf(w, "%s%3d  (corrupted, save or restore it)\n", marker, e.Slot)
+				continue
+			case e.Unreadable:
+				fmt.Fprintf(w, "%s%3d  (unreadable)\n", marker, e.Slot)
+				continue
+			}
+			fmt.Fprintf(w, "%s%3d  %-16s %2d bindings  rgb #%06X\n", marker, e.Slot, e.Name, e.BindingCount, e.RGBColor)
+		}
+	})
+}
+
+func (c *ctl) getProfile(slot uint8, output string) error {
+	p, err := c.client.GetProfile(c.ctx, slot)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		if err := writeProfile(output, p); err != nil {
+			return err
+		}
+	}
+
+	count := int(p.BindingCount)
+	if count > config.MaxBindings {
+		count = config.MaxBindings
+	}
+	v := profileJSON{
+		Slot:       slot,
+		Version:    p.Version,
+		Name:       p.GetName(),
+		Flags:      p.Flags,
+		RGBColor:   p.RGBColor,
+		RGBPattern: p.RGBPattern,
+		Bindings:   p.Bindings[:count],
+	}
+	return c.print(v, func(w io.Writer) {
+		fmt.Fprintf(w, "slot %d: %s\n", slot, v.Name)
+		fmt.Fprintf(w, "  flags 0x%08X  rgb #%06X  pattern %d\n", v.Flags, v.RGBColor, v.RGBPattern)
+		for i, b := range v.Bindings {
+			fmt.Fprintf(w, "  %2d: in %d/%-2d -> %s flags 0x%02X\n",
+				i, b.InputType, b.InputID, hidusage.FormatOutput(b.OutputType, b.OutputValue, b.Modifiers), b.Flags)
+		}
+		if output != "" {
+			fmt.Fprintf(w, "saved to %s\n", output)
+		}
+	})
+}
+
+func (c *ctl) stats() error {
+	v, err := c.client.GetStorageStats(c.ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(v, func(w io.Writer) {
+		fmt.Fprintf(w, "total     %d bytes\n", v.Total)
+		fmt.Fprintf(w, "used      %d bytes\n", v.Used)
+		fmt.Fprintf(w, "free      %d bytes\n", v.Free)
+		if v.BlockSize != 0 {
+			fmt.Fprintf(w, "blocks    %d of %d bytes (%d used)\n", v.BlockCount, v.BlockSize, v.Used/v.BlockSize)
+		}
+		fmt.Fprintf(w, "profiles  %d\n", v.Profiles)
+	})
+}
+
+func (c *ctl) unlock(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: unlock <pin>")
+	}
+	pin, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("PIN must be 0-65535")
+	}
+
+	if err := c.client.Unlock(c.ctx, uint16(pin)); err != nil {
+		return err
+	}
+	return c.print(map[string]any{"unlocked": true}, func(w io.Writer) {
+		fmt.Fprintln(w, "unlocked")
+	})
+}
+
+func (c *ctl) factoryReset(args []string) error {
+	fs := flag.NewFlagSet("factory-reset", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "confirm erasing all configuration")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*yes {
+		return errors.New("factory-reset erases all profiles and settings; rerun with -yes")
+	}
+
+	if err := c.client.FactoryReset(c.ctx); err != nil {
+		return err
+	}
+	return c.print(map[string]any{"reset": true}, func(w io.Writer) {
+		fmt.Fprintln(w, "all configuration erased")
+	})
+}
+
+// flashBase is where RP2040 firmware images start.
+const flashBase = 0x10000000
+
+// update sends a firmware image to the pad, which verifies it, installs it
+// and reboots.
+func (c *ctl) update(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: update <firmware.uf2|firmware.bin>")
+	}
+	image, err := readFirmware(args[0])
+	if err != nil {
+		return err
+	}
+
+	var progress func(sent, total int)
+	if !c.json {
+		progress = func(sent, total int) {
+			fmt.Fprintf(c.out, "\rsent %d of %d bytes", sent, total)
+		}
+	}
+	err = c.client.UpdateFirmware(c.ctx, image, progress)
+	if progress != nil {
+		fmt.Fprintln(c.out)
+	}
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]any{"updated": true, "size": len(image)}, func(w io.Writer) {
+		fmt.Fprintln(w, "firmware installed, pad is rebooting")
+	})
+}
+
+// readFirmware loads a firmware image from a UF2 file, as built by TinyGo,
+// or from a raw binary starting at the beginning of flash.
+func readFirmware(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".uf2") {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%s: empty file", path)
+		}
+		return data, nil
+	}
+
+	blocks, err := uf2.Decode(data, uf2.FamilyRP2040)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	base, image := uf2.Flatten(blocks)
+	if image == nil {
+		return nil, fmt.Errorf("%s: no RP2040 blocks", path)
+	}
+	if base != flashBase {
+		return nil, fmt.Errorf("%s: image starts at 0x%08X, not at the start of flash", path, base)
+	}
+	return image, nil
+}
+
+// lintResult is the JSON form of one file checked by lint.
+type lintResult struct {
+	File     string        `json:"file"`
+	Error    string        `json:"error,omitempty"`
+	Problems []lintProblem `json:"problems"`
+}
+
+type lintProblem struct {
+	Field   string `json:"field"`
+	Offset  int    `json:"offset"`
+	Message string `json:"message"`
+}
+
+// lint checks profile files (.toml or binary) and device config files
+// (12-byte binary) with the same rules the pad applies, without a pad.
+func (c *ctl) lint(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: lint <file>...")
+	}
+
+	results := []lintResult{}
+	bad := 0
+	for _, path := range args {
+		r := lintResult{File: path, Problems: []lintProblem{}}
+		ps, err := lintFile(path)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		for _, p := range ps {
+			r.Problems = append(r.Problems, lintProblem{p.Field, p.Offset, p.Msg})
+		}
+		if err != nil || len(ps) > 0 {
+			bad++
+		}
+		results = append(results, r)
+	}
+
+	err := c.print(results, func(w io.Writer) {
+		for _, r := range results {
+			switch {
+			case r.Error != "":
+				fmt.Fprintln(w, r.Error)
+			case len(r.Problems) == 0:
+				fmt.Fprintf(w, "%s: ok\n", r.File)
+			default:
+				fmt.Fprintf(w, "%s:\n", r.File)
+				for _, p := range r.Problems {
+					fmt.Fprintf(w, "  %s: %s (offset %d)\n", p.Field, p.Message, p.Offset)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d files invalid", bad, len(args))
+	}
+	return nil
+}
+
+// lintFile decodes a profile or device config file and validates it.
+func lintFile(path string) (config.Problems, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isText(path) && len(data) == 12 {
+		var cfg config.DeviceConfig
+		cfg.UnmarshalBinary(data)
+		return cfg.Validate(), nil
+	}
+	p, err := decodeProfile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return p.Validate(), nil
+}
+
+// isText reports whether a profile file uses the text format.
+func isText(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".toml")
+}
+
+// readProfile loads a text (.toml) or binary profile file and checks it
+// with Validate, so invalid profiles are reported before they reach the pad.
+func readProfile(path string) (*config.Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeProfile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if ps := p.Validate(); ps != nil {
+		return nil, ps.In(path)
+	}
+	return p, nil
+}
+
+// decodeProfile parses a text (.toml) or binary profile.
+func decodeProfile(path string, data []byte) (*config.Profile, error) {
+	p := &config.Profile{}
+	if isText(path) {
+		if err := configtext.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("%s:\n%w", path, err)
+		}
+		return p, nil
+	}
+	if len(data) != 286 || p.UnmarshalBinary(data) != nil {
+		return nil, fmt.Errorf("%s: not a binary profile (%d bytes, want 286)", path, len(data))
+	}
+	return p, nil
+}
+
+// writeProfile saves a profile as text (.toml) or binary.
+func writeProfile(path string, p *config.Profile) error {
+	if isText(path) {
+		return os.WriteFile(path, configtext.Marshal(p), 0644)
+	}
+	data, _ := p.MarshalBinary()
+	return os.WriteFile(path, data, 0644)
+}
+
+// parseSlot parses a profile slot number.
+func parseSlot(s string) (uint8, error) {
+	slot, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid slot %q (0-255)", s)
+	}
+	return uint8(slot), nil
+}
+
+// parseSlotArgs parses "<slot> [flags]" or "[flags] <slot>".
+func parseSlotArgs(fs *flag.FlagSet, args []string) (uint8, error) {
+	arg, err := parseArg(fs, args, "slot")
+	if err != nil {
+		return 0, err
+	}
+	return parseSlot(arg)
+}
+
+// parseFileArgs parses "<file> [flags]" or "[flags] <file>".
+func parseFileArgs(fs *flag.FlagSet, args []string) (string, error) {
+	return parseArg(fs, args, "file")
+}
+
+// parseArg parses flags and one positional argument given before or after
+// them.
+func parseArg(fs *flag.FlagSet, args []string, name string) (string, error) {
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		if err := fs.Parse(args[1:]); err != nil {
+			return "", err
+		}
+		if fs.NArg() != 0 {
+			return "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+		}
+		return args[0], nil
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("usage: %s <%s>", fs.Name(), name)
+	}
+	return fs.Arg(0), nil
+}
@@ -0,0 +1,165 @@
+// Command tuffctl manages Tuffpad devices over USB serial.
+//
+// Usage:
+//
+//	tuffctl [-port /dev/ttyACM0] [-json] [-timeout 2s] <command> [args]
+//
+// Without -port, tuffctl uses the only Tuffpad it can find. Run
+// "tuffctl help" for the list of commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/serialport"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/client"
+)
+
+const usageText = `usage: tuffctl [flags] <command> [args]
+
+commands:
+  discover                         list connected Tuffpads
+  ping [text]                      check the connection
+  version                          firmware version and identity
+  device-config get                show the device config
+  device-config set [flags]        change the device config (see -h)
+  device-config history            list earlier device configs
+  device-config restore [gen]      restore an earlier device config
+  profile list                     list stored profiles
+  profile get <slot> [-o file]     show a profile, or save it (.toml or binary)
+  profile set <slot> <file>        upload a profile (.toml or binary)
+  profile delete <slot>            delete a profile
+  profile history <slot>           list earlier versions of a profile
+  profile restore <slot> [gen]     restore an earlier version (default: undo
+                                   the last change)
+  stats                            storage usage
+  unlock <pin>                     unlock writes on a locked pad
+  factory-reset -yes               erase all configuration
+  update <file>                    install firmware (.uf2 or raw .bin) and reboot
+  lint <file>...                   check profile and device.bin files offline
+
+flags:
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "tuffctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags, connects and runs one command.
+func run(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("tuffctl", flag.ContinueOnError)
+	port := fs.String("port", "", "serial device (default: the only Tuffpad found)")
+	jsonOut := fs.Bool("json", false, "print results as JSON")
+	timeout := fs.Duration("timeout", 2*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usageText)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || fs.Arg(0) == "help" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := &ctl{
+		ctx:     ctx,
+		out:     stdout,
+		json:    *jsonOut,
+		timeout: *timeout,
+		port:    *port,
+	}
+	defer c.close()
+
+	return c.dispatch(fs.Args())
+}
+
+// connect opens the pad given by -port, or the only one found.
+func (c *ctl) connect() error {
+	if c.client != nil {
+		return nil
+	}
+
+	path := c.port
+	if path == "" {
+		pads, err := findPads(c.ctx, c.timeout)
+		if err != nil {
+			return err
+		}
+		switch len(pads) {
+		case 0:
+			return errors.New("no Tuffpad found (use -port)")
+		case 1:
+			path = pads[0].Port
+		default:
+			return fmt.Errorf("%d Tuffpads found, choose one with -port", len(pads))
+		}
+	}
+
+	conn, err := serialport.Open(path)
+	if err != nil {
+		return err
+	}
+	c.client = client.New(conn)
+	c.client.SetTimeout(c.timeout)
+	return nil
+}
+
+// close disconnects from the pad, if connected.
+func (c *ctl) close() {
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+// padInfo describes a discovered device.
+type padInfo struct {
+	Port     string          `json:"port"`
+	Identity client.Identity `json:"identity"`
+}
+
+// findPads probes every candidate serial port with CmdDiscover.
+func findPads(ctx context.Context, timeout time.Duration) ([]padInfo, error) {
+	ports, err := serialport.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var pads []padInfo
+	for _, path := range ports {
+		conn, err := serialport.Open(path)
+		if err != nil {
+			continue
+		}
+		c := client.New(conn)
+		c.SetTimeout(timeout)
+		c.SetRetries(0)
+		id, err := c.Discover(ctx)
+		c.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		pads = append(pads, padInfo{Port: path, Identity: *id})
+	}
+	return pads, nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/uf2"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/client"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/session"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// newTestCtl serves a session over net.Pipe and returns a ctl on the host end.
+func newTestCtl(t *testing.T, jsonOut bool) (*ctl, *bytes.Buffer, *storage.Manager) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := storage.New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	host, device := net.Pipe()
+	go session.New(device, protocol.NewHandler(mgr)).Run()
+	t.Cleanup(func() {
+		host.Close()
+		device.Close()
+		mgr.Close()
+	})
+
+	var out bytes.Buffer
+	return &ctl{ctx: context.Background(), client: client.New(host), out: &out, json: jsonOut}, &out, mgr
+}
+
+func testProfile(name string) *config.Profile {
+	p := &config.Profile{Version: config.CurrentVersion, BindingCount: 1}
+	p.SetName(name)
+	p.Bindings[0] = config.KeyBinding{InputType: 0, InputID: 2, OutputType: 1, OutputValue: 0x04}
+	return p
+}
+
+func TestPing(t *testing.T) {
+	c, out, _ := newTestCtl(t, false)
+	if err := c.dispatch([]string{"ping", "hello"}); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), `pong "hello"`) {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestVersionJSON(t *testing.T) {
+	c, out, _ := newTestCtl(t, true)
+	if err := c.dispatch([]string{"version"}); err != nil {
+		t.Fatalf("version failed: %v", err)
+	}
+
+	var id client.Identity
+	if err := json.Unmarshal(out.Bytes(), &id); err != nil {
+		t.Fatalf("Output is not JSON: %v\n%s", err, out.String())
+	}
+	if id.Firmware == "" || id.ConfigVersion != config.CurrentVersion {
+		t.Errorf("Unexpected identity: %+v", id)
+	}
+}
+
+func TestDeviceConfigSet(t *testing.T) {
+	c, _, mgr := newTestCtl(t, false)
+	if err := c.dispatch([]string{"device-config", "set", "-brightness", "40", "-active", "2"}); err != nil {
+		t.Fatalf("device-config set failed: %v", err)
+	}
+
+	var cfg config.DeviceConfig
+	if err := mgr.LoadDevice(&cfg); err != nil {
+		t.Fatalf("LoadDevice failed: %v", err)
+	}
+	if cfg.Brightness != 40 || cfg.ActiveProfile != 2 {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+
+	// Unset flags keep their stored values
+	if err := c.dispatch([]string{"device-config", "set", "-debounce", "5"}); err != nil {
+		t.Fatalf("device-config set failed: %v", err)
+	}
+	mgr.LoadDevice(&cfg)
+	if cfg.Brightness != 40 || cfg.DebounceMs != 5 {
+		t.Errorf("Unexpected config after second set: %+v", cfg)
+	}
+
+	if err := c.dispatch([]string{"device-config", "set", "-brightness", "300"}); err == nil {
+		t.Error("Expected range error for brightness 300")
+	}
+
+	// The history depth reaches the pad's storage
+	if err := c.dispatch([]string{"device-config", "set", "-history", "off"}); err != nil {
+		t.Fatalf("device-config set failed: %v", err)
+	}
+	if mgr.LoadDevice(&cfg); cfg.HistoryDepth != config.HistoryOff || mgr.HistoryDepth() != 0 {
+		t.Errorf("History not turned off: %+v, depth %d", cfg, mgr.HistoryDepth())
+	}
+	for _, bad := range []string{"0", "17", "some"} {
+		if err := c.dispatch([]string{"device-config", "set", "-history", bad}); err == nil {
+			t.Errorf("Expected range error for history %s", bad)
+		}
+	}
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	c, out, mgr := newTestCtl(t, true)
+	dir := t.TempDir()
+
+	src := testProfile("Driving")
+	data, _ := src.MarshalBinary()
+	in := filepath.Join(dir, "in.bin")
+	os.WriteFile(in, data, 0644)
+
+	if err := c.dispatch([]string{"profile", "set", "3", in}); err != nil {
+		t.Fatalf("profile set failed: %v", err)
+	}
+	if !mgr.ProfileExists(3) {
+		t.Fatal("Profile not stored")
+	}
+
+	out.Reset()
+	if err := c.dispatch([]string{"profile", "list"}); err != nil {
+		t.Fatalf("profile list failed: %v", err)
+	}
+	var entries []client.ProfileEntry
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil {
+		t.Fatalf("Output is not JSON: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Slot != 3 || entries[0].Name != "Driving" {
+		t.Errorf("Unexpected list: %+v", entries)
+	}
+
+	out.Reset()
+	saved := filepath.Join(dir, "out.bin")
+	if err := c.dispatch([]string{"profile", "get", "3", "-o", saved}); err != nil {
+		t.Fatalf("profile get failed: %v", err)
+	}
+	var p profileJSON
+	if err := json.Unmarshal(out.Bytes(), &p); err != nil {
+		t.Fatalf("Output is not JSON: %v", err)
+	}
+	if p.Name != "Driving" || len(p.Bindings) != 1 || p.Bindings[0].OutputValue != 0x04 {
+		t.Errorf("Unexpected profile: %+v", p)
+	}
+	got, _ := os.ReadFile(saved)
+	if !bytes.Equal(got, data) {
+		t.Error("Saved binary differs from uploaded profile")
+	}
+
+	if err := c.dispatch([]string{"profile", "delete", "3"}); err != nil {
+		t.Fatalf("profile delete failed: %v", err)
+	}
+	if mgr.ProfileExists(3) {
+		t.Error("Profile still exists after delete")
+	}
+}
+
+func TestProfileRestore(t *testing.T) {
+	c, out, mgr := newTestCtl(t, false)
+	for _, name := range []string{"Good", "Broken"} {
+		if err := mgr.SaveProfile(4, testProfile(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.dispatch([]string{"profile", "history", "4"}); err != nil {
+		t.Fatalf("profile history failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Good") {
+		t.Errorf("Unexpected history output: %q", out.String())
+	}
+
+	// Without a generation, restore undoes the last change
+	if err := c.dispatch([]string{"profile", "restore", "4"}); err != nil {
+		t.Fatalf("profile restore failed: %v", err)
+	}
+	var p config.Profile
+	if err := mgr.LoadProfile(4, &p); err != nil || p.GetName() != "Good" {
+		t.Errorf("Restored profile %q, %v", p.GetName(), err)
+	}
+
+	if err := c.dispatch([]string{"profile", "restore", "5"}); err == nil || !strings.Contains(err.Error(), "no earlier version") {
+		t.Errorf("Expected no earlier version error, got %v", err)
+	}
+	if err := c.dispatch([]string{"device-config", "restore", "77"}); err == nil {
+		t.Error("Expected an error for an unknown generation")
+	}
+}
+
+func TestDeviceErrorReported(t *testing.T) {
+	c, _, _ := newTestCtl(t, false)
+	err := c.dispatch([]string{"profile", "get", "9"})
+	if err == nil {
+		t.Fatal("Expected error for missing profile")
+	}
+	var se *client.StatusError
+	if !errors.As(err, &se) || se.Status != protocol.StatusNotFound {
+		t.Fatalf("Expected not-found device error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), protocol.StatusText(protocol.StatusNotFound)) {
+		t.Errorf("Error text missing status name: %q", err.Error())
+	}
+}
+
+func TestFactoryReset(t *testing.T) {
+	c, _, mgr := newTestCtl(t, false)
+	mgr.SaveProfile(1, testProfile("Gone"))
+
+	if err := c.dispatch([]string{"factory-reset"}); err == nil {
+		t.Error("Expected factory-reset without -yes to refuse")
+	}
+	if !mgr.ProfileExists(1) {
+		t.Fatal("Profile erased without confirmation")
+	}
+
+	if err := c.dispatch([]string{"factory-reset", "-yes"}); err != nil {
+		t.Fatalf("factory-reset failed: %v", err)
+	}
+	if mgr.ProfileExists(1) {
+		t.Error("Profile survived factory reset")
+	}
+}
+
+func TestRunHelp(t *testing.T) {
+	var out bytes.Buffer
+	if err := run([]string{"help"}, &out); err == nil {
+		t.Error("Expected flag.ErrHelp for help")
+	}
+}
+
+func TestProfileText(t *testing.T) {
+	c, _, mgr := newTestCtl(t, false)
+	dir := t.TempDir()
+	mgr.SaveProfile(0, testProfile("Text"))
+
+	path := filepath.Join(dir, "text.toml")
+	if err := c.dispatch([]string{"profile", "get", "0", "-o", path}); err != nil {
+		t.Fatalf("profile get failed: %v", err)
+	}
+	text, _ := os.ReadFile(path)
+	if !strings.Contains(string(text), `name = "Text"`) {
+		t.Fatalf("Expected text profile, got:\n%s", text)
+	}
+
+	if err := c.dispatch([]string{"profile", "set", "1", path}); err != nil {
+		t.Fatalf("profile set failed: %v", err)
+	}
+	var a, b config.Profile
+	mgr.LoadProfile(0, &a)
+	mgr.LoadProfile(1, &b)
+	if a != b {
+		t.Errorf("Text round trip changed the profile: %+v != %+v", a, b)
+	}
+
+	bad := filepath.Join(dir, "bad.toml")
+	os.WriteFile(bad, []byte("name = \"x\"\nrgb_pattern = 999\n"), 0644)
+	err := c.dispatch([]string{"profile", "set", "2", bad})
+	if err == nil || !strings.Contains(err.Error(), "line 2:") {
+		t.Errorf("Expected error on line 2, got %v", err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	c, out, mgr := newTestCtl(t, false)
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.bin")
+	writeProfile(good, testProfile("Good"))
+	bad := filepath.Join(dir, "bad.toml")
+	os.WriteFile(bad, []byte(`name = "Bad"
+flags = ["kb_mode"]
+
+[[binding]]
+input = "dpad"
+id = 4
+output = "keyboard"
+value = "a"
+
+[[binding]]
+input = "key"
+id = 1
+output = "consumer"
+value = "mute"
+modifiers = ["left_ctrl"]
+`), 0644)
+	device := filepath.Join(dir, "device.bin")
+	cfg := config.DeviceConfig{Version: config.CurrentVersion, HistoryDepth: 17}
+	data, _ := cfg.MarshalBinary()
+	os.WriteFile(device, data, 0644)
+
+	err := c.dispatch([]string{"lint", good, bad, device})
+	if err == nil || err.Error() != "2 of 3 files invalid" {
+		t.Errorf("Unexpected lint result %v", err)
+	}
+	for _, want := range []string{
+		good + ": ok",
+		"  Bindings[0].InputID: 4 is beyond the last input (3) (offset 31)",
+		"  Bindings[1].Modifiers: only apply to keyboard outputs (offset 43)",
+		"  HistoryDepth: 17 is above 16 (255 turns history off) (offset 9)",
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("Output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	// profile set refuses the file before it reaches the pad
+	err = c.dispatch([]string{"profile", "set", "0", bad})
+	if err == nil || !strings.Contains(err.Error(), "Bindings[0].InputID") {
+		t.Errorf("Expected profile set to fail validation, got %v", err)
+	}
+	var p config.Profile
+	if err := mgr.LoadProfile(0, &p); err == nil {
+		t.Error("Invalid profile was stored")
+	}
+}
+
+// padFirmware installs firmware images and takes reboots in memory.
+type padFirmware struct {
+	image []byte
+}
+
+func (f *padFirmware) Install(image io.ReaderAt, size int64) error {
+	f.image = make([]byte, size)
+	_, err := image.ReadAt(f.image, 0)
+	return err
+}
+
+func (f *padFirmware) Reboot(reboot.Mode) error { return nil }
+
+func TestUpdate(t *testing.T) {
+	mgr, err := storage.New(tinyfs.NewMemoryDevice(256, 4096, 64), true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	fw := &padFirmware{}
+	h := protocol.NewHandler(mgr)
+	h.SetUpdater(dfu.New(tinyfs.NewMemoryDevice(256, 4096, 16), fw))
+	h.SetRebooter(fw)
+	host, device := net.Pipe()
+	go session.New(device, h).Run()
+	t.Cleanup(func() {
+		host.Close()
+		device.Close()
+		mgr.Close()
+	})
+	var out bytes.Buffer
+	c := &ctl{ctx: context.Background(), client: client.New(host), out: &out, json: true}
+
+	// Two pages with a gap, as TinyGo lays out boot2 and the program
+	blocks := []uf2.Block{
+		{Addr: 0x10000000, Data: bytes.Repeat([]byte{0xB2}, 256)},
+		{Addr: 0x10000200, Data: bytes.Repeat([]byte{0x5A}, 256)},
+	}
+	var buf bytes.Buffer
+	if err := uf2.Encode(&buf, uf2.FamilyRP2040, blocks); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "fw.uf2")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.dispatch([]string{"update", path}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if len(fw.image) != 0x300 || fw.image[0] != 0xB2 || fw.image[0x100] != 0xFF || fw.image[0x2FF] != 0x5A {
+		t.Errorf("Installed image is wrong (%d bytes)", len(fw.image))
+	}
+	if !strings.Contains(out.String(), `"updated": true`) {
+		t.Errorf("Unexpected output: %s", out.String())
+	}
+
+	// Images that do not start at the beginning of flash are refused
+	buf.Reset()
+	uf2.Encode(&buf, uf2.FamilyRP2040, blocks[1:])
+	os.WriteFile(path, buf.Bytes(), 0644)
+	if _, err := readFirmware(path); err == nil || !strings.Contains(err.Error(), "start of flash") {
+		t.Errorf("Expected start of flash error, got %v", err)
+	}
+}
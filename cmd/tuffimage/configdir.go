@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/configtext"
+)
+
+// configDir is the configuration to lay down: an optional device config and
+// profiles by slot.
+type configDir struct {
+	device   *config.DeviceConfig
+	profiles map[uint8]*config.Profile
+	slots    []uint8 // Sorted keys of profiles
+}
+
+func (c *configDir) String() string {
+	s := "no device config"
+	if c.device != nil {
+		s = fmt.Sprintf("device config (active profile %d)", c.device.ActiveProfile)
+	}
+	if len(c.slots) == 0 {
+		return s + ", no profiles"
+	}
+	names := make([]string, len(c.slots))
+	for i, slot := range c.slots {
+		names[i] = fmt.Sprintf("%d %q", slot, c.profiles[slot].GetName())
+	}
+	return fmt.Sprintf("%s, %d profiles: %s", s, len(c.slots), strings.Join(names, ", "))
+}
+
+// readConfigDir loads device.bin and <slot>.bin or <slot>.toml profiles
+// from dir. Every record must be at the current version and pass Validate;
+// all problems are reported at once.
+func readConfigDir(dir string) (*configDir, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &configDir{profiles: make(map[uint8]*config.Profile)}
+	var errs []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := c.load(path, name); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s:\n%s", dir, strings.Join(errs, "\n"))
+	}
+	if c.device == nil && len(c.slots) == 0 {
+		return nil, fmt.Errorf("%s: no device.bin or profiles", dir)
+	}
+	slices.Sort(c.slots)
+	return c, nil
+}
+
+// load reads one file of the config directory.
+func (c *configDir) load(path, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if name == "device.bin" {
+		var d config.DeviceConfig
+		if len(data) != 12 || d.UnmarshalBinary(data) != nil {
+			return fmt.Errorf("%s: not a device config (%d bytes, want 12)", name, len(data))
+		}
+		if err := checkRecord(name, d.Version, d.Validate()); err != nil {
+			return err
+		}
+		c.device = &d
+		return nil
+	}
+
+	ext := filepath.Ext(name)
+	slot, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 8)
+	if err != nil || (ext != ".bin" && ext != ".toml") {
+		return fmt.Errorf("%s: expected device.bin, <slot>.bin or <slot>.toml", name)
+	}
+	if _, dup := c.profiles[uint8(slot)]; dup {
+		return fmt.Errorf("%s: slot %d given twice", name, slot)
+	}
+
+	p := &config.Profile{}
+	if ext == ".toml" {
+		if err := configtext.Unmarshal(data, p); err != nil {
+			return fmt.Errorf("%s:\n%w", name, err)
+		}
+	} else if len(data) != 286 || p.UnmarshalBinary(data) != nil {
+		return fmt.Errorf("%s: not a binary profile (%d bytes, want 286)", name, len(data))
+	}
+	if err := checkRecord(name, p.Version, p.Validate()); err != nil {
+		return err
+	}
+	c.profiles[uint8(slot)] = p
+	c.slots = append(c.slots, uint8(slot))
+	return nil
+}
+
+// checkRecord rejects records the firmware would migrate or refuse.
+func checkRecord(name string, version uint16, ps config.Problems) error {
+	if version != config.CurrentVersion {
+		return fmt.Errorf("%s: version %d, this build writes %d", name, version, config.CurrentVersion)
+	}
+	if ps == nil {
+		return nil
+	}
+	return ps.In(name)
+}
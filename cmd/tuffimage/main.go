@@ -0,0 +1,193 @@
+// Command tuffimage builds a pre-provisioned configuration filesystem, so a
+// batch of pads can be flashed with firmware and a ready-made config in one
+// step.
+//
+// It reads a config directory (device.bin and <slot>.bin or <slot>.toml
+// profiles, as written by tuffctl profile get -o),
+// stores it with the firmware's storage code on an in-memory copy of the
+// RP2040 filesystem region, and writes the region as a raw image and as a
+// UF2:
+//
+//	tuffimage -o pad config/
+//	tuffimage -firmware waveshare-tuffpad.uf2 -o pad config/
+//
+// The region is fixed by pkg/partition: from partition.StorageStart to the
+// end of flash, whatever the firmware. With -firmware, pad.uf2 carries the
+// firmware as well, which must fit partition.FirmwareSize. The raw image
+// can be loaded with picotool or served with tuffsim -image.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/uf2"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// Flash geometry of the RP2040 boards: 256-byte pages, 4 KiB sectors,
+// flash mapped at flashBase.
+const (
+	pageSize  = 256
+	blockSize = 4096
+	flashBase = 0x10000000
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "tuffimage:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run parses flags, builds the filesystem and writes the outputs.
+func run(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("tuffimage", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: tuffimage [flags] <config-dir>")
+		fs.PrintDefaults()
+	}
+	out := fs.String("o", "tuffpad", "write <name>.bin and <name>.uf2")
+	firmware := fs.String("firmware", "", "firmware UF2 to include in the UF2")
+	flashSize := fs.Uint64("flash-size", 2<<20, "flash size in bytes (2 MiB on the Waveshare RP2040-Zero)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one config directory")
+	}
+	dir := fs.Arg(0)
+
+	var fwBlocks []uf2.Block
+	if *firmware != "" {
+		data, err := os.ReadFile(*firmware)
+		if err != nil {
+			return err
+		}
+		fwBlocks, err = uf2.Decode(data, uf2.FamilyRP2040)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *firmware, err)
+		}
+		if len(fwBlocks) == 0 {
+			return fmt.Errorf("%s: no RP2040 blocks", *firmware)
+		}
+	}
+
+	reg, err := newRegion(*flashSize, fwBlocks)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := readConfigDir(dir)
+	if err != nil {
+		return err
+	}
+
+	dev := tinyfs.NewMemoryDevice(pageSize, blockSize, reg.blocks())
+	if err := cfg.store(dev); err != nil {
+		return err
+	}
+	image := make([]byte, dev.Size())
+	dev.ReadAt(image, 0)
+
+	if err := os.WriteFile(*out+".bin", image, 0644); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	blocks := append(fwBlocks, reg.pages(image)...)
+	if err := uf2.Encode(&buf, uf2.FamilyRP2040, blocks); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out+".uf2", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "filesystem 0x%08X-0x%08X (%d blocks of %d bytes)\n", reg.start, reg.end, reg.blocks(), blockSize)
+	fmt.Fprintln(stdout, cfg)
+	fmt.Fprintf(stdout, "wrote %s.bin and %s.uf2 (%d UF2 blocks)\n", *out, *out, len(blocks))
+	return nil
+}
+
+// region is the flash address range of the filesystem.
+type region struct {
+	start, end uint32
+}
+
+// newRegion places the filesystem region as partition.Storage lays it out
+// on the pad, and checks that the firmware fits its area.
+func newRegion(flashSize uint64, firmware []uf2.Block) (region, error) {
+	if flashSize%blockSize != 0 || flashSize < partition.StorageStart+2*blockSize || flashSize > 16<<20 {
+		return region{}, fmt.Errorf("flash size %d is not a multiple of %d from %d to 16 MiB", flashSize, blockSize, partition.StorageStart+2*blockSize)
+	}
+	for _, b := range firmware {
+		if b.Addr < flashBase || uint64(b.End()) > flashBase+partition.FirmwareSize {
+			return region{}, fmt.Errorf("firmware block at 0x%08X is outside the firmware area (%d bytes)", b.Addr, partition.FirmwareSize)
+		}
+	}
+	return region{start: flashBase + partition.StorageStart, end: uint32(flashBase + flashSize)}, nil
+}
+
+func (r region) blocks() int {
+	return int(r.end-r.start) / blockSize
+}
+
+// pages splits an image of the region into UF2 blocks. Erased sectors are
+// left out: LittleFS never reads blocks it has not allocated, so whatever
+// the pad held there before is harmless.
+func (r region) pages(image []byte) []uf2.Block {
+	var blocks []uf2.Block
+	for off := 0; off < len(image); off += blockSize {
+		sector := image[off : off+blockSize]
+		if erased(sector) {
+			continue
+		}
+		for p := 0; p < blockSize; p += pageSize {
+			blocks = append(blocks, uf2.Block{
+				Addr: r.start + uint32(off+p),
+				Data: sector[p : p+pageSize],
+			})
+		}
+	}
+	return blocks
+}
+
+func erased(b []byte) bool {
+	for _, v := range b {
+		if v != 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+// store formats dev and saves the config with the firmware's storage code.
+func (c *configDir) store(dev tinyfs.BlockDevice) error {
+	mgr, err := storage.New(dev, true)
+	if err != nil {
+		return err
+	}
+	if c.device != nil {
+		if err := mgr.SaveDevice(c.device); err != nil {
+			mgr.Close()
+			return fmt.Errorf("device config: %w", err)
+		}
+	}
+	for _, slot := range c.slots {
+		if err := mgr.SaveProfile(slot, c.profiles[slot]); err != nil {
+			mgr.Close()
+			return fmt.Errorf("profile %d: %w", slot, err)
+		}
+	}
+	return mgr.Close()
+}
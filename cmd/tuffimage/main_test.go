@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/uf2"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/configtext"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// writeConfigDir writes a device config and two profiles, one as text.
+func writeConfigDir(t *testing.T) string {
+	dir := t.TempDir()
+	dev := config.DeviceConfig{Version: config.CurrentVersion, ActiveProfile: 3, Brightness: 80}
+	data, _ := dev.MarshalBinary()
+	os.WriteFile(filepath.Join(dir, "device.bin"), data, 0644)
+
+	for _, slot := range []uint8{0, 3} {
+		p := &config.Profile{Version: config.CurrentVersion, BindingCount: 1}
+		p.SetName("Slot" + string('0'+rune(slot)))
+		p.Bindings[0] = config.KeyBinding{InputID: slot, OutputType: config.OutputTypeKeyboard, OutputValue: 0x04}
+		if slot == 0 {
+			os.WriteFile(filepath.Join(dir, "0.toml"), configtext.Marshal(p), 0644)
+		} else {
+			data, _ := p.MarshalBinary()
+			os.WriteFile(filepath.Join(dir, "3.bin"), data, 0644)
+		}
+	}
+	return dir
+}
+
+// mountImage boots storage on a raw filesystem image.
+func mountImage(t *testing.T, image []byte) *storage.Manager {
+	dev := tinyfs.NewMemoryDevice(pageSize, blockSize, len(image)/blockSize)
+	dev.WriteAt(image, 0)
+	mgr, err := storage.New(dev, false)
+	if err != nil {
+		t.Fatalf("Image does not mount: %v", err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+	return mgr
+}
+
+func TestBuildImage(t *testing.T) {
+	dir := writeConfigDir(t)
+	out := filepath.Join(t.TempDir(), "pad")
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-flash-size", "0x180000", "-o", out, dir}
+	if err := run(args, &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %v\n%s", err, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "filesystem 0x10100000-0x10180000 (128 blocks") ||
+		!strings.Contains(stdout.String(), `2 profiles: 0 "Slot0", 3 "Slot3"`) {
+		t.Errorf("Unexpected output:\n%s", stdout.String())
+	}
+
+	image, _ := os.ReadFile(out + ".bin")
+	if len(image) != 128*blockSize {
+		t.Fatalf("Image is %d bytes", len(image))
+	}
+	mgr := mountImage(t, image)
+	var dev config.DeviceConfig
+	if err := mgr.LoadDevice(&dev); err != nil || dev.ActiveProfile != 3 || dev.Brightness != 80 {
+		t.Errorf("Device config %+v, %v", dev, err)
+	}
+	slots, _ := mgr.ListProfiles()
+	if len(slots) != 2 {
+		t.Errorf("Profiles in image: %v", slots)
+	}
+
+	// The UF2 carries the non-erased sectors at their flash addresses
+	data, _ := os.ReadFile(out + ".uf2")
+	blocks, err := uf2.Decode(data, uf2.FamilyRP2040)
+	if err != nil || len(blocks) == 0 {
+		t.Fatalf("UF2: %d blocks, %v", len(blocks), err)
+	}
+	rebuilt := bytes.Repeat([]byte{0xFF}, len(image))
+	for _, b := range blocks {
+		if b.Addr < 0x10100000 || b.End() > 0x10180000 || len(b.Data) != uf2.PayloadSize {
+			t.Fatalf("Block at 0x%08X outside the region", b.Addr)
+		}
+		copy(rebuilt[b.Addr-0x10100000:], b.Data)
+	}
+	if !bytes.Equal(rebuilt, image) {
+		t.Error("UF2 contents differ from the raw image")
+	}
+	if len(blocks) >= len(image)/uf2.PayloadSize {
+		t.Errorf("Erased sectors were not skipped (%d blocks)", len(blocks))
+	}
+}
+
+func TestBuildWithFirmware(t *testing.T) {
+	dir := writeConfigDir(t)
+	tmp := t.TempDir()
+	out := filepath.Join(tmp, "pad")
+
+	// The filesystem stays at 1 MiB whatever the firmware size
+	writeFirmware := func(size uint32) string {
+		var fw []uf2.Block
+		for addr := uint32(0x10000000); addr < 0x10000000+size; addr += uf2.PayloadSize {
+			fw = append(fw, uf2.Block{Addr: addr, Data: bytes.Repeat([]byte{0x42}, uf2.PayloadSize)})
+		}
+		var buf bytes.Buffer
+		uf2.Encode(&buf, uf2.FamilyRP2040, fw)
+		fwPath := filepath.Join(tmp, "fw.uf2")
+		os.WriteFile(fwPath, buf.Bytes(), 0644)
+		return fwPath
+	}
+	fwPath := writeFirmware(5000)
+	fwBlocks := (5000 + uf2.PayloadSize - 1) / uf2.PayloadSize
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-firmware", fwPath, "-o", out, dir}
+	if err := run(args, &stdout, &stderr); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "filesystem 0x10100000-0x10200000 (256 blocks") {
+		t.Errorf("Unexpected output:\n%s", stdout.String())
+	}
+
+	data, _ := os.ReadFile(out + ".uf2")
+	blocks, _ := uf2.Decode(data, uf2.FamilyRP2040)
+	if len(blocks) <= fwBlocks || blocks[0].Addr != 0x10000000 || blocks[fwBlocks].Addr != 0x10100000 {
+		t.Errorf("UF2 does not hold the firmware followed by the filesystem")
+	}
+
+	// The firmware may not run into the staging area
+	args = []string{"-firmware", writeFirmware(partition.FirmwareSize + 256), "-o", out, dir}
+	if err := run(args, &stdout, &stderr); err == nil || !strings.Contains(err.Error(), "outside the firmware area") {
+		t.Errorf("Expected a firmware size error, got %v", err)
+	}
+}
+
+func TestInvalidConfigDir(t *testing.T) {
+	dir := writeConfigDir(t)
+	p := config.Profile{Version: config.CurrentVersion, BindingCount: 1}
+	p.Bindings[0] = config.KeyBinding{InputType: config.BindingTypeDPad, InputID: 7, OutputType: config.OutputTypeKeyboard, OutputValue: 4}
+	data, _ := p.MarshalBinary()
+	os.WriteFile(filepath.Join(dir, "5.bin"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "3.toml"), []byte("name = \"dup\"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0644)
+
+	var stdout, stderr bytes.Buffer
+	err := run([]string{"-o", filepath.Join(t.TempDir(), "pad"), dir}, &stdout, &stderr)
+	if err == nil {
+		t.Fatal("run accepted an invalid config dir")
+	}
+	for _, want := range []string{
+		"5.bin: invalid\n  Bindings[0].InputID: 7 is beyond the last input (3) (offset 31)",
+		"3.toml: slot 3 given twice",
+		"notes.txt: expected device.bin",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error lacks %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestFlashSize(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	// Unaligned, no room after the staging area, too large
+	for _, size := range []string{"0x180800", "0x100000", "0x2000000"} {
+		err := run([]string{"-flash-size", size, writeConfigDir(t)}, &stdout, &stderr)
+		if err == nil {
+			t.Errorf("-flash-size %s accepted", size)
+		}
+	}
+}
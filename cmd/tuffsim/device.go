@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/keymap"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/session"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// Flash geometry of the RP2040 boards: 256-byte pages, 4 KiB sectors.
+const (
+	pageSize  = 256
+	blockSize = 4096
+)
+
+var (
+	errRebooting  = errors.New("rebooting")
+	errBootloader = errors.New("device entered the USB bootloader")
+)
+
+// device is one emulated pad: flash, storage and protocol handler, wired
+// up the same way as the firmware's main.
+type device struct {
+	flash   tinyfs.BlockDevice
+	serial  []byte
+	history int // Storage history depth, or -1 for the device config's
+	faults  faults
+	logger  *log.Logger
+	verbose bool
+
+	storage *storage.Manager
+	handler *protocol.Handler
+	keymap  *keymap.Keymap // Profile applied at boot, as on the pad
+
+	// Firmware update staging area, and the last image installed
+	stage    tinyfs.BlockDevice
+	firmware []byte
+
+	// Set by Reboot while a session is running
+	rebooting  bool
+	rebootMode reboot.Mode
+}
+
+// boot mounts storage and creates a fresh handler, as after a reset.
+func (d *device) boot(mode reboot.Mode) error {
+	if d.storage != nil {
+		d.storage.Close()
+	}
+
+	mgr, err := storage.New(d.flash, true)
+	if err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	if d.history >= 0 {
+		mgr.SetHistoryDepth(d.history)
+	}
+
+	if d.stage == nil {
+		// Same capacity as the staging partition of a pad
+		d.stage = tinyfs.NewMemoryDevice(pageSize, blockSize, partition.StageSize/blockSize)
+	}
+
+	keys, err := keymap.Load(mgr, mode)
+	if err != nil {
+		d.logger.Printf("profile not applied: %v", err)
+	} else if slot, _, ok := keys.Profile(); ok && d.verbose {
+		d.logger.Printf("applied profile %d", slot)
+	}
+
+	h := protocol.NewHandler(mgr)
+	h.SetSerialNumber(d.serial)
+	h.SetRebooter(d)
+	h.SetUpdater(dfu.New(d.stage, d))
+	h.SetBootMode(mode)
+
+	d.storage = mgr
+	d.handler = h
+	d.keymap = keys
+	d.rebooting = false
+	return nil
+}
+
+// Reboot implements reboot.Rebooter. The session sends the response first;
+// the link then ends the session and serve boots again in the new mode.
+func (d *device) Reboot(mode reboot.Mode) error {
+	if !mode.Valid() {
+		return reboot.ErrInvalidMode
+	}
+	d.rebooting = true
+	d.rebootMode = mode
+	return nil
+}
+
+// Install implements dfu.Installer. The emulator keeps running its own
+// code; it only records the image, which the reboot after the commit
+// "boots".
+func (d *device) Install(image io.ReaderAt, size int64) error {
+	buf := make([]byte, size)
+	if _, err := image.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	d.firmware = buf
+	d.logger.Printf("installed firmware image (%d bytes, CRC32 %08X)", size, crc32.ChecksumIEEE(buf))
+	return nil
+}
+
+// serve runs sessions over rw until it fails, rebooting in place when the
+// host asks. Rebooting into the bootloader ends the emulation, since the
+// real pad disappears from the bus.
+func (d *device) serve(rw io.ReadWriter) error {
+	for {
+		s := session.New(&link{rw: rw, dev: d}, d.handler)
+		if d.verbose {
+			s.SetObserver(logObserver{d.logger})
+		}
+
+		err := s.Run()
+		if !errors.Is(err, errRebooting) {
+			return err
+		}
+		if d.rebootMode == reboot.ModeBootloader {
+			return errBootloader
+		}
+
+		d.logger.Printf("rebooting (%s)", modeName(d.rebootMode))
+		if err := d.boot(d.rebootMode); err != nil {
+			return err
+		}
+	}
+}
+
+// Close unmounts storage and flushes a file-backed image.
+func (d *device) Close() error {
+	if d.storage != nil {
+		d.storage.Close()
+	}
+	if c, ok := d.flash.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func modeName(m reboot.Mode) string {
+	switch m {
+	case reboot.ModeNormal:
+		return "normal"
+	case reboot.ModeBootloader:
+		return "bootloader"
+	case reboot.ModeSafe:
+		return "safe mode"
+	default:
+		return fmt.Sprintf("mode %d", m)
+	}
+}
+
+// logObserver prints session traffic for -v.
+type logObserver struct {
+	logger *log.Logger
+}
+
+func (o logObserver) Incoming(frame *protocol.Frame) {
+	o.logger.Printf("<- cmd 0x%02X, %d bytes", frame.Cmd, len(frame.Payload))
+}
+
+func (o logObserver) Outgoing(resp *protocol.Response) {
+	o.logger.Printf("-> %s, %d bytes", protocol.StatusText(resp.Status), len(resp.Payload))
+}
+
+func (o logObserver) ConsoleLine(line string) {
+	o.logger.Printf("<- console %q", line)
+}
+
+func (o logObserver) Error(err error) {
+	o.logger.Printf("!! %v", err)
+}
+
+// imageDevice is a memory block device mirrored to a flash image file, so
+// the emulated pad keeps its configuration across runs.
+type imageDevice struct {
+	*tinyfs.MemBlockDevice
+	file *os.File
+}
+
+// openImage loads a flash image, or creates a blank one of blocks erase
+// blocks. An existing image keeps its own size.
+func openImage(path string, blocks int) (*imageDevice, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if st.Size() > 0 {
+		if st.Size()%blockSize != 0 {
+			f.Close()
+			return nil, fmt.Errorf("%s: size %d is not a multiple of the %d-byte erase block", path, st.Size(), blockSize)
+		}
+		blocks = int(st.Size() / blockSize)
+	}
+
+	dev := &imageDevice{
+		MemBlockDevice: tinyfs.NewMemoryDevice(pageSize, blockSize, blocks),
+		file:           f,
+	}
+
+	if st.Size() > 0 {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := dev.MemBlockDevice.WriteAt(data, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		// Save the erased image
+		data := make([]byte, dev.Size())
+		dev.MemBlockDevice.ReadAt(data, 0)
+		if _, err := f.WriteAt(data, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+func (d *imageDevice) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := d.MemBlockDevice.WriteAt(buf, off)
+	if err != nil {
+		return n, err
+	}
+	return d.file.WriteAt(buf[:n], off)
+}
+
+func (d *imageDevice) EraseBlocks(start, n int64) error {
+	if err := d.MemBlockDevice.EraseBlocks(start, n); err != nil {
+		return err
+	}
+	buf := make([]byte, n*blockSize)
+	d.MemBlockDevice.ReadAt(buf, start*blockSize)
+	_, err := d.file.WriteAt(buf, start*blockSize)
+	return err
+}
+
+func (d *imageDevice) Sync() error {
+	return d.file.Sync()
+}
+
+func (d *imageDevice) Close() error {
+	d.file.Sync()
+	return d.file.Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// faults configures the transport errors the emulator injects.
+type faults struct {
+	latency time.Duration // Delay before every write to the host
+	drop    float64       // Probability of losing each byte, both directions
+	corrupt float64       // Probability of corrupting each read or write
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (f *faults) validate() error {
+	if f.drop < 0 || f.drop > 1 {
+		return fmt.Errorf("-drop %g must be between 0 and 1", f.drop)
+	}
+	if f.corrupt < 0 || f.corrupt > 1 {
+		return fmt.Errorf("-corrupt %g must be between 0 and 1", f.corrupt)
+	}
+	if f.latency < 0 {
+		return fmt.Errorf("-latency %v must not be negative", f.latency)
+	}
+	return nil
+}
+
+func (f *faults) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rng.Float64() < p
+}
+
+// apply drops and corrupts bytes of b in place and returns what is left.
+// Corruption flips the last byte, which in a whole frame is the CRC.
+func (f *faults) apply(b []byte) []byte {
+	if f.drop > 0 {
+		kept := b[:0]
+		for _, c := range b {
+			if !f.chance(f.drop) {
+				kept = append(kept, c)
+			}
+		}
+		b = kept
+	}
+	if len(b) > 0 && f.chance(f.corrupt) {
+		b[len(b)-1] ^= 0xFF
+	}
+	return b
+}
+
+// link is the session transport: it passes bytes through with the
+// configured faults and ends the session once the device reboots.
+type link struct {
+	rw  io.ReadWriter
+	dev *device
+}
+
+func (l *link) Read(b []byte) (int, error) {
+	if l.dev.rebooting {
+		return 0, errRebooting
+	}
+	n, err := l.rw.Read(b)
+	if n > 0 {
+		n = copy(b, l.dev.faults.apply(b[:n]))
+	}
+	return n, err
+}
+
+func (l *link) Write(b []byte) (int, error) {
+	if l.dev.faults.latency > 0 {
+		time.Sleep(l.dev.faults.latency)
+	}
+	out := l.dev.faults.apply(append([]byte(nil), b...))
+	if _, err := l.rw.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetReadDeadline lets the session poll. Both ptys and TCP connections
+// support deadlines.
+func (l *link) SetReadDeadline(t time.Time) error {
+	if d, ok := l.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Command tuffsim emulates a Tuffpad for PC app development without
+// hardware.
+//
+// It runs the firmware's protocol handler, session loop and storage on an
+// in-memory flash device, optionally backed by an image file, and serves
+// them on a pseudo-terminal or a TCP socket:
+//
+//	tuffsim                         # prints the pty path, e.g. /dev/pts/5
+//	tuffsim -listen :7420           # one client at a time over TCP
+//	tuffsim -image pad.img          # keep the configuration between runs
+//	tuffsim -latency 20ms -drop 0.001 -corrupt 0.01
+//
+// Host tools open the pty like a serial port: tuffctl -port /dev/pts/5 ping.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/serialport"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/buildinfo"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+
+	"tinygo.org/x/tinyfs"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "tuffsim:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run parses flags, boots the emulated device and serves it until
+// interrupted.
+func run(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("tuffsim", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	listen := fs.String("listen", "", "serve on this TCP address instead of a pty")
+	image := fs.String("image", "", "flash image file (created if missing)")
+	blocks := fs.Int("blocks", 256, "flash size in 4 KiB blocks for a new image")
+	serial := fs.String("serial", "53494D0000000001", "serial number (hex)")
+	history := fs.Int("history", -1, "earlier versions kept per profile and device config at boot (default: as the device config sets)")
+	latency := fs.Duration("latency", 0, "delay before each response")
+	drop := fs.Float64("drop", 0, "probability of dropping each byte")
+	corrupt := fs.Float64("corrupt", 0, "probability of corrupting each read or write")
+	seed := fs.Int64("seed", 0, "random seed for fault injection (default: time based)")
+	verbose := fs.Bool("v", false, "log every frame")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	serialBytes, err := hex.DecodeString(*serial)
+	if err != nil {
+		return fmt.Errorf("-serial: %w", err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	// Let apps tell the emulator from hardware
+	if buildinfo.Board == "unknown" {
+		buildinfo.Board = "tuffsim"
+	}
+
+	dev := &device{
+		serial:  serialBytes,
+		history: *history,
+		logger:  log.New(stderr, "tuffsim: ", log.Ltime|log.Lmicroseconds),
+		verbose: *verbose,
+		faults: faults{
+			latency: *latency,
+			drop:    *drop,
+			corrupt: *corrupt,
+			rng:     rand.New(rand.NewSource(*seed)),
+		},
+	}
+	if err := dev.faults.validate(); err != nil {
+		return err
+	}
+
+	if *image != "" {
+		img, err := openImage(*image, *blocks)
+		if err != nil {
+			return err
+		}
+		dev.flash = img
+	} else {
+		dev.flash = tinyfs.NewMemoryDevice(pageSize, blockSize, *blocks)
+	}
+	defer dev.Close()
+
+	if err := dev.boot(reboot.ModeNormal); err != nil {
+		return err
+	}
+
+	// Close the transport on Ctrl-C so serve returns and the image is synced
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	if *listen != "" {
+		ln, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-stop
+			ln.Close()
+		}()
+		fmt.Fprintln(stdout, ln.Addr())
+		err = serveTCP(dev, ln)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+
+	pty, err := serialport.OpenPTY()
+	if err != nil {
+		return fmt.Errorf("pty: %w (use -listen)", err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			pty.Close()
+		case <-closed:
+		}
+	}()
+	defer close(closed)
+
+	fmt.Fprintln(stdout, pty.Path)
+	err = dev.serve(pty.Master)
+	if errors.Is(err, errBootloader) {
+		dev.logger.Print(err)
+		return nil
+	}
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// serveTCP serves one connection at a time, like a serial port that only
+// one program can open.
+func serveTCP(dev *device, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		dev.logger.Printf("client %s connected", conn.RemoteAddr())
+		err = dev.serve(conn)
+		conn.Close()
+		if errors.Is(err, errBootloader) {
+			dev.logger.Print(err)
+			ln.Close()
+			return nil
+		}
+		dev.logger.Printf("client %s disconnected", conn.RemoteAddr())
+	}
+}
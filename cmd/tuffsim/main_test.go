@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/internal/serialport"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/client"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+
+	"tinygo.org/x/tinyfs"
+)
+
+func newTestDevice(t *testing.T, flash tinyfs.BlockDevice) *device {
+	t.Helper()
+	if flash == nil {
+		flash = tinyfs.NewMemoryDevice(pageSize, blockSize, 64)
+	}
+	dev := &device{
+		flash:  flash,
+		serial: []byte{1, 2, 3, 4},
+		logger: log.New(io.Discard, "", 0),
+		faults: faults{rng: rand.New(rand.NewSource(1))},
+	}
+	if err := dev.boot(reboot.ModeNormal); err != nil {
+		t.Fatalf("boot failed: %v", err)
+	}
+	return dev
+}
+
+// serveTest serves dev over net.Pipe and returns a client and the serve result.
+func serveTest(t *testing.T, dev *device) (*client.Client, chan error) {
+	host, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.serve(conn)
+	}()
+	t.Cleanup(func() {
+		host.Close()
+		conn.Close()
+		dev.Close()
+	})
+	return client.New(host), done
+}
+
+func testProfile(name string) *config.Profile {
+	p := &config.Profile{Version: config.CurrentVersion, BindingCount: 1}
+	p.SetName(name)
+	p.Bindings[0] = config.KeyBinding{OutputType: config.OutputTypeKeyboard, OutputValue: 0x04}
+	return p
+}
+
+func TestServeAndReboot(t *testing.T) {
+	dev := newTestDevice(t, nil)
+	c, done := serveTest(t, dev)
+	ctx := context.Background()
+
+	if err := c.SetProfile(ctx, 1, testProfile("Sim")); err != nil {
+		t.Fatalf("SetProfile failed: %v", err)
+	}
+
+	if err := c.Reboot(ctx, reboot.ModeSafe); err != nil {
+		t.Fatalf("Reboot failed: %v", err)
+	}
+	id, err := c.Discover(ctx)
+	if err != nil {
+		t.Fatalf("Discover after reboot failed: %v", err)
+	}
+	if id.BootMode != reboot.ModeSafe || id.Serial != "01020304" {
+		t.Errorf("Unexpected identity after reboot: %+v", id)
+	}
+	if p, err := c.GetProfile(ctx, 1); err != nil || p.GetName() != "Sim" {
+		t.Errorf("Profile lost across reboot: %v", err)
+	}
+
+	if err := c.Reboot(ctx, reboot.ModeBootloader); err != nil {
+		t.Fatalf("Reboot failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, errBootloader) {
+			t.Errorf("Expected errBootloader, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve did not stop after bootloader reboot")
+	}
+}
+
+func TestImagePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pad.img")
+
+	img, err := openImage(path, 32)
+	if err != nil {
+		t.Fatalf("openImage failed: %v", err)
+	}
+	dev := newTestDevice(t, img)
+	if err := dev.storage.SaveProfile(4, testProfile("Saved")); err != nil {
+		t.Fatalf("SaveProfile failed: %v", err)
+	}
+	dev.Close()
+
+	if st, _ := os.Stat(path); st.Size() != 32*blockSize {
+		t.Fatalf("Image is %d bytes, want %d", st.Size(), 32*blockSize)
+	}
+
+	// The image keeps its size regardless of -blocks
+	img, err = openImage(path, 256)
+	if err != nil {
+		t.Fatalf("openImage failed: %v", err)
+	}
+	dev = newTestDevice(t, img)
+	defer dev.Close()
+	var p config.Profile
+	if err := dev.storage.LoadProfile(4, &p); err != nil || p.GetName() != "Saved" {
+		t.Errorf("Profile not persisted: %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.img")
+	os.WriteFile(bad, make([]byte, 1000), 0644)
+	if _, err := openImage(bad, 32); err == nil {
+		t.Error("Expected error for an image that is not whole blocks")
+	}
+}
+
+func TestFaultsApply(t *testing.T) {
+	f := &faults{rng: rand.New(rand.NewSource(1))}
+	if got := f.apply([]byte{1, 2, 3}); !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("No faults changed the data: %v", got)
+	}
+
+	f.corrupt = 1
+	if got := f.apply([]byte{1, 2, 3}); !bytes.Equal(got, []byte{1, 2, 0xFC}) {
+		t.Errorf("Corrupt = %v, want last byte flipped", got)
+	}
+
+	f.corrupt = 0
+	f.drop = 1
+	if got := f.apply([]byte{1, 2, 3}); len(got) != 0 {
+		t.Errorf("Drop = %v, want nothing", got)
+	}
+
+	f.drop = 2
+	if f.validate() == nil {
+		t.Error("Expected validation error for -drop 2")
+	}
+}
+
+func TestInjectedFaultsRecovered(t *testing.T) {
+	dev := newTestDevice(t, nil)
+	dev.faults.corrupt = 0.2
+	dev.faults.latency = 5 * time.Millisecond
+	c, _ := serveTest(t, dev)
+	c.SetTimeout(200 * time.Millisecond)
+	c.SetRetries(10)
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if err := c.Ping(context.Background(), []byte("ping")); err != nil {
+			t.Fatalf("Ping %d failed: %v", i, err)
+		}
+	}
+	if time.Since(start) < 20*dev.faults.latency {
+		t.Error("Latency was not applied")
+	}
+}
+
+func TestServePTY(t *testing.T) {
+	pty, err := serialport.OpenPTY()
+	if err != nil {
+		t.Skipf("No pty available: %v", err)
+	}
+	dev := newTestDevice(t, nil)
+	go dev.serve(pty.Master)
+	defer func() {
+		pty.Close()
+		dev.Close()
+	}()
+
+	port, err := serialport.Open(pty.Path)
+	if err != nil {
+		t.Fatalf("Open %s failed: %v", pty.Path, err)
+	}
+	c := client.New(port)
+	defer c.Close()
+
+	id, err := c.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover over pty failed: %v", err)
+	}
+	if id.Serial != "01020304" {
+		t.Errorf("Unexpected identity: %+v", id)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package serialport
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// PTY is a pseudo-terminal that stands in for a serial port.
+// Host tools open Path like any serial device; the emulator side reads and
+// writes Master.
+type PTY struct {
+	Master *os.File
+	Path   string
+	slave  *os.File
+}
+
+// OpenPTY allocates a pseudo-terminal with its client side in raw mode.
+//
+// The client side is kept open for the life of the PTY, so the master does
+// not see a hangup each time a host tool closes the port.
+func OpenPTY() (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	var n uint32
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		var unlock int32
+		if ioctlErr = ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); ioctlErr != nil {
+			return
+		}
+		ioctlErr = ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		master.Close()
+		return nil, &os.PathError{Op: "configure", Path: "/dev/ptmx", Err: err}
+	}
+
+	path := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := Open(path)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	return &PTY{Master: master, Path: path, slave: slave}, nil
+}
+
+// Close releases both sides of the PTY.
+func (p *PTY) Close() error {
+	p.slave.Close()
+	return p.Master.Close()
+}
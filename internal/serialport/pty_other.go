@@ -0,0 +1,21 @@
+//go:build !linux
+
+package serialport
+
+import "os"
+
+// PTY is a pseudo-terminal that stands in for a serial port.
+type PTY struct {
+	Master *os.File
+	Path   string
+}
+
+// OpenPTY is only implemented on Linux.
+func OpenPTY() (*PTY, error) {
+	return nil, ErrUnsupported
+}
+
+// Close releases both sides of the PTY.
+func (p *PTY) Close() error {
+	return p.Master.Close()
+}
@@ -0,0 +1,32 @@
+// Package serialport opens serial devices for host tools.
+package serialport
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	ErrUnsupported = errors.New("serial ports are not supported on this platform")
+)
+
+// patterns match the device nodes USB CDC and USB-serial adapters appear as.
+var patterns = []string{
+	"/dev/ttyACM*",
+	"/dev/ttyUSB*",
+}
+
+// List returns the candidate serial device paths, sorted.
+func List() ([]string, error) {
+	var ports []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, matches...)
+	}
+	sort.Strings(ports)
+	return ports, nil
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package serialport
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbaud masks the baud rate bits in Termios.Cflag (not exported by syscall).
+const cbaud = 0010017
+
+// Open opens a serial device in raw 8N1 mode.
+// The returned file supports SetReadDeadline. Opening the port asserts DTR,
+// which the firmware waits for before answering.
+func Open(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		ioctlErr = makeRaw(fd)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "configure", Path: path, Err: err}
+	}
+	return f, nil
+}
+
+// makeRaw switches the terminal to raw mode, like cfmakeraw(3).
+// The baud rate is irrelevant for USB CDC but set for real UARTs.
+func makeRaw(fd uintptr) error {
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | cbaud
+	t.Cflag |= syscall.CS8 | syscall.CLOCAL | syscall.CREAD | syscall.B115200
+	t.Ispeed = syscall.B115200
+	t.Ospeed = syscall.B115200
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+
+	return ioctl(fd, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
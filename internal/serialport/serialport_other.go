@@ -0,0 +1,10 @@
+//go:build !linux
+
+package serialport
+
+import "os"
+
+// Open is only implemented on Linux.
+func Open(path string) (*os.File, error) {
+	return nil, &os.PathError{Op: "open", Path: path, Err: ErrUnsupported}
+}
@@ -0,0 +1,123 @@
+// Package uf2 reads and writes UF2 files, the format the RP2040 USB
+// bootloader accepts for flashing.
+//
+// A UF2 file is a sequence of 512-byte blocks, each carrying up to 476
+// bytes for one flash address. See https://github.com/microsoft/uf2.
+package uf2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FamilyRP2040 is the UF2 family ID of the RP2040.
+const FamilyRP2040 = 0xE48BFF56
+
+// PayloadSize is the data carried per block. The RP2040 bootloader only
+// accepts 256-byte payloads, one flash page each.
+const PayloadSize = 256
+
+const (
+	blockSize    = 512
+	maxPayload   = 476
+	magicStart0  = 0x0A324655
+	magicStart1  = 0x9E5D5157
+	magicEnd     = 0x0AB16F30
+	flagNotMain  = 0x00000001 // Block is not for main flash
+	flagFamilyID = 0x00002000 // FileSize holds the family ID
+)
+
+// ErrFormat is returned for data that is not a UF2 file.
+var ErrFormat = errors.New("not a UF2 file")
+
+// Block is the data for one flash address.
+type Block struct {
+	Addr uint32
+	Data []byte
+}
+
+// End returns the address just past the block's data.
+func (b Block) End() uint32 {
+	return b.Addr + uint32(len(b.Data))
+}
+
+// Encode writes blocks as a UF2 file for a chip family. Each block must
+// carry at most PayloadSize bytes.
+func Encode(w io.Writer, family uint32, blocks []Block) error {
+	buf := make([]byte, blockSize)
+	for i, b := range blocks {
+		if len(b.Data) > PayloadSize {
+			return fmt.Errorf("uf2: block %d has %d bytes, more than %d", i, len(b.Data), PayloadSize)
+		}
+		clear(buf)
+		binary.LittleEndian.PutUint32(buf[0:], magicStart0)
+		binary.LittleEndian.PutUint32(buf[4:], magicStart1)
+		binary.LittleEndian.PutUint32(buf[8:], flagFamilyID)
+		binary.LittleEndian.PutUint32(buf[12:], b.Addr)
+		binary.LittleEndian.PutUint32(buf[16:], uint32(len(b.Data)))
+		binary.LittleEndian.PutUint32(buf[20:], uint32(i))
+		binary.LittleEndian.PutUint32(buf[24:], uint32(len(blocks)))
+		binary.LittleEndian.PutUint32(buf[28:], family)
+		copy(buf[32:], b.Data)
+		binary.LittleEndian.PutUint32(buf[blockSize-4:], magicEnd)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode parses a UF2 file and returns the main flash blocks for a chip
+// family, in file order.
+func Decode(data []byte, family uint32) ([]Block, error) {
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, ErrFormat
+	}
+
+	var blocks []Block
+	for off := 0; off < len(data); off += blockSize {
+		buf := data[off : off+blockSize]
+		if binary.LittleEndian.Uint32(buf[0:]) != magicStart0 ||
+			binary.LittleEndian.Uint32(buf[4:]) != magicStart1 ||
+			binary.LittleEndian.Uint32(buf[blockSize-4:]) != magicEnd {
+			return nil, fmt.Errorf("%w: bad magic in block at offset %d", ErrFormat, off)
+		}
+		flags := binary.LittleEndian.Uint32(buf[8:])
+		size := binary.LittleEndian.Uint32(buf[16:])
+		if size > maxPayload {
+			return nil, fmt.Errorf("%w: block at offset %d has %d bytes", ErrFormat, off, size)
+		}
+		if flags&flagNotMain != 0 {
+			continue
+		}
+		if flags&flagFamilyID != 0 && binary.LittleEndian.Uint32(buf[28:]) != family {
+			continue
+		}
+		blocks = append(blocks, Block{
+			Addr: binary.LittleEndian.Uint32(buf[12:]),
+			Data: append([]byte(nil), buf[32:32+size]...),
+		})
+	}
+	return blocks, nil
+}
+
+// Flatten lays blocks out as one contiguous image starting at the lowest
+// address. Gaps between blocks read as erased flash (0xFF).
+func Flatten(blocks []Block) (base uint32, image []byte) {
+	if len(blocks) == 0 {
+		return 0, nil
+	}
+	base, end := blocks[0].Addr, blocks[0].End()
+	for _, b := range blocks[1:] {
+		base = min(base, b.Addr)
+		end = max(end, b.End())
+	}
+	image = bytes.Repeat([]byte{0xFF}, int(end-base))
+	for _, b := range blocks {
+		copy(image[b.Addr-base:], b.Data)
+	}
+	return base, image
+}
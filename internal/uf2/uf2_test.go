@@ -0,0 +1,76 @@
+package uf2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	blocks := []Block{
+		{Addr: 0x10000000, Data: bytes.Repeat([]byte{0xAB}, PayloadSize)},
+		{Addr: 0x10000100, Data: []byte{1, 2, 3}},
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, FamilyRP2040, blocks); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data := buf.Bytes()
+	if len(data) != 2*512 {
+		t.Fatalf("Encoded %d bytes, want 1024", len(data))
+	}
+	if n := binary.LittleEndian.Uint32(data[512+24:]); n != 2 {
+		t.Errorf("NumBlocks = %d", n)
+	}
+
+	got, err := Decode(data, FamilyRP2040)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if len(got) != 2 || got[1].Addr != 0x10000100 || !bytes.Equal(got[1].Data, []byte{1, 2, 3}) || got[1].End() != 0x10000103 {
+		t.Errorf("Decoded %+v", got)
+	}
+
+	// Blocks for other chips are skipped
+	other, err := Decode(data, 0x12345678)
+	if err != nil || len(other) != 0 {
+		t.Errorf("Decode for another family = %d blocks, %v", len(other), err)
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	err := Encode(&bytes.Buffer{}, FamilyRP2040, []Block{{Data: make([]byte, PayloadSize+1)}})
+	if err == nil {
+		t.Error("Encode accepted an oversized block")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, FamilyRP2040, []Block{{Addr: 0x10000000, Data: []byte{1}}})
+	bad := buf.Bytes()
+	bad[511] ^= 0xFF
+
+	for _, data := range [][]byte{nil, make([]byte, 100), make([]byte, 512), bad} {
+		if _, err := Decode(data, FamilyRP2040); !errors.Is(err, ErrFormat) {
+			t.Errorf("Decode(%d bytes) = %v, want ErrFormat", len(data), err)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	base, image := Flatten([]Block{
+		{Addr: 0x10000200, Data: []byte{3}},
+		{Addr: 0x10000000, Data: []byte{1, 2}},
+	})
+	if base != 0x10000000 || len(image) != 0x201 {
+		t.Fatalf("Flatten = 0x%08X, %d bytes", base, len(image))
+	}
+	if image[0] != 1 || image[1] != 2 || image[2] != 0xFF || image[0x200] != 3 {
+		t.Errorf("Unexpected image contents")
+	}
+	if _, image := Flatten(nil); image != nil {
+		t.Error("Flatten(nil) returned data")
+	}
+}
@@ -2,32 +2,103 @@ package main
 
 import (
 	"machine"
+	"time"
 
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/display"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/keymap"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/serial"
 )
 
+// Holding the recovery button (active low, to GND) for recoveryHold while
+// the pad powers up clears the configuration write lock and its PIN. The
+// lock cannot be cleared over serial without the PIN, so this is the way
+// back for an owner who lost it.
+const (
+	recoveryPin  = machine.GPIO2
+	recoveryHold = 3 * time.Second
+)
+
+// flashBase is where the on-chip flash is mapped.
+const flashBase = 0x10000000
+
 func main() {
+	// A safe mode boot keeps storage and serial running for recovery but
+	// must not apply stored profiles, in case one of them is the problem
+	bootMode := reboot.ModeNormal
+	if reboot.SafeModeRequested() {
+		bootMode = reboot.ModeSafe
+	}
+
 	// Initialize SSD1306 display for debug output
 	// This is optional - if it fails, serial still works
 	displayMgr := display.NewManager()
+	if bootMode == reboot.ModeSafe && displayMgr != nil {
+		displayMgr.ShowError("Safe mode")
+	}
 
-	// Initialize storage with on-chip flash
-	// Format=true allows automatic formatting on first boot
-	storageMgr, err := storage.New(machine.Flash, true)
+	// The on-chip flash after the firmware holds the update staging area and
+	// the configuration filesystem, at fixed offsets (see pkg/partition).
+	// The first boot after firmware from before that layout moves the
+	// filesystem; storage stays down if that fails, nothing is formatted.
+	base := int64(machine.FlashDataStart()) - flashBase
+	storageMgr, err := storage.Open(machine.Flash, base)
 	if err != nil {
 		// Storage init failure is critical - flash LED or log if possible
 		// For now, continue anyway so serial still works for recovery
 		if displayMgr != nil {
 			displayMgr.ShowError("Storage init failed")
 		}
+	} else if storageMgr.Damage().Any() && displayMgr != nil {
+		// Tell the user before a damaged profile types nonsense
+		displayMgr.ShowError("Config damaged")
+	}
+	if err == nil && recoveryHeld() {
+		if cleared, _ := protocol.ClearLock(storageMgr); cleared && displayMgr != nil {
+			displayMgr.ShowError("Lock cleared")
+		}
+	}
+
+	// Apply the active profile to the inputs; a safe mode boot skips it
+	keys, err := keymap.Load(storageMgr, bootMode)
+	if err != nil && displayMgr != nil {
+		displayMgr.ShowError("Profile not applied")
 	}
+	keymap.Apply(keys)
 
 	// Create protocol handler with storage
 	protoHandler := protocol.NewHandler(storageMgr)
 
+	// Report the flash chip's unique ID as the device serial number
+	protoHandler.SetSerialNumber(machine.DeviceID())
+
+	// Allow the PC app to reboot the pad or enter the USB bootloader, and
+	// to update the firmware. The installer copies a committed image over
+	// the firmware during the reboot that follows, so it is the rebooter.
+	if stageFlash, err := partition.Stage(machine.Flash, base); err == nil {
+		installer := dfu.NewFlashInstaller(stageFlash.Offset())
+		protoHandler.SetRebooter(installer)
+		protoHandler.SetUpdater(dfu.New(stageFlash, installer))
+	} else {
+		protoHandler.SetRebooter(reboot.Device{})
+	}
+	protoHandler.SetBootMode(bootMode)
+
+	// Runtime changes such as profile cycling are saved through the queue
+	// to spare the flash. It is written out before each serial command
+	// and before a reboot.
+	saveQueue := storage.NewQueue(storageMgr, storage.DefaultWriteDelay)
+	protoHandler.SetQueue(saveQueue)
+	go func() {
+		for range time.Tick(time.Second) {
+			saveQueue.FlushDue()
+		}
+	}()
+
 	// Create serial handler with protocol
 	serialer := machine.Serial // USB CDC Serial
 	mainSerial := serial.NewSerial(serialer, protoHandler)
@@ -41,3 +112,19 @@ func main() {
 	// Block main goroutine to keep program running
 	select {}
 }
+
+// recoveryHeld reports whether the recovery button is held down for
+// recoveryHold. A pad booting without it held is delayed by a millisecond.
+func recoveryHeld() bool {
+	recoveryPin.Configure(machine.PinConfig{Mode: machine.PinInputPullup})
+	time.Sleep(time.Millisecond) // Let the pull-up settle
+
+	deadline := time.Now().Add(recoveryHold)
+	for time.Now().Before(deadline) {
+		if recoveryPin.Get() {
+			return false // Released
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
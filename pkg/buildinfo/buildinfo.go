@@ -0,0 +1,51 @@
+// Package buildinfo holds the firmware build identity.
+// The values are injected at link time, for example:
+//
+//	tinygo build -ldflags "-X github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/buildinfo.Version=$(cat VERSION) \
+//	    -X github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/buildinfo.Commit=$(git rev-parse --short HEAD) \
+//	    -X github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ) \
+//	    -X github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/buildinfo.Board=waveshare-rp2040-zero" ...
+//
+// Version comes from the VERSION file at the repository root, never from
+// git, so untagged builds still report a numeric version. Builds without
+// ldflags report the defaults below, which match VERSION.
+package buildinfo
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	// Version is the semantic firmware version (MAJOR.MINOR.PATCH[-suffix]).
+	Version = "0.1.0"
+
+	// Commit is the git commit the firmware was built from.
+	Commit = "unknown"
+
+	// Date is the build timestamp (RFC 3339, UTC).
+	Date = "unknown"
+
+	// Board is the TinyGo target the firmware was built for.
+	Board = "unknown"
+)
+
+// Semver returns the numeric major, minor and patch parts of Version.
+// A leading "v" and any pre-release or build suffix are ignored.
+// Parts that are missing or not numeric are returned as 0.
+func Semver() (major, minor, patch uint8) {
+	v := strings.TrimPrefix(Version, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var parts [3]uint8
+	for i, s := range strings.SplitN(v, ".", 3) {
+		n, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			break
+		}
+		parts[i] = uint8(n)
+	}
+	return parts[0], parts[1], parts[2]
+}
@@ -0,0 +1,46 @@
+package buildinfo
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSemver(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+
+	tests := []struct {
+		version             string
+		major, minor, patch uint8
+	}{
+		{"1.2.3", 1, 2, 3},
+		{"v0.4.10", 0, 4, 10},
+		{"2.0.1-rc.1", 2, 0, 1},
+		{"3.1", 3, 1, 0},
+		{"1.2.3+dirty", 1, 2, 3},
+		{"dev", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		Version = tt.version
+		major, minor, patch := Semver()
+		if major != tt.major || minor != tt.minor || patch != tt.patch {
+			t.Errorf("Semver(%q): expected %d.%d.%d, got %d.%d.%d",
+				tt.version, tt.major, tt.minor, tt.patch, major, minor, patch)
+		}
+	}
+}
+
+// The default reported by builds without ldflags must match VERSION.
+func TestDefaultMatchesVersionFile(t *testing.T) {
+	data, err := os.ReadFile("../../VERSION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := strings.TrimSpace(string(data)); v != Version {
+		t.Errorf("VERSION is %q, buildinfo.Version defaults to %q", v, Version)
+	}
+	if major, minor, patch := Semver(); major == 0 && minor == 0 && patch == 0 {
+		t.Errorf("Version %q is not numeric", Version)
+	}
+}
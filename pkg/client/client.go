@@ -0,0 +1,222 @@
+// Package client is a Go API for talking to a Tuffpad over its serial
+// protocol.
+//
+// A Client wraps any io.ReadWriter: a serial port opened with
+// internal/serialport, a TCP connection to the simulator, or one end of
+// net.Pipe serving a pkg/session in tests. Timeouts and context
+// cancellation need a transport with SetDeadline, which *os.File and
+// net.Conn both provide; on other transports requests block until the
+// device answers.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+)
+
+const (
+	// DefaultTimeout is how long to wait for each response.
+	DefaultTimeout = 2 * time.Second
+
+	// DefaultRetries is how many times a failed request is resent.
+	DefaultRetries = 2
+
+	// drainWindow is how long to wait for a late response after a timeout
+	// before sending the next request.
+	drainWindow = 20 * time.Millisecond
+)
+
+// aLongTimeAgo is a deadline in the past, used to interrupt a blocked read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// deadliner is implemented by *os.File and net.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// Client sends requests to one device. It is safe for concurrent use;
+// requests are serialized.
+type Client struct {
+	mu      sync.Mutex
+	conn    io.ReadWriter
+	br      *bufio.Reader
+	timeout time.Duration
+	retries int
+	stale   bool // A request timed out; its response may still arrive
+}
+
+// New creates a client on an open connection.
+func New(conn io.ReadWriter) *Client {
+	return &Client{
+		conn:    conn,
+		br:      bufio.NewReaderSize(conn, 4+protocol.MaxPayload+2),
+		timeout: DefaultTimeout,
+		retries: DefaultRetries,
+	}
+}
+
+// SetTimeout sets how long to wait for each response. Zero waits forever
+// (or until the context is done).
+func (c *Client) SetTimeout(d time.Duration) {
+	c.mu.Lock()
+	c.timeout = d
+	c.mu.Unlock()
+}
+
+// SetRetries sets how many times a failed request is resent.
+//
+// A request is resent when the device reports a CRC error, since the
+// command never ran. Timeouts and malformed responses are only retried for
+// commands that are safe to run twice; DeleteProfile, Unlock, SetLock,
+// FactoryReset, Reboot and the firmware update commit are never resent after
+// a timeout.
+func (c *Client) SetRetries(n int) {
+	c.mu.Lock()
+	c.retries = n
+	c.mu.Unlock()
+}
+
+// Close closes the connection if it is an io.Closer.
+func (c *Client) Close() error {
+	if closer, ok := c.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Do sends one command and returns the payload of an OK response.
+// Non-OK responses are returned as *StatusError.
+func (c *Client) Do(ctx context.Context, cmd uint8, payload []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.roundTrip(ctx, cmd, payload)
+		if err == nil {
+			return resp, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if attempt >= c.retries || !retryable(cmd, err) {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip writes one request and reads its response.
+func (c *Client) roundTrip(ctx context.Context, cmd uint8, payload []byte) ([]byte, error) {
+	d, ok := c.conn.(deadliner)
+	if ok {
+		if c.stale {
+			c.drain(d)
+		}
+
+		var deadline time.Time
+		if c.timeout > 0 {
+			deadline = time.Now().Add(c.timeout)
+		}
+		if dl, ok := ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+			deadline = dl
+		}
+		d.SetDeadline(deadline)
+
+		// Interrupt a blocked read or write when the context is cancelled
+		fired := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			d.SetDeadline(aLongTimeAgo)
+			close(fired)
+		})
+		defer func() {
+			if !stop() {
+				<-fired
+			}
+		}()
+	}
+
+	if err := protocol.WriteFrame(c.conn, &protocol.Frame{Cmd: cmd, Payload: payload}); err != nil {
+		return nil, c.transportError(err)
+	}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		return nil, c.transportError(err)
+	}
+	if resp.Status != protocol.StatusOK {
+		e := &StatusError{Cmd: cmd, Status: resp.Status}
+		e.Detail.UnmarshalBinary(resp.Payload)
+		return nil, e
+	}
+	return resp.Payload, nil
+}
+
+// readResponse skips any bytes before the next sync byte, then reads a
+// response frame.
+func (c *Client) readResponse() (*protocol.Response, error) {
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == protocol.SyncByte {
+			c.br.UnreadByte()
+			return protocol.ReadResponse(c.br)
+		}
+	}
+}
+
+// drain discards a late response to a request that timed out, so it is
+// not mistaken for the response to the next one.
+func (c *Client) drain(d deadliner) {
+	c.br.Discard(c.br.Buffered())
+	d.SetDeadline(time.Now().Add(drainWindow))
+	var buf [64]byte
+	for {
+		if _, err := c.conn.Read(buf[:]); err != nil {
+			break
+		}
+	}
+	c.stale = false
+}
+
+// transportError classifies a read or write failure.
+func (c *Client) transportError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		c.stale = true
+		return ErrTimeout
+	case errors.Is(err, protocol.ErrCRCMismatch), errors.Is(err, protocol.ErrInvalidFrame):
+		c.stale = true
+		return fmt.Errorf("%w: %w", ErrBadResponse, err)
+	default:
+		return err
+	}
+}
+
+// retryable reports whether a failed request may be resent.
+func retryable(cmd uint8, err error) bool {
+	if errors.Is(err, ErrCRC) {
+		return true
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrBadResponse) {
+		switch cmd {
+		case protocol.CmdDeleteProfile, protocol.CmdUnlock, protocol.CmdSetLock,
+			protocol.CmdFactoryReset, protocol.CmdReboot, protocol.CmdUpdateCommit:
+			return false
+		}
+		return true
+	}
+	return false
+}
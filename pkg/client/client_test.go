@@ -0,0 +1,475 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/session"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// newTestDevice serves a handler backed by a memory block device over
+// net.Pipe and returns the host end.
+func newTestDevice(t *testing.T) (net.Conn, *storage.Manager) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := storage.New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	host, device := net.Pipe()
+	go session.New(device, protocol.NewHandler(mgr)).Run()
+	t.Cleanup(func() {
+		host.Close()
+		device.Close()
+		mgr.Close()
+	})
+	return host, mgr
+}
+
+func newTestClient(t *testing.T) (*Client, *storage.Manager) {
+	conn, mgr := newTestDevice(t)
+	return New(conn), mgr
+}
+
+func testProfile(name string) *config.Profile {
+	p := &config.Profile{Version: config.CurrentVersion, BindingCount: 1, RGBColor: 0x00FF00}
+	p.SetName(name)
+	p.Bindings[0] = config.KeyBinding{InputType: 0, InputID: 2, OutputType: 1, OutputValue: 0x04}
+	return p
+}
+
+// faultyConn drops or corrupts the first writes on its way to the device.
+type faultyConn struct {
+	net.Conn
+	mu      sync.Mutex
+	writes  int
+	drop    int // Number of writes to swallow
+	corrupt int // Number of writes to send with a bad CRC
+}
+
+func (f *faultyConn) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	f.writes++
+	drop := f.drop > 0
+	corrupt := !drop && f.corrupt > 0
+	if drop {
+		f.drop--
+	} else if corrupt {
+		f.corrupt--
+	}
+	f.mu.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	if corrupt {
+		bad := append([]byte(nil), b...)
+		bad[len(bad)-1] ^= 0xFF
+		return f.Conn.Write(bad)
+	}
+	return f.Conn.Write(b)
+}
+
+func (f *faultyConn) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.SetProfile(ctx, 2, testProfile("Racing")); err != nil {
+		t.Fatalf("SetProfile failed: %v", err)
+	}
+
+	p, err := c.GetProfile(ctx, 2)
+	if err != nil {
+		t.Fatalf("GetProfile failed: %v", err)
+	}
+	if p.GetName() != "Racing" || p.Bindings[0].OutputValue != 0x04 {
+		t.Errorf("Unexpected profile: %s %+v", p.GetName(), p.Bindings[0])
+	}
+
+	entries, err := c.ListProfiles(ctx)
+	if err != nil {
+		t.Fatalf("ListProfiles failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Slot != 2 || entries[0].Name != "Racing" || entries[0].RGBColor != 0x00FF00 {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	if err := c.DeleteProfile(ctx, 2); err != nil {
+		t.Fatalf("DeleteProfile failed: %v", err)
+	}
+	if _, err := c.GetProfile(ctx, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestListProfilesPaged(t *testing.T) {
+	c, mgr := newTestClient(t)
+	for slot := uint8(0); slot < 10; slot++ {
+		if err := mgr.SaveProfile(slot, testProfile("P")); err != nil {
+			t.Fatalf("SaveProfile failed: %v", err)
+		}
+	}
+
+	entries, err := c.ListProfiles(context.Background())
+	if err != nil {
+		t.Fatalf("ListProfiles failed: %v", err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("Expected 10 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.Slot != uint8(i) {
+			t.Errorf("Entry %d has slot %d", i, e.Slot)
+		}
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	if _, err := c.GetDeviceConfig(ctx); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound on a fresh device, got %v", err)
+	}
+
+	want := &config.DeviceConfig{Version: config.CurrentVersion, ActiveProfile: 3, Brightness: 90}
+	if err := c.SetDeviceConfig(ctx, want); err != nil {
+		t.Fatalf("SetDeviceConfig failed: %v", err)
+	}
+	got, err := c.GetDeviceConfig(ctx)
+	if err != nil {
+		t.Fatalf("GetDeviceConfig failed: %v", err)
+	}
+	if *got != *want {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"Good", "Broken"} {
+		if err := c.SetProfile(ctx, 2, testProfile(name)); err != nil {
+			t.Fatalf("SetProfile failed: %v", err)
+		}
+	}
+	gens, err := c.ProfileHistory(ctx, 2)
+	if err != nil {
+		t.Fatalf("ProfileHistory failed: %v", err)
+	}
+	if len(gens) != 1 || gens[0].Name != "Good" || gens[0].BindingCount != 1 || gens[0].Unreadable {
+		t.Fatalf("Unexpected history: %+v", gens)
+	}
+	if err := c.RestoreProfile(ctx, 2, gens[0].Generation); err != nil {
+		t.Fatalf("RestoreProfile failed: %v", err)
+	}
+	if p, err := c.GetProfile(ctx, 2); err != nil || p.GetName() != "Good" {
+		t.Errorf("Restored profile %v, %v", p, err)
+	}
+
+	for _, b := range []uint8{10, 20} {
+		c.SetDeviceConfig(ctx, &config.DeviceConfig{Version: config.CurrentVersion, Brightness: b})
+	}
+	gens, err = c.DeviceHistory(ctx)
+	if err != nil || len(gens) != 1 {
+		t.Fatalf("DeviceHistory = %+v, %v", gens, err)
+	}
+	if err := c.RestoreDevice(ctx, gens[0].Generation); err != nil {
+		t.Fatalf("RestoreDevice failed: %v", err)
+	}
+	if cfg, err := c.GetDeviceConfig(ctx); err != nil || cfg.Brightness != 10 {
+		t.Errorf("Restored device config %+v, %v", cfg, err)
+	}
+	if err := c.RestoreDevice(ctx, 999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestIdentityAndStats(t *testing.T) {
+	c, mgr := newTestClient(t)
+	ctx := context.Background()
+	mgr.SaveProfile(0, testProfile("A"))
+
+	if err := c.Ping(ctx, []byte("hello")); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+
+	id, err := c.Discover(ctx)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if id.Firmware == "" || id.ConfigVersion != config.CurrentVersion {
+		t.Errorf("Unexpected identity: %+v", id)
+	}
+	if v, err := c.GetVersion(ctx); err != nil || *v != *id {
+		t.Errorf("GetVersion = %+v, %v; want %+v", v, err, id)
+	}
+
+	stats, err := c.GetStorageStats(ctx)
+	if err != nil {
+		t.Fatalf("GetStorageStats failed: %v", err)
+	}
+	if stats.Profiles != 1 || stats.Total == 0 || stats.Total != stats.BlockSize*stats.BlockCount {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	diag, err := c.GetDiagnostics(ctx)
+	if err != nil {
+		t.Fatalf("GetDiagnostics failed: %v", err)
+	}
+	if _, ok := diag.Counters[metrics.FramesReceived]; !ok || diag.HeapSys == 0 ||
+		diag.DeviceDamaged || len(diag.DamagedSlots) != 0 {
+		t.Errorf("Unexpected diagnostics: %+v", diag)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	_, err := c.Do(context.Background(), protocol.CmdSetProfile, []byte{1})
+	var se *StatusError
+	if !errors.As(err, &se) {
+		t.Fatalf("Expected *StatusError, got %v", err)
+	}
+	if se.Cmd != protocol.CmdSetProfile || se.Status != protocol.StatusInvalidData {
+		t.Errorf("Unexpected error: %+v", se)
+	}
+	if se.Detail.Reason != protocol.ReasonLength {
+		t.Errorf("Expected length reason, got %d", se.Detail.Reason)
+	}
+	if !errors.Is(err, ErrInvalidData) || errors.Is(err, ErrNotFound) {
+		t.Errorf("errors.Is does not match the status: %v", err)
+	}
+}
+
+func TestLockedError(t *testing.T) {
+	c, mgr := newTestClient(t)
+	mgr.SaveDevice(&config.DeviceConfig{
+		Version: config.CurrentVersion,
+		Flags:   config.DeviceFlagLocked,
+		LockPIN: 1234,
+	})
+	ctx := context.Background()
+
+	if err := c.DeleteProfile(ctx, 0); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	if err := c.Unlock(ctx, 1234); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := c.SetProfile(ctx, 0, testProfile("A")); err != nil {
+		t.Errorf("SetProfile after unlock failed: %v", err)
+	}
+}
+
+func TestRetryOnCRCError(t *testing.T) {
+	conn, _ := newTestDevice(t)
+	fc := &faultyConn{Conn: conn, corrupt: 1}
+	c := New(fc)
+
+	if err := c.Ping(context.Background(), []byte("x")); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if fc.count() != 2 {
+		t.Errorf("Expected 2 writes, got %d", fc.count())
+	}
+
+	fc.corrupt = 1
+	c.SetRetries(0)
+	if err := c.Ping(context.Background(), []byte("x")); !errors.Is(err, ErrCRC) {
+		t.Errorf("Expected ErrCRC without retries, got %v", err)
+	}
+}
+
+func TestRetryOnTimeout(t *testing.T) {
+	conn, mgr := newTestDevice(t)
+	mgr.SaveProfile(1, testProfile("A"))
+	fc := &faultyConn{Conn: conn, drop: 1}
+	c := New(fc)
+	c.SetTimeout(100 * time.Millisecond)
+
+	if _, err := c.GetProfile(context.Background(), 1); err != nil {
+		t.Fatalf("GetProfile failed: %v", err)
+	}
+	if fc.count() != 2 {
+		t.Errorf("Expected 2 writes, got %d", fc.count())
+	}
+
+	// Deleting twice is not safe, so a lost delete is reported
+	fc.drop = 1
+	before := fc.count()
+	if err := c.DeleteProfile(context.Background(), 1); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if fc.count()-before != 1 {
+		t.Errorf("DeleteProfile was resent")
+	}
+
+	// A resent lock would fail against the pad it just locked
+	fc.drop = 1
+	before = fc.count()
+	if err := c.SetLock(context.Background(), true, 1234); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if fc.count()-before != 1 {
+		t.Errorf("SetLock was resent")
+	}
+}
+
+// updateTarget installs firmware images and takes reboots in memory.
+type updateTarget struct {
+	image    []byte
+	rebooted chan reboot.Mode
+}
+
+func (u *updateTarget) Install(image io.ReaderAt, size int64) error {
+	u.image = make([]byte, size)
+	_, err := image.ReadAt(u.image, 0)
+	return err
+}
+
+func (u *updateTarget) Reboot(mode reboot.Mode) error {
+	u.rebooted <- mode
+	return nil
+}
+
+func TestUpdateFirmware(t *testing.T) {
+	c, _ := newTestClient(t)
+	if err := c.UpdateFirmware(context.Background(), []byte{1}, nil); !errors.Is(err, ErrDevice) {
+		t.Errorf("Expected ErrDevice without update support, got %v", err)
+	}
+
+	mgr, err := storage.New(tinyfs.NewMemoryDevice(256, 4096, 64), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &updateTarget{rebooted: make(chan reboot.Mode, 1)}
+	h := protocol.NewHandler(mgr)
+	h.SetUpdater(dfu.New(tinyfs.NewMemoryDevice(256, 4096, 16), target))
+	h.SetRebooter(target)
+	host, device := net.Pipe()
+	go session.New(device, h).Run()
+	t.Cleanup(func() {
+		host.Close()
+		device.Close()
+		mgr.Close()
+	})
+
+	image := bytes.Repeat([]byte{0xC3, 0x5A, 0x01}, 5000)
+	var calls, last int
+	err = New(host).UpdateFirmware(context.Background(), image, func(sent, total int) {
+		calls++
+		last = sent
+		if total != len(image) {
+			t.Errorf("progress total %d", total)
+		}
+	})
+	if err != nil {
+		t.Fatalf("UpdateFirmware failed: %v", err)
+	}
+	if !bytes.Equal(target.image, image) {
+		t.Error("Installed image differs")
+	}
+	if calls != 4 || last != len(image) {
+		t.Errorf("progress called %d times, last %d", calls, last)
+	}
+	// The session reboots once the commit response is out
+	select {
+	case mode := <-target.rebooted:
+		if mode != reboot.ModeNormal {
+			t.Errorf("Rebooted into mode %d", mode)
+		}
+	case <-time.After(time.Second):
+		t.Error("Device did not reboot after the commit")
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	host, device := net.Pipe()
+	defer host.Close()
+	defer device.Close()
+
+	// A device that reads requests but never answers
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, err := device.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := New(host)
+	c.SetTimeout(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := c.Ping(ctx, []byte("x")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Cancel did not interrupt the read")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Ping(ctx, []byte("x")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestLateResponseDrained(t *testing.T) {
+	host, device := net.Pipe()
+	defer host.Close()
+	defer device.Close()
+
+	// A device that answers the first ping after the client gave up
+	go func() {
+		for i := 0; ; i++ {
+			frame, err := protocol.ReadFrame(device)
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			protocol.WriteResponse(device, &protocol.Response{Status: protocol.StatusOK, Payload: frame.Payload})
+		}
+	}()
+
+	c := New(host)
+	c.SetTimeout(50 * time.Millisecond)
+	c.SetRetries(0)
+
+	if err := c.Ping(context.Background(), []byte("one")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	time.Sleep(80 * time.Millisecond)
+
+	c.SetTimeout(time.Second)
+	if err := c.Ping(context.Background(), []byte("two")); err != nil {
+		t.Errorf("Ping after timeout failed: %v", err)
+	}
+}
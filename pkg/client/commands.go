@@ -0,0 +1,442 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+)
+
+// Identity is the build identity reported by GetVersion and Discover.
+type Identity struct {
+	Firmware      string      `json:"firmware"`
+	Commit        string      `json:"commit,omitempty"`
+	BuildDate     string      `json:"build_date,omitempty"`
+	Board         string      `json:"board,omitempty"`
+	ConfigVersion uint16      `json:"config_version"`
+	Serial        string      `json:"serial,omitempty"`
+	BootMode      reboot.Mode `json:"boot_mode"`
+}
+
+// ProfileEntry is one stored profile as listed by ListProfiles.
+type ProfileEntry struct {
+	Slot         uint8  `json:"slot"`
+	Name         string `json:"name"`
+	Active       bool   `json:"active"`
+	Unreadable   bool   `json:"unreadable,omitempty"`
+	Corrupted    bool   `json:"corrupted,omitempty"` // Failed its checksum
+	BindingCount uint8  `json:"binding_count"`
+	Flags        uint32 `json:"flags"`
+	RGBColor     uint32 `json:"rgb_color"`
+	RGBPattern   uint8  `json:"rgb_pattern"`
+	Size         uint32 `json:"size"`
+}
+
+// Generation is one earlier version of a profile or of the device config,
+// as listed by ProfileHistory and DeviceHistory.
+type Generation struct {
+	Generation   uint32 `json:"generation"`
+	Name         string `json:"name,omitempty"`
+	BindingCount uint8  `json:"binding_count,omitempty"`
+	Unreadable   bool   `json:"unreadable,omitempty"`
+}
+
+// StorageStats is the flash usage reported by GetStorageStats. The block
+// fields are zero for firmware that does not report them.
+type StorageStats struct {
+	Total      uint32 `json:"total"`
+	Used       uint32 `json:"used"`
+	Free       uint32 `json:"free"`
+	Profiles   uint8  `json:"profiles"`
+	BlockSize  uint32 `json:"block_size,omitempty"`
+	BlockCount uint32 `json:"block_count,omitempty"`
+}
+
+// Diagnostics is the runtime state reported by GetDiagnostics.
+type Diagnostics struct {
+	Uptime     time.Duration
+	HeapAlloc  uint32
+	HeapSys    uint32
+	Goroutines uint16
+	Counters   map[metrics.Counter]uint32
+
+	// Stored records failing their checksum
+	DeviceDamaged bool
+	DamagedSlots  []uint8
+}
+
+// Ping sends data and checks that the device echoes it back.
+func (c *Client) Ping(ctx context.Context, data []byte) error {
+	echo, err := c.Do(ctx, protocol.CmdPing, data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(echo, data) {
+		return badResponse(protocol.CmdPing, "echo %q does not match %q", echo, data)
+	}
+	return nil
+}
+
+// GetVersion returns the device's build identity.
+func (c *Client) GetVersion(ctx context.Context) (*Identity, error) {
+	payload, err := c.Do(ctx, protocol.CmdGetVersion, []byte{protocol.IdentityFormatTLV})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 {
+		return nil, badResponse(protocol.CmdGetVersion, "%d bytes", len(payload))
+	}
+	return parseIdentity(protocol.CmdGetVersion, payload[4:])
+}
+
+// Discover checks that the device is a Tuffpad and returns its identity.
+// It returns ErrNotTuffpad if something else answered.
+func (c *Client) Discover(ctx context.Context) (*Identity, error) {
+	payload, err := c.Do(ctx, protocol.CmdDiscover, []byte{protocol.IdentityFormatTLV})
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(payload, []byte(protocol.DeviceIdentifier)) {
+		return nil, ErrNotTuffpad
+	}
+	return parseIdentity(protocol.CmdDiscover, payload[len(protocol.DeviceIdentifier):])
+}
+
+// parseIdentity decodes the identity TLVs.
+func parseIdentity(cmd uint8, data []byte) (*Identity, error) {
+	entries, err := protocol.ParseTLV(data)
+	if err != nil {
+		return nil, badResponse(cmd, "identity: %v", err)
+	}
+
+	id := &Identity{}
+	for _, e := range entries {
+		switch e.Type {
+		case protocol.InfoVersionString:
+			id.Firmware = string(e.Value)
+		case protocol.InfoCommit:
+			id.Commit = string(e.Value)
+		case protocol.InfoBuildDate:
+			id.BuildDate = string(e.Value)
+		case protocol.InfoBoard:
+			id.Board = string(e.Value)
+		case protocol.InfoConfigVersion:
+			if len(e.Value) == 2 {
+				id.ConfigVersion = binary.LittleEndian.Uint16(e.Value)
+			}
+		case protocol.InfoSerialNumber:
+			id.Serial = fmt.Sprintf("%X", e.Value)
+		case protocol.InfoBootMode:
+			if len(e.Value) == 1 {
+				id.BootMode = reboot.Mode(e.Value[0])
+			}
+		}
+	}
+	return id, nil
+}
+
+// GetDeviceConfig reads the device configuration. The lock PIN is always
+// returned as zero. It returns ErrNotFound on a device that has never been
+// configured.
+func (c *Client) GetDeviceConfig(ctx context.Context) (*config.DeviceConfig, error) {
+	payload, err := c.Do(ctx, protocol.CmdGetDeviceConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config.DeviceConfig{}
+	if err := cfg.UnmarshalBinary(payload); err != nil {
+		return nil, badResponse(protocol.CmdGetDeviceConfig, "%v", err)
+	}
+	return cfg, nil
+}
+
+// SetDeviceConfig writes the device configuration. The device keeps its
+// stored lock state and PIN; use SetLock to change them.
+func (c *Client) SetDeviceConfig(ctx context.Context, cfg *config.DeviceConfig) error {
+	data, err := cfg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(ctx, protocol.CmdSetDeviceConfig, data)
+	return err
+}
+
+// GetProfile reads the profile in a slot.
+func (c *Client) GetProfile(ctx context.Context, slot uint8) (*config.Profile, error) {
+	payload, err := c.Do(ctx, protocol.CmdGetProfile, []byte{slot})
+	if err != nil {
+		return nil, err
+	}
+	p := &config.Profile{}
+	if err := p.UnmarshalBinary(payload); err != nil {
+		return nil, badResponse(protocol.CmdGetProfile, "%v", err)
+	}
+	return p, nil
+}
+
+// SetProfile writes a profile to a slot.
+func (c *Client) SetProfile(ctx context.Context, slot uint8, p *config.Profile) error {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(ctx, protocol.CmdSetProfile, append([]byte{slot}, data...))
+	return err
+}
+
+// DeleteProfile deletes the profile in a slot.
+func (c *Client) DeleteProfile(ctx context.Context, slot uint8) error {
+	_, err := c.Do(ctx, protocol.CmdDeleteProfile, []byte{slot})
+	return err
+}
+
+// ListProfiles returns every stored profile, fetching as many pages of
+// CmdListProfilesEx as needed.
+func (c *Client) ListProfiles(ctx context.Context) ([]ProfileEntry, error) {
+	entries := []ProfileEntry{}
+	for offset := 0; offset <= 255; {
+		payload, err := c.Do(ctx, protocol.CmdListProfilesEx, []byte{uint8(offset)})
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) < 4 {
+			return nil, badResponse(protocol.CmdListProfilesEx, "%d bytes", len(payload))
+		}
+
+		total := int(binary.LittleEndian.Uint16(payload[0:]))
+		count := int(payload[3])
+		if len(payload) < 4+count*protocol.ProfileEntrySize {
+			return nil, badResponse(protocol.CmdListProfilesEx, "%d entries in %d bytes", count, len(payload))
+		}
+		for i := 0; i < count; i++ {
+			entries = append(entries, parseProfileEntry(payload[4+i*protocol.ProfileEntrySize:]))
+		}
+
+		offset += count
+		if count == 0 || offset >= total {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// parseProfileEntry decodes one CmdListProfilesEx entry:
+// [Slot:1][EntryFlags:1][BindingCount:1][RGBPattern:1][Flags:4][RGBColor:4][FileSize:4][Name:16]
+func parseProfileEntry(e []byte) ProfileEntry {
+	var p config.Profile
+	copy(p.Name[:], e[16:32])
+	return ProfileEntry{
+		Slot:         e[0],
+		Name:         p.GetName(),
+		Active:       e[1]&protocol.EntryFlagActive != 0,
+		Unreadable:   e[1]&protocol.EntryFlagUnreadable != 0,
+		Corrupted:    e[1]&protocol.EntryFlagCorrupt != 0,
+		BindingCount: e[2],
+		RGBPattern:   e[3],
+		Flags:        binary.LittleEndian.Uint32(e[4:]),
+		RGBColor:     binary.LittleEndian.Uint32(e[8:]),
+		Size:         binary.LittleEndian.Uint32(e[12:]),
+	}
+}
+
+// ProfileHistory returns the stored earlier versions of a slot, newest
+// first.
+func (c *Client) ProfileHistory(ctx context.Context, slot uint8) ([]Generation, error) {
+	return c.history(ctx, protocol.HistoryProfile, slot)
+}
+
+// DeviceHistory returns the stored earlier versions of the device config,
+// newest first.
+func (c *Client) DeviceHistory(ctx context.Context) ([]Generation, error) {
+	return c.history(ctx, protocol.HistoryDevice, 0)
+}
+
+// history decodes a CmdListHistory response:
+// [Count:1][Generation:4][EntryFlags:1][BindingCount:1][Name:16]...
+func (c *Client) history(ctx context.Context, record, slot uint8) ([]Generation, error) {
+	payload, err := c.Do(ctx, protocol.CmdListHistory, []byte{record, slot})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 1 || len(payload) < 1+int(payload[0])*protocol.HistoryEntrySize {
+		return nil, badResponse(protocol.CmdListHistory, "%d bytes", len(payload))
+	}
+
+	gens := make([]Generation, payload[0])
+	for i := range gens {
+		e := payload[1+i*protocol.HistoryEntrySize:]
+		var p config.Profile
+		copy(p.Name[:], e[6:22])
+		gens[i] = Generation{
+			Generation:   binary.LittleEndian.Uint32(e),
+			Name:         p.GetName(),
+			BindingCount: e[5],
+			Unreadable:   e[4]&protocol.EntryFlagUnreadable != 0,
+		}
+	}
+	return gens, nil
+}
+
+// RestoreProfile makes a stored generation the slot's profile again. The
+// profile it replaces becomes the newest generation.
+func (c *Client) RestoreProfile(ctx context.Context, slot uint8, gen uint32) error {
+	_, err := c.Do(ctx, protocol.CmdRestoreHistory, binary.LittleEndian.AppendUint32([]byte{protocol.HistoryProfile, slot}, gen))
+	return err
+}
+
+// RestoreDevice makes a stored generation the device config again. The
+// device keeps its current lock state and PIN.
+func (c *Client) RestoreDevice(ctx context.Context, gen uint32) error {
+	_, err := c.Do(ctx, protocol.CmdRestoreHistory, binary.LittleEndian.AppendUint32([]byte{protocol.HistoryDevice, 0}, gen))
+	return err
+}
+
+// GetStorageStats returns flash usage.
+func (c *Client) GetStorageStats(ctx context.Context) (*StorageStats, error) {
+	payload, err := c.Do(ctx, protocol.CmdGetStorageStats, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 13 {
+		return nil, badResponse(protocol.CmdGetStorageStats, "%d bytes", len(payload))
+	}
+	stats := &StorageStats{
+		Total:    binary.LittleEndian.Uint32(payload[0:]),
+		Used:     binary.LittleEndian.Uint32(payload[4:]),
+		Free:     binary.LittleEndian.Uint32(payload[8:]),
+		Profiles: payload[12],
+	}
+	if len(payload) >= 21 {
+		stats.BlockSize = binary.LittleEndian.Uint32(payload[13:])
+		stats.BlockCount = binary.LittleEndian.Uint32(payload[17:])
+	}
+	return stats, nil
+}
+
+// GetDiagnostics returns uptime, memory use, damaged records and the
+// error counters.
+func (c *Client) GetDiagnostics(ctx context.Context) (*Diagnostics, error) {
+	payload, err := c.Do(ctx, protocol.CmdGetDiagnostics, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := protocol.ParseTLV(payload)
+	if err != nil {
+		return nil, badResponse(protocol.CmdGetDiagnostics, "%v", err)
+	}
+
+	d := &Diagnostics{Counters: make(map[metrics.Counter]uint32)}
+	for _, e := range entries {
+		if e.Type == protocol.DiagDamaged && len(e.Value) > 0 {
+			d.DeviceDamaged = e.Value[0] != 0
+			d.DamagedSlots = append([]uint8(nil), e.Value[1:]...)
+			continue
+		}
+
+		var v uint32
+		switch len(e.Value) {
+		case 2:
+			v = uint32(binary.LittleEndian.Uint16(e.Value))
+		case 4:
+			v = binary.LittleEndian.Uint32(e.Value)
+		default:
+			continue
+		}
+
+		switch {
+		case e.Type == protocol.DiagUptime:
+			d.Uptime = time.Duration(v) * time.Millisecond
+		case e.Type == protocol.DiagHeapAlloc:
+			d.HeapAlloc = v
+		case e.Type == protocol.DiagHeapSys:
+			d.HeapSys = v
+		case e.Type == protocol.DiagGoroutines:
+			d.Goroutines = uint16(v)
+		case e.Type >= protocol.DiagCounterBase:
+			d.Counters[metrics.Counter(e.Type-protocol.DiagCounterBase)] = v
+		}
+	}
+	return d, nil
+}
+
+// Unlock unlocks configuration writes on a locked device until it reboots.
+func (c *Client) Unlock(ctx context.Context, pin uint16) error {
+	payload := binary.LittleEndian.AppendUint16(nil, pin)
+	_, err := c.Do(ctx, protocol.CmdUnlock, payload)
+	return err
+}
+
+// SetLock enables or disables the write lock. Enabling sets the PIN.
+func (c *Client) SetLock(ctx context.Context, enable bool, pin uint16) error {
+	payload := []byte{0}
+	if enable {
+		payload[0] = 1
+	}
+	payload = binary.LittleEndian.AppendUint16(payload, pin)
+	_, err := c.Do(ctx, protocol.CmdSetLock, payload)
+	return err
+}
+
+// FactoryReset erases all profiles and settings. It runs both steps of
+// the reset challenge.
+func (c *Client) FactoryReset(ctx context.Context) error {
+	token, err := c.Do(ctx, protocol.CmdFactoryReset, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(ctx, protocol.CmdFactoryReset, token)
+	return err
+}
+
+// Reboot restarts the device in the given mode. The device resets right
+// after answering, so the connection must be reopened.
+func (c *Client) Reboot(ctx context.Context, mode reboot.Mode) error {
+	if !mode.Valid() {
+		return reboot.ErrInvalidMode
+	}
+	_, err := c.Do(ctx, protocol.CmdReboot, []byte{uint8(mode)})
+	return err
+}
+
+// UpdateFirmware sends a firmware image, has the device verify it and
+// commits it. The device reboots into the new firmware right after
+// answering, so the connection must be reopened. If the transfer fails, the
+// running firmware is kept and the update can simply be started again.
+// progress, if not nil, is called after each chunk with the bytes sent.
+func (c *Client) UpdateFirmware(ctx context.Context, image []byte, progress func(sent, total int)) error {
+	begin := binary.LittleEndian.AppendUint32(nil, uint32(len(image)))
+	begin = binary.LittleEndian.AppendUint32(begin, crc32.ChecksumIEEE(image))
+	resp, err := c.Do(ctx, protocol.CmdUpdateBegin, begin)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 2 || binary.LittleEndian.Uint16(resp) == 0 {
+		return badResponse(protocol.CmdUpdateBegin, "%x", resp)
+	}
+	chunk := min(int(binary.LittleEndian.Uint16(resp)), protocol.MaxUpdateChunk)
+
+	for off := 0; off < len(image); off += chunk {
+		end := min(off+chunk, len(image))
+		payload := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+end-off), uint32(off))
+		payload = append(payload, image[off:end]...)
+		if _, err := c.Do(ctx, protocol.CmdUpdateData, payload); err != nil {
+			return fmt.Errorf("offset %d: %w", off, err)
+		}
+		if progress != nil {
+			progress(end, len(image))
+		}
+	}
+
+	if _, err := c.Do(ctx, protocol.CmdUpdateVerify, nil); err != nil {
+		return err
+	}
+	_, err = c.Do(ctx, protocol.CmdUpdateCommit, nil)
+	return err
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+)
+
+// Errors matched by StatusError, one per non-OK status code.
+// Use errors.Is(err, client.ErrNotFound) to test for a status.
+var (
+	ErrDevice          = errors.New("device error")
+	ErrInvalidCommand  = errors.New("invalid command")
+	ErrInvalidData     = errors.New("invalid data")
+	ErrNotFound        = errors.New("not found")
+	ErrNoSpace         = errors.New("no space")
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrCRC             = errors.New("CRC error")
+	ErrLocked          = errors.New("device locked")
+	ErrCorrupted       = errors.New("record corrupted")
+)
+
+// Transport errors.
+var (
+	ErrTimeout     = errors.New("no response from device")
+	ErrBadResponse = errors.New("malformed response")
+	ErrNotTuffpad  = errors.New("not a Tuffpad")
+)
+
+var statusErrors = map[uint8]error{
+	protocol.StatusError:           ErrDevice,
+	protocol.StatusInvalidCmd:      ErrInvalidCommand,
+	protocol.StatusInvalidData:     ErrInvalidData,
+	protocol.StatusNotFound:        ErrNotFound,
+	protocol.StatusNoSpace:         ErrNoSpace,
+	protocol.StatusVersionMismatch: ErrVersionMismatch,
+	protocol.StatusCRCError:        ErrCRC,
+	protocol.StatusLocked:          ErrLocked,
+	protocol.StatusCorrupted:       ErrCorrupted,
+}
+
+// StatusError is a non-OK response from the device.
+type StatusError struct {
+	Cmd    uint8
+	Status uint8
+	Detail protocol.ErrorDetail // Zero if the device sent no detail
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("device: %s (status 0x%02X)", protocol.StatusText(e.Status), e.Status)
+	if e.Detail.Message != "" {
+		msg += ": " + e.Detail.Message
+	}
+	return msg
+}
+
+// Unwrap returns the Err* value for the status, or nil for unknown codes.
+func (e *StatusError) Unwrap() error {
+	return statusErrors[e.Status]
+}
+
+func badResponse(cmd uint8, format string, args ...any) error {
+	return fmt.Errorf("%w to command 0x%02X: %s", ErrBadResponse, cmd, fmt.Sprintf(format, args...))
+}
@@ -6,12 +6,23 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"unicode/utf8"
 )
 
 // CurrentVersion is the config format version.
-// Bump this when making breaking changes to the config format.
-// When firmware boots and finds a different version in flash, configs are wiped.
-const CurrentVersion uint16 = 1
+// Bump this when making breaking changes to the config format, and register
+// the upgrade steps from the previous version in Migrations. When firmware
+// boots and finds older records in flash, they are migrated in place; records
+// without a migration path are wiped.
+//
+// Version history:
+//   - 1: initial layout
+//   - 2: DeviceConfig Flags bit 0 and bytes 10-11 became the write lock
+//     (DeviceFlagLocked, LockPIN); both are cleared when migrating
+const CurrentVersion uint16 = 2
+
+// MaxBindings is the number of binding entries in every Profile.
+const MaxBindings = 32
 
 // BindingType indicates what kind of input this binding responds to
 type BindingType uint8
@@ -34,12 +45,25 @@ const (
 	OutputTypeConsumer // Media keys, etc.
 )
 
+// Profile flags (Profile.Flags)
+const (
+	// ProfileFlagKBMode enables keyboard (KB) mode for the profile.
+	ProfileFlagKBMode uint32 = 1 << 0
+)
+
+// Binding flags (KeyBinding.Flags)
+const (
+	BindingFlagTap       uint8 = 1 << 0 // Fire on a short press
+	BindingFlagHold      uint8 = 1 << 1 // Fire while held past the hold time
+	BindingFlagDoubleTap uint8 = 1 << 2 // Fire on two presses in quick succession
+)
+
 // KeyBinding maps one input to one output.
 // Total size: 8 bytes
 // Packed layout: [InputType:1][InputID:1][OutputType:1][OutputValueHi:1][OutputValueLo:1][Modifiers:1][Flags:1][Reserved:1]
 type KeyBinding struct {
 	InputType   BindingType // 1 byte
-	InputID     uint8       // Which key/button/dpad (0-31)
+	InputID     uint8       // Which key/button/dpad (below InputCount(InputType))
 	OutputType  OutputType  // 1 byte
 	OutputValue uint16      // HID keycode or button mask
 	Modifiers   uint8       // Ctrl/Shift/Alt/Gui (HID modifier byte)
@@ -61,15 +85,15 @@ type KeyBinding struct {
 //   [14-29]: Name ([16]byte)
 //   [30-285]: Bindings ([32]KeyBinding)
 type Profile struct {
-	Version      uint16         // Config format version
-	Flags        uint32         // Profile-level flags (KB mode enabled, etc.)
-	RGBColor     uint32         // RGB LED color (RGB888)
-	RGBPattern   uint8          // RGB pattern ID
-	Reserved1    uint8          // Padding
-	BindingCount uint8          // Actual number of bindings (<= 32)
-	Reserved2    uint8          // Padding
-	Name         [16]byte       // UTF-8 name (null-terminated if shorter)
-	Bindings     [32]KeyBinding // Fixed array, uses BindingCount
+	Version      uint16                  // Config format version
+	Flags        uint32                  // Profile-level flags (KB mode enabled, etc.)
+	RGBColor     uint32                  // RGB LED color (RGB888)
+	RGBPattern   uint8                   // RGB pattern ID
+	Reserved1    uint8                   // Padding
+	BindingCount uint8                   // Actual number of bindings (<= MaxBindings)
+	Reserved2    uint8                   // Padding
+	Name         [16]byte                // UTF-8 name (null-terminated if shorter)
+	Bindings     [MaxBindings]KeyBinding // Fixed array, uses BindingCount
 }
 
 // Device global settings.
@@ -80,16 +104,36 @@ type Profile struct {
 //   [6]:    ActiveProfile (uint8)
 //   [7]:    Brightness (uint8)
 //   [8]:    DebounceMs (uint8)
-//   [9]:    Reserved (uint8)
-//   [10-11]: Reserved for future use
+//   [9]:    HistoryDepth (uint8)
+//   [10-11]: LockPIN (uint16)
 type DeviceConfig struct {
 	Version       uint16 // Config format version
 	Flags         uint32 // Global feature flags
 	ActiveProfile uint8  // Which profile is active on boot
 	Brightness    uint8  // LED brightness 0-255
 	DebounceMs    uint8  // Input debounce time
-	Reserved1     uint8  // Padding
-	Reserved2     uint16 // Reserved for future use
+	HistoryDepth  uint8  // Earlier versions kept per record, see HistoryDefault
+	LockPIN       uint16 // PIN for unlocking writes (used when DeviceFlagLocked is set)
+}
+
+// Device flags (DeviceConfig.Flags)
+const (
+	// DeviceFlagLocked enables the configuration write lock.
+	// Write and destructive commands are refused until unlocked with LockPIN.
+	DeviceFlagLocked uint32 = 1 << 0
+)
+
+// History depth values (DeviceConfig.HistoryDepth). Byte 9 was reserved and
+// always 0 before, so older configs keep the firmware default.
+const (
+	HistoryDefault  uint8 = 0    // The firmware's default depth
+	HistoryOff      uint8 = 0xFF // Keep no earlier versions
+	MaxHistoryDepth uint8 = 16   // Largest explicit depth
+)
+
+// Locked reports whether the configuration write lock is enabled.
+func (d *DeviceConfig) Locked() bool {
+	return d.Flags&DeviceFlagLocked != 0
 }
 
 // Errors
@@ -231,8 +275,8 @@ func (d *DeviceConfig) MarshalBinary() ([]byte, error) {
 	buf[6] = d.ActiveProfile
 	buf[7] = d.Brightness
 	buf[8] = d.DebounceMs
-	buf[9] = d.Reserved1
-	binary.LittleEndian.PutUint16(buf[10:], d.Reserved2)
+	buf[9] = d.HistoryDepth
+	binary.LittleEndian.PutUint16(buf[10:], d.LockPIN)
 	return buf, nil
 }
 
@@ -247,8 +291,8 @@ func (d *DeviceConfig) UnmarshalBinary(data []byte) error {
 	d.ActiveProfile = data[6]
 	d.Brightness = data[7]
 	d.DebounceMs = data[8]
-	d.Reserved1 = data[9]
-	d.Reserved2 = binary.LittleEndian.Uint16(data[10:])
+	d.HistoryDepth = data[9]
+	d.LockPIN = binary.LittleEndian.Uint16(data[10:])
 	return nil
 }
 
@@ -264,12 +308,16 @@ func (p *Profile) GetName() string {
 }
 
 // SetName sets the profile name from a string.
-// If the name is longer than 15 bytes, it is truncated.
+// If the name is longer than 15 bytes, it is truncated at a rune boundary.
 // The name is always null-terminated.
 func (p *Profile) SetName(name string) {
 	b := []byte(name)
 	if len(b) > 15 {
-		b = b[:15]
+		n := 15
+		for n > 0 && !utf8.RuneStart(b[n]) {
+			n--
+		}
+		b = b[:n]
 	}
 	copy(p.Name[:], b)
 	p.Name[len(b)] = 0 // Null terminate
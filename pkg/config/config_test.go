@@ -12,8 +12,8 @@ func TestDeviceConfigMarshalUnmarshal(t *testing.T) {
 		ActiveProfile: 5,
 		Brightness:    128,
 		DebounceMs:    10,
-		Reserved1:     0,
-		Reserved2:     0xABCD,
+		HistoryDepth:  5,
+		LockPIN:       0xABCD,
 	}
 	
 	// Marshal
@@ -48,8 +48,8 @@ func TestDeviceConfigMarshalUnmarshal(t *testing.T) {
 	if decoded.DebounceMs != original.DebounceMs {
 		t.Errorf("DebounceMs: expected %d, got %d", original.DebounceMs, decoded.DebounceMs)
 	}
-	if decoded.Reserved2 != original.Reserved2 {
-		t.Errorf("Reserved2: expected 0x%x, got 0x%x", original.Reserved2, decoded.Reserved2)
+	if decoded.LockPIN != original.LockPIN {
+		t.Errorf("LockPIN: expected 0x%x, got 0x%x", original.LockPIN, decoded.LockPIN)
 	}
 }
 
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Record identifies a type of stored config record.
+type Record uint8
+
+const (
+	RecordDevice Record = iota
+	RecordProfile
+)
+
+// String returns the record type name.
+func (r Record) String() string {
+	switch r {
+	case RecordDevice:
+		return "device config"
+	case RecordProfile:
+		return "profile"
+	default:
+		return fmt.Sprintf("record %d", uint8(r))
+	}
+}
+
+// Size returns the encoded size of the record type at CurrentVersion.
+func (r Record) Size() int {
+	switch r {
+	case RecordDevice:
+		return 12
+	case RecordProfile:
+		return 286
+	default:
+		return 0
+	}
+}
+
+// Migration errors
+var (
+	ErrNoMigration  = errors.New("no migration path")
+	ErrMigrateStep  = errors.New("migration step failed")
+	ErrRecordLength = errors.New("migrated record has the wrong size")
+)
+
+// MigrateFunc upgrades the encoded bytes of one record by one version. It
+// receives the record as stored at version N and returns it in the layout of
+// version N+1. Every layout starts with the uint16 version; the Migrator
+// stamps the new version, so steps only convert the remaining fields.
+type MigrateFunc func(data []byte) ([]byte, error)
+
+type migrationKey struct {
+	rec  Record
+	from uint16
+}
+
+// Migrator holds the upgrade steps for each record type and applies them
+// in sequence up to a target version.
+type Migrator struct {
+	target uint16
+	steps  map[migrationKey]MigrateFunc
+}
+
+// Migrations is the firmware's migration registry, targeting CurrentVersion.
+// When bumping CurrentVersion, register a step from the previous version for
+// each record type whose layout or meaning changed, plus a step that returns
+// data unchanged for the others.
+var Migrations = NewMigrator(CurrentVersion)
+
+// NewMigrator returns an empty Migrator that upgrades records to target.
+func NewMigrator(target uint16) *Migrator {
+	return &Migrator{
+		target: target,
+		steps:  make(map[migrationKey]MigrateFunc),
+	}
+}
+
+// Target returns the version records are migrated to.
+func (m *Migrator) Target() uint16 {
+	return m.target
+}
+
+// Register adds the step that upgrades rec from version from to from+1.
+// It panics if the step is already registered or does not lead towards the
+// target, since both are programming errors.
+func (m *Migrator) Register(rec Record, from uint16, fn MigrateFunc) {
+	if from >= m.target {
+		panic(fmt.Sprintf("config: %s migration from version %d does not lead to %d", rec, from, m.target))
+	}
+	key := migrationKey{rec, from}
+	if _, ok := m.steps[key]; ok {
+		panic(fmt.Sprintf("config: duplicate %s migration from version %d", rec, from))
+	}
+	m.steps[key] = fn
+}
+
+// CanMigrate reports whether rec can be upgraded from version from to the
+// target. A record already at the target trivially can.
+func (m *Migrator) CanMigrate(rec Record, from uint16) bool {
+	if from > m.target {
+		return false
+	}
+	for v := from; v < m.target; v++ {
+		if _, ok := m.steps[migrationKey{rec, v}]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Migrate upgrades an encoded record to the target version and returns the
+// new encoding. data is not modified. A record already at the target is
+// returned as is. ErrNoMigration is returned if a step is missing or the
+// record is newer than the target.
+func (m *Migrator) Migrate(rec Record, data []byte) ([]byte, error) {
+	from, err := RecordVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	if !m.CanMigrate(rec, from) {
+		return nil, fmt.Errorf("%w: %s version %d to %d", ErrNoMigration, rec, from, m.target)
+	}
+
+	for v := from; v < m.target; v++ {
+		next, err := m.steps[migrationKey{rec, v}](append([]byte(nil), data...))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s version %d: %w", ErrMigrateStep, rec, v, err)
+		}
+		if len(next) < 2 {
+			return nil, fmt.Errorf("%w: %s version %d", ErrRecordLength, rec, v+1)
+		}
+		binary.LittleEndian.PutUint16(next, v+1)
+		data = next
+	}
+	return data, nil
+}
+
+// RecordVersion returns the version stored at the start of an encoded record.
+func RecordVersion(data []byte) (uint16, error) {
+	if len(data) < 2 {
+		return 0, ErrInvalidSize
+	}
+	return binary.LittleEndian.Uint16(data), nil
+}
+
+func init() {
+	Migrations.Register(RecordDevice, 1, clearLock)
+	Migrations.Register(RecordProfile, 1, unchanged)
+}
+
+// unchanged is the step for records whose layout did not change.
+func unchanged(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// clearLock upgrades a version 1 device config. Flags bit 0 and the
+// reserved bytes that became LockPIN were free for other uses before, so a
+// set bit must not lock the pad with whatever PIN those bytes hold.
+func clearLock(data []byte) ([]byte, error) {
+	if len(data) != RecordDevice.Size() {
+		return nil, ErrInvalidSize
+	}
+	flags := binary.LittleEndian.Uint32(data[2:])
+	binary.LittleEndian.PutUint32(data[2:], flags&^DeviceFlagLocked)
+	binary.LittleEndian.PutUint16(data[10:], 0)
+	return data, nil
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// testMigrator upgrades profiles from version 1 to 3: version 2 moved the
+// RGB pattern into the high byte of Flags, version 3 moved it back and
+// turned RGBColor from BGR into RGB.
+func testMigrator() *Migrator {
+	m := NewMigrator(3)
+	m.Register(RecordProfile, 1, func(data []byte) ([]byte, error) {
+		data[5] = data[10]
+		data[10] = 0
+		return data, nil
+	})
+	m.Register(RecordProfile, 2, func(data []byte) ([]byte, error) {
+		data[10] = data[5]
+		data[5] = 0
+		data[6], data[8] = data[8], data[6]
+		return data, nil
+	})
+	m.Register(RecordDevice, 2, func(data []byte) ([]byte, error) {
+		return nil, errors.New("broken step")
+	})
+	return m
+}
+
+func TestMigrateProfile(t *testing.T) {
+	old := Profile{Version: 1, RGBColor: 0x112233, RGBPattern: 4, BindingCount: 1}
+	old.SetName("Old")
+	data, _ := old.MarshalBinary()
+	orig := append([]byte(nil), data...)
+
+	out, err := testMigrator().Migrate(RecordProfile, data)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if !bytes.Equal(data, orig) {
+		t.Error("Migrate modified its input")
+	}
+
+	var p Profile
+	p.UnmarshalBinary(out)
+	if p.Version != 3 || p.RGBColor != 0x332211 || p.RGBPattern != 4 || p.Flags != 0 || p.GetName() != "Old" {
+		t.Errorf("Unexpected migrated profile: %+v", p)
+	}
+
+	// Starting half way
+	old.Version = 2
+	data, _ = old.MarshalBinary()
+	data[5], data[10] = 4, 0
+	out, _ = testMigrator().Migrate(RecordProfile, data)
+	p.UnmarshalBinary(out)
+	if p.Version != 3 || p.RGBPattern != 4 {
+		t.Errorf("Unexpected profile migrated from version 2: %+v", p)
+	}
+
+	// Current records pass through
+	old.Version = 3
+	data, _ = old.MarshalBinary()
+	if out, err := testMigrator().Migrate(RecordProfile, data); err != nil || !bytes.Equal(out, data) {
+		t.Errorf("Current record changed: %v", err)
+	}
+}
+
+func TestMigrateNoPath(t *testing.T) {
+	m := testMigrator()
+
+	tests := []struct {
+		rec     Record
+		version uint16
+		want    error
+	}{
+		{RecordProfile, 0, ErrNoMigration}, // Too old
+		{RecordProfile, 4, ErrNoMigration}, // Newer firmware
+		{RecordDevice, 1, ErrNoMigration},  // Missing 1 -> 2
+		{RecordDevice, 2, ErrMigrateStep},  // Step fails
+		{RecordDevice, 3, nil},             // Current
+	}
+	for _, tt := range tests {
+		data := []byte{byte(tt.version), byte(tt.version >> 8), 0, 0}
+		_, err := m.Migrate(tt.rec, data)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Migrate(%s v%d) error = %v, want %v", tt.rec, tt.version, err, tt.want)
+		}
+		if can, want := m.CanMigrate(tt.rec, tt.version), tt.want != ErrNoMigration; can != want {
+			t.Errorf("CanMigrate(%s v%d) = %v, want %v", tt.rec, tt.version, can, want)
+		}
+	}
+
+	if _, err := m.Migrate(RecordProfile, []byte{1}); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("Expected ErrInvalidSize for a short record, got %v", err)
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	for name, fn := range map[string]func(m *Migrator){
+		"duplicate": func(m *Migrator) { m.Register(RecordProfile, 1, nil) },
+		"at target": func(m *Migrator) { m.Register(RecordProfile, 3, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", name)
+				}
+			}()
+			fn(testMigrator())
+		}()
+	}
+}
+
+func TestMigrateClearsLock(t *testing.T) {
+	// Bit 0 and bytes 10-11 were free to use in version 1
+	old := DeviceConfig{Version: 1, Flags: 0x11, Brightness: 80, LockPIN: 0xBEEF}
+	data, _ := old.MarshalBinary()
+	out, err := Migrations.Migrate(RecordDevice, data)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	var d DeviceConfig
+	d.UnmarshalBinary(out)
+	if d.Version != CurrentVersion || d.Locked() || d.LockPIN != 0 || d.Flags != 0x10 || d.Brightness != 80 {
+		t.Errorf("Unexpected migrated device config: %+v", d)
+	}
+
+	p := Profile{Version: 1, RGBColor: 0x123456}
+	data, _ = p.MarshalBinary()
+	if out, err := Migrations.Migrate(RecordProfile, data); err != nil || !bytes.Equal(out[2:], data[2:]) {
+		t.Errorf("Profile not carried over: %v", err)
+	}
+}
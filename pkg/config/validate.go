@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Physical inputs of the pad. A binding's InputID must be below the count
+// for its BindingType; RGB pattern triggers are bound to keys.
+const (
+	NumKeys            = 21
+	NumJoystickButtons = 1
+	NumDPadDirections  = 4 // Up, down, left, right
+)
+
+// Defined flag bits; any other bit is rejected by Validate.
+const (
+	profileFlagsDefined = ProfileFlagKBMode
+	bindingFlagsDefined = BindingFlagTap | BindingFlagHold | BindingFlagDoubleTap
+	deviceFlagsDefined  = DeviceFlagLocked
+)
+
+// maxKeycode is the last HID Keyboard/Keypad page usage (Right GUI).
+const maxKeycode = 0xE7
+
+// InputCount returns the number of physical inputs of a binding type, or 0
+// for an unknown type.
+func InputCount(t BindingType) int {
+	switch t {
+	case BindingTypeKey, BindingTypeRGBPattern:
+		return NumKeys
+	case BindingTypeJoystickButton:
+		return NumJoystickButtons
+	case BindingTypeDPad:
+		return NumDPadDirections
+	default:
+		return 0
+	}
+}
+
+// Problem is one invalid field found by Validate.
+type Problem struct {
+	Field  string // Go field path, e.g. "Bindings[3].InputID"
+	Offset int    // Byte offset of the field in the binary encoding
+	Msg    string
+}
+
+func (p Problem) Error() string {
+	return p.Field + ": " + p.Msg
+}
+
+// Problems lists every invalid field, in encoding order.
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	msgs := make([]string, len(ps))
+	for i, p := range ps {
+		msgs[i] = p.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// In reports the problems found in the file at path, one per line with
+// its offset, as the host tools print them.
+func (ps Problems) In(path string) error {
+	var sb strings.Builder
+	sb.WriteString(path + ": invalid")
+	for _, p := range ps {
+		fmt.Fprintf(&sb, "\n  %s (offset %d)", p.Error(), p.Offset)
+	}
+	return errors.New(sb.String())
+}
+
+func (ps *Problems) add(field string, offset int, format string, args ...any) {
+	*ps = append(*ps, Problem{Field: field, Offset: offset, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks that the profile only uses defined values and that every
+// binding maps a physical input. It returns nil if the profile is valid.
+// The version is not checked; storage and the protocol handle it.
+func (p *Profile) Validate() Problems {
+	var ps Problems
+
+	if undef := p.Flags &^ profileFlagsDefined; undef != 0 {
+		ps.add("Flags", 2, "undefined bits 0x%X", undef)
+	}
+	if p.RGBColor > 0xFFFFFF {
+		ps.add("RGBColor", 6, "0x%X is not RGB888", p.RGBColor)
+	}
+	if p.Reserved1 != 0 {
+		ps.add("Reserved1", 11, "must be 0")
+	}
+	if p.BindingCount > MaxBindings {
+		ps.add("BindingCount", 12, "%d is more than %d", p.BindingCount, MaxBindings)
+	}
+	if p.Reserved2 != 0 {
+		ps.add("Reserved2", 13, "must be 0")
+	}
+	if name := p.GetName(); !utf8.ValidString(name) {
+		ps.add("Name", 14, "%q is not UTF-8", name)
+	}
+
+	count := int(p.BindingCount)
+	if count > MaxBindings {
+		count = MaxBindings
+	}
+	for i := 0; i < count; i++ {
+		p.validateBinding(i, &ps)
+	}
+	return ps
+}
+
+// triggers returns the binding's trigger flags, with a plain press as its
+// own bit, so two bindings on one input conflict if they share a bit.
+// Bindings with OutputTypeNone emit nothing and never conflict.
+func (b *KeyBinding) triggers() uint8 {
+	t := b.Flags & bindingFlagsDefined
+	if t == 0 {
+		return 1 << 7
+	}
+	return t
+}
+
+func (p *Profile) validateBinding(i int, ps *Problems) {
+	b := &p.Bindings[i]
+	field := "Bindings[" + strconv.Itoa(i) + "]."
+	off := 30 + i*8
+
+	if n := InputCount(b.InputType); n == 0 {
+		ps.add(field+"InputType", off, "undefined input type %d", b.InputType)
+	} else if int(b.InputID) >= n {
+		ps.add(field+"InputID", off+1, "%d is beyond the last input (%d)", b.InputID, n-1)
+	} else if b.OutputType != OutputTypeNone {
+		for j := 0; j < i; j++ {
+			o := &p.Bindings[j]
+			if o.InputType == b.InputType && o.InputID == b.InputID &&
+				o.OutputType != OutputTypeNone && o.triggers()&b.triggers() != 0 {
+				ps.add(field+"InputID", off+1, "input %d already bound by Bindings[%d]", b.InputID, j)
+				break
+			}
+		}
+	}
+
+	switch b.OutputType {
+	case OutputTypeNone:
+	case OutputTypeKeyboard:
+		if b.OutputValue > maxKeycode {
+			ps.add(field+"OutputValue", off+3, "keycode 0x%X is beyond 0x%X", b.OutputValue, maxKeycode)
+		}
+	case OutputTypeGamepadButton:
+		if b.OutputValue == 0 {
+			ps.add(field+"OutputValue", off+3, "no gamepad buttons")
+		}
+	case OutputTypeMouseButton:
+		if b.OutputValue == 0 || b.OutputValue > 0x1F {
+			ps.add(field+"OutputValue", off+3, "mouse buttons 0x%X not in 0x01-0x1F", b.OutputValue)
+		}
+	case OutputTypeConsumer:
+		if b.OutputValue == 0 {
+			ps.add(field+"OutputValue", off+3, "no consumer usage")
+		}
+	default:
+		ps.add(field+"OutputType", off+2, "undefined output type %d", b.OutputType)
+	}
+
+	if b.Modifiers != 0 && b.OutputType != OutputTypeKeyboard {
+		ps.add(field+"Modifiers", off+5, "only apply to keyboard outputs")
+	}
+	if undef := b.Flags &^ bindingFlagsDefined; undef != 0 {
+		ps.add(field+"Flags", off+6, "undefined bits 0x%X", undef)
+	}
+	if b.Reserved != 0 {
+		ps.add(field+"Reserved", off+7, "must be 0")
+	}
+}
+
+// Validate checks that the device config only uses defined values. It
+// returns nil if the config is valid.
+func (d *DeviceConfig) Validate() Problems {
+	var ps Problems
+	if undef := d.Flags &^ deviceFlagsDefined; undef != 0 {
+		ps.add("Flags", 2, "undefined bits 0x%X", undef)
+	}
+	if d.HistoryDepth > MaxHistoryDepth && d.HistoryDepth != HistoryOff {
+		ps.add("HistoryDepth", 9, "%d is above %d (%d turns history off)", d.HistoryDepth, MaxHistoryDepth, HistoryOff)
+	}
+	return ps
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func validProfile() *Profile {
+	p := &Profile{Version: CurrentVersion, Flags: ProfileFlagKBMode, RGBColor: 0x00FF00, BindingCount: 4}
+	p.SetName("Valid")
+	p.Bindings[0] = KeyBinding{InputType: BindingTypeKey, InputID: 0, OutputType: OutputTypeKeyboard, OutputValue: 0x04, Modifiers: 0x02}
+	p.Bindings[1] = KeyBinding{InputType: BindingTypeKey, InputID: 0, OutputType: OutputTypeConsumer, OutputValue: 0xE9, Flags: BindingFlagHold}
+	p.Bindings[2] = KeyBinding{InputType: BindingTypeDPad, InputID: NumDPadDirections - 1, OutputType: OutputTypeGamepadButton, OutputValue: 1 << 12}
+	p.Bindings[3] = KeyBinding{InputType: BindingTypeKey, InputID: 0} // Disabled, never conflicts
+	return p
+}
+
+func TestValidateProfile(t *testing.T) {
+	if ps := validProfile().Validate(); ps != nil {
+		t.Fatalf("valid profile rejected: %v", ps)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(p *Profile)
+		field  string
+		offset int
+	}{
+		{"flags", func(p *Profile) { p.Flags |= 0x100 }, "Flags", 2},
+		{"color", func(p *Profile) { p.RGBColor = 0x01000000 }, "RGBColor", 6},
+		{"count", func(p *Profile) { p.BindingCount = MaxBindings + 1 }, "BindingCount", 12},
+		{"name", func(p *Profile) { p.Name[2] = 0xFF }, "Name", 14},
+		{"input type", func(p *Profile) { p.Bindings[2].InputType = 9 }, "Bindings[2].InputType", 46},
+		{"input id", func(p *Profile) { p.Bindings[2].InputID = NumDPadDirections }, "Bindings[2].InputID", 47},
+		{"duplicate", func(p *Profile) { p.Bindings[1].Flags = 0 }, "Bindings[1].InputID", 39},
+		{"output type", func(p *Profile) { p.Bindings[2].OutputType = 5 }, "Bindings[2].OutputType", 48},
+		{"keycode", func(p *Profile) { p.Bindings[0].OutputValue = 0x1FF }, "Bindings[0].OutputValue", 33},
+		{"modifiers", func(p *Profile) { p.Bindings[1].Modifiers = 1 }, "Bindings[1].Modifiers", 43},
+		{"binding flags", func(p *Profile) { p.Bindings[2].Flags = 0x80 }, "Bindings[2].Flags", 52},
+		{"reserved", func(p *Profile) { p.Bindings[0].Reserved = 1 }, "Bindings[0].Reserved", 37},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := validProfile()
+			tt.mutate(p)
+			ps := p.Validate()
+			if len(ps) != 1 {
+				t.Fatalf("expected 1 problem, got %v", ps)
+			}
+			if ps[0].Field != tt.field || ps[0].Offset != tt.offset {
+				t.Errorf("got %s at %d, expected %s at %d", ps[0].Field, ps[0].Offset, tt.field, tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateOffsetsMatchEncoding(t *testing.T) {
+	// Flip a defined field through the struct and check that Validate
+	// points at the byte the encoding changed.
+	p := validProfile()
+	p.Bindings[5].Reserved = 0xAA
+	p.BindingCount = 6
+	data, _ := p.MarshalBinary()
+	ps := p.Validate()
+	if len(ps) != 1 || data[ps[0].Offset] != 0xAA {
+		t.Errorf("problems %v do not locate the reserved byte", ps)
+	}
+}
+
+func TestValidateStaleBindings(t *testing.T) {
+	p := validProfile()
+	p.Bindings[MaxBindings-1].InputType = 9 // Beyond BindingCount, ignored
+	if ps := p.Validate(); ps != nil {
+		t.Errorf("stale binding reported: %v", ps)
+	}
+}
+
+func TestValidateDevice(t *testing.T) {
+	d := DeviceConfig{Version: CurrentVersion, Flags: DeviceFlagLocked, Brightness: 255}
+	if ps := d.Validate(); ps != nil {
+		t.Fatalf("valid device config rejected: %v", ps)
+	}
+	for _, depth := range []uint8{HistoryDefault, 1, MaxHistoryDepth, HistoryOff} {
+		d.HistoryDepth = depth
+		if ps := d.Validate(); ps != nil {
+			t.Errorf("history depth %d rejected: %v", depth, ps)
+		}
+	}
+	d.Flags |= 0x80000000
+	d.HistoryDepth = MaxHistoryDepth + 1
+	ps := d.Validate()
+	if len(ps) != 2 || ps[0].Offset != 2 || ps[1].Offset != 9 {
+		t.Fatalf("unexpected problems %v", ps)
+	}
+	if msg := ps.Error(); !strings.Contains(msg, "Flags: undefined bits 0x80000000") || !strings.Contains(msg, "; HistoryDepth: 17 is above 16") {
+		t.Errorf("unexpected message %q", msg)
+	}
+	want := "device.bin: invalid\n  Flags: undefined bits 0x80000000 (offset 2)\n  HistoryDepth: "
+	if msg := ps.In("device.bin").Error(); !strings.HasPrefix(msg, want) {
+		t.Errorf("unexpected report %q", msg)
+	}
+}
+
+func TestSetNameRuneBoundary(t *testing.T) {
+	var p Profile
+	p.SetName("ProfilesProfilé") // é is bytes 14-15
+	if name := p.GetName(); name != "ProfilesProfil" {
+		t.Errorf("SetName truncated to %q", name)
+	}
+	if ps := p.Validate(); ps != nil {
+		t.Errorf("truncated name rejected: %v", ps)
+	}
+}
@@ -0,0 +1,484 @@
+// Package configtext converts profiles to and from a human-readable text
+// format, so they can be reviewed in git or pasted into a chat.
+//
+// The format is a subset of TOML with symbolic names for input and output
+// types, HID keycodes, modifiers and flags:
+//
+//	# Tuffpad profile
+//	version = 2
+//	name = "Driving"
+//	flags = ["kb_mode"]
+//	rgb_color = "#FF00FF"
+//	rgb_pattern = 2
+//
+//	[[binding]]
+//	input = "key"
+//	id = 0
+//	output = "keyboard"
+//	value = "w"
+//	modifiers = ["left_shift"]
+//
+// Any value may also be written as a number, so unnamed keycodes and
+// unknown flag bits survive a round trip. Marshal followed by Unmarshal
+// reproduces the exact bytes of Profile.MarshalBinary, including reserved
+// fields and stale entries past BindingCount (written with unused = true).
+package configtext
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/hidusage"
+)
+
+// Error is a problem on one line of a profile file.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ErrorList is every problem found in a profile file, in line order.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l *ErrorList) add(line int, format string, args ...any) {
+	*l = append(*l, &Error{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Marshal writes a profile as text.
+func Marshal(p *config.Profile) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Tuffpad profile\n")
+	fmt.Fprintf(&b, "version = %d\n", p.Version)
+	if name, ok := nameString(p.Name); ok {
+		fmt.Fprintf(&b, "name = %s\n", quote(name))
+	} else {
+		fmt.Fprintf(&b, "name_bytes = %s\n", formatBytes(p.Name[:]))
+	}
+	if p.Flags != 0 {
+		fmt.Fprintf(&b, "flags = %s\n", formatBits(profileFlags, p.Flags, false))
+	}
+	if p.RGBColor <= 0xFFFFFF {
+		fmt.Fprintf(&b, "rgb_color = \"#%06X\"\n", p.RGBColor)
+	} else {
+		fmt.Fprintf(&b, "rgb_color = 0x%08X\n", p.RGBColor)
+	}
+	fmt.Fprintf(&b, "rgb_pattern = %d\n", p.RGBPattern)
+	if p.Reserved1 != 0 {
+		fmt.Fprintf(&b, "reserved1 = %d\n", p.Reserved1)
+	}
+	if p.Reserved2 != 0 {
+		fmt.Fprintf(&b, "reserved2 = %d\n", p.Reserved2)
+	}
+	if p.BindingCount > config.MaxBindings {
+		fmt.Fprintf(&b, "binding_count = %d\n", p.BindingCount)
+	}
+
+	// Write the active bindings plus any stale data after them
+	n := min(int(p.BindingCount), config.MaxBindings)
+	for i := n; i < config.MaxBindings; i++ {
+		if p.Bindings[i] != (config.KeyBinding{}) {
+			n = i + 1
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		kb := &p.Bindings[i]
+		b.WriteString("\n[[binding]]\n")
+		fmt.Fprintf(&b, "input = %s\n", formatName(bindingTypes, uint16(kb.InputType)))
+		fmt.Fprintf(&b, "id = %d\n", kb.InputID)
+		fmt.Fprintf(&b, "output = %s\n", formatName(outputTypes, uint16(kb.OutputType)))
+		if kb.OutputType != config.OutputTypeNone || kb.OutputValue != 0 {
+			fmt.Fprintf(&b, "value = %s\n", formatValue(kb.OutputType, kb.OutputValue))
+		}
+		if kb.Modifiers != 0 {
+			fmt.Fprintf(&b, "modifiers = %s\n", formatBits(hidusage.Modifiers, uint32(kb.Modifiers), false))
+		}
+		if kb.Flags != 0 {
+			fmt.Fprintf(&b, "flags = %s\n", formatBits(bindingFlags, uint32(kb.Flags), false))
+		}
+		if kb.Reserved != 0 {
+			fmt.Fprintf(&b, "reserved = %d\n", kb.Reserved)
+		}
+		if i >= int(p.BindingCount) {
+			b.WriteString("unused = true\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// nameString returns the profile name as a string if it can be written as
+// one without losing bytes.
+func nameString(name [16]byte) (string, bool) {
+	end := bytes.IndexByte(name[:], 0)
+	if end < 0 {
+		end = len(name)
+	}
+	for _, c := range name[end:] {
+		if c != 0 {
+			return "", false
+		}
+	}
+
+	s := string(name[:end])
+	if !utf8.ValidString(s) {
+		return "", false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// formatBytes writes name bytes as an integer array, trailing zeros omitted.
+func formatBytes(data []byte) string {
+	data = bytes.TrimRight(data, "\x00")
+	parts := make([]string, len(data))
+	for i, c := range data {
+		parts[i] = fmt.Sprintf("0x%02X", c)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func formatName(n *hidusage.Table, v uint16) string {
+	if s, ok := n.Name(v); ok {
+		return quote(s)
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+// formatBits writes the named bits of v as an array of strings, followed
+// by any unnamed bits as one number. With single set, a lone named bit is
+// written as a plain string.
+func formatBits(b *hidusage.BitTable, v uint32, single bool) string {
+	var parts []string
+	names, v := b.Names(v)
+	for _, name := range names {
+		parts = append(parts, quote(name))
+	}
+	if v != 0 {
+		parts = append(parts, fmt.Sprintf("0x%X", v))
+	} else if single && len(parts) == 1 {
+		return parts[0]
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// formatValue writes an output value in the form that suits its type.
+func formatValue(t config.OutputType, v uint16) string {
+	switch t {
+	case config.OutputTypeKeyboard:
+		if s, ok := hidusage.Keyboard.Name(v); ok {
+			return quote(s)
+		}
+	case config.OutputTypeConsumer:
+		if s, ok := hidusage.Consumer.Name(v); ok {
+			return quote(s)
+		}
+	case config.OutputTypeGamepadButton:
+		if v != 0 {
+			return formatBits(hidusage.GamepadButtons, uint32(v), true)
+		}
+	case config.OutputTypeMouseButton:
+		if v != 0 {
+			return formatBits(hidusage.MouseButtons, uint32(v), true)
+		}
+	}
+	return fmt.Sprintf("0x%02X", v)
+}
+
+// Unmarshal parses a profile from text. On failure it returns an
+// ErrorList with every problem found and leaves p unchanged.
+func Unmarshal(data []byte, p *config.Profile) error {
+	doc, errs := parse(data)
+	d := &decoder{errs: errs}
+	out := d.profile(doc)
+	if len(d.errs) > 0 {
+		d.sort()
+		return d.errs
+	}
+	*p = *out
+	return nil
+}
+
+// decoder turns a parsed document into a Profile, collecting errors.
+type decoder struct {
+	errs ErrorList
+}
+
+func (d *decoder) profile(doc *document) *config.Profile {
+	p := &config.Profile{Version: config.CurrentVersion}
+	bindingCount := -1
+
+	for _, e := range doc.root.entries {
+		switch e.key {
+		case "version":
+			p.Version = uint16(d.uint(e, 0xFFFF))
+		case "name":
+			if s, ok := d.str(e); ok {
+				if len(s) > len(p.Name) {
+					d.errs.add(e.line, "name is %d bytes, the limit is %d", len(s), len(p.Name))
+				}
+				copy(p.Name[:], s)
+			}
+		case "name_bytes":
+			d.nameBytes(e, &p.Name)
+		case "flags":
+			p.Flags = d.bits(e, profileFlags, 0xFFFFFFFF)
+		case "rgb_color":
+			p.RGBColor = d.color(e)
+		case "rgb_pattern":
+			p.RGBPattern = uint8(d.uint(e, 0xFF))
+		case "reserved1":
+			p.Reserved1 = uint8(d.uint(e, 0xFF))
+		case "reserved2":
+			p.Reserved2 = uint8(d.uint(e, 0xFF))
+		case "binding_count":
+			bindingCount = int(d.uint(e, 0xFF))
+		default:
+			d.errs.add(e.line, "unknown key %q", e.key)
+		}
+	}
+	if name, ok := doc.root.get("name"); ok {
+		if _, dup := doc.root.get("name_bytes"); dup {
+			d.errs.add(name.line, "name and name_bytes are both set")
+		}
+	}
+
+	if len(doc.bindings) > config.MaxBindings {
+		d.errs.add(doc.bindings[config.MaxBindings].line,
+			"too many bindings (%d), the limit is %d", len(doc.bindings), config.MaxBindings)
+	}
+
+	active := 0
+	firstUnused := 0
+	for i, t := range doc.bindings {
+		if i >= config.MaxBindings {
+			break
+		}
+		unused := d.binding(t, &p.Bindings[i])
+		switch {
+		case !unused && firstUnused != 0:
+			d.errs.add(t.line, "active binding after the unused binding on line %d", firstUnused)
+		case unused && firstUnused == 0:
+			firstUnused = t.line
+		case !unused:
+			active++
+		}
+	}
+
+	p.BindingCount = uint8(active)
+	if bindingCount >= 0 {
+		p.BindingCount = uint8(bindingCount)
+	}
+	return p
+}
+
+// binding decodes one [[binding]] table and reports whether it is marked
+// unused.
+func (d *decoder) binding(t *table, kb *config.KeyBinding) (unused bool) {
+	for _, key := range []string{"input", "id", "output"} {
+		if _, ok := t.get(key); !ok {
+			d.errs.add(t.line, "binding is missing %s", key)
+		}
+	}
+
+	var value *entry
+	for _, e := range t.entries {
+		switch e.key {
+		case "input":
+			kb.InputType = config.BindingType(d.named(e, bindingTypes, 0xFF))
+		case "id":
+			kb.InputID = uint8(d.uint(e, 0xFF))
+		case "output":
+			kb.OutputType = config.OutputType(d.named(e, outputTypes, 0xFF))
+		case "value":
+			value = &e
+		case "modifiers":
+			kb.Modifiers = uint8(d.bits(e, hidusage.Modifiers, 0xFF))
+		case "flags":
+			kb.Flags = uint8(d.bits(e, bindingFlags, 0xFF))
+		case "reserved":
+			kb.Reserved = uint8(d.uint(e, 0xFF))
+		case "unused":
+			if e.val.kind != kindBool {
+				d.errs.add(e.line, "unused must be true or false")
+			}
+			unused = e.val.b
+		default:
+			d.errs.add(e.line, "unknown binding key %q", e.key)
+		}
+	}
+
+	// The value's names depend on the output type, so decode it last
+	if value != nil {
+		kb.OutputValue = d.outputValue(*value, kb.OutputType)
+	}
+	return unused
+}
+
+func (d *decoder) outputValue(e entry, t config.OutputType) uint16 {
+	switch t {
+	case config.OutputTypeKeyboard:
+		return d.named(e, hidusage.Keyboard, 0xFFFF)
+	case config.OutputTypeConsumer:
+		return d.named(e, hidusage.Consumer, 0xFFFF)
+	case config.OutputTypeGamepadButton:
+		return uint16(d.bits(e, hidusage.GamepadButtons, 0xFFFF))
+	case config.OutputTypeMouseButton:
+		return uint16(d.bits(e, hidusage.MouseButtons, 0xFFFF))
+	default:
+		return uint16(d.uint(e, 0xFFFF))
+	}
+}
+
+// uint decodes an integer in [0, max].
+func (d *decoder) uint(e entry, max int64) int64 {
+	if e.val.kind != kindInt {
+		d.errs.add(e.line, "%s must be an integer, not %s", e.key, e.val.kind)
+		return 0
+	}
+	return d.inRange(e, e.val.num, max)
+}
+
+func (d *decoder) inRange(e entry, n, max int64) int64 {
+	if n < 0 || n > max {
+		d.errs.add(e.line, "%s %d is out of range (0-%d)", e.key, n, max)
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) str(e entry) (string, bool) {
+	if e.val.kind != kindString {
+		d.errs.add(e.line, "%s must be a string, not %s", e.key, e.val.kind)
+		return "", false
+	}
+	return e.val.str, true
+}
+
+// named decodes a symbolic name or a number.
+func (d *decoder) named(e entry, n *hidusage.Table, max int64) uint16 {
+	if e.val.kind == kindString {
+		v, ok := n.Code(e.val.str)
+		if !ok {
+			d.errs.add(e.line, "unknown %s %q", n.Kind(), e.val.str)
+		}
+		return v
+	}
+	if e.val.kind != kindInt {
+		d.errs.add(e.line, "%s must be a %s name or a number", e.key, n.Kind())
+		return 0
+	}
+	return uint16(d.inRange(e, e.val.num, max))
+}
+
+// bits decodes a flag name, a number, or an array of either.
+func (d *decoder) bits(e entry, b *hidusage.BitTable, max int64) uint32 {
+	items := []value{e.val}
+	if e.val.kind == kindArray {
+		items = e.val.items
+	}
+
+	var v uint32
+	for _, item := range items {
+		switch item.kind {
+		case kindString:
+			mask, ok := b.Mask(item.str)
+			if !ok {
+				d.errs.add(e.line, "unknown %s %q", b.Kind(), item.str)
+			}
+			v |= mask
+		case kindInt:
+			v |= uint32(d.inRange(e, item.num, max))
+		default:
+			d.errs.add(e.line, "%s must be %s names or numbers", e.key, b.Kind())
+		}
+	}
+	if int64(v) > max {
+		d.errs.add(e.line, "%s 0x%X is out of range (0-0x%X)", e.key, v, max)
+	}
+	return v
+}
+
+// color decodes "#RRGGBB" or a number.
+func (d *decoder) color(e entry) uint32 {
+	if e.val.kind == kindInt {
+		return uint32(d.inRange(e, e.val.num, 0xFFFFFFFF))
+	}
+	s, ok := d.str(e)
+	if !ok {
+		return 0
+	}
+
+	var rgb uint32
+	if len(s) != 7 || s[0] != '#' {
+		d.errs.add(e.line, "rgb_color %q must look like \"#RRGGBB\"", s)
+		return 0
+	}
+	for _, c := range s[1:] {
+		var nibble uint32
+		switch {
+		case c >= '0' && c <= '9':
+			nibble = uint32(c - '0')
+		case c >= 'a' && c <= 'f':
+			nibble = uint32(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			nibble = uint32(c-'A') + 10
+		default:
+			d.errs.add(e.line, "rgb_color %q must look like \"#RRGGBB\"", s)
+			return 0
+		}
+		rgb = rgb<<4 | nibble
+	}
+	return rgb
+}
+
+func (d *decoder) nameBytes(e entry, name *[16]byte) {
+	if e.val.kind != kindArray {
+		d.errs.add(e.line, "name_bytes must be an array of integers")
+		return
+	}
+	if len(e.val.items) > len(name) {
+		d.errs.add(e.line, "name_bytes has %d bytes, the limit is %d", len(e.val.items), len(name))
+		return
+	}
+	for i, item := range e.val.items {
+		if item.kind != kindInt {
+			d.errs.add(e.line, "name_bytes must be an array of integers")
+			return
+		}
+		name[i] = uint8(d.inRange(e, item.num, 0xFF))
+	}
+}
+
+// sort orders errors by line; parse and decode errors are found in
+// separate passes.
+func (d *decoder) sort() {
+	sort.SliceStable(d.errs, func(i, j int) bool {
+		return d.errs[i].Line < d.errs[j].Line
+	})
+}
@@ -0,0 +1,264 @@
+package configtext
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+func TestUnmarshalExample(t *testing.T) {
+	text := `# Tuffpad profile
+version = 1
+name = "Driving"
+flags = ["kb_mode"]
+rgb_color = "#FF00FF"
+rgb_pattern = 2
+
+[[binding]]
+input = "key"
+id = 0
+output = "keyboard"
+value = "w"
+modifiers = ["left_shift"]
+
+[[binding]]
+input = "joystick_button"
+id = 3
+output = "gamepad_button"
+value = ["button1", "button3"]   # A + X
+flags = ["hold"]
+
+[[binding]]
+input = "dpad"
+id = 1
+output = "consumer"
+value = "volume_up"
+`
+	var p config.Profile
+	if err := Unmarshal([]byte(text), &p); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if p.GetName() != "Driving" || p.Flags != config.ProfileFlagKBMode ||
+		p.RGBColor != 0xFF00FF || p.RGBPattern != 2 || p.BindingCount != 3 {
+		t.Errorf("Unexpected header: %+v", p)
+	}
+
+	want := []config.KeyBinding{
+		{InputType: config.BindingTypeKey, InputID: 0, OutputType: config.OutputTypeKeyboard, OutputValue: 0x1A, Modifiers: 0x02},
+		{InputType: config.BindingTypeJoystickButton, InputID: 3, OutputType: config.OutputTypeGamepadButton, OutputValue: 0x05, Flags: config.BindingFlagHold},
+		{InputType: config.BindingTypeDPad, InputID: 1, OutputType: config.OutputTypeConsumer, OutputValue: 0xE9},
+	}
+	for i, w := range want {
+		if p.Bindings[i] != w {
+			t.Errorf("Binding %d = %+v, want %+v", i, p.Bindings[i], w)
+		}
+	}
+}
+
+func TestMarshalNames(t *testing.T) {
+	p := config.Profile{Version: 1, RGBColor: 0x00FF00, BindingCount: 2}
+	p.SetName("Say \"hi\"")
+	p.Bindings[0] = config.KeyBinding{InputType: config.BindingTypeKey, InputID: 4,
+		OutputType: config.OutputTypeKeyboard, OutputValue: 0x28, Modifiers: 0x11}
+	p.Bindings[1] = config.KeyBinding{InputType: config.BindingTypeKey, InputID: 5,
+		OutputType: config.OutputTypeMouseButton, OutputValue: 0x02, Flags: 0x81}
+
+	text := string(Marshal(&p))
+	for _, want := range []string{
+		`name = "Say \"hi\""`,
+		`rgb_color = "#00FF00"`,
+		`value = "enter"`,
+		`modifiers = ["left_ctrl", "right_ctrl"]`,
+		`value = "right"`,
+		`flags = ["tap", 0x80]`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Output missing %s:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "unused") || strings.Contains(text, "binding_count") {
+		t.Errorf("Unexpected unused/binding_count in:\n%s", text)
+	}
+}
+
+// roundTrip checks that a profile survives Marshal and Unmarshal byte for byte.
+func roundTrip(t *testing.T, p *config.Profile) {
+	t.Helper()
+	want, _ := p.MarshalBinary()
+
+	text := Marshal(p)
+	var got config.Profile
+	if err := Unmarshal(text, &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v\n%s", err, text)
+	}
+	data, _ := got.MarshalBinary()
+	if !bytes.Equal(data, want) {
+		t.Fatalf("Round trip changed the profile:\n%s", text)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	p := &config.Profile{Version: config.CurrentVersion, RGBColor: 0xFFFFFF, RGBPattern: 7, BindingCount: 2}
+	p.SetName("Ünïcode ☃")
+	p.Bindings[0] = config.KeyBinding{InputType: config.BindingTypeRGBPattern, InputID: 31,
+		OutputType: config.OutputTypeNone}
+	p.Bindings[1] = config.KeyBinding{InputType: config.BindingTypeKey, InputID: 1,
+		OutputType: config.OutputTypeKeyboard, OutputValue: 0x99} // No name
+	roundTrip(t, p)
+
+	// Empty profile
+	roundTrip(t, &config.Profile{})
+
+	// Stale binding after BindingCount, reserved bytes and odd values
+	p = &config.Profile{Version: 9, Flags: 0xF0000001, RGBColor: 0xAA123456,
+		Reserved1: 1, Reserved2: 2, BindingCount: 1}
+	copy(p.Name[:], "abc\x00def")
+	p.Bindings[0] = config.KeyBinding{InputType: 9, OutputType: 7, OutputValue: 0xBEEF, Reserved: 3}
+	p.Bindings[5] = config.KeyBinding{InputType: config.BindingTypeKey, OutputType: config.OutputTypeKeyboard, OutputValue: 4}
+	roundTrip(t, p)
+
+	// BindingCount past the array and a 16-byte name
+	p = &config.Profile{BindingCount: 200}
+	copy(p.Name[:], "sixteen-chars-ok")
+	roundTrip(t, p)
+}
+
+func TestRoundTripRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 286)
+	for i := 0; i < 500; i++ {
+		rng.Read(data)
+		// Small type values, so the named forms get exercised too
+		for j := 0; j < config.MaxBindings; j++ {
+			data[30+j*8] %= 5
+			data[30+j*8+2] %= 6
+		}
+		var p config.Profile
+		p.UnmarshalBinary(data)
+		roundTrip(t, &p)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	text := `name = "Bad"
+rgb_color = "red"
+colour = 1
+
+[[binding]]
+input = "key"
+id = 300
+output = "keyboard"
+value = "not_a_key"
+
+[[binding]]
+input = "key"
+output = "gamepad_button"
+value = ["button1", "button99"]
+modifiers = ["left_shift"
+
+[profile]
+`
+	var p config.Profile
+	p.SetName("Untouched")
+	err := Unmarshal([]byte(text), &p)
+
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("Expected ErrorList, got %v", err)
+	}
+
+	want := map[int]string{
+		2:  `rgb_color "red"`,
+		3:  `unknown key "colour"`,
+		7:  "out of range",
+		9:  `unknown keycode "not_a_key"`,
+		11: "missing id",
+		14: `unknown gamepad button "button99"`,
+		15: "unterminated array",
+		17: "unknown table [profile]",
+	}
+	if len(list) != len(want) {
+		t.Errorf("Got %d errors, want %d:\n%v", len(list), len(want), err)
+	}
+	for _, e := range list {
+		if msg, ok := want[e.Line]; !ok || !strings.Contains(e.Msg, msg) {
+			t.Errorf("Unexpected error %q, want line %d to mention %q", e.Error(), e.Line, msg)
+		}
+	}
+
+	if p.GetName() != "Untouched" {
+		t.Error("Profile modified despite errors")
+	}
+}
+
+func TestUnmarshalBindingOrder(t *testing.T) {
+	text := `[[binding]]
+input = "key"
+id = 0
+output = "none"
+unused = true
+
+[[binding]]
+input = "key"
+id = 1
+output = "none"
+`
+	var p config.Profile
+	err := Unmarshal([]byte(text), &p)
+	var list ErrorList
+	if !errors.As(err, &list) || len(list) != 1 || list[0].Line != 7 {
+		t.Errorf("Expected one error on line 7, got %v", err)
+	}
+}
+
+func TestTooManyBindings(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i <= config.MaxBindings; i++ {
+		sb.WriteString("[[binding]]\ninput = \"key\"\nid = 0\noutput = \"none\"\n")
+	}
+
+	var p config.Profile
+	err := Unmarshal([]byte(sb.String()), &p)
+	var list ErrorList
+	if !errors.As(err, &list) || len(list) != 1 || list[0].Line != config.MaxBindings*4+1 {
+		t.Errorf("Expected one error on the 33rd binding, got %v", err)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	tests := []struct {
+		in   string
+		want value
+		ok   bool
+	}{
+		{` 0x1F`, value{kind: kindInt, num: 31}, true},
+		{`1_000`, value{kind: kindInt, num: 1000}, true},
+		{`-5 # comment`, value{kind: kindInt, num: -5}, true},
+		{`true`, value{kind: kindBool, b: true}, true},
+		{`"a\"b\u00e9"`, value{kind: kindString, str: "a\"bé"}, true},
+		{`007`, value{}, false},
+		{`"open`, value{}, false},
+		{`1 2`, value{}, false},
+		{`yes`, value{}, false},
+		{`[[1]]`, value{}, false},
+	}
+	for _, tt := range tests {
+		p := &valueParser{s: tt.in}
+		got, err := p.parseValue()
+		if err == nil {
+			err = p.end()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("parse(%q) error = %v, want ok=%v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got.kind != tt.want.kind || got.num != tt.want.num || got.str != tt.want.str || got.b != tt.want.b) {
+			t.Errorf("parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package configtext
+
+import (
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/hidusage"
+)
+
+// Names of the config enums and flags. HID usage names come from
+// pkg/hidusage so the text format matches the firmware console.
+
+var bindingTypes = hidusage.NewTable("input type",
+	hidusage.Usage{Code: uint16(config.BindingTypeKey), Name: "key"},
+	hidusage.Usage{Code: uint16(config.BindingTypeJoystickButton), Name: "joystick_button"},
+	hidusage.Usage{Code: uint16(config.BindingTypeDPad), Name: "dpad"},
+	hidusage.Usage{Code: uint16(config.BindingTypeRGBPattern), Name: "rgb_pattern"},
+)
+
+var outputTypes = hidusage.NewTable("output type",
+	hidusage.Usage{Code: uint16(config.OutputTypeNone), Name: "none"},
+	hidusage.Usage{Code: uint16(config.OutputTypeKeyboard), Name: "keyboard"},
+	hidusage.Usage{Code: uint16(config.OutputTypeGamepadButton), Name: "gamepad_button"},
+	hidusage.Usage{Code: uint16(config.OutputTypeMouseButton), Name: "mouse_button"},
+	hidusage.Usage{Code: uint16(config.OutputTypeConsumer), Name: "consumer"},
+)
+
+var profileFlags = hidusage.NewBitTable("profile flag",
+	hidusage.Bit{Mask: config.ProfileFlagKBMode, Name: "kb_mode"},
+)
+
+var bindingFlags = hidusage.NewBitTable("binding flag",
+	hidusage.Bit{Mask: uint32(config.BindingFlagTap), Name: "tap"},
+	hidusage.Bit{Mask: uint32(config.BindingFlagHold), Name: "hold"},
+	hidusage.Bit{Mask: uint32(config.BindingFlagDoubleTap), Name: "double_tap"},
+)
@@ -0,0 +1,303 @@
+package configtext
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The text format is a subset of TOML: comments, "key = value" pairs,
+// and [[binding]] array tables. Values are strings, integers, booleans or
+// single-line arrays of those.
+
+type valueKind uint8
+
+const (
+	kindString valueKind = iota
+	kindInt
+	kindBool
+	kindArray
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindInt:
+		return "integer"
+	case kindBool:
+		return "boolean"
+	default:
+		return "array"
+	}
+}
+
+// value is one parsed TOML value.
+type value struct {
+	kind  valueKind
+	str   string
+	num   int64
+	b     bool
+	items []value
+}
+
+// entry is a key/value pair and the line it was defined on.
+type entry struct {
+	key  string
+	val  value
+	line int
+}
+
+// table is the top level or one [[binding]] table.
+type table struct {
+	line    int
+	entries []entry
+}
+
+func (t *table) get(key string) (entry, bool) {
+	for _, e := range t.entries {
+		if e.key == key {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+// document is a parsed profile file.
+type document struct {
+	root     table
+	bindings []*table
+}
+
+// parse splits data into tables. Syntax errors are collected so the
+// caller sees every bad line at once.
+func parse(data []byte) (*document, ErrorList) {
+	doc := &document{root: table{line: 1}}
+	current := &doc.root
+	seen := map[*table]map[string]int{}
+	var errs ErrorList
+
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := i + 1
+		text := strings.TrimSpace(strings.TrimSuffix(raw, "\r"))
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		if text[0] == '[' {
+			header := stripComment(text)
+			switch {
+			case header == "[[binding]]":
+				current = &table{line: line}
+				doc.bindings = append(doc.bindings, current)
+			case strings.HasPrefix(header, "[["):
+				errs.add(line, "unknown array table %s", header)
+				current = &table{line: line} // Parse and discard its keys
+			default:
+				errs.add(line, "unknown table %s", header)
+				current = &table{line: line}
+			}
+			continue
+		}
+
+		key, rest, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !isBareKey(key) {
+			errs.add(line, "expected key = value")
+			continue
+		}
+
+		p := &valueParser{s: rest}
+		val, err := p.parseValue()
+		if err == nil {
+			err = p.end()
+		}
+		if err != nil {
+			errs.add(line, "%s: %v", key, err)
+			continue
+		}
+
+		if seen[current] == nil {
+			seen[current] = map[string]int{}
+		}
+		if first, dup := seen[current][key]; dup {
+			errs.add(line, "%s already set on line %d", key, first)
+			continue
+		}
+		seen[current][key] = line
+		current.entries = append(current.entries, entry{key: key, val: val, line: line})
+	}
+	return doc, errs
+}
+
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// stripComment removes a trailing comment from a table header line.
+func stripComment(s string) string {
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// valueParser reads one value from the text after '='.
+type valueParser struct {
+	s   string
+	pos int
+}
+
+func (p *valueParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// end checks that only whitespace or a comment follows the value.
+func (p *valueParser) end() error {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] != '#' {
+		return fmt.Errorf("unexpected %q after value", p.s[p.pos:])
+	}
+	return nil
+}
+
+func (p *valueParser) parseValue() (value, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return value{}, fmt.Errorf("missing value")
+	}
+
+	switch c := p.s[p.pos]; {
+	case c == '"':
+		s, err := p.parseString()
+		return value{kind: kindString, str: s}, err
+	case c == '[':
+		return p.parseArray()
+	case c == 't' || c == 'f':
+		return p.parseBool()
+	case c == '+' || c == '-' || c >= '0' && c <= '9':
+		return p.parseInt()
+	default:
+		return value{}, fmt.Errorf("unexpected %q", p.s[p.pos:])
+	}
+}
+
+func (p *valueParser) parseString() (string, error) {
+	p.pos++ // Opening quote
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return sb.String(), nil
+		case c == '\\':
+			if p.pos+1 >= len(p.s) {
+				return "", fmt.Errorf("unterminated string")
+			}
+			esc := p.s[p.pos+1]
+			p.pos += 2
+			switch esc {
+			case '"', '\\':
+				sb.WriteByte(esc)
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'u', 'U':
+				n := 4
+				if esc == 'U' {
+					n = 8
+				}
+				if p.pos+n > len(p.s) {
+					return "", fmt.Errorf("short \\%c escape", esc)
+				}
+				r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", fmt.Errorf("invalid \\%c escape", esc)
+				}
+				sb.WriteRune(rune(r))
+				p.pos += n
+			default:
+				return "", fmt.Errorf("invalid escape \\%c", esc)
+			}
+		case c < 0x20 && c != '\t':
+			return "", fmt.Errorf("control character in string")
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *valueParser) parseArray() (value, error) {
+	p.pos++ // '['
+	arr := value{kind: kindArray}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return value{}, fmt.Errorf("unterminated array (arrays must fit on one line)")
+		}
+		if p.s[p.pos] == ']' {
+			p.pos++
+			return arr, nil
+		}
+
+		item, err := p.parseValue()
+		if err != nil {
+			return value{}, err
+		}
+		if item.kind == kindArray {
+			return value{}, fmt.Errorf("nested arrays are not supported")
+		}
+		arr.items = append(arr.items, item)
+
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.s) && p.s[p.pos] != ']' {
+			return value{}, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *valueParser) parseBool() (value, error) {
+	for _, word := range []string{"true", "false"} {
+		if strings.HasPrefix(p.s[p.pos:], word) {
+			p.pos += len(word)
+			return value{kind: kindBool, b: word == "true"}, nil
+		}
+	}
+	return value{}, fmt.Errorf("unexpected %q", p.s[p.pos:])
+}
+
+func (p *valueParser) parseInt() (value, error) {
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte("+-_0123456789abcdefABCDEFxob", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	lit := p.s[start:p.pos]
+	digits := strings.TrimLeft(lit, "+-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return value{}, fmt.Errorf("leading zero in %q", lit)
+	}
+	n, err := strconv.ParseInt(lit, 0, 64)
+	if err != nil {
+		return value{}, fmt.Errorf("invalid integer %q", lit)
+	}
+	return value{kind: kindInt, num: n}, nil
+}
@@ -0,0 +1,301 @@
+// Package console implements a plain-text debug console for bench testing
+// with a serial terminal.
+//
+// Every command is answered by sending the equivalent binary request to
+// protocol.Handler and formatting its response, so the console can never
+// disagree with what the PC app sees (including the write lock).
+package console
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/hidusage"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+)
+
+// DiscoveryQuery is the legacy CircuitPython discovery line.
+// The answer is the query followed by "yes".
+const DiscoveryQuery = "areyouatuffpad?"
+
+// newline ends every output line; terminals expect CR LF.
+const newline = "\r\n"
+
+// Console answers text commands.
+type Console struct {
+	handler *protocol.Handler
+}
+
+// New creates a console backed by the protocol handler.
+func New(handler *protocol.Handler) *Console {
+	return &Console{handler: handler}
+}
+
+// consoleCommand is one entry in the console's command table.
+type consoleCommand struct {
+	name  string
+	usage string
+	run   func(c *Console, args []string, out *strings.Builder)
+}
+
+var commands []consoleCommand
+
+func init() {
+	commands = []consoleCommand{
+		{"help", "help             list commands", (*Console).help},
+		{"version", "version          firmware version and identity", (*Console).version},
+		{"profiles", "profiles         list stored profiles", (*Console).profiles},
+		{"show", "show <slot>      show a profile's settings and bindings", (*Console).show},
+		{"stats", "stats            storage usage", (*Console).stats},
+		{"diag", "diag             uptime, memory and error counters", (*Console).diag},
+		{DiscoveryQuery, DiscoveryQuery + "  legacy discovery", (*Console).discover},
+	}
+}
+
+// Execute runs one command line and returns the text to send back.
+// The output always ends with a newline.
+func (c *Console) Execute(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	for i := range commands {
+		if commands[i].name == fields[0] {
+			commands[i].run(c, fields[1:], &out)
+			return out.String()
+		}
+	}
+
+	out.WriteString("unknown command: " + fields[0] + " (try help)" + newline)
+	return out.String()
+}
+
+// request sends a binary command through the handler. On failure it writes
+// the error to out and returns nil.
+func (c *Console) request(cmd uint8, payload []byte, out *strings.Builder) []byte {
+	resp := c.handler.Handle(&protocol.Frame{Cmd: cmd, Payload: payload})
+	if resp.Status == protocol.StatusOK {
+		if resp.Payload == nil {
+			return []byte{}
+		}
+		return resp.Payload
+	}
+
+	fmt.Fprintf(out, "error: status 0x%02X", resp.Status)
+	var detail protocol.ErrorDetail
+	if err := detail.UnmarshalBinary(resp.Payload); err == nil && detail.Message != "" {
+		out.WriteString(": " + detail.Message)
+	}
+	out.WriteString(newline)
+	return nil
+}
+
+func (c *Console) help(_ []string, out *strings.Builder) {
+	for i := range commands {
+		out.WriteString(commands[i].usage + newline)
+	}
+}
+
+func (c *Console) discover(_ []string, out *strings.Builder) {
+	// Check the handler really answers discovery before claiming to be a pad
+	if payload := c.request(protocol.CmdDiscover, nil, out); payload != nil {
+		out.WriteString(DiscoveryQuery + "yes" + newline)
+	}
+}
+
+func (c *Console) version(_ []string, out *strings.Builder) {
+	payload := c.request(protocol.CmdGetVersion, []byte{protocol.IdentityFormatTLV}, out)
+	if payload == nil {
+		return
+	}
+	if len(payload) < 4 {
+		out.WriteString("error: short response" + newline)
+		return
+	}
+
+	info := make(map[uint8][]byte)
+	if entries, err := protocol.ParseTLV(payload[4:]); err == nil {
+		for _, e := range entries {
+			info[e.Type] = e.Value
+		}
+	}
+
+	fmt.Fprintf(out, "firmware: %s (commit %s, built %s)"+newline,
+		info[protocol.InfoVersionString], info[protocol.InfoCommit], info[protocol.InfoBuildDate])
+	fmt.Fprintf(out, "board:    %s"+newline, info[protocol.InfoBoard])
+	fmt.Fprintf(out, "config:   v%d"+newline, binary.LittleEndian.Uint16(payload[2:]))
+	if serial := info[protocol.InfoSerialNumber]; len(serial) > 0 {
+		fmt.Fprintf(out, "serial:   %X"+newline, serial)
+	}
+	if mode := info[protocol.InfoBootMode]; len(mode) == 1 && mode[0] != 0 {
+		fmt.Fprintf(out, "boot:     mode %d"+newline, mode[0])
+	}
+}
+
+func (c *Console) profiles(_ []string, out *strings.Builder) {
+	offset := 0
+	shown := 0
+	for {
+		payload := c.request(protocol.CmdListProfilesEx, []byte{uint8(offset)}, out)
+		if payload == nil {
+			return
+		}
+		if len(payload) < 4 {
+			out.WriteString("error: short response" + newline)
+			return
+		}
+
+		total := int(binary.LittleEndian.Uint16(payload[0:]))
+		count := int(payload[3])
+		for i := 0; i < count; i++ {
+			start := 4 + i*protocol.ProfileEntrySize
+			if start+protocol.ProfileEntrySize > len(payload) {
+				break
+			}
+			writeEntry(payload[start:start+protocol.ProfileEntrySize], out)
+			shown++
+		}
+
+		offset += count
+		if count == 0 || offset >= total || offset > 255 {
+			break
+		}
+	}
+
+	if shown == 0 {
+		out.WriteString("no profiles" + newline)
+	}
+}
+
+// writeEntry formats one CmdListProfilesEx entry.
+func writeEntry(entry []byte, out *strings.Builder) {
+	marker := " "
+	if entry[1]&protocol.EntryFlagActive != 0 {
+		marker = "*"
+	}
+	if entry[1]&protocol.EntryFlagUnreadable != 0 {
+		fmt.Fprintf(out, "%s%3d  (unreadable)"+newline, marker, entry[0])
+		return
+	}
+
+	name := entry[16:32]
+	if i := strings.IndexByte(string(name), 0); i >= 0 {
+		name = name[:i]
+	}
+	fmt.Fprintf(out, "%s%3d  %-16s %2d bindings"+newline, marker, entry[0], name, entry[2])
+}
+
+func (c *Console) show(args []string, out *strings.Builder) {
+	if len(args) != 1 {
+		out.WriteString("usage: show <slot>" + newline)
+		return
+	}
+	slot, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil {
+		out.WriteString("error: slot must be 0-255" + newline)
+		return
+	}
+
+	payload := c.request(protocol.CmdGetProfile, []byte{uint8(slot)}, out)
+	if payload == nil {
+		return
+	}
+	var p config.Profile
+	if err := p.UnmarshalBinary(payload); err != nil {
+		out.WriteString("error: " + err.Error() + newline)
+		return
+	}
+
+	fmt.Fprintf(out, "slot %d: %s"+newline, slot, p.GetName())
+	fmt.Fprintf(out, "  flags 0x%08X  rgb #%06X  pattern %d"+newline, p.Flags, p.RGBColor, p.RGBPattern)
+
+	count := int(p.BindingCount)
+	if count > config.MaxBindings {
+		count = config.MaxBindings
+	}
+	for i := 0; i < count; i++ {
+		b := &p.Bindings[i]
+		fmt.Fprintf(out, "  %2d: in %d/%-2d -> %s flags 0x%02X"+newline,
+			i, b.InputType, b.InputID, hidusage.FormatOutput(b.OutputType, b.OutputValue, b.Modifiers), b.Flags)
+	}
+}
+
+func (c *Console) stats(_ []string, out *strings.Builder) {
+	payload := c.request(protocol.CmdGetStorageStats, nil, out)
+	if payload == nil {
+		return
+	}
+	if len(payload) < 13 {
+		out.WriteString("error: short response" + newline)
+		return
+	}
+
+	fmt.Fprintf(out, "total %d  used %d  free %d  profiles %d"+newline,
+		binary.LittleEndian.Uint32(payload[0:]),
+		binary.LittleEndian.Uint32(payload[4:]),
+		binary.LittleEndian.Uint32(payload[8:]),
+		payload[12])
+	if len(payload) >= 21 {
+		fmt.Fprintf(out, "blocks %d of %d bytes"+newline,
+			binary.LittleEndian.Uint32(payload[17:]),
+			binary.LittleEndian.Uint32(payload[13:]))
+	}
+}
+
+func (c *Console) diag(_ []string, out *strings.Builder) {
+	payload := c.request(protocol.CmdGetDiagnostics, nil, out)
+	if payload == nil {
+		return
+	}
+	entries, err := protocol.ParseTLV(payload)
+	if err != nil {
+		out.WriteString("error: " + err.Error() + newline)
+		return
+	}
+
+	for _, e := range entries {
+		if e.Type == protocol.DiagDamaged {
+			// Only shown when something is damaged
+			if len(e.Value) > 1 || len(e.Value) == 1 && e.Value[0] != 0 {
+				out.WriteString("damaged    ")
+				if e.Value[0] != 0 {
+					out.WriteString(" device")
+				}
+				for _, slot := range e.Value[1:] {
+					fmt.Fprintf(out, " %d", slot)
+				}
+				out.WriteString(newline)
+			}
+			continue
+		}
+
+		var v uint32
+		switch len(e.Value) {
+		case 2:
+			v = uint32(binary.LittleEndian.Uint16(e.Value))
+		case 4:
+			v = binary.LittleEndian.Uint32(e.Value)
+		default:
+			continue
+		}
+
+		switch {
+		case e.Type == protocol.DiagUptime:
+			fmt.Fprintf(out, "uptime      %d.%03ds"+newline, v/1000, v%1000)
+		case e.Type == protocol.DiagHeapAlloc:
+			fmt.Fprintf(out, "heap alloc  %d"+newline, v)
+		case e.Type == protocol.DiagHeapSys:
+			fmt.Fprintf(out, "heap sys    %d"+newline, v)
+		case e.Type == protocol.DiagGoroutines:
+			fmt.Fprintf(out, "goroutines  %d"+newline, v)
+		case e.Type >= protocol.DiagCounterBase:
+			fmt.Fprintf(out, "%-20s %d"+newline, metrics.Counter(e.Type-protocol.DiagCounterBase), v)
+		}
+	}
+}
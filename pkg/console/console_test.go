@@ -0,0 +1,142 @@
+package console
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+func newTestConsole(t *testing.T) (*Console, *storage.Manager) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := storage.New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	return New(protocol.NewHandler(mgr)), mgr
+}
+
+func TestLineReader(t *testing.T) {
+	var r LineReader
+
+	// Lines may arrive split across chunks, with CR LF endings
+	if n := r.Write([]byte("hel")); n != 3 {
+		t.Errorf("Expected 3 bytes consumed, got %d", n)
+	}
+	r.Write([]byte("p\r\nstats\n"))
+
+	for _, want := range []string{"help", "stats"} {
+		line, ok := r.Next()
+		if !ok || line != want {
+			t.Errorf("Expected %q, got %q (ok=%v)", want, line, ok)
+		}
+	}
+	if _, ok := r.Next(); ok {
+		t.Error("Expected no more lines")
+	}
+
+	// Backspace edits the line
+	r.Write([]byte("shox\bw 1\r"))
+	if line, _ := r.Next(); line != "show 1" {
+		t.Errorf("Expected 'show 1', got %q", line)
+	}
+
+	// A sync byte stops text and drops the partial line
+	frame := []byte{'x', 'y', protocol.SyncByte, protocol.CmdPing, 0, 0}
+	if n := r.Write(frame); n != 2 {
+		t.Errorf("Expected text to stop at the sync byte, consumed %d", n)
+	}
+	if r.Pending() {
+		t.Error("Partial line should be dropped")
+	}
+	r.Write([]byte("\n"))
+	if _, ok := r.Next(); ok {
+		t.Error("Dropped partial line must not complete")
+	}
+
+	// Overlong lines are discarded
+	r.Write([]byte(strings.Repeat("a", MaxLineLength+1) + "\n"))
+	if _, ok := r.Next(); ok {
+		t.Error("Overlong line should be discarded")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	c, mgr := newTestConsole(t)
+	defer mgr.Close()
+
+	if out := c.Execute(DiscoveryQuery); out != "areyouatuffpad?yes\r\n" {
+		t.Errorf("Unexpected discovery reply %q", out)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c, mgr := newTestConsole(t)
+	defer mgr.Close()
+
+	if out := c.Execute("profiles"); !strings.Contains(out, "no profiles") {
+		t.Errorf("Expected empty profile list, got %q", out)
+	}
+
+	profile := config.Profile{
+		BindingCount: 1,
+		RGBColor:     0x00FF00,
+	}
+	profile.SetName("Gaming")
+	profile.Bindings[0] = config.KeyBinding{
+		InputType:   config.BindingTypeKey,
+		InputID:     3,
+		OutputType:  config.OutputTypeKeyboard,
+		OutputValue: 0x04,
+	}
+	mgr.SaveProfile(2, &profile)
+	mgr.SaveDevice(&config.DeviceConfig{ActiveProfile: 2})
+
+	out := c.Execute("profiles")
+	if !strings.Contains(out, "*  2  Gaming") {
+		t.Errorf("Expected active profile 2 'Gaming', got %q", out)
+	}
+
+	out = c.Execute("show 2")
+	if !strings.Contains(out, "slot 2: Gaming") || !strings.Contains(out, "rgb #00FF00") {
+		t.Errorf("Unexpected profile output %q", out)
+	}
+	if !strings.Contains(out, "-> keyboard a") {
+		t.Errorf("Expected binding in output, got %q", out)
+	}
+
+	if out := c.Execute("show 9"); !strings.HasPrefix(out, "error: status 0x04") {
+		t.Errorf("Expected not-found error, got %q", out)
+	}
+	if out := c.Execute("show x"); !strings.HasPrefix(out, "error:") {
+		t.Errorf("Expected slot error, got %q", out)
+	}
+
+	if out := c.Execute("stats"); !strings.Contains(out, "profiles 1") || !strings.Contains(out, "of 4096 bytes") {
+		t.Errorf("Unexpected stats %q", out)
+	}
+	if out := c.Execute("version"); !strings.Contains(out, "firmware:") {
+		t.Errorf("Unexpected version %q", out)
+	}
+	if out := c.Execute("diag"); !strings.Contains(out, "uptime") || !strings.Contains(out, "crc-errors") {
+		t.Errorf("Unexpected diagnostics %q", out)
+	}
+
+	help := c.Execute("help")
+	for _, cmd := range []string{"profiles", "show", "stats", "version", DiscoveryQuery} {
+		if !strings.Contains(help, cmd) {
+			t.Errorf("help does not mention %s", cmd)
+		}
+	}
+
+	if out := c.Execute("bogus"); !strings.HasPrefix(out, "unknown command") {
+		t.Errorf("Unexpected reply %q", out)
+	}
+	if out := c.Execute("   "); out != "" {
+		t.Errorf("Expected no reply to a blank line, got %q", out)
+	}
+}
@@ -0,0 +1,75 @@
+package console
+
+// MaxLineLength is the longest console line accepted. Longer lines are
+// discarded, since no console command needs that much.
+const MaxLineLength = 80
+
+// LineReader collects console text lines from a byte stream that also
+// carries binary frames.
+//
+// Text is printable ASCII terminated by CR or LF. Binary frames start with
+// protocol.SyncByte (0xAA), which is not printable, so the first byte of a
+// chunk is enough to tell the two apart. The caller must only offer bytes
+// while no binary frame is in progress.
+type LineReader struct {
+	buf      []byte
+	overflow bool
+	lines    []string
+}
+
+// Write consumes the leading text bytes of data and returns how many it
+// took. The remaining bytes are binary and belong to the frame scanner.
+// A partial line is dropped when binary data interrupts it.
+func (r *LineReader) Write(data []byte) int {
+	for i, b := range data {
+		switch {
+		case b == '\r' || b == '\n':
+			r.endLine()
+		case b >= 0x20 && b < 0x7F || b == '\t':
+			if len(r.buf) >= MaxLineLength {
+				r.overflow = true
+				continue
+			}
+			r.buf = append(r.buf, b)
+		case b == 0x08 || b == 0x7F:
+			// Backspace/delete from interactive terminals
+			if len(r.buf) > 0 {
+				r.buf = r.buf[:len(r.buf)-1]
+			}
+		default:
+			r.Reset()
+			return i
+		}
+	}
+	return len(data)
+}
+
+// Next returns the next complete line, if any.
+func (r *LineReader) Next() (string, bool) {
+	if len(r.lines) == 0 {
+		return "", false
+	}
+	line := r.lines[0]
+	r.lines = r.lines[1:]
+	return line, true
+}
+
+// Pending reports whether a partial line is buffered.
+func (r *LineReader) Pending() bool {
+	return len(r.buf) > 0
+}
+
+// Reset drops a partial line.
+func (r *LineReader) Reset() {
+	r.buf = r.buf[:0]
+	r.overflow = false
+}
+
+// endLine completes the buffered line. Empty lines (the LF of a CR LF pair)
+// are skipped.
+func (r *LineReader) endLine() {
+	if len(r.buf) > 0 && !r.overflow {
+		r.lines = append(r.lines, string(r.buf))
+	}
+	r.Reset()
+}
@@ -0,0 +1,236 @@
+// Package dfu receives a firmware image in chunks into a staging area,
+// verifies it, and hands it to an Installer.
+//
+// The running firmware is never written while an image is received: chunks
+// go to a separate block device, and the Installer only sees an image whose
+// length and CRC32 match what the host announced, read back from the
+// staging area. An interrupted or failed transfer leaves a partial image
+// behind that is never installed; the next Begin starts over.
+//
+// Everything here depends on the tinyfs.BlockDevice and Installer
+// interfaces, so the flow runs on Linux with a tinyfs.MemBlockDevice. The
+// RP2040 build adds FlashInstaller, which stages in a machine.Flash
+// partition and copies the image over the firmware from RAM, following a
+// Plan that Apply carries out on any block device.
+package dfu
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// State is the progress of an update.
+type State uint8
+
+const (
+	StateIdle      State = iota // No update in progress
+	StateReceiving              // Begin accepted, chunks arriving
+	StateVerified               // Image complete and CRC checked, ready to commit
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateReceiving:
+		return "receiving"
+	case StateVerified:
+		return "verified"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	ErrTooLarge    = errors.New("image larger than the staging area")
+	ErrEmpty       = errors.New("empty image")
+	ErrNotStarted  = errors.New("no update in progress")
+	ErrOffset      = errors.New("chunk out of order")
+	ErrOverflow    = errors.New("chunk beyond the announced size")
+	ErrIncomplete  = errors.New("image incomplete")
+	ErrChecksum    = errors.New("image CRC32 mismatch")
+	ErrNotVerified = errors.New("image not verified")
+)
+
+// Installer replaces the running firmware with a staged image.
+// Install is only called with a complete image that matched its CRC32; the
+// device is rebooted after it returns. image reads the staged bytes.
+type Installer interface {
+	Install(image io.ReaderAt, size int64) error
+}
+
+// Updater stages one firmware image at a time.
+type Updater struct {
+	stage tinyfs.BlockDevice
+	inst  Installer
+
+	state   State
+	size    uint32 // Announced image size
+	crc     uint32 // Announced CRC32 (IEEE)
+	written uint32 // Bytes received so far
+	erased  int64  // Staging bytes erased so far
+	page    []byte // Received bytes not yet programmed, less than a write block
+}
+
+// New returns an updater that stages images on stage and installs them
+// with inst.
+func New(stage tinyfs.BlockDevice, inst Installer) *Updater {
+	return &Updater{stage: stage, inst: inst}
+}
+
+// Capacity returns the largest image the staging area holds.
+func (u *Updater) Capacity() int64 {
+	return u.stage.Size()
+}
+
+// Status reports the state, the announced size and the bytes received.
+// After an error the host resumes with a Write at Written.
+func (u *Updater) Status() (state State, size, written uint32) {
+	return u.state, u.size, u.written
+}
+
+// Begin starts receiving an image of size bytes with the given CRC32,
+// dropping any update in progress. Staging blocks are erased as chunks
+// arrive, so Begin returns quickly.
+func (u *Updater) Begin(size, crc uint32) error {
+	u.Abort()
+	if size == 0 {
+		return ErrEmpty
+	}
+	if int64(size) > u.stage.Size() {
+		return ErrTooLarge
+	}
+	u.state = StateReceiving
+	u.size = size
+	u.crc = crc
+	return nil
+}
+
+// Abort drops the update in progress. The staged bytes are left as they
+// are; they are never installed.
+func (u *Updater) Abort() {
+	u.state = StateIdle
+	u.size, u.crc, u.written = 0, 0, 0
+	u.erased = 0
+	u.page = u.page[:0]
+}
+
+// Write stores the chunk at offset, which must be Written. Resending the
+// last chunk is accepted and ignored, so a host may retry a chunk whose
+// response was lost.
+func (u *Updater) Write(offset uint32, data []byte) error {
+	if u.state != StateReceiving {
+		return ErrNotStarted
+	}
+	end := uint64(offset) + uint64(len(data))
+	if offset != u.written {
+		if end == uint64(u.written) && len(data) > 0 {
+			return nil // Duplicate of the last chunk
+		}
+		return ErrOffset
+	}
+	if end > uint64(u.size) {
+		return ErrOverflow
+	}
+
+	// Program whole write blocks, keep the rest for the next chunk
+	wbs := int(u.stage.WriteBlockSize())
+	for len(data) > 0 {
+		n := min(wbs-len(u.page), len(data))
+		u.page = append(u.page, data[:n]...)
+		data = data[n:]
+		u.written += uint32(n)
+		if len(u.page) == wbs {
+			if err := u.program(); err != nil {
+				u.Abort()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// program writes the buffered write block, erasing the next erase block
+// first if needed.
+func (u *Updater) program() error {
+	wbs := u.stage.WriteBlockSize()
+	off := (int64(u.written) - int64(len(u.page))) / wbs * wbs
+	if off+wbs > u.erased {
+		ebs := u.stage.EraseBlockSize()
+		if err := u.stage.EraseBlocks(u.erased/ebs, 1); err != nil {
+			return err
+		}
+		u.erased += ebs
+	}
+	for len(u.page) < int(wbs) {
+		u.page = append(u.page, 0xFF) // Erased flash value
+	}
+	if _, err := u.stage.WriteAt(u.page, off); err != nil {
+		return err
+	}
+	u.page = u.page[:0]
+	return nil
+}
+
+// Verify checks that the whole image arrived and that the staged bytes,
+// read back from the block device, match the announced CRC32. A mismatch
+// drops the update.
+func (u *Updater) Verify() error {
+	switch {
+	case u.state == StateVerified:
+		return nil
+	case u.state != StateReceiving:
+		return ErrNotStarted
+	case u.written != u.size:
+		return ErrIncomplete
+	}
+	if len(u.page) > 0 {
+		if err := u.program(); err != nil {
+			u.Abort()
+			return err
+		}
+	}
+
+	crc, err := u.checksum()
+	if err != nil {
+		u.Abort()
+		return err
+	}
+	if crc != u.crc {
+		u.Abort()
+		return ErrChecksum
+	}
+	u.state = StateVerified
+	return nil
+}
+
+// checksum computes the CRC32 of the staged image.
+func (u *Updater) checksum() (uint32, error) {
+	h := crc32.NewIEEE()
+	buf := make([]byte, u.stage.WriteBlockSize())
+	for off := int64(0); off < int64(u.size); off += int64(len(buf)) {
+		n := min(int64(len(buf)), int64(u.size)-off)
+		if _, err := u.stage.ReadAt(buf[:n], off); err != nil {
+			return 0, err
+		}
+		h.Write(buf[:n])
+	}
+	return h.Sum32(), nil
+}
+
+// Commit installs the verified image. The caller reboots the device
+// afterwards.
+func (u *Updater) Commit() error {
+	if u.state != StateVerified {
+		return ErrNotVerified
+	}
+	image := io.NewSectionReader(u.stage, 0, int64(u.size))
+	if err := u.inst.Install(image, int64(u.size)); err != nil {
+		return err
+	}
+	u.Abort()
+	return nil
+}
@@ -0,0 +1,258 @@
+package dfu
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// fakeInstaller records the installed image.
+type fakeInstaller struct {
+	image []byte
+	err   error
+}
+
+func (f *fakeInstaller) Install(image io.ReaderAt, size int64) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.image = make([]byte, size)
+	_, err := image.ReadAt(f.image, 0)
+	return err
+}
+
+func newTestUpdater() (*Updater, *tinyfs.MemBlockDevice, *fakeInstaller) {
+	stage := tinyfs.NewMemoryDevice(256, 4096, 16)
+	inst := &fakeInstaller{}
+	return New(stage, inst), stage, inst
+}
+
+func testImage(n int) []byte {
+	img := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(img)
+	return img
+}
+
+// send writes img in chunks of the given size.
+func send(t *testing.T, u *Updater, img []byte, chunk int) {
+	t.Helper()
+	for off := 0; off < len(img); off += chunk {
+		end := min(off+chunk, len(img))
+		if err := u.Write(uint32(off), img[off:end]); err != nil {
+			t.Fatalf("Write at %d failed: %v", off, err)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	// Chunk sizes that do and do not line up with the 256-byte pages
+	for _, chunk := range []int{100, 256, 4092} {
+		u, _, inst := newTestUpdater()
+		img := testImage(10000)
+		if err := u.Begin(uint32(len(img)), crc32.ChecksumIEEE(img)); err != nil {
+			t.Fatalf("Begin failed: %v", err)
+		}
+		send(t, u, img, chunk)
+		if state, size, written := u.Status(); state != StateReceiving || size != 10000 || written != 10000 {
+			t.Errorf("Status = %v %d %d", state, size, written)
+		}
+		if err := u.Verify(); err != nil {
+			t.Fatalf("chunk %d: Verify failed: %v", chunk, err)
+		}
+		if err := u.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		if !bytes.Equal(inst.image, img) {
+			t.Errorf("chunk %d: installed image differs", chunk)
+		}
+		if state, _, _ := u.Status(); state != StateIdle {
+			t.Errorf("State after commit = %v", state)
+		}
+	}
+}
+
+func TestUpdateChecksumMismatch(t *testing.T) {
+	u, stage, inst := newTestUpdater()
+	img := testImage(5000)
+	u.Begin(uint32(len(img)), crc32.ChecksumIEEE(img))
+	send(t, u, img, 1000)
+
+	// Corrupt the staged copy: Verify reads back the flash, not the stream
+	stage.WriteAt([]byte{img[10] ^ 0xFF}, 10)
+	if err := u.Verify(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("Verify = %v, want ErrChecksum", err)
+	}
+	if err := u.Commit(); !errors.Is(err, ErrNotVerified) {
+		t.Errorf("Commit = %v, want ErrNotVerified", err)
+	}
+	if inst.image != nil {
+		t.Error("Corrupt image was installed")
+	}
+}
+
+func TestUpdateSequence(t *testing.T) {
+	u, _, inst := newTestUpdater()
+	img := testImage(3000)
+
+	if err := u.Write(0, img[:10]); !errors.Is(err, ErrNotStarted) {
+		t.Errorf("Write before Begin = %v", err)
+	}
+	if err := u.Begin(0, 0); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Begin(0) = %v", err)
+	}
+	if err := u.Begin(16*4096+1, 0); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Begin(too large) = %v", err)
+	}
+
+	u.Begin(uint32(len(img)), crc32.ChecksumIEEE(img))
+	u.Write(0, img[:1000])
+	if err := u.Write(0, img[:1000]); err != nil {
+		t.Errorf("Resent chunk rejected: %v", err)
+	}
+	if err := u.Write(2000, img[2000:]); !errors.Is(err, ErrOffset) {
+		t.Errorf("Skipped chunk = %v, want ErrOffset", err)
+	}
+	if err := u.Verify(); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("Verify of a partial image = %v", err)
+	}
+	if err := u.Commit(); !errors.Is(err, ErrNotVerified) {
+		t.Errorf("Commit of a partial image = %v", err)
+	}
+	if err := u.Write(1000, append(img[1000:], 0)); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Oversized chunk = %v, want ErrOverflow", err)
+	}
+	u.Write(1000, img[1000:])
+
+	// A failing installer keeps the image verified so Commit can be retried
+	u.Verify()
+	inst.err = errors.New("flash busy")
+	if err := u.Commit(); err == nil {
+		t.Fatal("Commit ignored the installer error")
+	}
+	inst.err = nil
+	if err := u.Commit(); err != nil || !bytes.Equal(inst.image, img) {
+		t.Errorf("Commit retry: %v", err)
+	}
+}
+
+func TestUpdateRestart(t *testing.T) {
+	// An interrupted transfer is dropped by the next Begin
+	u, _, inst := newTestUpdater()
+	old := testImage(9000)
+	u.Begin(uint32(len(old)), crc32.ChecksumIEEE(old))
+	send(t, u, old[:6000], 512)
+
+	img := testImage(4500)
+	if err := u.Begin(uint32(len(img)), crc32.ChecksumIEEE(img)); err != nil {
+		t.Fatal(err)
+	}
+	send(t, u, img, 777)
+	if err := u.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	u.Commit()
+	if !bytes.Equal(inst.image, img) {
+		t.Error("Installed image differs")
+	}
+}
+
+// cutFlash fails every erase and write after the first ops.
+type cutFlash struct {
+	*tinyfs.MemBlockDevice
+	ops int
+}
+
+var errCut = errors.New("power lost")
+
+func (f *cutFlash) EraseBlocks(start, n int64) error {
+	if f.ops--; f.ops < 0 {
+		return errCut
+	}
+	return f.MemBlockDevice.EraseBlocks(start, n)
+}
+
+func (f *cutFlash) WriteAt(p []byte, off int64) (int, error) {
+	if f.ops--; f.ops < 0 {
+		return 0, errCut
+	}
+	return f.MemBlockDevice.WriteAt(p, off)
+}
+
+// newInstallFlash returns flash holding firmware at 0 and the image staged
+// at stage, and the firmware as installed by a complete copy.
+func newInstallFlash(firmware, image []byte) (dev *tinyfs.MemBlockDevice, stage int64, want []byte) {
+	const sectors = 4
+	dev = tinyfs.NewMemoryDevice(256, SectorSize, 2*sectors)
+	stage = sectors * SectorSize
+	dev.WriteAt(firmware, 0)
+	dev.WriteAt(image, stage)
+	want = make([]byte, stage)
+	dev.ReadAt(want, 0)
+	copy(want, image)
+	for i := len(image); i < (len(image)+SectorSize-1)/SectorSize*SectorSize; i++ {
+		want[i] = 0xFF
+	}
+	return dev, stage, want
+}
+
+func TestPlan(t *testing.T) {
+	firmware := testImage(3 * SectorSize)
+	image := bytes.Clone(firmware[:2*SectorSize+100])
+	image[SectorSize+5] ^= 0xFF // Sector 1 changes, sector 2 is cut short
+	dev, stage, want := newInstallFlash(firmware, image)
+
+	plan, err := NewPlan(bytes.NewReader(image), dev, int64(len(image)))
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if want := (Plan{SectorSize, 2 * SectorSize, 0}); !slices.Equal(plan, want) {
+		t.Errorf("plan %v, want %v", plan, want)
+	}
+	if err := plan.Apply(dev, stage, int64(len(image))); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	got := make([]byte, stage)
+	dev.ReadAt(got, 0)
+	if !bytes.Equal(got, want) {
+		t.Error("installed firmware differs from the image")
+	}
+
+	// Installing the same image again changes nothing
+	plan, err = NewPlan(bytes.NewReader(image), dev, int64(len(image)))
+	if err != nil || len(plan) != 0 {
+		t.Errorf("plan for the installed image: %v, %v", plan, err)
+	}
+}
+
+func TestPlanInterrupted(t *testing.T) {
+	const boot2Size = 256
+	firmware := testImage(3 * SectorSize)
+	image := testImage(3*SectorSize - 10)
+	for ops := 0; ; ops++ {
+		mem, stage, want := newInstallFlash(firmware, image)
+		plan, err := NewPlan(bytes.NewReader(image), mem, int64(len(image)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = plan.Apply(&cutFlash{MemBlockDevice: mem, ops: ops}, stage, int64(len(image)))
+		got := make([]byte, stage)
+		mem.ReadAt(got, 0)
+		if err == nil {
+			if !bytes.Equal(got, want) {
+				t.Error("complete install differs from the image")
+			}
+			break
+		}
+
+		// Cut short: the old firmware untouched, or no boot stage 2 left
+		if !bytes.Equal(got[:len(firmware)], firmware) && !bytes.Equal(got[:boot2Size], bytes.Repeat([]byte{0xFF}, boot2Size)) {
+			t.Fatalf("install cut after %d ops left a bootable mix", ops)
+		}
+	}
+}
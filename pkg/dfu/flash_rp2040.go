@@ -0,0 +1,156 @@
+//go:build rp2040
+
+package dfu
+
+/*
+#include <stdint.h>
+
+// The copy runs from RAM: it erases the flash the firmware executes from,
+// and XIP is off while the flash is erased or programmed. It calls nothing
+// but the boot ROM, and the byte loops read through volatile pointers so
+// the compiler does not turn them into a memcpy call into flash.
+#define ram_func __attribute__((section(".ramfuncs"), noinline, noreturn))
+
+#define XIP_BASE        0x10000000u
+#define SECTOR_SIZE     4096u
+#define BLOCK_SIZE      65536u // ROM erase: 64 KiB blocks where aligned
+#define BLOCK_ERASE_CMD 0xD8
+
+#define REG(addr)     (*(volatile uint32_t *)(addr))
+#define PSM_FRCE_OFF  0x40010004u
+#define PSM_WDSEL     0x40010008u
+#define PSM_PROC1     (1u << 16)
+#define PSM_ALL       0x0001FFFFu
+#define PSM_OSC       0x00000003u // ROSC and XOSC keep running
+#define WATCHDOG_CTRL 0x40058000u
+#define WATCHDOG_SCR0 0x4005800Cu
+#define WATCHDOG_TRIG (1u << 31)
+#define SET_ALIAS     0x2000u
+#define CLR_ALIAS     0x3000u
+
+#define ROM_CODE(c1, c2) ((c1) | ((c2) << 8))
+#define ROM_HWORD_PTR(addr) ((void *)(uintptr_t)(*(uint16_t *)(uintptr_t)(addr)))
+
+typedef void *(*rom_lookup_fn)(uint16_t *table, uint32_t code);
+typedef void (*rom_void_fn)(void);
+typedef void (*rom_erase_fn)(uint32_t addr, uint32_t count, uint32_t block_size, uint8_t block_cmd);
+typedef void (*rom_program_fn)(uint32_t addr, const uint8_t *data, uint32_t count);
+
+static uint8_t dfu_sector[SECTOR_SIZE] __attribute__((aligned(4)));
+
+// dfu_install copies the n sectors at the flash offsets in plan from the
+// image of size bytes staged at flash offset stage, and resets the chip.
+// It follows dfu.Plan: sector 0 is erased first and is the last in plan.
+// It does not return.
+ram_func void dfu_install(uint32_t stage, uint32_t size, const uint32_t *plan, uint32_t n) {
+	rom_lookup_fn lookup = (rom_lookup_fn)ROM_HWORD_PTR(0x18);
+	uint16_t *table = (uint16_t *)ROM_HWORD_PTR(0x14);
+	rom_void_fn connect = (rom_void_fn)lookup(table, ROM_CODE('I', 'F'));
+	rom_void_fn exit_xip = (rom_void_fn)lookup(table, ROM_CODE('E', 'X'));
+	rom_erase_fn erase = (rom_erase_fn)lookup(table, ROM_CODE('R', 'E'));
+	rom_program_fn program = (rom_program_fn)lookup(table, ROM_CODE('R', 'P'));
+	rom_void_fn flush = (rom_void_fn)lookup(table, ROM_CODE('F', 'C'));
+	rom_void_fn enter_xip = (rom_void_fn)lookup(table, ROM_CODE('C', 'X'));
+
+	// Nothing may run from flash any more: no interrupts, and core 1 is
+	// held off until the reset
+	__asm volatile("cpsid i" ::: "memory");
+	REG(PSM_FRCE_OFF + SET_ALIAS) = PSM_PROC1;
+
+	// Without boot stage 2 an interrupted copy boots the USB bootloader
+	connect();
+	exit_xip();
+	erase(0, SECTOR_SIZE, BLOCK_SIZE, BLOCK_ERASE_CMD);
+	flush();
+	enter_xip();
+
+	for (uint32_t i = 0; i < n; i++) {
+		uint32_t off = plan[i];
+		volatile const uint8_t *src = (volatile const uint8_t *)(XIP_BASE + stage + off);
+		volatile uint8_t *dst = dfu_sector;
+		for (uint32_t j = 0; j < SECTOR_SIZE; j++) {
+			dst[j] = off + j < size ? src[j] : 0xFF;
+		}
+
+		connect();
+		exit_xip();
+		erase(off, SECTOR_SIZE, BLOCK_SIZE, BLOCK_ERASE_CMD);
+		program(off, dfu_sector, SECTOR_SIZE);
+		flush();
+		enter_xip(); // Read the next staged sector
+	}
+
+	// Boot normally, through a full watchdog reset that also restarts core 1
+	REG(PSM_FRCE_OFF + CLR_ALIAS) = PSM_PROC1;
+	REG(WATCHDOG_SCR0) = 0;
+	REG(PSM_WDSEL) = PSM_ALL & ~PSM_OSC;
+	REG(WATCHDOG_CTRL + SET_ALIAS) = WATCHDOG_TRIG;
+	for (;;) {
+	}
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"machine"
+	"unsafe"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+)
+
+// flashBase is where the flash is mapped and images start.
+const flashBase = 0x10000000
+
+// FlashInstaller installs images staged in a range of machine.Flash. The
+// copy over the running firmware cannot be undone halfway, so Install only
+// accepts the image and the copy runs when the device reboots: use the
+// FlashInstaller as the handler's Rebooter too.
+//
+// The copy takes a few seconds and is not atomic. It follows a Plan, so if
+// it is cut short, by a power loss or an unplugged cable, the pad starts
+// the USB bootloader in ROM instead of a broken firmware; copy a UF2 to
+// the RPI-RP2 drive to recover.
+type FlashInstaller struct {
+	stage   uint32 // Flash offset of the staging area
+	size    uint32 // Size of the image to install at reboot
+	pending Plan
+}
+
+// NewFlashInstaller returns an installer for images staged at offset in
+// machine.Flash.
+func NewFlashInstaller(offset int64) *FlashInstaller {
+	start := int64(machine.FlashDataStart()) - flashBase
+	return &FlashInstaller{stage: uint32(start + offset)}
+}
+
+// Install plans the copy of the staged image for the next normal reboot.
+// The image must fit the firmware area, partition.FirmwareSize, which ends
+// where the staging area begins.
+func (f *FlashInstaller) Install(image io.ReaderAt, size int64) error {
+	f.pending = nil
+	if size > partition.FirmwareSize {
+		return fmt.Errorf("%w: image larger than the firmware area (%d > %d bytes)", ErrTooLarge, size, partition.FirmwareSize)
+	}
+	firmware := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(flashBase))), partition.FirmwareSize)
+	plan, err := NewPlan(image, bytes.NewReader(firmware), size)
+	if err != nil {
+		return err
+	}
+	f.size = uint32(size)
+	f.pending = plan
+	return nil
+}
+
+// Reboot implements reboot.Rebooter. A normal reboot with an image
+// pending installs it and does not return.
+func (f *FlashInstaller) Reboot(mode reboot.Mode) error {
+	if len(f.pending) > 0 && mode == reboot.ModeNormal {
+		C.dfu_install(C.uint32_t(f.stage), C.uint32_t(f.size),
+			(*C.uint32_t)(unsafe.Pointer(&f.pending[0])), C.uint32_t(len(f.pending)))
+	}
+	return reboot.Device{}.Reboot(mode)
+}
@@ -0,0 +1,95 @@
+package dfu
+
+import (
+	"bytes"
+	"io"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// SectorSize is the flash erase sector of the RP2040 boards, the unit an
+// install rewrites.
+const SectorSize = 4096
+
+// Plan is the order in which an install rewrites the firmware: the flash
+// offsets of the sectors whose staged contents differ from the running
+// firmware, ending with sector 0.
+//
+// Copying over the running firmware cannot be made atomic without a second
+// firmware slot, which the RP2040 boot ROM does not support. Instead,
+// sector 0 is erased before any other sector is written and written back
+// last. It starts with boot stage 2, which the boot ROM only runs if its
+// last 4 bytes hold the CRC32 of the first 252. An install cut short by a
+// power loss or a reset thus leaves no valid boot stage 2, and the boot ROM
+// starts the USB bootloader rather than a half-written firmware: the pad
+// shows up as the RPI-RP2 drive and takes a UF2, without the BOOTSEL
+// button. Skipping the unchanged sectors keeps that window short.
+type Plan []uint32
+
+// NewPlan compares size bytes of the staged image with the running
+// firmware, current, whole sectors of which are read. An image identical
+// to the firmware returns an empty plan.
+func NewPlan(image, current io.ReaderAt, size int64) (Plan, error) {
+	var plan Plan
+	changed := false
+	staged := make([]byte, SectorSize)
+	running := make([]byte, SectorSize)
+	for off := int64(0); off < size; off += SectorSize {
+		if err := readSector(staged, image, off, size); err != nil {
+			return nil, err
+		}
+		if _, err := current.ReadAt(running, off); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(staged, running) {
+			changed = true
+			if off > 0 {
+				plan = append(plan, uint32(off))
+			}
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return append(plan, 0), nil
+}
+
+// readSector reads the sector of an image of size bytes at off, padded
+// with erased bytes as it is written.
+func readSector(sector []byte, image io.ReaderAt, off, size int64) error {
+	n := min(int64(len(sector)), size-off)
+	if _, err := image.ReadAt(sector[:n], off); err != nil {
+		return err
+	}
+	for i := n; i < int64(len(sector)); i++ {
+		sector[i] = 0xFF
+	}
+	return nil
+}
+
+// Apply carries out the plan on flash, which holds the firmware from
+// offset 0 and the staged image of size bytes at stage. It is what the
+// RP2040 FlashInstaller does from RAM, for tests and emulators; an error
+// stops it where a power loss would.
+func (p Plan) Apply(flash tinyfs.BlockDevice, stage, size int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := flash.EraseBlocks(0, 1); err != nil {
+		return err
+	}
+	image := io.NewSectionReader(flash, stage, size)
+	sector := make([]byte, SectorSize)
+	for _, off := range p {
+		if err := readSector(sector, image, int64(off), size); err != nil {
+			return err
+		}
+		if err := flash.EraseBlocks(int64(off)/SectorSize, 1); err != nil {
+			return err
+		}
+		if _, err := flash.WriteAt(sector, int64(off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
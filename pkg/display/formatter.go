@@ -10,7 +10,10 @@ import (
 
 // FrameFormatter formats protocol frames for display on the SSD1306.
 // It creates compact string representations suitable for 16-character wide display rows.
-type FrameFormatter struct{}
+type FrameFormatter struct {
+	// The last incoming command carried a secret, so its response may too
+	secret bool
+}
 
 // NewFrameFormatter creates a new frame formatter.
 func NewFrameFormatter() *FrameFormatter {
@@ -21,6 +24,7 @@ func NewFrameFormatter() *FrameFormatter {
 // Returns bytes string and parsed string.
 func (f *FrameFormatter) FormatIncoming(frame *protocol.Frame) (bytesStr, parsedStr string) {
 	// Format raw bytes (sync byte not included in frame, but we show it conceptually)
+	f.secret = secretPayload(frame.Cmd)
 	bytesStr = f.formatFrameBytes(frame.Cmd, frame.Payload)
 
 	// Format parsed info
@@ -73,21 +77,39 @@ func (f *FrameFormatter) formatFrameBytes(cmd uint8, payload []byte) string {
 	binary.LittleEndian.PutUint16(lenBytes, payloadLen)
 	b.WriteString(fmt.Sprintf("%02X%02X ", lenBytes[0], lenBytes[1]))
 
-	// Payload (first few bytes only)
+	writePayload(&b, payload, f.secret)
+
+	// CRC placeholder (we don't calculate it here, just show dots)
+	b.WriteString("..")
+
+	return b.String()
+}
+
+// secretPayload reports whether cmd carries a PIN or a factory reset token
+// in its request or response. Those must not show on the pad's screen.
+func secretPayload(cmd uint8) bool {
+	switch cmd {
+	case protocol.CmdUnlock, protocol.CmdSetLock, protocol.CmdFactoryReset:
+		return true
+	}
+	return false
+}
+
+// writePayload writes the first few payload bytes as hex, or masked.
+func writePayload(b *strings.Builder, payload []byte, secret bool) {
 	maxPayloadBytes := 4 // Show max 4 payload bytes to fit on display
 	for i := 0; i < len(payload) && i < maxPayloadBytes; i++ {
-		b.WriteString(fmt.Sprintf("%02X", payload[i]))
+		if secret {
+			b.WriteString("**")
+		} else {
+			b.WriteString(fmt.Sprintf("%02X", payload[i]))
+		}
 	}
 	if len(payload) > maxPayloadBytes {
 		b.WriteString("..")
 	} else if len(payload) > 0 {
 		b.WriteString(" ")
 	}
-
-	// CRC placeholder (we don't calculate it here, just show dots)
-	b.WriteString("..")
-
-	return b.String()
 }
 
 // formatResponseBytes formats the raw bytes of a response as hex.
@@ -109,16 +131,7 @@ func (f *FrameFormatter) formatResponseBytes(status uint8, payload []byte) strin
 	binary.LittleEndian.PutUint16(lenBytes, payloadLen)
 	b.WriteString(fmt.Sprintf("%02X%02X ", lenBytes[0], lenBytes[1]))
 
-	// Payload (first few bytes only)
-	maxPayloadBytes := 4 // Show max 4 payload bytes to fit on display
-	for i := 0; i < len(payload) && i < maxPayloadBytes; i++ {
-		b.WriteString(fmt.Sprintf("%02X", payload[i]))
-	}
-	if len(payload) > maxPayloadBytes {
-		b.WriteString("..")
-	} else if len(payload) > 0 {
-		b.WriteString(" ")
-	}
+	writePayload(&b, payload, f.secret)
 
 	// CRC placeholder
 	b.WriteString("..")
@@ -141,6 +154,10 @@ func (f *FrameFormatter) getCommandName(cmd uint8) string {
 		return "DelProf"
 	case protocol.CmdListProfiles:
 		return "LstProf"
+	case protocol.CmdListProfilesEx:
+		return "LstProfX"
+	case protocol.CmdGetCapabilities:
+		return "GetCaps"
 	case protocol.CmdGetStorageStats:
 		return "GetStor"
 	case protocol.CmdPing:
@@ -149,6 +166,28 @@ func (f *FrameFormatter) getCommandName(cmd uint8) string {
 		return "FctRst"
 	case protocol.CmdGetVersion:
 		return "GetVer"
+	case protocol.CmdUnlock:
+		return "Unlock"
+	case protocol.CmdSetLock:
+		return "SetLock"
+	case protocol.CmdReboot:
+		return "Reboot"
+	case protocol.CmdGetDiagnostics:
+		return "Diag"
+	case protocol.CmdUpdateBegin:
+		return "UpdBegin"
+	case protocol.CmdUpdateData:
+		return "UpdData"
+	case protocol.CmdUpdateVerify:
+		return "UpdVrfy"
+	case protocol.CmdUpdateCommit:
+		return "UpdCmt"
+	case protocol.CmdUpdateStatus:
+		return "UpdStat"
+	case protocol.CmdListHistory:
+		return "LstHist"
+	case protocol.CmdRestoreHistory:
+		return "RstHist"
 	case protocol.CmdDiscover:
 		return "Discvr"
 	default:
@@ -175,6 +214,10 @@ func (f *FrameFormatter) getStatusName(status uint8) string {
 		return "VerMis"
 	case protocol.StatusCRCError:
 		return "CRC"
+	case protocol.StatusLocked:
+		return "Locked"
+	case protocol.StatusCorrupted:
+		return "Corrupt"
 	default:
 		return fmt.Sprintf("Sts%02X", status)
 	}
@@ -0,0 +1,39 @@
+package display
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+)
+
+func TestSecretsMasked(t *testing.T) {
+	f := NewFrameFormatter()
+	token := []byte{0xC0, 0xFF, 0xEE, 0x42}
+
+	tests := []struct {
+		frame *protocol.Frame
+		resp  *protocol.Response
+	}{
+		{&protocol.Frame{Cmd: protocol.CmdUnlock, Payload: []byte{0xD2, 0x04}}, &protocol.Response{}},
+		{&protocol.Frame{Cmd: protocol.CmdSetLock, Payload: []byte{1, 0xD2, 0x04}}, &protocol.Response{}},
+		{&protocol.Frame{Cmd: protocol.CmdFactoryReset}, &protocol.Response{Payload: token}},
+		{&protocol.Frame{Cmd: protocol.CmdFactoryReset, Payload: token}, &protocol.Response{}},
+	}
+	for _, tt := range tests {
+		in, _ := f.FormatIncoming(tt.frame)
+		out, _ := f.FormatOutgoing(tt.resp)
+		for _, s := range []string{in, out} {
+			if strings.Contains(s, "D204") || strings.Contains(s, "C0FF") {
+				t.Errorf("Cmd 0x%02X: secret shown in %q", tt.frame.Cmd, s)
+			}
+		}
+	}
+
+	// Other payloads are still shown
+	in, _ := f.FormatIncoming(&protocol.Frame{Cmd: protocol.CmdPing, Payload: token})
+	out, _ := f.FormatOutgoing(&protocol.Response{Payload: token})
+	if !strings.Contains(in, "C0FFEE42") || !strings.Contains(out, "C0FFEE42") {
+		t.Errorf("Ping payload not shown: %q, %q", in, out)
+	}
+}
@@ -5,6 +5,8 @@ package gamepad
 import (
 	"machine"
 	"machine/usb/hid"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
 )
 
 // Button represents a gamepad button (0-15)
@@ -80,6 +82,7 @@ func (g *Gamepad) TxHandler() bool {
 	if b, ok := g.buf.Get(); ok {
 		g.waitTxc = true
 		hid.SendUSBPacket(b)
+		metrics.Inc(metrics.HIDReportsSent)
 		return true
 	}
 	return false
@@ -95,15 +98,21 @@ func (g *Gamepad) RxHandler(b []byte) bool {
 
 // tx sends a report packet, queuing if necessary
 func (g *Gamepad) tx(b []byte) {
-	if machine.USBDev.InitEndpointComplete {
-		if g.waitTxc {
-			// USB busy, queue for later
-			g.buf.Put(b)
-		} else {
-			// Send immediately
-			g.waitTxc = true
-			hid.SendUSBPacket(b)
+	if !machine.USBDev.InitEndpointComplete {
+		// Host has not configured the device yet
+		metrics.Inc(metrics.HIDReportsDropped)
+		return
+	}
+	if g.waitTxc {
+		// USB busy, queue for later
+		if !g.buf.Put(b) {
+			metrics.Inc(metrics.HIDReportsDropped)
 		}
+	} else {
+		// Send immediately
+		g.waitTxc = true
+		hid.SendUSBPacket(b)
+		metrics.Inc(metrics.HIDReportsSent)
 	}
 }
 
@@ -0,0 +1,230 @@
+// Package hidusage names HID usage codes: keyboard keys, modifier bits,
+// consumer controls, and gamepad and mouse buttons.
+//
+// The tables are static slices, so the package links into firmware (the
+// display and text console) without allocating at init, and host formats
+// such as pkg/configtext share the same names. Names are lower case with
+// underscores, e.g. "left_shift" or "volume_up".
+package hidusage
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// Usage is one named code. A table may list several names for a code; the
+// first one listed is canonical and the others are accepted as aliases.
+type Usage struct {
+	Code uint16
+	Name string
+}
+
+// Table maps usage codes to names and back.
+type Table struct {
+	kind   string
+	usages []Usage
+}
+
+// NewTable returns a table of usages. kind describes an entry in error
+// messages, e.g. "keycode".
+func NewTable(kind string, usages ...Usage) *Table {
+	return &Table{kind: kind, usages: usages}
+}
+
+// Kind describes what the table names, e.g. "keycode".
+func (t *Table) Kind() string {
+	return t.kind
+}
+
+// Name returns the canonical name of code.
+func (t *Table) Name(code uint16) (string, bool) {
+	for _, u := range t.usages {
+		if u.Code == code {
+			return u.Name, true
+		}
+	}
+	return "", false
+}
+
+// Code returns the code for a canonical name or an alias.
+func (t *Table) Code(name string) (uint16, bool) {
+	for _, u := range t.usages {
+		if u.Name == name {
+			return u.Code, true
+		}
+	}
+	return 0, false
+}
+
+// Usages returns every entry, aliases included, in table order. The slice
+// must not be modified.
+func (t *Table) Usages() []Usage {
+	return t.usages
+}
+
+// Bit is one named bit of a mask.
+type Bit struct {
+	Mask uint32
+	Name string
+}
+
+// BitTable names the bits of a mask, e.g. the keyboard modifier byte.
+type BitTable struct {
+	kind string
+	bits []Bit
+}
+
+// NewBitTable returns a table of named bits. kind describes a bit in error
+// messages, e.g. "modifier".
+func NewBitTable(kind string, bits ...Bit) *BitTable {
+	return &BitTable{kind: kind, bits: bits}
+}
+
+// Kind describes what the table names, e.g. "modifier".
+func (t *BitTable) Kind() string {
+	return t.kind
+}
+
+// Mask returns the bit for name.
+func (t *BitTable) Mask(name string) (uint32, bool) {
+	for _, b := range t.bits {
+		if b.Name == name {
+			return b.Mask, true
+		}
+	}
+	return 0, false
+}
+
+// Names returns the names of the bits set in mask, in table order, and
+// the bits that have no name.
+func (t *BitTable) Names(mask uint32) (names []string, rest uint32) {
+	rest = mask
+	for _, b := range t.bits {
+		if mask&b.Mask != 0 {
+			names = append(names, b.Name)
+			rest &^= b.Mask
+		}
+	}
+	return names, rest
+}
+
+// Bits returns every named bit in table order. The slice must not be
+// modified.
+func (t *BitTable) Bits() []Bit {
+	return t.bits
+}
+
+// Consumer names common HID Consumer page (0x0C) usages.
+var Consumer = &Table{
+	kind: "consumer usage",
+	usages: []Usage{
+		{0x6F, "brightness_up"},
+		{0x70, "brightness_down"},
+		{0xB2, "record"},
+		{0xB3, "fast_forward"},
+		{0xB4, "rewind"},
+		{0xB5, "scan_next"},
+		{0xB6, "scan_previous"},
+		{0xB7, "stop"},
+		{0xB8, "eject"},
+		{0xCD, "play_pause"},
+		{0xE2, "mute"},
+		{0xE9, "volume_up"},
+		{0xEA, "volume_down"},
+		{0x192, "calculator"},
+		{0x223, "browser_home"},
+		{0x224, "browser_back"},
+		{0x225, "browser_forward"},
+	},
+}
+
+// GamepadButtons names the 16 bits of the gamepad button mask.
+var GamepadButtons = &BitTable{
+	kind: "gamepad button",
+	bits: []Bit{
+		{1 << 0, "button1"},
+		{1 << 1, "button2"},
+		{1 << 2, "button3"},
+		{1 << 3, "button4"},
+		{1 << 4, "button5"},
+		{1 << 5, "button6"},
+		{1 << 6, "button7"},
+		{1 << 7, "button8"},
+		{1 << 8, "button9"},
+		{1 << 9, "button10"},
+		{1 << 10, "button11"},
+		{1 << 11, "button12"},
+		{1 << 12, "button13"},
+		{1 << 13, "button14"},
+		{1 << 14, "button15"},
+		{1 << 15, "button16"},
+	},
+}
+
+// MouseButtons names the bits of the HID mouse button byte.
+var MouseButtons = &BitTable{
+	kind: "mouse button",
+	bits: []Bit{
+		{0x01, "left"},
+		{0x02, "right"},
+		{0x04, "middle"},
+		{0x08, "back"},
+		{0x10, "forward"},
+	},
+}
+
+// FormatOutput describes a binding's output for people, e.g.
+// "keyboard left_shift+a", "gamepad button1+button3" or "consumer volume_up".
+// Unnamed values are shown in hex.
+func FormatOutput(t config.OutputType, value uint16, modifiers uint8) string {
+	switch t {
+	case config.OutputTypeNone:
+		return "none"
+	case config.OutputTypeKeyboard:
+		mods, _ := Modifiers.Names(uint32(modifiers)) // All 8 bits are named
+		s := ""
+		for _, m := range mods {
+			s += m + "+"
+		}
+		return "keyboard " + s + name(Keyboard, value)
+	case config.OutputTypeConsumer:
+		return "consumer " + name(Consumer, value)
+	case config.OutputTypeGamepadButton:
+		return "gamepad " + bitNames(GamepadButtons, value)
+	case config.OutputTypeMouseButton:
+		return "mouse " + bitNames(MouseButtons, value)
+	default:
+		return "output " + strconv.Itoa(int(t)) + " " + hex(value)
+	}
+}
+
+func name(t *Table, code uint16) string {
+	if s, ok := t.Name(code); ok {
+		return s
+	}
+	return hex(code)
+}
+
+func bitNames(t *BitTable, mask uint16) string {
+	names, rest := t.Names(uint32(mask))
+	s := ""
+	for i, n := range names {
+		if i > 0 {
+			s += "+"
+		}
+		s += n
+	}
+	if rest != 0 || mask == 0 {
+		if s != "" {
+			s += "+"
+		}
+		s += hex(uint16(rest))
+	}
+	return s
+}
+
+func hex(v uint16) string {
+	return "0x" + strings.ToUpper(strconv.FormatUint(uint64(v), 16))
+}
@@ -0,0 +1,119 @@
+package hidusage
+
+import (
+	"math/bits"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// checkTable verifies that every name is unique and resolves back to its
+// code, and that each code's canonical name is the first one listed.
+func checkTable(t *testing.T, table *Table) {
+	t.Helper()
+	seen := make(map[string]bool)
+	canonical := make(map[uint16]string)
+	for _, u := range table.Usages() {
+		if u.Name == "" || seen[u.Name] {
+			t.Errorf("%s: empty or duplicate name %q", table.Kind(), u.Name)
+		}
+		seen[u.Name] = true
+		if _, ok := canonical[u.Code]; !ok {
+			canonical[u.Code] = u.Name
+		}
+
+		if code, ok := table.Code(u.Name); !ok || code != u.Code {
+			t.Errorf("%s: Code(%q) = 0x%X, %v, want 0x%X", table.Kind(), u.Name, code, ok, u.Code)
+		}
+	}
+	for code, want := range canonical {
+		if name, ok := table.Name(code); !ok || name != want {
+			t.Errorf("%s: Name(0x%X) = %q, want %q", table.Kind(), code, name, want)
+		}
+	}
+}
+
+func checkBits(t *testing.T, table *BitTable) {
+	t.Helper()
+	var all uint32
+	for _, b := range table.Bits() {
+		if bits.OnesCount32(b.Mask) != 1 || all&b.Mask != 0 {
+			t.Errorf("%s %q: mask 0x%X is not a new single bit", table.Kind(), b.Name, b.Mask)
+		}
+		all |= b.Mask
+		if mask, ok := table.Mask(b.Name); !ok || mask != b.Mask {
+			t.Errorf("%s: Mask(%q) = 0x%X, %v", table.Kind(), b.Name, mask, ok)
+		}
+	}
+
+	// Every combination round trips through its names
+	names, rest := table.Names(all | 1<<31)
+	if rest != 1<<31 || len(names) != len(table.Bits()) {
+		t.Errorf("%s: Names(all) = %v, rest 0x%X", table.Kind(), names, rest)
+	}
+	var mask uint32
+	for _, n := range names {
+		m, _ := table.Mask(n)
+		mask |= m
+	}
+	if mask != all {
+		t.Errorf("%s: names of all bits give 0x%X, want 0x%X", table.Kind(), mask, all)
+	}
+}
+
+func TestTables(t *testing.T) {
+	for _, table := range []*Table{Keyboard, Consumer} {
+		checkTable(t, table)
+	}
+	for _, table := range []*BitTable{Modifiers, GamepadButtons, MouseButtons} {
+		checkBits(t, table)
+	}
+}
+
+func TestKeyboardComplete(t *testing.T) {
+	// Every usage from a to F24, and the modifier keys
+	for code := uint16(0x04); code <= 0x73; code++ {
+		if _, ok := Keyboard.Name(code); !ok {
+			t.Errorf("Keycode 0x%02X has no name", code)
+		}
+	}
+	for i, b := range Modifiers.Bits() {
+		name, ok := Keyboard.Name(0xE0 + uint16(i))
+		if !ok || name != b.Name || b.Mask != 1<<i {
+			t.Errorf("Modifier key 0x%02X = %q, modifier bit %d = %q", 0xE0+i, name, i, b.Name)
+		}
+	}
+	if len(GamepadButtons.Bits()) != 16 {
+		t.Errorf("Expected 16 gamepad buttons, got %d", len(GamepadButtons.Bits()))
+	}
+
+	if code, _ := Keyboard.Code("return"); code != 0x28 {
+		t.Errorf("Alias return = 0x%X, want 0x28", code)
+	}
+	if name, _ := Keyboard.Name(0x28); name != "enter" {
+		t.Errorf("Name(0x28) = %q, want enter", name)
+	}
+}
+
+func TestFormatOutput(t *testing.T) {
+	tests := []struct {
+		out  config.OutputType
+		val  uint16
+		mods uint8
+		want string
+	}{
+		{config.OutputTypeKeyboard, 0x1A, 0x22, "keyboard left_shift+right_shift+w"},
+		{config.OutputTypeKeyboard, 0xA5, 0, "keyboard 0xA5"},
+		{config.OutputTypeConsumer, 0xE9, 0, "consumer volume_up"},
+		{config.OutputTypeGamepadButton, 0x8005, 0, "gamepad button1+button3+button16"},
+		{config.OutputTypeMouseButton, 0x41, 0, "mouse left+0x40"},
+		{config.OutputTypeMouseButton, 0, 0, "mouse 0x0"},
+		{config.OutputTypeNone, 7, 0, "none"},
+		{9, 0x1234, 0, "output 9 0x1234"},
+	}
+	for _, tt := range tests {
+		if got := FormatOutput(tt.out, tt.val, tt.mods); got != tt.want {
+			t.Errorf("FormatOutput(%d, 0x%X, 0x%X) = %q, want %q", tt.out, tt.val, tt.mods, got, tt.want)
+		}
+	}
+}
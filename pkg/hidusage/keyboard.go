@@ -0,0 +1,147 @@
+package hidusage
+
+// Keyboard names HID Keyboard/Keypad page (0x07) usages. Names are lower
+// case; letters and digits name themselves, keypad keys start with "kp_".
+var Keyboard = &Table{
+	kind: "keycode",
+	usages: []Usage{
+		{0x04, "a"},
+		{0x05, "b"},
+		{0x06, "c"},
+		{0x07, "d"},
+		{0x08, "e"},
+		{0x09, "f"},
+		{0x0A, "g"},
+		{0x0B, "h"},
+		{0x0C, "i"},
+		{0x0D, "j"},
+		{0x0E, "k"},
+		{0x0F, "l"},
+		{0x10, "m"},
+		{0x11, "n"},
+		{0x12, "o"},
+		{0x13, "p"},
+		{0x14, "q"},
+		{0x15, "r"},
+		{0x16, "s"},
+		{0x17, "t"},
+		{0x18, "u"},
+		{0x19, "v"},
+		{0x1A, "w"},
+		{0x1B, "x"},
+		{0x1C, "y"},
+		{0x1D, "z"},
+		{0x1E, "1"},
+		{0x1F, "2"},
+		{0x20, "3"},
+		{0x21, "4"},
+		{0x22, "5"},
+		{0x23, "6"},
+		{0x24, "7"},
+		{0x25, "8"},
+		{0x26, "9"},
+		{0x27, "0"},
+		{0x28, "enter"},
+		{0x28, "return"},
+		{0x29, "escape"},
+		{0x29, "esc"},
+		{0x2A, "backspace"},
+		{0x2B, "tab"},
+		{0x2C, "space"},
+		{0x2D, "minus"},
+		{0x2E, "equal"},
+		{0x2F, "left_bracket"},
+		{0x30, "right_bracket"},
+		{0x31, "backslash"},
+		{0x32, "non_us_hash"},
+		{0x33, "semicolon"},
+		{0x34, "quote"},
+		{0x35, "grave"},
+		{0x36, "comma"},
+		{0x37, "period"},
+		{0x38, "slash"},
+		{0x39, "caps_lock"},
+		{0x3A, "f1"},
+		{0x3B, "f2"},
+		{0x3C, "f3"},
+		{0x3D, "f4"},
+		{0x3E, "f5"},
+		{0x3F, "f6"},
+		{0x40, "f7"},
+		{0x41, "f8"},
+		{0x42, "f9"},
+		{0x43, "f10"},
+		{0x44, "f11"},
+		{0x45, "f12"},
+		{0x46, "print_screen"},
+		{0x47, "scroll_lock"},
+		{0x48, "pause"},
+		{0x49, "insert"},
+		{0x4A, "home"},
+		{0x4B, "page_up"},
+		{0x4C, "delete"},
+		{0x4D, "end"},
+		{0x4E, "page_down"},
+		{0x4F, "right"},
+		{0x50, "left"},
+		{0x51, "down"},
+		{0x52, "up"},
+		{0x53, "num_lock"},
+		{0x54, "kp_slash"},
+		{0x55, "kp_asterisk"},
+		{0x56, "kp_minus"},
+		{0x57, "kp_plus"},
+		{0x58, "kp_enter"},
+		{0x59, "kp_1"},
+		{0x5A, "kp_2"},
+		{0x5B, "kp_3"},
+		{0x5C, "kp_4"},
+		{0x5D, "kp_5"},
+		{0x5E, "kp_6"},
+		{0x5F, "kp_7"},
+		{0x60, "kp_8"},
+		{0x61, "kp_9"},
+		{0x62, "kp_0"},
+		{0x63, "kp_period"},
+		{0x64, "non_us_backslash"},
+		{0x65, "application"},
+		{0x65, "menu"},
+		{0x66, "power"},
+		{0x67, "kp_equal"},
+		{0x68, "f13"},
+		{0x69, "f14"},
+		{0x6A, "f15"},
+		{0x6B, "f16"},
+		{0x6C, "f17"},
+		{0x6D, "f18"},
+		{0x6E, "f19"},
+		{0x6F, "f20"},
+		{0x70, "f21"},
+		{0x71, "f22"},
+		{0x72, "f23"},
+		{0x73, "f24"},
+		{0xE0, "left_ctrl"},
+		{0xE1, "left_shift"},
+		{0xE2, "left_alt"},
+		{0xE3, "left_gui"},
+		{0xE4, "right_ctrl"},
+		{0xE5, "right_shift"},
+		{0xE6, "right_alt"},
+		{0xE7, "right_gui"},
+	},
+}
+
+// Modifiers names the bits of the HID keyboard modifier byte.
+var Modifiers = &BitTable{
+	kind: "modifier",
+	bits: []Bit{
+		{0x01, "left_ctrl"},
+		{0x02, "left_shift"},
+		{0x04, "left_alt"},
+		{0x08, "left_gui"},
+		{0x10, "right_ctrl"},
+		{0x20, "right_shift"},
+		{0x40, "right_alt"},
+		{0x80, "right_gui"},
+	},
+}
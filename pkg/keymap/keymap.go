@@ -0,0 +1,89 @@
+// Package keymap holds the bindings the pad applies to its inputs: those of
+// the active profile, or none after a safe mode boot.
+// The keymap in effect is set once at boot with Apply; input handling reads
+// it through Active, from any goroutine.
+package keymap
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+)
+
+// Keymap is a loaded profile, or the empty keymap that binds nothing.
+type Keymap struct {
+	slot    uint8
+	applied bool
+	profile config.Profile
+}
+
+var active atomic.Pointer[Keymap]
+
+// Load returns the keymap for a boot in mode. A normal boot applies the
+// active profile of the stored device config. A safe mode boot applies no
+// profile, so one that jams the pad can be fixed or deleted over serial;
+// neither does a pad without storage, a device config or the active
+// profile. Damaged records return their storage error and the empty keymap.
+func Load(sm *storage.Manager, mode reboot.Mode) (*Keymap, error) {
+	k := &Keymap{}
+	if mode == reboot.ModeSafe || sm == nil {
+		return k, nil
+	}
+
+	var cfg config.DeviceConfig
+	if err := sm.LoadDevice(&cfg); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			return k, nil
+		}
+		return k, err
+	}
+	if err := sm.LoadProfile(cfg.ActiveProfile, &k.profile); err != nil {
+		k.profile = config.Profile{}
+		if errors.Is(err, storage.ErrProfileNotFound) {
+			return k, nil
+		}
+		return k, err
+	}
+	k.slot = cfg.ActiveProfile
+	k.applied = true
+	return k, nil
+}
+
+// Apply makes k the keymap in effect.
+func Apply(k *Keymap) {
+	active.Store(k)
+}
+
+// Active returns the keymap in effect, the empty keymap before Apply.
+func Active() *Keymap {
+	if k := active.Load(); k != nil {
+		return k
+	}
+	return &Keymap{}
+}
+
+// Profile returns the applied profile and its slot; ok is false when no
+// profile is applied.
+func (k *Keymap) Profile() (slot uint8, profile *config.Profile, ok bool) {
+	if !k.applied {
+		return 0, nil, false
+	}
+	return k.slot, &k.profile, true
+}
+
+// Binding returns the first binding for an input; ok is false when the
+// input is unbound.
+func (k *Keymap) Binding(input config.BindingType, id uint8) (b config.KeyBinding, ok bool) {
+	if !k.applied {
+		return config.KeyBinding{}, false
+	}
+	for _, b := range k.profile.Bindings[:min(int(k.profile.BindingCount), config.MaxBindings)] {
+		if b.InputType == input && b.InputID == id && b.OutputType != config.OutputTypeNone {
+			return b, true
+		}
+	}
+	return config.KeyBinding{}, false
+}
@@ -0,0 +1,90 @@
+package keymap
+
+import (
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// newTestStorage returns storage whose active profile, slot 2, binds key 5
+// to the keyboard 'A'.
+func newTestStorage(t *testing.T) *storage.Manager {
+	t.Helper()
+	mgr, err := storage.New(tinyfs.NewMemoryDevice(256, 4096, 64), true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+
+	p := config.Profile{BindingCount: 1}
+	p.SetName("Game")
+	p.Bindings[0] = config.KeyBinding{InputType: config.BindingTypeKey, InputID: 5, OutputType: config.OutputTypeKeyboard, OutputValue: 0x04}
+	if err := mgr.SaveProfile(2, &p); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.SaveDevice(&config.DeviceConfig{ActiveProfile: 2}); err != nil {
+		t.Fatal(err)
+	}
+	return mgr
+}
+
+func TestLoadAppliesActiveProfile(t *testing.T) {
+	k, err := Load(newTestStorage(t), reboot.ModeNormal)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if slot, p, ok := k.Profile(); !ok || slot != 2 || p.GetName() != "Game" {
+		t.Errorf("Profile() = %d, %v, %v; want slot 2", slot, p, ok)
+	}
+	if b, ok := k.Binding(config.BindingTypeKey, 5); !ok || b.OutputValue != 0x04 {
+		t.Errorf("Binding(key 5) = %+v, %v", b, ok)
+	}
+	if _, ok := k.Binding(config.BindingTypeKey, 6); ok {
+		t.Error("Unbound key 6 has a binding")
+	}
+}
+
+func TestSafeModeSkipsProfiles(t *testing.T) {
+	k, err := Load(newTestStorage(t), reboot.ModeSafe)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, _, ok := k.Profile(); ok {
+		t.Error("Safe mode boot applied a profile")
+	}
+	if _, ok := k.Binding(config.BindingTypeKey, 5); ok {
+		t.Error("Safe mode boot applied a binding")
+	}
+}
+
+func TestLoadWithoutProfile(t *testing.T) {
+	mgr := newTestStorage(t)
+	if err := mgr.DeleteProfile(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range []*storage.Manager{mgr, nil} {
+		k, err := Load(sm, reboot.ModeNormal)
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if _, _, ok := k.Profile(); ok {
+			t.Error("Applied a profile that does not exist")
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	defer Apply(nil)
+	if _, _, ok := Active().Profile(); ok {
+		t.Error("Profile applied before Apply")
+	}
+	k, _ := Load(newTestStorage(t), reboot.ModeNormal)
+	Apply(k)
+	if Active() != k {
+		t.Error("Active did not return the applied keymap")
+	}
+}
@@ -0,0 +1,84 @@
+// Package metrics keeps device-wide event counters for diagnostics.
+// Counters are plain atomics so any goroutine, including the HID transmit
+// path, can increment them without locks or allocations.
+package metrics
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Counter identifies one event counter.
+type Counter uint8
+
+const (
+	FramesReceived      Counter = iota // Valid request frames parsed
+	CRCErrors                          // Frames rejected for a bad CRC
+	InvalidFrames                      // Frame candidates with an impossible header
+	FrameTimeouts                      // Partial frames dropped by the inter-byte timeout
+	ResponseWriteErrors                // protocol.WriteResponse failures
+	HIDReportsSent                     // HID reports handed to the USB hardware
+	HIDReportsDropped                  // HID reports lost (queue full or USB not ready)
+	StorageErrors                      // Flash/filesystem errors other than "not found"
+	ConfigMigrated                     // Stored records upgraded to the current version at boot
+	ConfigDropped                      // Stored records removed at boot for lack of a migration path
+	ConfigCorrupt                      // Stored records failing their checksum at boot
+
+	NumCounters
+)
+
+var (
+	counters [NumCounters]atomic.Uint32
+	start    = time.Now()
+)
+
+// Inc increments a counter. Counters wrap at 2^32.
+func Inc(c Counter) {
+	if c < NumCounters {
+		counters[c].Add(1)
+	}
+}
+
+// Get returns the current value of a counter.
+func Get(c Counter) uint32 {
+	if c >= NumCounters {
+		return 0
+	}
+	return counters[c].Load()
+}
+
+// Uptime returns the time since the program started.
+func Uptime() time.Duration {
+	return time.Since(start)
+}
+
+// Reset zeroes all counters.
+func Reset() {
+	for i := range counters {
+		counters[i].Store(0)
+	}
+}
+
+// counterNames are indexed by Counter.
+var counterNames = [NumCounters]string{
+	FramesReceived:      "frames",
+	CRCErrors:           "crc-errors",
+	InvalidFrames:       "invalid-frames",
+	FrameTimeouts:       "frame-timeouts",
+	ResponseWriteErrors: "write-errors",
+	HIDReportsSent:      "hid-sent",
+	HIDReportsDropped:   "hid-dropped",
+	StorageErrors:       "storage-errors",
+	ConfigMigrated:      "config-migrated",
+	ConfigDropped:       "config-dropped",
+	ConfigCorrupt:       "config-corrupt",
+}
+
+// String returns a short name for the counter.
+func (c Counter) String() string {
+	if c >= NumCounters {
+		return "counter-" + strconv.Itoa(int(c))
+	}
+	return counterNames[c]
+}
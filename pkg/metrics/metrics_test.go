@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	Reset()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				Inc(CRCErrors)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := Get(CRCErrors); got != 4000 {
+		t.Errorf("Expected 4000 CRC errors, got %d", got)
+	}
+	if got := Get(FramesReceived); got != 0 {
+		t.Errorf("Expected 0 frames, got %d", got)
+	}
+
+	// Out-of-range counters are ignored
+	Inc(NumCounters)
+	if got := Get(NumCounters); got != 0 {
+		t.Errorf("Expected 0 for invalid counter, got %d", got)
+	}
+
+	Reset()
+	if got := Get(CRCErrors); got != 0 {
+		t.Errorf("Expected 0 after Reset, got %d", got)
+	}
+}
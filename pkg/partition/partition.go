@@ -0,0 +1,124 @@
+// Package partition divides the RP2040's flash into the firmware, the
+// firmware update staging area and the configuration filesystem, as ranges
+// of whole erase blocks of machine.Flash.
+//
+// The layout, as offsets from the start of flash, is
+//
+//	[firmware, FirmwareSize][staging area, StageSize][filesystem ...]
+//
+// Both boundaries are fixed. Firmware of any size up to FirmwareSize runs
+// with the filesystem in the same place, so an update never moves it, and
+// the staging area holds any image that fits the firmware area. The
+// filesystem takes the rest of flash, 1 MiB on the 2 MiB boards.
+package partition
+
+import (
+	"errors"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// Flash layout, as offsets from the start of flash.
+const (
+	FirmwareSize = 512 << 10 // Largest firmware image
+	StageStart   = FirmwareSize
+	StageSize    = FirmwareSize
+	StorageStart = StageStart + StageSize
+)
+
+var (
+	ErrAlignment = errors.New("partition not aligned to erase blocks")
+	ErrRange     = errors.New("access outside the partition")
+	ErrFirmware  = errors.New("firmware overlaps the partition")
+)
+
+// Device is a range of another block device.
+type Device struct {
+	dev   tinyfs.BlockDevice
+	start int64 // Byte offset in dev
+	size  int64
+}
+
+// New returns the size bytes of dev starting at start. Both must be
+// multiples of the erase block size.
+func New(dev tinyfs.BlockDevice, start, size int64) (*Device, error) {
+	ebs := dev.EraseBlockSize()
+	switch {
+	case start%ebs != 0 || size%ebs != 0:
+		return nil, ErrAlignment
+	case start < 0 || size <= 0 || start+size > dev.Size():
+		return nil, ErrRange
+	}
+	return &Device{dev: dev, start: start, size: size}, nil
+}
+
+// Stage returns the staging area of dev, which maps the flash from offset
+// base on. machine.Flash starts after the running firmware, at
+// machine.FlashDataStart. Firmware larger than FirmwareSize returns
+// ErrFirmware.
+func Stage(dev tinyfs.BlockDevice, base int64) (*Device, error) {
+	return fixed(dev, base, StageStart, StageSize)
+}
+
+// Storage returns the filesystem area of dev, which maps the flash from
+// offset base on: everything after StorageStart.
+func Storage(dev tinyfs.BlockDevice, base int64) (*Device, error) {
+	return fixed(dev, base, StorageStart, base+dev.Size()-StorageStart)
+}
+
+// fixed returns the size bytes of flash from start, in dev mapping the
+// flash from base on.
+func fixed(dev tinyfs.BlockDevice, base, start, size int64) (*Device, error) {
+	if base > start {
+		return nil, ErrFirmware
+	}
+	return New(dev, start-base, size)
+}
+
+// Offset returns where the partition starts in the underlying device.
+func (d *Device) Offset() int64 {
+	return d.start
+}
+
+// check reports whether n bytes at off lie inside the partition.
+func (d *Device) check(off int64, n int) error {
+	if off < 0 || off+int64(n) > d.size {
+		return ErrRange
+	}
+	return nil
+}
+
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if err := d.check(off, len(p)); err != nil {
+		return 0, err
+	}
+	return d.dev.ReadAt(p, d.start+off)
+}
+
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if err := d.check(off, len(p)); err != nil {
+		return 0, err
+	}
+	return d.dev.WriteAt(p, d.start+off)
+}
+
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+func (d *Device) WriteBlockSize() int64 {
+	return d.dev.WriteBlockSize()
+}
+
+func (d *Device) EraseBlockSize() int64 {
+	return d.dev.EraseBlockSize()
+}
+
+// EraseBlocks erases len blocks from block start of the partition.
+func (d *Device) EraseBlocks(start, len int64) error {
+	ebs := d.dev.EraseBlockSize()
+	if start < 0 || len < 0 || (start+len)*ebs > d.size {
+		return ErrRange
+	}
+	return d.dev.EraseBlocks(d.start/ebs+start, len)
+}
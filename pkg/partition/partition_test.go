@@ -0,0 +1,110 @@
+package partition
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// newFlash returns a device like machine.Flash on a 2 MiB board whose
+// firmware ends at base.
+func newFlash(base int64) *tinyfs.MemBlockDevice {
+	return tinyfs.NewMemoryDevice(256, 4096, int(2<<20-base)/4096)
+}
+
+func TestLayout(t *testing.T) {
+	const base = 64 << 10
+	dev := newFlash(base)
+	fs, err := Storage(dev, base)
+	if err != nil {
+		t.Fatalf("Storage failed: %v", err)
+	}
+	stage, err := Stage(dev, base)
+	if err != nil {
+		t.Fatalf("Stage failed: %v", err)
+	}
+	if fs.Offset() != StorageStart-base || fs.Size() != 1<<20 {
+		t.Errorf("fs %d bytes at %d", fs.Size(), fs.Offset())
+	}
+	if stage.Offset() != StageStart-base || stage.Size() != StageSize {
+		t.Errorf("stage %d bytes at %d", stage.Size(), stage.Offset())
+	}
+
+	// Larger firmware maps the same flash
+	const grown = 256 << 10
+	fs2, err := Storage(newFlash(grown), grown)
+	if err != nil || fs2.Offset()+grown != fs.Offset()+base || fs2.Size() != fs.Size() {
+		t.Errorf("fs moved with the firmware: %d bytes at %d, %v", fs2.Size(), fs2.Offset(), err)
+	}
+
+	// Writes land in their own range of the device
+	page := bytes.Repeat([]byte{0xA5}, 256)
+	if _, err := stage.WriteAt(page, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, 256)
+	dev.ReadAt(got, StageStart-base)
+	if !bytes.Equal(got, page) {
+		t.Error("stage write did not land at StageStart")
+	}
+	fs.ReadAt(got, 0)
+	if bytes.Equal(got, page) {
+		t.Error("stage write reached the filesystem")
+	}
+
+	// Erasing the filesystem leaves the stage alone
+	if err := fs.EraseBlocks(0, fs.Size()/4096); err != nil {
+		t.Fatalf("EraseBlocks failed: %v", err)
+	}
+	stage.ReadAt(got, 0)
+	if !bytes.Equal(got, page) {
+		t.Error("erasing the filesystem erased the stage")
+	}
+	if err := stage.EraseBlocks(0, 1); err != nil {
+		t.Fatalf("EraseBlocks failed: %v", err)
+	}
+	stage.ReadAt(got, 0)
+	if got[0] != 0xFF {
+		t.Error("stage block not erased")
+	}
+}
+
+func TestLargeFirmware(t *testing.T) {
+	const base = FirmwareSize + 4096
+	dev := newFlash(base)
+	if _, err := Stage(dev, base); !errors.Is(err, ErrFirmware) {
+		t.Errorf("Stage over the firmware: got %v", err)
+	}
+	if _, err := Storage(dev, base); err != nil {
+		t.Errorf("Storage failed: %v", err)
+	}
+	if _, err := Storage(newFlash(StorageStart+4096), StorageStart+4096); !errors.Is(err, ErrFirmware) {
+		t.Errorf("Storage over the firmware: got %v", err)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	dev := tinyfs.NewMemoryDevice(256, 4096, 16)
+	if _, err := New(dev, 100, 4096); !errors.Is(err, ErrAlignment) {
+		t.Errorf("unaligned start: got %v", err)
+	}
+	if _, err := New(dev, 12*4096, 8*4096); !errors.Is(err, ErrRange) {
+		t.Errorf("past the end: got %v", err)
+	}
+	if _, err := Storage(dev, StorageStart-16*4096); !errors.Is(err, ErrRange) {
+		t.Errorf("no room for the filesystem: got %v", err)
+	}
+
+	p, _ := New(dev, 4096, 2*4096)
+	if _, err := p.WriteAt(make([]byte, 256), 2*4096-128); !errors.Is(err, ErrRange) {
+		t.Errorf("write across the end: got %v", err)
+	}
+	if _, err := p.ReadAt(make([]byte, 1), -1); !errors.Is(err, ErrRange) {
+		t.Errorf("negative offset: got %v", err)
+	}
+	if err := p.EraseBlocks(1, 2); !errors.Is(err, ErrRange) {
+		t.Errorf("erase past the end: got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+)
+
+// Error reason codes carried in the payload of error responses.
+// The status byte keeps the coarse category; the reason says what exactly
+// went wrong so the PC app can show an actionable message.
+const (
+	ReasonUnspecified = 0x00
+	ReasonLength      = 0x01 // Payload has the wrong length; Offset is the expected length
+	ReasonValue       = 0x02 // A field holds an invalid value; Offset locates it
+	ReasonVersion     = 0x03 // Config version mismatch; Offset locates the version field
+	ReasonNotFound    = 0x04 // Requested profile or config does not exist
+	ReasonNoSpace     = 0x05 // Flash is full
+	ReasonIO          = 0x06 // Flash read, program or erase failed
+	ReasonCorrupt     = 0x07 // Filesystem or record is corrupted
+	ReasonFilesystem  = 0x08 // Other filesystem error
+	ReasonEncoding    = 0x09 // Data could not be encoded or decoded
+	ReasonLocked      = 0x0A // Configuration is locked; send CmdUnlock first
+	ReasonChallenge   = 0x0B // Confirmation token missing, wrong or expired
+	ReasonUnsupported = 0x0C // Not supported by this device or build
+
+	// NoOffset marks an error that is not tied to a field or offset.
+	NoOffset = 0xFFFF
+
+	// maxErrorMessage caps the message length to keep error frames small.
+	maxErrorMessage = 48
+)
+
+// ErrorDetail is the structured payload of an error response.
+// Wire format: [Reason:1][Offset:2][Message:N]
+//   - Reason: one of the Reason* codes
+//   - Offset: byte offset of the offending field in the request payload
+//     (uint16, little-endian), NoOffset if not applicable
+//   - Message: short ASCII description
+type ErrorDetail struct {
+	Reason  uint8
+	Offset  uint16
+	Message string
+}
+
+// MarshalBinary encodes the error detail.
+func (e *ErrorDetail) MarshalBinary() ([]byte, error) {
+	msg := e.Message
+	if len(msg) > maxErrorMessage {
+		msg = msg[:maxErrorMessage]
+	}
+	buf := make([]byte, 3+len(msg))
+	buf[0] = e.Reason
+	binary.LittleEndian.PutUint16(buf[1:], e.Offset)
+	copy(buf[3:], msg)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes an error detail from an error response payload.
+func (e *ErrorDetail) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 {
+		return ErrInvalidFrame
+	}
+	e.Reason = data[0]
+	e.Offset = binary.LittleEndian.Uint16(data[1:])
+	e.Message = string(data[3:])
+	return nil
+}
+
+// errorResponse builds an error response with a detail payload.
+func errorResponse(status, reason uint8, offset uint16, msg string) *Response {
+	detail := ErrorDetail{Reason: reason, Offset: offset, Message: msg}
+	payload, _ := detail.MarshalBinary()
+	return &Response{
+		Status:  status,
+		Payload: payload,
+	}
+}
+
+// lengthError reports a payload of the wrong size.
+func lengthError(expected int) *Response {
+	return errorResponse(StatusInvalidData, ReasonLength, uint16(expected), "bad payload length")
+}
+
+// shortError reports a payload below the minimum size of a command taking
+// variable-length data.
+func shortError(minimum int) *Response {
+	return errorResponse(StatusInvalidData, ReasonLength, uint16(minimum), "need at least "+strconv.Itoa(minimum)+" bytes")
+}
+
+// validationError reports the first problem found by Validate. base is the
+// offset of the record in the request payload.
+func validationError(ps config.Problems, base int) *Response {
+	p := ps[0]
+	return errorResponse(StatusInvalidData, ReasonValue, uint16(base+p.Offset), p.Error())
+}
+
+// storageError maps a storage error to a status and reason.
+func storageError(err error) *Response {
+	switch {
+	case errors.Is(err, storage.ErrProfileNotFound), errors.Is(err, storage.ErrDeviceNotFound):
+		return errorResponse(StatusNotFound, ReasonNotFound, NoOffset, err.Error())
+	case errors.Is(err, storage.ErrVersionMismatch):
+		return errorResponse(StatusVersionMismatch, ReasonVersion, NoOffset, "no migration for stored record")
+	case errors.Is(err, storage.ErrFlashFull):
+		return errorResponse(StatusNoSpace, ReasonNoSpace, NoOffset, "flash full")
+	case errors.Is(err, storage.ErrIO):
+		return errorResponse(StatusError, ReasonIO, NoOffset, "flash I/O error")
+	case errors.Is(err, storage.ErrRecordCorrupt):
+		return errorResponse(StatusCorrupted, ReasonCorrupt, NoOffset, "stored record failed its checksum")
+	case errors.Is(err, storage.ErrCorrupted):
+		return errorResponse(StatusError, ReasonCorrupt, NoOffset, "filesystem corrupted")
+	case errors.Is(err, storage.ErrInvalidProfile):
+		return errorResponse(StatusError, ReasonCorrupt, NoOffset, "stored record has wrong size")
+	case errors.Is(err, storage.ErrFilesystem):
+		return errorResponse(StatusError, ReasonFilesystem, NoOffset, err.Error())
+	default:
+		return errorResponse(StatusError, ReasonUnspecified, NoOffset, err.Error())
+	}
+}
+
+// StatusText returns a short description of a status code.
+func StatusText(status uint8) string {
+	switch status {
+	case StatusOK:
+		return "ok"
+	case StatusError:
+		return "error"
+	case StatusInvalidCmd:
+		return "invalid command"
+	case StatusInvalidData:
+		return "invalid data"
+	case StatusNotFound:
+		return "not found"
+	case StatusNoSpace:
+		return "no space"
+	case StatusVersionMismatch:
+		return "version mismatch"
+	case StatusCRCError:
+		return "CRC error"
+	case StatusLocked:
+		return "locked"
+	case StatusCorrupted:
+		return "record corrupted"
+	default:
+		return "unknown status"
+	}
+}
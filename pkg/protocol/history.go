@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"encoding/binary"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// handleListHistory lists the stored generations of a profile slot or of the
+// device config, newest first.
+// Payload: [Record:1][Slot:1] (see History* records)
+// Response: [Count:1][Entry:22]...
+// Entry: [Generation:4][EntryFlags:1][BindingCount:1][Name:16]
+// Device config entries have no binding count or name.
+func (h *Handler) handleListHistory(payload []byte) *Response {
+	if len(payload) != 2 {
+		return lengthError(2)
+	}
+	record, slot := payload[0], payload[1]
+
+	var gens []uint32
+	var err error
+	switch record {
+	case HistoryProfile:
+		gens, err = h.storage.ProfileHistory(slot)
+	case HistoryDevice:
+		gens, err = h.storage.DeviceHistory()
+	default:
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "unknown history record")
+	}
+	if err != nil {
+		return storageError(err)
+	}
+	gens = gens[:min(len(gens), 255, (MaxPayload-1)/HistoryEntrySize)]
+
+	resp := make([]byte, 1+len(gens)*HistoryEntrySize)
+	resp[0] = uint8(len(gens))
+	for i, gen := range gens {
+		entry := resp[1+i*HistoryEntrySize : 1+(i+1)*HistoryEntrySize]
+		binary.LittleEndian.PutUint32(entry, gen)
+		if record == HistoryDevice {
+			var cfg config.DeviceConfig
+			if h.storage.LoadDeviceGeneration(gen, &cfg) != nil {
+				entry[4] |= EntryFlagUnreadable
+			}
+			continue
+		}
+
+		var profile config.Profile
+		if h.storage.LoadProfileGeneration(slot, gen, &profile) != nil {
+			entry[4] |= EntryFlagUnreadable
+			continue
+		}
+		entry[5] = profile.BindingCount
+		copy(entry[6:], profile.GetName())
+	}
+
+	return &Response{
+		Status:  StatusOK,
+		Payload: resp,
+	}
+}
+
+// handleRestoreHistory makes a stored generation current again. The record
+// it replaces becomes the newest generation, so a restore can be undone.
+// A restored device config keeps the current lock settings.
+// Payload: [Record:1][Slot:1][Generation:4]
+func (h *Handler) handleRestoreHistory(payload []byte) *Response {
+	if len(payload) != 6 {
+		return lengthError(6)
+	}
+	record, slot := payload[0], payload[1]
+	gen := binary.LittleEndian.Uint32(payload[2:])
+
+	switch record {
+	case HistoryProfile:
+		if err := h.storage.RestoreProfile(slot, gen); err != nil {
+			return storageError(err)
+		}
+	case HistoryDevice:
+		if err := h.storage.RestoreDevice(gen); err != nil {
+			return storageError(err)
+		}
+	default:
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "unknown history record")
+	}
+	return &Response{Status: StatusOK}
+}
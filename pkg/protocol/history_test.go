@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+func restorePayload(record, slot uint8, gen uint32) []byte {
+	return binary.LittleEndian.AppendUint32([]byte{record, slot}, gen)
+}
+
+func TestProfileHistory(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	for _, name := range []string{"Good", "Broken"} {
+		p := config.Profile{Version: config.CurrentVersion, BindingCount: uint8(len(name))}
+		p.SetName(name)
+		data, _ := p.MarshalBinary()
+		if resp := handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{3}, data...)}); resp.Status != StatusOK {
+			t.Fatalf("SetProfile failed: status 0x%x", resp.Status)
+		}
+	}
+
+	resp := handler.Handle(&Frame{Cmd: CmdListHistory, Payload: []byte{HistoryProfile, 3}})
+	if resp.Status != StatusOK || len(resp.Payload) != 1+HistoryEntrySize || resp.Payload[0] != 1 {
+		t.Fatalf("ListHistory: status 0x%x, payload %x", resp.Status, resp.Payload)
+	}
+	entry := resp.Payload[1:]
+	gen := binary.LittleEndian.Uint32(entry)
+	if entry[4] != 0 || entry[5] != 4 || string(entry[6:10]) != "Good" {
+		t.Errorf("Unexpected entry %x", entry)
+	}
+
+	// One-step rollback
+	resp = handler.Handle(&Frame{Cmd: CmdRestoreHistory, Payload: restorePayload(HistoryProfile, 3, gen)})
+	if resp.Status != StatusOK {
+		t.Fatalf("RestoreHistory failed: status 0x%x", resp.Status)
+	}
+	var p config.Profile
+	if err := mgr.LoadProfile(3, &p); err != nil || p.GetName() != "Good" {
+		t.Errorf("Restored profile %q, %v", p.GetName(), err)
+	}
+
+	resp = handler.Handle(&Frame{Cmd: CmdRestoreHistory, Payload: restorePayload(HistoryProfile, 3, 999)})
+	if resp.Status != StatusNotFound {
+		t.Errorf("Expected StatusNotFound for an unknown generation, got 0x%x", resp.Status)
+	}
+	resp = handler.Handle(&Frame{Cmd: CmdListHistory, Payload: []byte{7, 0}})
+	if resp.Status != StatusInvalidData || resp.Payload[0] != ReasonValue {
+		t.Errorf("Expected ReasonValue for an unknown record, got status 0x%x", resp.Status)
+	}
+	resp = handler.Handle(&Frame{Cmd: CmdListHistory, Payload: []byte{HistoryProfile, 9}})
+	if resp.Status != StatusOK || resp.Payload[0] != 0 {
+		t.Errorf("Expected an empty history, got status 0x%x, payload %x", resp.Status, resp.Payload)
+	}
+
+	resp = handler.Handle(&Frame{Cmd: CmdGetCapabilities})
+	entries, _ := ParseTLV(resp.Payload)
+	caps := make(map[uint8][]byte)
+	for _, e := range entries {
+		caps[e.Type] = e.Value
+	}
+	if v := caps[CapHistoryDepth]; len(v) != 1 || int(v[0]) != mgr.HistoryDepth() {
+		t.Errorf("Unexpected history depth capability %x", v)
+	}
+}
+
+func TestDeviceHistoryKeepsLock(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	for _, b := range []uint8{10, 20} {
+		data, _ := (&config.DeviceConfig{Version: config.CurrentVersion, Brightness: b}).MarshalBinary()
+		handler.Handle(&Frame{Cmd: CmdSetDeviceConfig, Payload: data})
+	}
+	handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{1, 0xD2, 0x04}}) // PIN 1234
+
+	resp := handler.Handle(&Frame{Cmd: CmdListHistory, Payload: []byte{HistoryDevice, 0}})
+	if resp.Status != StatusOK || resp.Payload[0] == 0 {
+		t.Fatalf("ListHistory: status 0x%x, payload %x", resp.Status, resp.Payload)
+	}
+
+	// Restoring is protected; the oldest generation predates the lock
+	oldest := resp.Payload[1+(int(resp.Payload[0])-1)*HistoryEntrySize:]
+	restore := &Frame{Cmd: CmdRestoreHistory, Payload: restorePayload(HistoryDevice, 0, binary.LittleEndian.Uint32(oldest))}
+	if resp := handler.Handle(restore); resp.Status != StatusLocked {
+		t.Fatalf("Expected StatusLocked, got 0x%x", resp.Status)
+	}
+	handler.Handle(&Frame{Cmd: CmdUnlock, Payload: []byte{0xD2, 0x04}})
+	if resp := handler.Handle(restore); resp.Status != StatusOK {
+		t.Fatalf("RestoreHistory failed: status 0x%x", resp.Status)
+	}
+
+	var cfg config.DeviceConfig
+	mgr.LoadDevice(&cfg)
+	if cfg.Brightness != 10 || !cfg.Locked() || cfg.LockPIN != 1234 {
+		t.Errorf("Unexpected restored config: %+v", cfg)
+	}
+}
@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+)
+
+// checkLock returns a StatusLocked response if the write lock is enabled
+// and this session has not been unlocked, or nil if the command may run.
+func (h *Handler) checkLock() *Response {
+	if h.unlocked {
+		return nil
+	}
+
+	var cfg config.DeviceConfig
+	if err := h.storage.LoadDevice(&cfg); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			return nil // Nothing saved yet, so no lock either
+		}
+		return storageError(err)
+	}
+	if !cfg.Locked() {
+		return nil
+	}
+
+	return errorResponse(StatusLocked, ReasonLocked, NoOffset, "configuration locked")
+}
+
+// touch relocks a session that has been idle for UnlockIdleTimeout and
+// records the time of the current command.
+func (h *Handler) touch() {
+	now := h.now()
+	if h.unlocked && now.Sub(h.lastCommand) >= UnlockIdleTimeout {
+		h.unlocked = false
+	}
+	h.lastCommand = now
+}
+
+// EndSession relocks protected commands and drops a pending factory reset
+// challenge. The transport calls it when the host closes the port, so an
+// unlock never carries over to the next program that opens it.
+func (h *Handler) EndSession() {
+	h.unlocked = false
+	h.resetToken = nil
+}
+
+// ClearLock disables the write lock and clears the PIN, reporting whether
+// a lock was set. It is the physical-presence override for an owner who
+// lost the PIN, or whose pad was locked by another program: the firmware
+// calls it when the recovery button is held at boot, since every command
+// that could clear the lock is itself protected. The stored count of wrong
+// PINs is cleared too, ending any unlock backoff.
+func ClearLock(sm *storage.Manager) (bool, error) {
+	if err := sm.SetUnlockFailures(0); err != nil {
+		return false, err
+	}
+	var cfg config.DeviceConfig
+	if err := sm.LoadDevice(&cfg); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !cfg.Locked() && cfg.LockPIN == 0 {
+		return false, nil
+	}
+	cfg.Flags &^= config.DeviceFlagLocked
+	cfg.LockPIN = 0
+	return true, sm.SaveDevice(&cfg)
+}
+
+// keepLock copies the stored lock flag and PIN into cfg before it is
+// saved: the lock is only changed through CmdSetLock.
+func (h *Handler) keepLock(cfg *config.DeviceConfig) *Response {
+	var current config.DeviceConfig
+	if err := h.storage.LoadDevice(&current); err != nil && !errors.Is(err, storage.ErrDeviceNotFound) {
+		return storageError(err)
+	}
+	cfg.Flags = cfg.Flags&^config.DeviceFlagLocked | current.Flags&config.DeviceFlagLocked
+	cfg.LockPIN = current.LockPIN
+	return nil
+}
+
+// unlockBackoff returns how long CmdUnlock is refused after failures wrong
+// PINs: UnlockBackoff after MaxUnlockAttempts, doubling with every further
+// MaxUnlockAttempts up to MaxUnlockBackoff.
+func unlockBackoff(failures int) time.Duration {
+	d := UnlockBackoff
+	for n := failures/MaxUnlockAttempts - 1; n > 0 && d < MaxUnlockBackoff; n-- {
+		d *= 2
+	}
+	return min(d, MaxUnlockBackoff)
+}
+
+// loadFailures reads the stored count of wrong PINs once per boot. A pad
+// that restarted during a backoff starts the backoff over, as the time
+// already spent is unknown. A damaged count is taken as a full backoff.
+func (h *Handler) loadFailures(now time.Time) {
+	if h.failuresKnown {
+		return
+	}
+	h.failuresKnown = true
+	n, err := h.storage.UnlockFailures()
+	if err != nil {
+		n = MaxUnlockAttempts
+	}
+	h.failedUnlocks = n
+	if n >= MaxUnlockAttempts {
+		h.blockedUntil = now.Add(unlockBackoff(n))
+	}
+}
+
+// handleUnlock unlocks protected commands for this session, see
+// EndSession and UnlockIdleTimeout.
+// Payload: [PIN:2]
+// Wrong PINs are counted in storage and back off, see MaxUnlockAttempts.
+// The PIN has 16 bits. Past MaxUnlockBackoff a program on the PC gets 5
+// tries an hour, restarts included, so trying all of them takes about a
+// year and a half. Someone holding the pad does not need the PIN at all,
+// see ClearLock; the lock guards against other programs, not the owner.
+func (h *Handler) handleUnlock(payload []byte) *Response {
+	if len(payload) != 2 {
+		return lengthError(2)
+	}
+
+	now := h.now()
+	h.loadFailures(now)
+	if now.Before(h.blockedUntil) {
+		return errorResponse(StatusLocked, ReasonLocked, NoOffset, "too many attempts, retry later")
+	}
+
+	var cfg config.DeviceConfig
+	if err := h.storage.LoadDevice(&cfg); err != nil && !errors.Is(err, storage.ErrDeviceNotFound) {
+		return storageError(err)
+	}
+
+	if cfg.Locked() && binary.LittleEndian.Uint16(payload) != cfg.LockPIN {
+		// Counted before answering, so a reset right after does not lose
+		// the attempt
+		h.failedUnlocks++
+		if err := h.storage.SetUnlockFailures(h.failedUnlocks); err != nil {
+			h.blockedUntil = now.Add(unlockBackoff(max(h.failedUnlocks, MaxUnlockAttempts)))
+		} else if h.failedUnlocks%MaxUnlockAttempts == 0 {
+			h.blockedUntil = now.Add(unlockBackoff(h.failedUnlocks))
+		}
+		return errorResponse(StatusLocked, ReasonValue, 0, "wrong PIN")
+	}
+
+	if h.failedUnlocks > 0 {
+		if err := h.storage.SetUnlockFailures(0); err != nil {
+			return storageError(err)
+		}
+		h.failedUnlocks = 0
+	}
+	h.unlocked = true
+	return &Response{Status: StatusOK}
+}
+
+// handleSetLock enables or disables the write lock.
+// Payload: [Enable:1][PIN:2]
+// Enabling stores the PIN and locks immediately, including this session.
+// Disabling clears the stored PIN. Both require an unlocked session.
+func (h *Handler) handleSetLock(payload []byte) *Response {
+	if len(payload) != 3 {
+		return lengthError(3)
+	}
+	if payload[0] > 1 {
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "enable must be 0 or 1")
+	}
+
+	var cfg config.DeviceConfig
+	if err := h.storage.LoadDevice(&cfg); err != nil && !errors.Is(err, storage.ErrDeviceNotFound) {
+		return storageError(err)
+	}
+
+	if payload[0] == 1 {
+		cfg.Flags |= config.DeviceFlagLocked
+		cfg.LockPIN = binary.LittleEndian.Uint16(payload[1:])
+	} else {
+		cfg.Flags &^= config.DeviceFlagLocked
+		cfg.LockPIN = 0
+	}
+
+	if err := h.storage.SaveDevice(&cfg); err != nil {
+		return storageError(err)
+	}
+
+	h.unlocked = false
+	return &Response{Status: StatusOK}
+}
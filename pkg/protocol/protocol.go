@@ -14,11 +14,19 @@
 package protocol
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
+	"runtime"
+	"time"
 
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/buildinfo"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
 )
 
@@ -36,6 +44,19 @@ const (
 	CmdPing            = 0x08
 	CmdFactoryReset    = 0x09
 	CmdGetVersion      = 0x10
+	CmdListProfilesEx  = 0x11
+	CmdGetCapabilities = 0x12
+	CmdUnlock          = 0x13
+	CmdSetLock         = 0x14
+	CmdReboot          = 0x15
+	CmdGetDiagnostics  = 0x16
+	CmdUpdateBegin     = 0x17
+	CmdUpdateData      = 0x18
+	CmdUpdateVerify    = 0x19
+	CmdUpdateCommit    = 0x1A
+	CmdUpdateStatus    = 0x1B
+	CmdListHistory     = 0x1C
+	CmdRestoreHistory  = 0x1D
 	CmdDiscover        = 0x7F
 
 	// Response status codes (Device → PC)
@@ -47,6 +68,85 @@ const (
 	StatusNoSpace         = 0x05
 	StatusVersionMismatch = 0x06
 	StatusCRCError        = 0x07
+	StatusLocked          = 0x08
+	StatusCorrupted       = 0x09
+
+	// MaxPayload is the largest payload accepted in a single frame.
+	MaxPayload = 4096
+
+	// ProfileEntrySize is the size of one entry in a CmdListProfilesEx response.
+	ProfileEntrySize = 32
+
+	// Profile entry flags (CmdListProfilesEx)
+	EntryFlagActive     = 0x01 // Slot is DeviceConfig.ActiveProfile
+	EntryFlagUnreadable = 0x02 // Profile file exists but could not be loaded
+	EntryFlagCorrupt    = 0x04 // Profile failed its checksum; also unreadable
+
+	// HistoryEntrySize is the size of one entry in a CmdListHistory response.
+	HistoryEntrySize = 22
+
+	// History records (CmdListHistory, CmdRestoreHistory)
+	HistoryProfile = 0x00 // A profile slot
+	HistoryDevice  = 0x01 // The device config; the slot byte is ignored
+
+	// Capability TLV types (CmdGetCapabilities)
+	CapCommands           = 0x01 // Supported command codes, 1 byte each
+	CapMaxPayload         = 0x02 // Largest accepted payload (uint16)
+	CapMaxSlots           = 0x03 // Number of addressable profile slots (uint16)
+	CapBindingsPerProfile = 0x04 // Bindings per profile (uint8)
+	CapConfigVersion      = 0x05 // Config format version (uint16)
+	CapPersonalities      = 0x06 // HID report personalities, 1 byte each
+	CapProtectedCommands  = 0x07 // Commands refused while locked, 1 byte each
+	CapUpdateCapacity     = 0x08 // Largest firmware image accepted (uint32); absent without update support
+	CapHistoryDepth       = 0x09 // Generations kept per profile and device config (uint8)
+
+	// HID report personalities (CapPersonalities).
+	// Values match the report IDs in the composite HID descriptor.
+	PersonalityMouse    = 0x01
+	PersonalityKeyboard = 0x02
+	PersonalityConsumer = 0x03
+	PersonalityGamepad  = 0x04
+
+	// DeviceIdentifier is the CmdDiscover response prefix.
+	DeviceIdentifier = "tuffpad"
+
+	// IdentityFormatTLV requests the extended CmdGetVersion/CmdDiscover response.
+	IdentityFormatTLV = 0x01
+
+	// Identity TLV types (CmdGetVersion/CmdDiscover with IdentityFormatTLV)
+	InfoVersion       = 0x01 // Firmware version [Major:1][Minor:1][Patch:1]
+	InfoVersionString = 0x02 // Full semantic version string
+	InfoCommit        = 0x03 // Git commit
+	InfoBuildDate     = 0x04 // Build timestamp (RFC 3339)
+	InfoBoard         = 0x05 // Board/target name
+	InfoConfigVersion = 0x06 // Config format version (uint16)
+	InfoSerialNumber  = 0x07 // RP2040 flash unique ID
+	InfoBootMode      = 0x08 // Mode the device booted in (reboot.Mode, uint8)
+
+	// Diagnostics TLV types (CmdGetDiagnostics)
+	DiagUptime      = 0x01 // Milliseconds since boot (uint32)
+	DiagHeapAlloc   = 0x02 // Bytes of allocated heap objects (uint32)
+	DiagHeapSys     = 0x03 // Bytes of heap obtained from the system (uint32)
+	DiagGoroutines  = 0x04 // Number of goroutines (uint16)
+	DiagDamaged     = 0x05 // Records failing their checksum: [Device:1][Slot:1]...
+	DiagCounterBase = 0x10 // DiagCounterBase + metrics.Counter: counter value (uint32)
+
+	// ResetTokenSize is the size of the CmdFactoryReset confirmation token.
+	ResetTokenSize = 4
+
+	// ResetTokenTimeout is how long a factory reset token stays valid.
+	ResetTokenTimeout = 10 * time.Second
+
+	// Every MaxUnlockAttempts wrong PINs block CmdUnlock, for UnlockBackoff
+	// the first time and twice as long each further time, up to
+	// MaxUnlockBackoff. The count is stored, so restarting does not help.
+	MaxUnlockAttempts = 5
+	UnlockBackoff     = 30 * time.Second
+	MaxUnlockBackoff  = time.Hour
+
+	// UnlockIdleTimeout relocks an unlocked session that sent no command
+	// for this long.
+	UnlockIdleTimeout = 5 * time.Minute
 )
 
 var (
@@ -57,14 +157,139 @@ var (
 
 // Handler processes protocol commands.
 type Handler struct {
-	storage *storage.Manager
+	storage  *storage.Manager
+	queue    *storage.Queue // Deferred runtime saves; nil if unused
+	commands []command
+	serial   []byte
+
+	// Reboot support. A requested reboot is held until the transport has
+	// sent the response, see RebootPending.
+	rebooter      reboot.Rebooter
+	rebootPending bool
+	rebootMode    reboot.Mode
+	bootMode      reboot.Mode
+
+	// Firmware update support; nil if the build cannot install images
+	updater *dfu.Updater
+
+	// Write lock state. unlocked lasts until the session ends, the host
+	// goes idle for UnlockIdleTimeout, the lock is re-enabled or the device
+	// restarts; the lock setting itself lives in DeviceConfig.
+	unlocked      bool
+	lastCommand   time.Time
+	failedUnlocks int  // Wrong PINs since the last unlock, also in storage
+	failuresKnown bool // failedUnlocks has been loaded from storage
+	blockedUntil  time.Time
+
+	// Pending factory reset challenge
+	resetToken   []byte
+	resetExpires time.Time
+
+	now func() time.Time
 }
 
+// command is one entry in the handler's command table.
+// Handle dispatches through this table and CmdGetCapabilities reports it,
+// so the advertised command set always matches what is implemented.
+type command struct {
+	code   uint8
+	handle func(payload []byte) *Response
+	flags  uint8
+}
+
+// Command flags
+const (
+	// cmdProtected commands write or erase configuration and are refused
+	// with StatusLocked while the write lock is engaged.
+	cmdProtected = 0x01
+
+	// cmdStored commands read or write stored records, so the save queue
+	// is written out first. Other commands leave it alone, so a PC app
+	// polling status does not defeat the queue's coalescing.
+	cmdStored = 0x02
+)
+
 // NewHandler creates a new protocol handler.
 func NewHandler(sm *storage.Manager) *Handler {
-	return &Handler{
+	h := &Handler{
 		storage: sm,
+		now:     time.Now,
+	}
+	h.commands = []command{
+		{CmdGetDeviceConfig, h.handleGetDeviceConfig, cmdStored},
+		{CmdSetDeviceConfig, h.handleSetDeviceConfig, cmdProtected | cmdStored},
+		{CmdGetProfile, h.handleGetProfile, cmdStored},
+		{CmdSetProfile, h.handleSetProfile, cmdProtected | cmdStored},
+		{CmdDeleteProfile, h.handleDeleteProfile, cmdProtected | cmdStored},
+		{CmdListProfiles, h.handleListProfiles, cmdStored},
+		{CmdGetStorageStats, h.handleGetStorageStats, cmdStored},
+		{CmdPing, h.handlePing, 0},
+		{CmdFactoryReset, h.handleFactoryReset, cmdProtected | cmdStored},
+		{CmdGetVersion, h.handleGetVersion, 0},
+		{CmdListProfilesEx, h.handleListProfilesEx, cmdStored},
+		{CmdGetCapabilities, h.handleGetCapabilities, 0},
+		{CmdUnlock, h.handleUnlock, 0},
+		{CmdSetLock, h.handleSetLock, cmdProtected | cmdStored},
+		{CmdReboot, h.handleReboot, cmdProtected},
+		{CmdGetDiagnostics, h.handleGetDiagnostics, 0},
+		{CmdUpdateBegin, h.handleUpdateBegin, cmdProtected},
+		{CmdUpdateData, h.handleUpdateData, cmdProtected},
+		{CmdUpdateVerify, h.handleUpdateVerify, cmdProtected},
+		{CmdUpdateCommit, h.handleUpdateCommit, cmdProtected},
+		{CmdUpdateStatus, h.handleUpdateStatus, 0},
+		{CmdListHistory, h.handleListHistory, cmdStored},
+		{CmdRestoreHistory, h.handleRestoreHistory, cmdProtected | cmdStored},
+		{CmdDiscover, h.handleDiscover, 0},
+	}
+	return h
+}
+
+// SetSerialNumber sets the device serial number reported by CmdGetVersion
+// and CmdDiscover. On the RP2040 this is the flash chip's unique ID.
+func (h *Handler) SetSerialNumber(serial []byte) {
+	h.serial = serial
+}
+
+// SetQueue makes the handler write the queue's pending saves before each
+// command that reads or writes stored records, so the PC never reads a
+// stale record or has its write replaced by an older pending one, and
+// before rebooting.
+func (h *Handler) SetQueue(q *storage.Queue) {
+	h.queue = q
+}
+
+// SetRebooter enables CmdReboot. Without a rebooter the command fails.
+func (h *Handler) SetRebooter(r reboot.Rebooter) {
+	h.rebooter = r
+}
+
+// SetUpdater enables firmware updates over the protocol. Committing an
+// update also needs a rebooter, see SetRebooter.
+func (h *Handler) SetUpdater(u *dfu.Updater) {
+	h.updater = u
+}
+
+// SetBootMode records the mode the device booted in, reported by
+// CmdGetVersion and CmdDiscover.
+func (h *Handler) SetBootMode(mode reboot.Mode) {
+	h.bootMode = mode
+}
+
+// RebootPending reports whether the last command requested a reboot.
+// The transport must send the response, flush it and then call Reboot.
+func (h *Handler) RebootPending() bool {
+	return h.rebootPending
+}
+
+// Reboot performs the pending reboot. On hardware it does not return.
+// Pending saves are written first; one that fails is lost.
+func (h *Handler) Reboot() error {
+	if !h.rebootPending {
+		return nil
 	}
+	h.rebootPending = false
+	h.flushQueue()
+	return h.rebooter.Reboot(h.rebootMode)
 }
 
 // Frame represents a protocol frame.
@@ -100,7 +325,7 @@ func ReadFrame(r io.Reader) (*Frame, error) {
 	length := binary.LittleEndian.Uint16(header[1:])
 
 	// Sanity check on length
-	if length > 4096 {
+	if length > MaxPayload {
 		return nil, ErrInvalidFrame
 	}
 
@@ -132,6 +357,18 @@ func ReadFrame(r io.Reader) (*Frame, error) {
 	}, nil
 }
 
+// ReadResponse reads and validates a response frame (for the PC side).
+func ReadResponse(r io.Reader) (*Response, error) {
+	frame, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		Status:  frame.Cmd,
+		Payload: frame.Payload,
+	}, nil
+}
+
 // WriteResponse writes a response frame to the writer.
 func WriteResponse(w io.Writer, resp *Response) error {
 	// Calculate total size
@@ -160,8 +397,11 @@ func WriteResponse(w io.Writer, resp *Response) error {
 	binary.LittleEndian.PutUint16(crcBytes, crc)
 	buf = append(buf, crcBytes...)
 
-	_, err := w.Write(buf)
-	return err
+	if _, err := w.Write(buf); err != nil {
+		metrics.Inc(metrics.ResponseWriteErrors)
+		return err
+	}
+	return nil
 }
 
 // WriteFrame writes a request frame (for testing/PC side).
@@ -197,31 +437,30 @@ func WriteFrame(w io.Writer, frame *Frame) error {
 
 // Handle processes a command frame and returns a response.
 func (h *Handler) Handle(frame *Frame) *Response {
-	switch frame.Cmd {
-	case CmdPing:
-		return h.handlePing(frame.Payload)
-	case CmdGetDeviceConfig:
-		return h.handleGetDeviceConfig()
-	case CmdSetDeviceConfig:
-		return h.handleSetDeviceConfig(frame.Payload)
-	case CmdGetProfile:
-		return h.handleGetProfile(frame.Payload)
-	case CmdSetProfile:
-		return h.handleSetProfile(frame.Payload)
-	case CmdDeleteProfile:
-		return h.handleDeleteProfile(frame.Payload)
-	case CmdListProfiles:
-		return h.handleListProfiles()
-	case CmdGetStorageStats:
-		return h.handleGetStorageStats()
-	case CmdFactoryReset:
-		return h.handleFactoryReset()
-	case CmdGetVersion:
-		return h.handleGetVersion()
-	case CmdDiscover:
-		return h.handleDiscover()
-	default:
-		return &Response{Status: StatusInvalidCmd}
+	h.touch()
+	for i := range h.commands {
+		c := &h.commands[i]
+		if c.code != frame.Cmd {
+			continue
+		}
+		if c.flags&cmdStored != 0 {
+			h.flushQueue()
+		}
+		if c.flags&cmdProtected != 0 {
+			if resp := h.checkLock(); resp != nil {
+				return resp
+			}
+		}
+		return c.handle(frame.Payload)
+	}
+	return &Response{Status: StatusInvalidCmd}
+}
+
+// flushQueue writes the queue's pending saves. Errors are not reported:
+// they are counted by storage, and the saves stay queued.
+func (h *Handler) flushQueue() {
+	if h.queue != nil {
+		h.queue.Flush()
 	}
 }
 
@@ -234,18 +473,18 @@ func (h *Handler) handlePing(payload []byte) *Response {
 }
 
 // handleGetDeviceConfig returns the current device configuration.
-func (h *Handler) handleGetDeviceConfig() *Response {
+func (h *Handler) handleGetDeviceConfig(_ []byte) *Response {
 	var cfg config.DeviceConfig
 	if err := h.storage.LoadDevice(&cfg); err != nil {
-		if err == storage.ErrProfileNotFound {
-			return &Response{Status: StatusNotFound}
-		}
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
+	// Never reveal the PIN
+	cfg.LockPIN = 0
+
 	data, err := cfg.MarshalBinary()
 	if err != nil {
-		return &Response{Status: StatusError}
+		return errorResponse(StatusError, ReasonEncoding, NoOffset, err.Error())
 	}
 
 	return &Response{
@@ -258,19 +497,22 @@ func (h *Handler) handleGetDeviceConfig() *Response {
 // Payload: [DeviceConfig:12 bytes]
 func (h *Handler) handleSetDeviceConfig(payload []byte) *Response {
 	if len(payload) != 12 {
-		return &Response{Status: StatusInvalidData}
+		return lengthError(12)
 	}
 
 	var cfg config.DeviceConfig
 	if err := cfg.UnmarshalBinary(payload); err != nil {
-		return &Response{Status: StatusInvalidData}
+		return errorResponse(StatusInvalidData, ReasonEncoding, NoOffset, err.Error())
+	}
+	if ps := cfg.Validate(); ps != nil {
+		return validationError(ps, 0)
 	}
 
+	if resp := h.keepLock(&cfg); resp != nil {
+		return resp
+	}
 	if err := h.storage.SaveDevice(&cfg); err != nil {
-		if err == storage.ErrFlashFull {
-			return &Response{Status: StatusNoSpace}
-		}
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
 	return &Response{Status: StatusOK}
@@ -280,22 +522,19 @@ func (h *Handler) handleSetDeviceConfig(payload []byte) *Response {
 // Payload: [Slot:1 byte]
 func (h *Handler) handleGetProfile(payload []byte) *Response {
 	if len(payload) != 1 {
-		return &Response{Status: StatusInvalidData}
+		return lengthError(1)
 	}
 
 	slot := payload[0]
 
 	var profile config.Profile
 	if err := h.storage.LoadProfile(slot, &profile); err != nil {
-		if err == storage.ErrProfileNotFound {
-			return &Response{Status: StatusNotFound}
-		}
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
 	data, err := profile.MarshalBinary()
 	if err != nil {
-		return &Response{Status: StatusError}
+		return errorResponse(StatusError, ReasonEncoding, NoOffset, err.Error())
 	}
 
 	return &Response{
@@ -308,26 +547,30 @@ func (h *Handler) handleGetProfile(payload []byte) *Response {
 // Payload: [Slot:1 byte][Profile:286 bytes]
 func (h *Handler) handleSetProfile(payload []byte) *Response {
 	if len(payload) != 287 {
-		return &Response{Status: StatusInvalidData}
+		return lengthError(287)
 	}
 
 	slot := payload[0]
 
 	var profile config.Profile
 	if err := profile.UnmarshalBinary(payload[1:]); err != nil {
-		return &Response{Status: StatusInvalidData}
+		return errorResponse(StatusInvalidData, ReasonEncoding, NoOffset, err.Error())
 	}
 
-	// Check version
+	// Check version (offset 1: the version is the first profile field).
+	// Older profiles, e.g. from backups, are upgraded like stored ones.
 	if profile.Version != config.CurrentVersion {
-		return &Response{Status: StatusVersionMismatch}
+		data, err := config.Migrations.Migrate(config.RecordProfile, payload[1:])
+		if err != nil || profile.UnmarshalBinary(data) != nil {
+			return errorResponse(StatusVersionMismatch, ReasonVersion, 1, "unsupported profile version")
+		}
+	}
+	if ps := profile.Validate(); ps != nil {
+		return validationError(ps, 1)
 	}
 
 	if err := h.storage.SaveProfile(slot, &profile); err != nil {
-		if err == storage.ErrFlashFull {
-			return &Response{Status: StatusNoSpace}
-		}
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
 	return &Response{Status: StatusOK}
@@ -337,13 +580,13 @@ func (h *Handler) handleSetProfile(payload []byte) *Response {
 // Payload: [Slot:1 byte]
 func (h *Handler) handleDeleteProfile(payload []byte) *Response {
 	if len(payload) != 1 {
-		return &Response{Status: StatusInvalidData}
+		return lengthError(1)
 	}
 
 	slot := payload[0]
 
 	if err := h.storage.DeleteProfile(slot); err != nil {
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
 	return &Response{Status: StatusOK}
@@ -351,10 +594,10 @@ func (h *Handler) handleDeleteProfile(payload []byte) *Response {
 
 // handleListProfiles returns all occupied profile slots.
 // Response: [Count:1 byte][Slot1:1 byte][Slot2:1 byte]...
-func (h *Handler) handleListProfiles() *Response {
+func (h *Handler) handleListProfiles(_ []byte) *Response {
 	slots, err := h.storage.ListProfiles()
 	if err != nil {
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
 	payload := make([]byte, 1+len(slots))
@@ -369,19 +612,93 @@ func (h *Handler) handleListProfiles() *Response {
 	}
 }
 
+// handleListProfilesEx returns one page of occupied slots with their metadata.
+// Payload: [] or [Offset:1] (index into the sorted slot list, default 0)
+// Response: [Total:2][Offset:1][Count:1][Entry:32]...
+// Entry: [Slot:1][EntryFlags:1][BindingCount:1][RGBPattern:1][Flags:4][RGBColor:4][FileSize:4][Name:16]
+// If Offset+Count < Total, request the next page with Offset+Count.
+func (h *Handler) handleListProfilesEx(payload []byte) *Response {
+	if len(payload) > 1 {
+		return lengthError(1)
+	}
+	offset := 0
+	if len(payload) == 1 {
+		offset = int(payload[0])
+	}
+
+	slots, err := h.storage.ListProfiles()
+	if err != nil {
+		return storageError(err)
+	}
+	if offset > len(slots) {
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "offset beyond profile count")
+	}
+
+	// The active slot is only known if a device config has been saved
+	active := -1
+	var cfg config.DeviceConfig
+	if err := h.storage.LoadDevice(&cfg); err == nil {
+		active = int(cfg.ActiveProfile)
+	}
+
+	count := len(slots) - offset
+	if perPage := (MaxPayload - 4) / ProfileEntrySize; count > perPage {
+		count = perPage
+	}
+
+	resp := make([]byte, 4+count*ProfileEntrySize)
+	binary.LittleEndian.PutUint16(resp[0:], uint16(len(slots)))
+	resp[2] = uint8(offset)
+	resp[3] = uint8(count)
+
+	for i, slot := range slots[offset : offset+count] {
+		entry := resp[4+i*ProfileEntrySize : 4+(i+1)*ProfileEntrySize]
+		entry[0] = slot
+		if int(slot) == active {
+			entry[1] |= EntryFlagActive
+		}
+
+		size, err := h.storage.ProfileSize(slot)
+		if err == nil {
+			binary.LittleEndian.PutUint32(entry[12:], uint32(size))
+		}
+
+		var profile config.Profile
+		if err := h.storage.LoadProfile(slot, &profile); err != nil {
+			entry[1] |= EntryFlagUnreadable
+			if errors.Is(err, storage.ErrRecordCorrupt) {
+				entry[1] |= EntryFlagCorrupt
+			}
+			continue
+		}
+		entry[2] = profile.BindingCount
+		entry[3] = profile.RGBPattern
+		binary.LittleEndian.PutUint32(entry[4:], profile.Flags)
+		binary.LittleEndian.PutUint32(entry[8:], profile.RGBColor)
+		copy(entry[16:], profile.GetName())
+	}
+
+	return &Response{
+		Status:  StatusOK,
+		Payload: resp,
+	}
+}
+
 // handleGetStorageStats returns storage statistics.
-// Response: [Total:4][Used:4][Free:4][ProfileCount:1]
-func (h *Handler) handleGetStorageStats() *Response {
+// Response: [Total:4][Used:4][Free:4][ProfileCount:1][BlockSize:4][BlockCount:4]
+func (h *Handler) handleGetStorageStats(_ []byte) *Response {
 	stats, err := h.storage.GetStats()
 	if err != nil {
-		return &Response{Status: StatusError}
+		return storageError(err)
 	}
 
-	payload := make([]byte, 13)
+	payload := make([]byte, 21)
 	binary.LittleEndian.PutUint32(payload[0:], uint32(stats.TotalSpace))
 	binary.LittleEndian.PutUint32(payload[4:], uint32(stats.UsedSpace))
 	binary.LittleEndian.PutUint32(payload[8:], uint32(stats.FreeSpace))
 	payload[12] = uint8(stats.ProfileCount)
+	binary.LittleEndian.PutUint32(payload[13:], uint32(stats.BlockSize))
+	binary.LittleEndian.PutUint32(payload[17:], uint32(stats.BlockCount))
 
 	return &Response{
 		Status:  StatusOK,
@@ -389,38 +706,207 @@ func (h *Handler) handleGetStorageStats() *Response {
 	}
 }
 
-// handleFactoryReset wipes all configuration.
-func (h *Handler) handleFactoryReset() *Response {
-	if err := h.storage.ForceWipe(); err != nil {
-		return &Response{Status: StatusError}
+// handleFactoryReset wipes all configuration in two steps.
+// Payload: [] requests a challenge; Response: [Token:4]
+// Payload: [Token:4] confirms within ResetTokenTimeout and wipes.
+// A token is good for one confirmation attempt only.
+func (h *Handler) handleFactoryReset(payload []byte) *Response {
+	switch len(payload) {
+	case 0:
+		token := make([]byte, ResetTokenSize)
+		if _, err := rand.Read(token); err != nil {
+			return errorResponse(StatusError, ReasonUnspecified, NoOffset, "no random source")
+		}
+		h.resetToken = token
+		h.resetExpires = h.now().Add(ResetTokenTimeout)
+		return &Response{
+			Status:  StatusOK,
+			Payload: token,
+		}
+
+	case ResetTokenSize:
+		token := h.resetToken
+		h.resetToken = nil
+		if token == nil || h.now().After(h.resetExpires) || !bytes.Equal(payload, token) {
+			return errorResponse(StatusInvalidData, ReasonChallenge, 0, "invalid or expired token")
+		}
+
+		if err := h.storage.ForceWipe(); err != nil {
+			return storageError(err)
+		}
+		h.unlocked = false
+		return &Response{Status: StatusOK}
+
+	default:
+		return lengthError(ResetTokenSize)
+	}
+}
+
+// handleReboot schedules a reboot once the response has been sent.
+// Payload: [Mode:1] (0 = normal, 1 = USB bootloader, 2 = safe mode)
+func (h *Handler) handleReboot(payload []byte) *Response {
+	if len(payload) != 1 {
+		return lengthError(1)
+	}
+	mode := reboot.Mode(payload[0])
+	if !mode.Valid() {
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "unknown reboot mode")
+	}
+	if h.rebooter == nil {
+		return errorResponse(StatusError, ReasonUnsupported, NoOffset, "reboot not supported")
 	}
+
+	h.rebootMode = mode
+	h.rebootPending = true
 	return &Response{Status: StatusOK}
 }
 
 // handleGetVersion returns firmware and config version info.
+// Payload: [] or [Format:1]
 // Response: [FirmwareVersionMajor:1][FirmwareVersionMinor:1][ConfigVersion:2]
-func (h *Handler) handleGetVersion() *Response {
-	// TODO: Get firmware version from build info
-	payload := make([]byte, 4)
-	payload[0] = 0 // Firmware major
-	payload[1] = 1 // Firmware minor
-	binary.LittleEndian.PutUint16(payload[2:], config.CurrentVersion)
+// With Format = IdentityFormatTLV the build identity TLVs are appended.
+func (h *Handler) handleGetVersion(payload []byte) *Response {
+	extended, ok := identityRequested(payload)
+	if !ok {
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "unknown identity format")
+	}
+
+	major, minor, _ := buildinfo.Semver()
+	resp := make([]byte, 4)
+	resp[0] = major
+	resp[1] = minor
+	binary.LittleEndian.PutUint16(resp[2:], config.CurrentVersion)
+
+	if extended {
+		resp = h.appendIdentity(resp)
+	}
 
 	return &Response{
 		Status:  StatusOK,
-		Payload: payload,
+		Payload: resp,
+	}
+}
+
+// handleGetCapabilities describes what this firmware supports.
+// Response: a sequence of [Type:1][Len:1][Value:Len] entries (see Cap* types).
+// Clients must skip entries with unknown types.
+func (h *Handler) handleGetCapabilities(_ []byte) *Response {
+	cmds := make([]byte, len(h.commands))
+	for i := range h.commands {
+		cmds[i] = h.commands[i].code
+	}
+
+	var buf []byte
+	buf = AppendTLV(buf, CapCommands, cmds)
+	buf = appendTLVUint16(buf, CapMaxPayload, MaxPayload)
+	buf = appendTLVUint16(buf, CapMaxSlots, 256)
+	buf = AppendTLV(buf, CapBindingsPerProfile, []byte{config.MaxBindings})
+	buf = appendTLVUint16(buf, CapConfigVersion, config.CurrentVersion)
+	buf = AppendTLV(buf, CapPersonalities, []byte{
+		PersonalityMouse,
+		PersonalityKeyboard,
+		PersonalityConsumer,
+		PersonalityGamepad,
+	})
+
+	var protected []byte
+	for i := range h.commands {
+		if h.commands[i].flags&cmdProtected != 0 {
+			protected = append(protected, h.commands[i].code)
+		}
+	}
+	buf = AppendTLV(buf, CapProtectedCommands, protected)
+	if h.updater != nil {
+		buf = appendTLVUint32(buf, CapUpdateCapacity, uint32(h.updater.Capacity()))
+	}
+	buf = AppendTLV(buf, CapHistoryDepth, []byte{uint8(min(h.storage.HistoryDepth(), 255))})
+
+	return &Response{
+		Status:  StatusOK,
+		Payload: buf,
+	}
+}
+
+// handleGetDiagnostics reports uptime, memory use, damaged records and
+// event counters.
+// Response: a sequence of [Type:1][Len:1][Value:Len] entries (see Diag* types).
+// Clients must skip entries with unknown types.
+func (h *Handler) handleGetDiagnostics(_ []byte) *Response {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var buf []byte
+	buf = appendTLVUint32(buf, DiagUptime, uint32(metrics.Uptime()/time.Millisecond))
+	buf = appendTLVUint32(buf, DiagHeapAlloc, uint32(mem.HeapAlloc))
+	buf = appendTLVUint32(buf, DiagHeapSys, uint32(mem.HeapSys))
+	buf = appendTLVUint16(buf, DiagGoroutines, uint16(runtime.NumGoroutine()))
+	damage := h.storage.Damage()
+	damaged := []byte{0}
+	if damage.Device {
+		damaged[0] = 1
+	}
+	buf = AppendTLV(buf, DiagDamaged, append(damaged, damage.Profiles...))
+	for c := metrics.Counter(0); c < metrics.NumCounters; c++ {
+		buf = appendTLVUint32(buf, DiagCounterBase+uint8(c), metrics.Get(c))
+	}
+
+	return &Response{
+		Status:  StatusOK,
+		Payload: buf,
 	}
 }
 
 // handleDiscover returns device identifier for PC app enumeration.
+// Payload: [] or [Format:1]
 // Response: ["tuffpad"] (7 bytes)
-func (h *Handler) handleDiscover() *Response {
+// With Format = IdentityFormatTLV the build identity TLVs follow the identifier,
+// so several pads on one PC can be told apart by serial number.
+func (h *Handler) handleDiscover(payload []byte) *Response {
+	extended, ok := identityRequested(payload)
+	if !ok {
+		return errorResponse(StatusInvalidData, ReasonValue, 0, "unknown identity format")
+	}
+
+	resp := []byte(DeviceIdentifier)
+	if extended {
+		resp = h.appendIdentity(resp)
+	}
+
 	return &Response{
 		Status:  StatusOK,
-		Payload: []byte("tuffpad"),
+		Payload: resp,
 	}
 }
 
+// identityRequested parses the optional [Format:1] payload of
+// CmdGetVersion and CmdDiscover. An empty payload keeps the legacy response.
+func identityRequested(payload []byte) (extended, ok bool) {
+	switch {
+	case len(payload) == 0:
+		return false, true
+	case len(payload) == 1 && payload[0] == IdentityFormatTLV:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// appendIdentity appends the build identity TLVs to buf.
+func (h *Handler) appendIdentity(buf []byte) []byte {
+	major, minor, patch := buildinfo.Semver()
+	buf = AppendTLV(buf, InfoVersion, []byte{major, minor, patch})
+	buf = AppendTLV(buf, InfoVersionString, []byte(buildinfo.Version))
+	buf = AppendTLV(buf, InfoCommit, []byte(buildinfo.Commit))
+	buf = AppendTLV(buf, InfoBuildDate, []byte(buildinfo.Date))
+	buf = AppendTLV(buf, InfoBoard, []byte(buildinfo.Board))
+	buf = appendTLVUint16(buf, InfoConfigVersion, config.CurrentVersion)
+	if len(h.serial) > 0 {
+		buf = AppendTLV(buf, InfoSerialNumber, h.serial)
+	}
+	buf = AppendTLV(buf, InfoBootMode, []byte{uint8(h.bootMode)})
+	return buf
+}
+
 // calcCRC calculates CRC16-CCITT.
 // Polynomial: 0x1021, Initial: 0xFFFF
 func calcCRC(data []byte) uint16 {
@@ -3,9 +3,14 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
 
 	"tinygo.org/x/tinyfs"
@@ -73,7 +78,6 @@ func TestGetSetDeviceConfig(t *testing.T) {
 
 	// Set device config
 	deviceCfg := config.DeviceConfig{
-		Flags:         0xDEADBEEF,
 		ActiveProfile: 3,
 		Brightness:    200,
 		DebounceMs:    10,
@@ -113,6 +117,9 @@ func TestGetSetDeviceConfig(t *testing.T) {
 	if loaded.Brightness != deviceCfg.Brightness {
 		t.Errorf("Brightness: expected %d, got %d", deviceCfg.Brightness, loaded.Brightness)
 	}
+	if loaded.DebounceMs != deviceCfg.DebounceMs || loaded.Flags != deviceCfg.Flags {
+		t.Errorf("Unexpected config: %+v", loaded)
+	}
 }
 
 func TestGetSetProfile(t *testing.T) {
@@ -123,7 +130,7 @@ func TestGetSetProfile(t *testing.T) {
 	slot := uint8(5)
 	profile := config.Profile{
 		Version:      config.CurrentVersion, // Must match current version
-		Flags:        0x12345678,
+		Flags:        config.ProfileFlagKBMode,
 		RGBColor:     0x00FF00,
 		RGBPattern:   2,
 		BindingCount: 1,
@@ -270,15 +277,17 @@ func TestStorageStats(t *testing.T) {
 		t.Fatalf("GetStorageStats failed: status 0x%x", resp.Status)
 	}
 
-	// Verify response format: [Total:4][Used:4][Free:4][ProfileCount:1]
-	if len(resp.Payload) != 13 {
-		t.Errorf("Expected 13 bytes, got %d", len(resp.Payload))
+	// Verify response format: [Total:4][Used:4][Free:4][ProfileCount:1][BlockSize:4][BlockCount:4]
+	if len(resp.Payload) != 21 {
+		t.Fatalf("Expected 21 bytes, got %d", len(resp.Payload))
 	}
 
 	total := binary.LittleEndian.Uint32(resp.Payload[0:4])
 	used := binary.LittleEndian.Uint32(resp.Payload[4:8])
 	free := binary.LittleEndian.Uint32(resp.Payload[8:12])
 	profileCount := resp.Payload[12]
+	blockSize := binary.LittleEndian.Uint32(resp.Payload[13:17])
+	blockCount := binary.LittleEndian.Uint32(resp.Payload[17:21])
 
 	if total == 0 {
 		t.Error("Total space should not be zero")
@@ -292,6 +301,9 @@ func TestStorageStats(t *testing.T) {
 	if profileCount != 0 {
 		t.Errorf("Expected 0 profiles initially, got %d", profileCount)
 	}
+	if blockSize == 0 || total != blockSize*blockCount || used+free != total || used%blockSize != 0 {
+		t.Errorf("Inconsistent stats: total %d used %d free %d, %d blocks of %d", total, used, free, blockCount, blockSize)
+	}
 }
 
 func TestFactoryReset(t *testing.T) {
@@ -303,12 +315,12 @@ func TestFactoryReset(t *testing.T) {
 	data, _ := deviceCfg.MarshalBinary()
 	handler.Handle(&Frame{Cmd: CmdSetDeviceConfig, Payload: data})
 
-	profile := config.Profile{}
+	profile := config.Profile{Version: config.CurrentVersion}
 	profile.SetName("Profile")
 	profileData, _ := profile.MarshalBinary()
 	handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{0}, profileData...)})
 
-	// Factory reset
+	// Factory reset: request a challenge token
 	resetFrame := &Frame{
 		Cmd:     CmdFactoryReset,
 		Payload: nil,
@@ -316,11 +328,26 @@ func TestFactoryReset(t *testing.T) {
 
 	resetResp := handler.Handle(resetFrame)
 	if resetResp.Status != StatusOK {
-		t.Errorf("FactoryReset failed: status 0x%x", resetResp.Status)
+		t.Fatalf("FactoryReset challenge failed: status 0x%x", resetResp.Status)
+	}
+	if len(resetResp.Payload) != ResetTokenSize {
+		t.Fatalf("Expected %d byte token, got %d", ResetTokenSize, len(resetResp.Payload))
 	}
 
-	// Verify profiles are gone
+	// The challenge alone must not wipe anything
 	listResp := handler.Handle(&Frame{Cmd: CmdListProfiles})
+	if listResp.Payload[0] != 1 {
+		t.Fatalf("Expected 1 profile before confirming, got %d", listResp.Payload[0])
+	}
+
+	// Confirm with the token
+	confirmResp := handler.Handle(&Frame{Cmd: CmdFactoryReset, Payload: resetResp.Payload})
+	if confirmResp.Status != StatusOK {
+		t.Errorf("FactoryReset confirm failed: status 0x%x", confirmResp.Status)
+	}
+
+	// Verify profiles are gone
+	listResp = handler.Handle(&Frame{Cmd: CmdListProfiles})
 	if listResp.Payload[0] != 0 {
 		t.Error("Expected 0 profiles after reset")
 	}
@@ -432,6 +459,18 @@ func TestProfileVersionMismatch(t *testing.T) {
 	if resp.Status != StatusVersionMismatch {
 		t.Errorf("Expected StatusVersionMismatch, got 0x%x", resp.Status)
 	}
+
+	// An older version is upgraded
+	profile.Version = 1
+	profileData, _ = profile.MarshalBinary()
+	resp = handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{0}, profileData...)})
+	if resp.Status != StatusOK {
+		t.Fatalf("Version 1 profile refused: status 0x%x", resp.Status)
+	}
+	var stored config.Profile
+	if err := mgr.LoadProfile(0, &stored); err != nil || stored.Version != config.CurrentVersion || stored.GetName() != "WrongVersion" {
+		t.Errorf("Stored %+v, %v", stored, err)
+	}
 }
 
 func TestNotFound(t *testing.T) {
@@ -470,3 +509,785 @@ func TestDiscoverCommand(t *testing.T) {
 		t.Errorf("Expected payload '%s', got '%s'", expected, string(resp.Payload))
 	}
 }
+
+func TestListProfilesEx(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	for _, slot := range []uint8{9, 1, 4} {
+		profile := config.Profile{
+			Version:      config.CurrentVersion,
+			Flags:        0x01,
+			RGBColor:     0x112233,
+			RGBPattern:   3,
+			BindingCount: slot,
+		}
+		profile.SetName("Slot")
+		data, _ := profile.MarshalBinary()
+		resp := handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{slot}, data...)})
+		if resp.Status != StatusOK {
+			t.Fatalf("Failed to create profile %d: status 0x%x", slot, resp.Status)
+		}
+	}
+
+	deviceCfg := config.DeviceConfig{ActiveProfile: 4}
+	data, _ := deviceCfg.MarshalBinary()
+	handler.Handle(&Frame{Cmd: CmdSetDeviceConfig, Payload: data})
+
+	resp := handler.Handle(&Frame{Cmd: CmdListProfilesEx})
+	if resp.Status != StatusOK {
+		t.Fatalf("ListProfilesEx failed: status 0x%x", resp.Status)
+	}
+
+	// Verify header: [Total:2][Offset:1][Count:1]
+	total := binary.LittleEndian.Uint16(resp.Payload[0:2])
+	if total != 3 || resp.Payload[2] != 0 || resp.Payload[3] != 3 {
+		t.Fatalf("Unexpected header: %v", resp.Payload[:4])
+	}
+	if len(resp.Payload) != 4+3*ProfileEntrySize {
+		t.Fatalf("Expected payload length %d, got %d", 4+3*ProfileEntrySize, len(resp.Payload))
+	}
+
+	// Entries are sorted by slot
+	for i, slot := range []uint8{1, 4, 9} {
+		entry := resp.Payload[4+i*ProfileEntrySize:]
+		if entry[0] != slot {
+			t.Errorf("Entry %d: expected slot %d, got %d", i, slot, entry[0])
+		}
+		if active := entry[1]&EntryFlagActive != 0; active != (slot == 4) {
+			t.Errorf("Entry %d: unexpected active flag %v", i, active)
+		}
+		if entry[2] != slot {
+			t.Errorf("Entry %d: expected binding count %d, got %d", i, slot, entry[2])
+		}
+		if entry[3] != 3 {
+			t.Errorf("Entry %d: expected RGB pattern 3, got %d", i, entry[3])
+		}
+		if color := binary.LittleEndian.Uint32(entry[8:]); color != 0x112233 {
+			t.Errorf("Entry %d: expected RGB color 0x112233, got 0x%x", i, color)
+		}
+		if size := binary.LittleEndian.Uint32(entry[12:]); size != 298 {
+			t.Errorf("Entry %d: expected file size 298 (profile and envelope), got %d", i, size)
+		}
+		if name := string(bytes.TrimRight(entry[16:32], "\x00")); name != "Slot" {
+			t.Errorf("Entry %d: expected name 'Slot', got '%s'", i, name)
+		}
+	}
+
+	// Request the second page
+	resp = handler.Handle(&Frame{Cmd: CmdListProfilesEx, Payload: []byte{2}})
+	if resp.Status != StatusOK {
+		t.Fatalf("ListProfilesEx offset 2 failed: status 0x%x", resp.Status)
+	}
+	if resp.Payload[2] != 2 || resp.Payload[3] != 1 || resp.Payload[4] != 9 {
+		t.Errorf("Unexpected second page: %v", resp.Payload[:5])
+	}
+
+	// Offset beyond the list is rejected
+	resp = handler.Handle(&Frame{Cmd: CmdListProfilesEx, Payload: []byte{4}})
+	if resp.Status != StatusInvalidData {
+		t.Errorf("Expected StatusInvalidData, got 0x%x", resp.Status)
+	}
+}
+
+func TestListProfilesExPagination(t *testing.T) {
+	// Larger device so that more than one page of profiles fits
+	mgr, err := storage.New(tinyfs.NewMemoryDevice(256, 4096, 512), true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer mgr.Close()
+	handler := NewHandler(mgr)
+
+	perPage := (MaxPayload - 4) / ProfileEntrySize
+	for slot := 0; slot < perPage+3; slot++ {
+		profile := config.Profile{Version: config.CurrentVersion}
+		data, _ := profile.MarshalBinary()
+		resp := handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{uint8(slot)}, data...)})
+		if resp.Status != StatusOK {
+			t.Fatalf("Failed to create profile %d: status 0x%x", slot, resp.Status)
+		}
+	}
+
+	var seen int
+	offset := 0
+	for {
+		resp := handler.Handle(&Frame{Cmd: CmdListProfilesEx, Payload: []byte{uint8(offset)}})
+		if resp.Status != StatusOK {
+			t.Fatalf("ListProfilesEx failed: status 0x%x", resp.Status)
+		}
+		if len(resp.Payload) > MaxPayload {
+			t.Fatalf("Page exceeds MaxPayload: %d bytes", len(resp.Payload))
+		}
+		total := int(binary.LittleEndian.Uint16(resp.Payload[0:2]))
+		count := int(resp.Payload[3])
+		seen += count
+		offset += count
+		if offset >= total {
+			break
+		}
+	}
+
+	if seen != perPage+3 {
+		t.Errorf("Expected %d entries across pages, got %d", perPage+3, seen)
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	resp := handler.Handle(&Frame{Cmd: CmdGetCapabilities})
+	if resp.Status != StatusOK {
+		t.Fatalf("GetCapabilities failed: status 0x%x", resp.Status)
+	}
+
+	entries, err := ParseTLV(resp.Payload)
+	if err != nil {
+		t.Fatalf("ParseTLV failed: %v", err)
+	}
+
+	caps := make(map[uint8][]byte)
+	for _, e := range entries {
+		caps[e.Type] = e.Value
+	}
+
+	if v := caps[CapMaxPayload]; len(v) != 2 || binary.LittleEndian.Uint16(v) != MaxPayload {
+		t.Errorf("CapMaxPayload: unexpected value %v", v)
+	}
+	if v := caps[CapBindingsPerProfile]; len(v) != 1 || v[0] != config.MaxBindings {
+		t.Errorf("CapBindingsPerProfile: unexpected value %v", v)
+	}
+	if v := caps[CapConfigVersion]; len(v) != 2 || binary.LittleEndian.Uint16(v) != config.CurrentVersion {
+		t.Errorf("CapConfigVersion: unexpected value %v", v)
+	}
+	if v := caps[CapPersonalities]; len(v) == 0 {
+		t.Error("CapPersonalities: expected at least one personality")
+	}
+
+	// The advertised command list must match what Handle accepts
+	advertised := make(map[uint8]bool)
+	for _, cmd := range caps[CapCommands] {
+		advertised[cmd] = true
+	}
+	for _, cmd := range []uint8{CmdPing, CmdDiscover, CmdGetCapabilities, CmdListProfilesEx} {
+		if !advertised[cmd] {
+			t.Errorf("Command 0x%02x not advertised", cmd)
+		}
+	}
+	for cmd := 0; cmd < 256; cmd++ {
+		if advertised[uint8(cmd)] {
+			continue
+		}
+		resp := handler.Handle(&Frame{Cmd: uint8(cmd)})
+		if resp.Status != StatusInvalidCmd {
+			t.Errorf("Command 0x%02x handled but not advertised", cmd)
+		}
+	}
+}
+
+func TestParseTLV(t *testing.T) {
+	var buf []byte
+	buf = AppendTLV(buf, 0x01, []byte{1, 2, 3})
+	buf = AppendTLV(buf, 0x02, nil)
+	buf = AppendTLV(buf, 0x03, []byte("tuffpad"))
+
+	entries, err := ParseTLV(buf)
+	if err != nil {
+		t.Fatalf("ParseTLV failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if entries[2].Type != 0x03 || string(entries[2].Value) != "tuffpad" {
+		t.Errorf("Unexpected entry: %+v", entries[2])
+	}
+
+	// Truncated value
+	if _, err := ParseTLV(buf[:len(buf)-1]); err != ErrInvalidFrame {
+		t.Errorf("Expected ErrInvalidFrame for truncated TLV, got %v", err)
+	}
+}
+
+func TestGetVersionIdentity(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	serial := []byte{0xE6, 0x61, 0x38, 0x52, 0x83, 0x4B, 0x2F, 0x2B}
+	handler.SetSerialNumber(serial)
+
+	for _, cmd := range []uint8{CmdGetVersion, CmdDiscover} {
+		resp := handler.Handle(&Frame{Cmd: cmd, Payload: []byte{IdentityFormatTLV}})
+		if resp.Status != StatusOK {
+			t.Fatalf("Cmd 0x%02x failed: status 0x%x", cmd, resp.Status)
+		}
+
+		// The legacy response is kept as a prefix
+		prefixLen := 4
+		if cmd == CmdDiscover {
+			prefixLen = len(DeviceIdentifier)
+			if string(resp.Payload[:prefixLen]) != DeviceIdentifier {
+				t.Errorf("Expected '%s' prefix, got %q", DeviceIdentifier, resp.Payload[:prefixLen])
+			}
+		}
+
+		entries, err := ParseTLV(resp.Payload[prefixLen:])
+		if err != nil {
+			t.Fatalf("Cmd 0x%02x: ParseTLV failed: %v", cmd, err)
+		}
+		info := make(map[uint8][]byte)
+		for _, e := range entries {
+			info[e.Type] = e.Value
+		}
+
+		if !bytes.Equal(info[InfoSerialNumber], serial) {
+			t.Errorf("Cmd 0x%02x: expected serial %x, got %x", cmd, serial, info[InfoSerialNumber])
+		}
+		if len(info[InfoVersion]) != 3 {
+			t.Errorf("Cmd 0x%02x: expected 3-byte version, got %v", cmd, info[InfoVersion])
+		}
+		for _, typ := range []uint8{InfoVersionString, InfoCommit, InfoBuildDate, InfoBoard} {
+			if len(info[typ]) == 0 {
+				t.Errorf("Cmd 0x%02x: missing identity TLV 0x%02x", cmd, typ)
+			}
+		}
+	}
+
+	// Unknown formats are rejected
+	resp := handler.Handle(&Frame{Cmd: CmdGetVersion, Payload: []byte{0x7E}})
+	if resp.Status != StatusInvalidData {
+		t.Errorf("Expected StatusInvalidData, got 0x%x", resp.Status)
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	badVersion := config.Profile{Version: config.CurrentVersion + 1}
+	profileData, _ := badVersion.MarshalBinary()
+	badInput := config.Profile{Version: config.CurrentVersion, BindingCount: 3}
+	badInput.Bindings[2] = config.KeyBinding{InputType: config.BindingTypeDPad, InputID: 99, OutputType: config.OutputTypeKeyboard, OutputValue: 0x04}
+	inputData, _ := badInput.MarshalBinary()
+	badFlags := config.DeviceConfig{Version: config.CurrentVersion, Flags: 1 << 31}
+	deviceData, _ := badFlags.MarshalBinary()
+
+	tests := []struct {
+		name   string
+		frame  *Frame
+		status uint8
+		reason uint8
+		offset uint16
+	}{
+		{"wrong length", &Frame{Cmd: CmdSetDeviceConfig, Payload: []byte{1, 2, 3}}, StatusInvalidData, ReasonLength, 12},
+		{"version", &Frame{Cmd: CmdSetProfile, Payload: append([]byte{0}, profileData...)}, StatusVersionMismatch, ReasonVersion, 1},
+		{"invalid binding", &Frame{Cmd: CmdSetProfile, Payload: append([]byte{3}, inputData...)}, StatusInvalidData, ReasonValue, 1 + 30 + 2*8 + 1},
+		{"undefined device flags", &Frame{Cmd: CmdSetDeviceConfig, Payload: deviceData}, StatusInvalidData, ReasonValue, 2},
+		{"missing profile", &Frame{Cmd: CmdGetProfile, Payload: []byte{99}}, StatusNotFound, ReasonNotFound, NoOffset},
+		{"invalid profile not saved", &Frame{Cmd: CmdGetProfile, Payload: []byte{3}}, StatusNotFound, ReasonNotFound, NoOffset},
+		{"missing device config", &Frame{Cmd: CmdGetDeviceConfig}, StatusNotFound, ReasonNotFound, NoOffset},
+		{"delete missing profile", &Frame{Cmd: CmdDeleteProfile, Payload: []byte{7}}, StatusNotFound, ReasonNotFound, NoOffset},
+		{"list offset", &Frame{Cmd: CmdListProfilesEx, Payload: []byte{5}}, StatusInvalidData, ReasonValue, 0},
+	}
+
+	for _, tt := range tests {
+		resp := handler.Handle(tt.frame)
+		if resp.Status != tt.status {
+			t.Errorf("%s: expected status 0x%x, got 0x%x", tt.name, tt.status, resp.Status)
+			continue
+		}
+
+		var detail ErrorDetail
+		if err := detail.UnmarshalBinary(resp.Payload); err != nil {
+			t.Errorf("%s: UnmarshalBinary failed: %v", tt.name, err)
+			continue
+		}
+		if detail.Reason != tt.reason {
+			t.Errorf("%s: expected reason 0x%x, got 0x%x", tt.name, tt.reason, detail.Reason)
+		}
+		if detail.Offset != tt.offset {
+			t.Errorf("%s: expected offset 0x%x, got 0x%x", tt.name, tt.offset, detail.Offset)
+		}
+		if detail.Message == "" {
+			t.Errorf("%s: expected a message", tt.name)
+		}
+	}
+}
+
+func TestStorageErrorMapping(t *testing.T) {
+	tests := []struct {
+		err    error
+		status uint8
+		reason uint8
+	}{
+		{storage.ErrProfileNotFound, StatusNotFound, ReasonNotFound},
+		{storage.ErrDeviceNotFound, StatusNotFound, ReasonNotFound},
+		{fmt.Errorf("%w: disk", storage.ErrFlashFull), StatusNoSpace, ReasonNoSpace},
+		{fmt.Errorf("%w: disk", storage.ErrIO), StatusError, ReasonIO},
+		{fmt.Errorf("%w: disk", storage.ErrCorrupted), StatusError, ReasonCorrupt},
+		{storage.ErrRecordCorrupt, StatusCorrupted, ReasonCorrupt},
+		{fmt.Errorf("%w: disk", storage.ErrFilesystem), StatusError, ReasonFilesystem},
+		{errors.New("other"), StatusError, ReasonUnspecified},
+	}
+
+	for _, tt := range tests {
+		resp := storageError(tt.err)
+		if resp.Status != tt.status {
+			t.Errorf("%v: expected status 0x%x, got 0x%x", tt.err, tt.status, resp.Status)
+		}
+		if resp.Payload[0] != tt.reason {
+			t.Errorf("%v: expected reason 0x%x, got 0x%x", tt.err, tt.reason, resp.Payload[0])
+		}
+	}
+}
+
+func TestFactoryResetChallenge(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	now := time.Unix(1000, 0)
+	handler.now = func() time.Time { return now }
+
+	profile := config.Profile{Version: config.CurrentVersion}
+	profileData, _ := profile.MarshalBinary()
+	handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{0}, profileData...)})
+
+	// Confirming without a challenge fails
+	resp := handler.Handle(&Frame{Cmd: CmdFactoryReset, Payload: []byte{1, 2, 3, 4}})
+	if resp.Status != StatusInvalidData || resp.Payload[0] != ReasonChallenge {
+		t.Errorf("Expected challenge error without a token, got status 0x%x", resp.Status)
+	}
+
+	// A wrong token consumes the challenge
+	token := handler.Handle(&Frame{Cmd: CmdFactoryReset}).Payload
+	wrong := append([]byte(nil), token...)
+	wrong[0] ^= 0xFF
+	if resp := handler.Handle(&Frame{Cmd: CmdFactoryReset, Payload: wrong}); resp.Status != StatusInvalidData {
+		t.Errorf("Expected StatusInvalidData for wrong token, got 0x%x", resp.Status)
+	}
+	if resp := handler.Handle(&Frame{Cmd: CmdFactoryReset, Payload: token}); resp.Status != StatusInvalidData {
+		t.Errorf("Expected token to be single-use, got 0x%x", resp.Status)
+	}
+
+	// An expired token is rejected
+	token = handler.Handle(&Frame{Cmd: CmdFactoryReset}).Payload
+	now = now.Add(ResetTokenTimeout + time.Second)
+	if resp := handler.Handle(&Frame{Cmd: CmdFactoryReset, Payload: token}); resp.Status != StatusInvalidData {
+		t.Errorf("Expected StatusInvalidData for expired token, got 0x%x", resp.Status)
+	}
+
+	if !mgr.ProfileExists(0) {
+		t.Error("Profile should survive failed confirmations")
+	}
+}
+
+func TestWriteLock(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	deviceCfg := config.DeviceConfig{ActiveProfile: 2}
+	data, _ := deviceCfg.MarshalBinary()
+	handler.Handle(&Frame{Cmd: CmdSetDeviceConfig, Payload: data})
+
+	// Enable the lock with PIN 1234
+	pin := make([]byte, 2)
+	binary.LittleEndian.PutUint16(pin, 1234)
+	resp := handler.Handle(&Frame{Cmd: CmdSetLock, Payload: append([]byte{1}, pin...)})
+	if resp.Status != StatusOK {
+		t.Fatalf("SetLock failed: status 0x%x", resp.Status)
+	}
+
+	// Protected commands are refused, reads still work
+	profile := config.Profile{Version: config.CurrentVersion}
+	profileData, _ := profile.MarshalBinary()
+	locked := []*Frame{
+		{Cmd: CmdSetDeviceConfig, Payload: data},
+		{Cmd: CmdSetProfile, Payload: append([]byte{0}, profileData...)},
+		{Cmd: CmdDeleteProfile, Payload: []byte{0}},
+		{Cmd: CmdFactoryReset},
+		{Cmd: CmdSetLock, Payload: []byte{0, 0, 0}},
+	}
+	for _, frame := range locked {
+		resp := handler.Handle(frame)
+		if resp.Status != StatusLocked {
+			t.Errorf("Cmd 0x%02x: expected StatusLocked, got 0x%x", frame.Cmd, resp.Status)
+		}
+	}
+
+	getResp := handler.Handle(&Frame{Cmd: CmdGetDeviceConfig})
+	if getResp.Status != StatusOK {
+		t.Fatalf("GetDeviceConfig failed while locked: status 0x%x", getResp.Status)
+	}
+	var got config.DeviceConfig
+	got.UnmarshalBinary(getResp.Payload)
+	if !got.Locked() {
+		t.Error("Expected lock flag in device config")
+	}
+	if got.LockPIN != 0 {
+		t.Errorf("PIN should be masked, got %d", got.LockPIN)
+	}
+
+	// Wrong PIN
+	if resp := handler.Handle(&Frame{Cmd: CmdUnlock, Payload: []byte{0, 0}}); resp.Status != StatusLocked {
+		t.Errorf("Expected StatusLocked for wrong PIN, got 0x%x", resp.Status)
+	}
+
+	// Right PIN unlocks writes
+	if resp := handler.Handle(&Frame{Cmd: CmdUnlock, Payload: pin}); resp.Status != StatusOK {
+		t.Fatalf("Unlock failed: status 0x%x", resp.Status)
+	}
+	if resp := handler.Handle(&Frame{Cmd: CmdSetProfile, Payload: append([]byte{0}, profileData...)}); resp.Status != StatusOK {
+		t.Errorf("SetProfile after unlock failed: status 0x%x", resp.Status)
+	}
+
+	// SetDeviceConfig cannot clear the lock or change the PIN
+	handler.Handle(&Frame{Cmd: CmdSetDeviceConfig, Payload: data})
+	var stored config.DeviceConfig
+	mgr.LoadDevice(&stored)
+	if !stored.Locked() || stored.LockPIN != 1234 {
+		t.Errorf("SetDeviceConfig changed lock settings: flags 0x%x, PIN %d", stored.Flags, stored.LockPIN)
+	}
+
+	// Disabling the lock
+	if resp := handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{0, 0, 0}}); resp.Status != StatusOK {
+		t.Fatalf("SetLock disable failed: status 0x%x", resp.Status)
+	}
+	if resp := handler.Handle(&Frame{Cmd: CmdDeleteProfile, Payload: []byte{0}}); resp.Status != StatusOK {
+		t.Errorf("DeleteProfile after disabling lock failed: status 0x%x", resp.Status)
+	}
+}
+
+func TestUnlockBackoff(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	now := time.Unix(1000, 0)
+	handler.now = func() time.Time { return now }
+
+	handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{1, 0x39, 0x05}}) // PIN 1337
+	pin := []byte{0x39, 0x05}
+
+	for i := 0; i < MaxUnlockAttempts; i++ {
+		handler.Handle(&Frame{Cmd: CmdUnlock, Payload: []byte{0, 0}})
+	}
+
+	// Even the right PIN is refused during the backoff
+	resp := handler.Handle(&Frame{Cmd: CmdUnlock, Payload: pin})
+	if resp.Status != StatusLocked || resp.Payload[0] != ReasonLocked {
+		t.Errorf("Expected unlock to be blocked, got status 0x%x", resp.Status)
+	}
+
+	now = now.Add(UnlockBackoff)
+	if resp := handler.Handle(&Frame{Cmd: CmdUnlock, Payload: pin}); resp.Status != StatusOK {
+		t.Errorf("Unlock after backoff failed: status 0x%x", resp.Status)
+	}
+	if n, err := mgr.UnlockFailures(); n != 0 || err != nil {
+		t.Errorf("Stored failures after unlocking = %d, %v", n, err)
+	}
+}
+
+func TestUnlockBackoffGrows(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		MaxUnlockAttempts:      UnlockBackoff,
+		2 * MaxUnlockAttempts:  2 * UnlockBackoff,
+		3 * MaxUnlockAttempts:  4 * UnlockBackoff,
+		50 * MaxUnlockAttempts: MaxUnlockBackoff,
+	} {
+		if got := unlockBackoff(failures); got != want {
+			t.Errorf("unlockBackoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestUnlockBackoffSurvivesRestart(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	now := time.Unix(1000, 0)
+	handler.now = func() time.Time { return now }
+	handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{1, 0x39, 0x05}}) // PIN 1337
+	pin := &Frame{Cmd: CmdUnlock, Payload: []byte{0x39, 0x05}}
+
+	// Four wrong PINs, then a restart: the fifth still starts the backoff
+	for i := 0; i < MaxUnlockAttempts-1; i++ {
+		handler.Handle(&Frame{Cmd: CmdUnlock, Payload: []byte{0, 0}})
+	}
+	handler = NewHandler(mgr)
+	handler.now = func() time.Time { return now }
+	handler.Handle(&Frame{Cmd: CmdUnlock, Payload: []byte{0, 0}})
+	if resp := handler.Handle(pin); resp.Status != StatusLocked || resp.Payload[0] != ReasonLocked {
+		t.Fatalf("Expected the backoff after a restart, got status 0x%x", resp.Status)
+	}
+
+	// A restart during the backoff starts it over
+	handler = NewHandler(mgr)
+	handler.now = func() time.Time { return now }
+	if resp := handler.Handle(pin); resp.Status != StatusLocked || resp.Payload[0] != ReasonLocked {
+		t.Fatalf("Restart ended the backoff: status 0x%x", resp.Status)
+	}
+	now = now.Add(UnlockBackoff)
+	if resp := handler.Handle(pin); resp.Status != StatusOK {
+		t.Errorf("Unlock after backoff failed: status 0x%x", resp.Status)
+	}
+
+	// The recovery button clears the count
+	handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{1, 0x39, 0x05}})
+	for i := 0; i < MaxUnlockAttempts; i++ {
+		handler.Handle(&Frame{Cmd: CmdUnlock, Payload: []byte{0, 0}})
+	}
+	if _, err := ClearLock(mgr); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := mgr.UnlockFailures(); n != 0 || err != nil {
+		t.Errorf("Stored failures after ClearLock = %d, %v", n, err)
+	}
+}
+
+func TestUnlockEndsWithSession(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	now := time.Unix(1000, 0)
+	handler.now = func() time.Time { return now }
+	handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{1, 0x39, 0x05}}) // PIN 1337
+	unlock := &Frame{Cmd: CmdUnlock, Payload: []byte{0x39, 0x05}}
+	del := &Frame{Cmd: CmdDeleteProfile, Payload: []byte{0}}
+
+	// Closing the port relocks
+	handler.Handle(unlock)
+	handler.EndSession()
+	if resp := handler.Handle(del); resp.Status != StatusLocked {
+		t.Errorf("Expected StatusLocked after the session ended, got 0x%x", resp.Status)
+	}
+
+	// So does going idle, but not steady use
+	handler.Handle(unlock)
+	for i := 0; i < 3; i++ {
+		now = now.Add(UnlockIdleTimeout - time.Second)
+		if resp := handler.Handle(&Frame{Cmd: CmdPing}); resp.Status != StatusOK {
+			t.Fatal("Ping failed")
+		}
+	}
+	if resp := handler.Handle(del); resp.Status == StatusLocked {
+		t.Error("Relocked while in use")
+	}
+	now = now.Add(UnlockIdleTimeout)
+	if resp := handler.Handle(del); resp.Status != StatusLocked {
+		t.Errorf("Expected StatusLocked after going idle, got 0x%x", resp.Status)
+	}
+}
+
+func TestClearLock(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	if cleared, err := ClearLock(mgr); cleared || err != nil {
+		t.Errorf("ClearLock without a device config = %v, %v", cleared, err)
+	}
+
+	data, _ := (&config.DeviceConfig{Brightness: 90}).MarshalBinary()
+	handler.Handle(&Frame{Cmd: CmdSetDeviceConfig, Payload: data})
+	handler.Handle(&Frame{Cmd: CmdSetLock, Payload: []byte{1, 0x39, 0x05}}) // PIN 1337
+	if cleared, err := ClearLock(mgr); !cleared || err != nil {
+		t.Fatalf("ClearLock = %v, %v", cleared, err)
+	}
+
+	var cfg config.DeviceConfig
+	mgr.LoadDevice(&cfg)
+	if cfg.Locked() || cfg.LockPIN != 0 || cfg.Brightness != 90 {
+		t.Errorf("Unexpected config after ClearLock: %+v", cfg)
+	}
+	if resp := handler.Handle(&Frame{Cmd: CmdFactoryReset}); resp.Status != StatusOK {
+		t.Errorf("FactoryReset still locked: status 0x%x", resp.Status)
+	}
+}
+
+// fakeRebooter records reboot requests instead of resetting.
+type fakeRebooter struct {
+	modes []reboot.Mode
+}
+
+func (f *fakeRebooter) Reboot(mode reboot.Mode) error {
+	f.modes = append(f.modes, mode)
+	return nil
+}
+
+func TestReboot(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	// Without a rebooter the command is unsupported
+	resp := handler.Handle(&Frame{Cmd: CmdReboot, Payload: []byte{0}})
+	if resp.Status != StatusError || resp.Payload[0] != ReasonUnsupported {
+		t.Errorf("Expected unsupported error, got status 0x%x", resp.Status)
+	}
+
+	rebooter := &fakeRebooter{}
+	handler.SetRebooter(rebooter)
+
+	resp = handler.Handle(&Frame{Cmd: CmdReboot, Payload: []byte{9}})
+	if resp.Status != StatusInvalidData {
+		t.Errorf("Expected StatusInvalidData for unknown mode, got 0x%x", resp.Status)
+	}
+
+	for _, mode := range []reboot.Mode{reboot.ModeNormal, reboot.ModeBootloader, reboot.ModeSafe} {
+		resp := handler.Handle(&Frame{Cmd: CmdReboot, Payload: []byte{uint8(mode)}})
+		if resp.Status != StatusOK {
+			t.Fatalf("Reboot %d failed: status 0x%x", mode, resp.Status)
+		}
+
+		// Nothing happens until the transport has sent the response
+		if len(rebooter.modes) != 0 {
+			t.Fatal("Reboot happened before the response was sent")
+		}
+		if !handler.RebootPending() {
+			t.Fatal("Expected a pending reboot")
+		}
+
+		if err := handler.Reboot(); err != nil {
+			t.Fatalf("Reboot returned %v", err)
+		}
+		if len(rebooter.modes) != 1 || rebooter.modes[0] != mode {
+			t.Errorf("Expected reboot into mode %d, got %v", mode, rebooter.modes)
+		}
+		if handler.RebootPending() {
+			t.Error("Reboot should clear the pending request")
+		}
+		rebooter.modes = nil
+	}
+}
+
+func TestQueueFlushed(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	queue := storage.NewQueue(mgr, time.Hour)
+	handler.SetQueue(queue)
+	handler.SetRebooter(&fakeRebooter{})
+
+	// Polling commands leave the queue alone
+	queue.SaveDevice(&config.DeviceConfig{Brightness: 77})
+	for _, cmd := range []uint8{CmdPing, CmdGetCapabilities, CmdGetDiagnostics, CmdDiscover} {
+		handler.Handle(&Frame{Cmd: cmd})
+	}
+	if !queue.Pending().Device {
+		t.Error("Polling flushed the queue")
+	}
+
+	// The PC reads what the pad has queued
+	resp := handler.Handle(&Frame{Cmd: CmdGetDeviceConfig})
+	var cfg config.DeviceConfig
+	if resp.Status != StatusOK || cfg.UnmarshalBinary(resp.Payload) != nil || cfg.Brightness != 77 {
+		t.Errorf("GetDeviceConfig = 0x%x %+v", resp.Status, cfg)
+	}
+
+	// Queued saves are written before a reboot into the bootloader
+	handler.Handle(&Frame{Cmd: CmdReboot, Payload: []byte{uint8(reboot.ModeBootloader)}})
+	queue.SaveProfile(5, &config.Profile{})
+	if err := handler.Reboot(); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Pending().Any() || !mgr.ProfileExists(5) {
+		t.Errorf("Queue not flushed before reboot: %+v", queue.Pending())
+	}
+}
+
+func TestBootModeIdentity(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	handler.SetBootMode(reboot.ModeSafe)
+
+	resp := handler.Handle(&Frame{Cmd: CmdGetVersion, Payload: []byte{IdentityFormatTLV}})
+	entries, err := ParseTLV(resp.Payload[4:])
+	if err != nil {
+		t.Fatalf("ParseTLV failed: %v", err)
+	}
+	for _, e := range entries {
+		if e.Type == InfoBootMode {
+			if len(e.Value) != 1 || reboot.Mode(e.Value[0]) != reboot.ModeSafe {
+				t.Errorf("Expected safe boot mode, got %v", e.Value)
+			}
+			return
+		}
+	}
+	t.Error("Missing boot mode TLV")
+}
+
+func TestGetDiagnostics(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	metrics.Reset()
+
+	// Two good frames and one corrupted one through the scanner
+	var stream bytes.Buffer
+	WriteFrame(&stream, &Frame{Cmd: CmdPing})
+	WriteFrame(&stream, &Frame{Cmd: CmdPing, Payload: []byte{0x10, 0x20}})
+	bad := stream.Bytes()[len(stream.Bytes())-8:]
+	stream.Write(append([]byte(nil), bad...))
+	stream.Bytes()[stream.Len()-3] ^= 0xFF
+
+	scanner := NewScanner(0)
+	scanner.Push(stream.Bytes(), time.Now())
+	for {
+		frame, err := scanner.Next()
+		if frame == nil && err == nil {
+			break
+		}
+	}
+
+	resp := handler.Handle(&Frame{Cmd: CmdGetDiagnostics})
+	if resp.Status != StatusOK {
+		t.Fatalf("GetDiagnostics failed: status 0x%x", resp.Status)
+	}
+
+	entries, err := ParseTLV(resp.Payload)
+	if err != nil {
+		t.Fatalf("ParseTLV failed: %v", err)
+	}
+	diag := make(map[uint8][]byte)
+	for _, e := range entries {
+		diag[e.Type] = e.Value
+	}
+
+	for _, typ := range []uint8{DiagUptime, DiagHeapAlloc, DiagHeapSys} {
+		if len(diag[typ]) != 4 {
+			t.Errorf("Expected 4-byte value for TLV 0x%02x, got %v", typ, diag[typ])
+		}
+	}
+	if len(diag[DiagGoroutines]) != 2 {
+		t.Errorf("Expected 2-byte goroutine count, got %v", diag[DiagGoroutines])
+	}
+	if !bytes.Equal(diag[DiagDamaged], []byte{0}) {
+		t.Errorf("Expected no damaged records, got %v", diag[DiagDamaged])
+	}
+
+	counter := func(c metrics.Counter) uint32 {
+		v := diag[DiagCounterBase+uint8(c)]
+		if len(v) != 4 {
+			t.Fatalf("Missing counter %d", c)
+		}
+		return binary.LittleEndian.Uint32(v)
+	}
+	if got := counter(metrics.FramesReceived); got != 2 {
+		t.Errorf("Expected 2 frames received, got %d", got)
+	}
+	if got := counter(metrics.CRCErrors); got != 1 {
+		t.Errorf("Expected 1 CRC error, got %d", got)
+	}
+}
+
+// failingWriter always fails, like a disconnected host.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disconnected")
+}
+
+func TestWriteResponseErrorCounted(t *testing.T) {
+	metrics.Reset()
+	if err := WriteResponse(failingWriter{}, &Response{Status: StatusOK}); err == nil {
+		t.Fatal("Expected write error")
+	}
+	if got := metrics.Get(metrics.ResponseWriteErrors); got != 1 {
+		t.Errorf("Expected 1 write error, got %d", got)
+	}
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+)
+
+// Scanner extracts frames from a raw byte stream.
+//
+// Unlike ReadFrame, it never gives up on the stream: bytes before a SyncByte
+// are skipped, and when a candidate frame fails its CRC the scanner backtracks
+// to the byte after that SyncByte and searches again. A stray byte or a
+// half-sent frame therefore costs at most the frames it overlaps.
+//
+// Partial frames are abandoned when no byte arrives within the inter-byte
+// timeout, so a truncated frame cannot swallow the next request.
+type Scanner struct {
+	buf     []byte
+	start   int // first unconsumed byte in buf
+	timeout time.Duration
+	last    time.Time
+
+	// stale is set by Expire when the buffered bytes timed out. A stale
+	// partial frame is abandoned instead of waited on; truncated records
+	// that one was abandoned without a valid frame inside it.
+	stale     bool
+	truncated bool
+
+	// crcFailed is set when a candidate frame failed its CRC check.
+	// failEnd is the end of that candidate relative to start. If no valid
+	// frame starts before failEnd, the failure is reported as ErrCRCMismatch.
+	crcFailed bool
+	failEnd   int
+}
+
+// NewScanner creates a frame scanner.
+// A zero interByteTimeout disables expiry of partial frames.
+func NewScanner(interByteTimeout time.Duration) *Scanner {
+	return &Scanner{
+		timeout: interByteTimeout,
+	}
+}
+
+// Push appends received bytes. now is the time they were received.
+func (s *Scanner) Push(data []byte, now time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	// Compact before growing so the buffer stays around one frame in size
+	if s.start > 0 && s.start >= len(s.buf)/2 {
+		s.buf = s.buf[:copy(s.buf, s.buf[s.start:])]
+		s.start = 0
+	}
+	s.buf = append(s.buf, data...)
+	s.last = now
+	s.stale = false
+}
+
+// Pending returns the number of buffered bytes not yet consumed.
+func (s *Scanner) Pending() int {
+	return len(s.buf) - s.start
+}
+
+// Next returns the next complete frame in the buffered data.
+// It returns (nil, nil) when more data is needed.
+// It returns ErrCRCMismatch when a frame failed its CRC check and no valid
+// frame started inside it, and ErrTimeout when a partial frame abandoned by
+// Expire held no valid frame. In both cases the scanner has already
+// resynchronized and Next can be called again.
+func (s *Scanner) Next() (*Frame, error) {
+	for {
+		data := s.buf[s.start:]
+		i := bytes.IndexByte(data, SyncByte)
+
+		if s.crcFailed && (i < 0 || i >= s.failEnd) {
+			// Nothing valid started inside the corrupted frame
+			if i < 0 {
+				i = len(data)
+			}
+			s.discard(i)
+			s.crcFailed = false
+			s.truncated = false
+			metrics.Inc(metrics.CRCErrors)
+			return nil, ErrCRCMismatch
+		}
+
+		if i < 0 {
+			s.discard(len(data))
+			if s.truncated {
+				s.truncated = false
+				metrics.Inc(metrics.FrameTimeouts)
+				return nil, ErrTimeout
+			}
+			return nil, nil
+		}
+		s.discard(i)
+		data = s.buf[s.start:]
+
+		length := -1
+		if len(data) >= 4 {
+			length = int(binary.LittleEndian.Uint16(data[2:]))
+		}
+		if length > MaxPayload {
+			// Not a real frame start, resync on the next SyncByte
+			metrics.Inc(metrics.InvalidFrames)
+			s.discard(1)
+			continue
+		}
+
+		total := 4 + length + 2
+		if length < 0 || len(data) < total {
+			if !s.stale {
+				// Wait for the rest of the frame
+				return nil, nil
+			}
+			// Timed out: abandon this candidate and look for a frame inside it
+			s.truncated = true
+			s.discard(1)
+			continue
+		}
+
+		receivedCRC := binary.LittleEndian.Uint16(data[total-2:])
+		if receivedCRC != calcCRC(data[1:total-2]) {
+			// Backtrack: the SyncByte may have been noise
+			if !s.crcFailed || total > s.failEnd {
+				s.failEnd = total
+			}
+			s.crcFailed = true
+			s.discard(1)
+			continue
+		}
+
+		frame := &Frame{Cmd: data[1]}
+		if length > 0 {
+			frame.Payload = make([]byte, length)
+			copy(frame.Payload, data[4:4+length])
+		}
+		s.discard(total)
+		s.crcFailed = false
+		s.truncated = false
+		metrics.Inc(metrics.FramesReceived)
+		return frame, nil
+	}
+}
+
+// Expire abandons a partial frame if the inter-byte timeout has elapsed
+// since the last byte was received. It returns true if the buffered bytes
+// timed out; the caller should then drain Next, which rescans them for
+// frames and reports what was dropped.
+func (s *Scanner) Expire(now time.Time) bool {
+	if s.timeout == 0 || s.stale || s.Pending() == 0 || now.Sub(s.last) < s.timeout {
+		return false
+	}
+	s.stale = true
+	return true
+}
+
+// discard consumes n bytes from the front of the buffer.
+func (s *Scanner) discard(n int) {
+	s.start += n
+	s.failEnd -= n
+	if s.start == len(s.buf) {
+		s.buf = s.buf[:0]
+		s.start = 0
+		s.stale = false
+	}
+}
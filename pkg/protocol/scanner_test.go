@@ -0,0 +1,248 @@
+package protocol
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// encodeFrame returns the wire bytes of a request frame.
+func encodeFrame(t *testing.T, cmd uint8, payload []byte) []byte {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, &Frame{Cmd: cmd, Payload: payload}); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// drain collects all frames and errors currently available from the scanner.
+func drain(s *Scanner) (frames []*Frame, errs []error) {
+	for {
+		frame, err := s.Next()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if frame == nil {
+			return frames, errs
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestScannerSkipsNoise(t *testing.T) {
+	s := NewScanner(0)
+	now := time.Now()
+
+	stream := []byte{0x00, 0x13, 0x55, 0xFF}
+	stream = append(stream, encodeFrame(t, CmdPing, []byte{1, 2, 3})...)
+	stream = append(stream, 0x42, 0x10)
+	stream = append(stream, encodeFrame(t, CmdDiscover, nil)...)
+	s.Push(stream, now)
+
+	frames, errs := drain(s)
+	if len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, got %d", len(frames))
+	}
+	if frames[0].Cmd != CmdPing || !bytes.Equal(frames[0].Payload, []byte{1, 2, 3}) {
+		t.Errorf("Unexpected first frame: %+v", frames[0])
+	}
+	if frames[1].Cmd != CmdDiscover || len(frames[1].Payload) != 0 {
+		t.Errorf("Unexpected second frame: %+v", frames[1])
+	}
+	if s.Pending() != 0 {
+		t.Errorf("Expected empty buffer, %d bytes pending", s.Pending())
+	}
+}
+
+func TestScannerByteAtATime(t *testing.T) {
+	s := NewScanner(0)
+	now := time.Now()
+
+	stream := encodeFrame(t, CmdGetProfile, []byte{5})
+	var frames []*Frame
+	for _, b := range stream {
+		s.Push([]byte{b}, now)
+		f, errs := drain(s)
+		if len(errs) != 0 {
+			t.Fatalf("Unexpected errors: %v", errs)
+		}
+		frames = append(frames, f...)
+	}
+
+	if len(frames) != 1 || frames[0].Cmd != CmdGetProfile {
+		t.Fatalf("Expected one GetProfile frame, got %+v", frames)
+	}
+}
+
+func TestScannerStraySyncByte(t *testing.T) {
+	s := NewScanner(50 * time.Millisecond)
+	start := time.Now()
+
+	// A stray 0xAA right before a real frame makes the scanner wait for a
+	// bogus length; the inter-byte timeout recovers the real frame.
+	stream := append([]byte{SyncByte}, encodeFrame(t, CmdPing, []byte{9})...)
+	s.Push(stream, start)
+
+	if frames, errs := drain(s); len(frames) != 0 || len(errs) != 0 {
+		t.Fatalf("Expected scanner to wait, got %v %v", frames, errs)
+	}
+	if !s.Expire(start.Add(60 * time.Millisecond)) {
+		t.Fatal("Expected Expire to time out the buffered bytes")
+	}
+
+	frames, errs := drain(s)
+	if len(frames) != 1 || frames[0].Cmd != CmdPing {
+		t.Fatalf("Expected ping frame after stray sync byte, got %+v", frames)
+	}
+	if len(errs) != 0 {
+		t.Errorf("Stray sync byte should not be reported, got %v", errs)
+	}
+}
+
+func TestScannerCRCErrorThenValidFrame(t *testing.T) {
+	s := NewScanner(0)
+
+	bad := encodeFrame(t, CmdSetProfile, []byte{0x10, 0x20, 0x30, 0x40})
+	bad[5] ^= 0x80 // Corrupt a payload byte
+	stream := append(bad, encodeFrame(t, CmdPing, nil)...)
+	s.Push(stream, time.Now())
+
+	frames, errs := drain(s)
+	if len(errs) != 1 || errs[0] != ErrCRCMismatch {
+		t.Errorf("Expected one ErrCRCMismatch, got %v", errs)
+	}
+	if len(frames) != 1 || frames[0].Cmd != CmdPing {
+		t.Errorf("Expected ping frame after corrupted frame, got %+v", frames)
+	}
+}
+
+func TestScannerFrameInsideCorruptedPayload(t *testing.T) {
+	s := NewScanner(0)
+
+	// A frame embedded in the payload of a corrupted frame is recovered by
+	// backtracking, and the outer frame is treated as noise.
+	inner := encodeFrame(t, CmdPing, []byte{7})
+	outer := encodeFrame(t, CmdSetDeviceConfig, append([]byte{0, 0}, inner...))
+	outer[len(outer)-2] ^= 0x01
+	s.Push(outer, time.Now())
+
+	frames, _ := drain(s)
+	if len(frames) != 1 || frames[0].Cmd != CmdPing || !bytes.Equal(frames[0].Payload, []byte{7}) {
+		t.Fatalf("Expected embedded ping frame, got %+v", frames)
+	}
+}
+
+func TestScannerOversizedLength(t *testing.T) {
+	s := NewScanner(0)
+
+	// Header claims a payload larger than MaxPayload
+	stream := []byte{SyncByte, CmdPing, 0xFF, 0xFF}
+	stream = append(stream, encodeFrame(t, CmdPing, nil)...)
+	s.Push(stream, time.Now())
+
+	frames, errs := drain(s)
+	if len(frames) != 1 {
+		t.Fatalf("Expected 1 frame after oversized header, got %d", len(frames))
+	}
+	if len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+func TestScannerTruncatedFrameTimeout(t *testing.T) {
+	s := NewScanner(50 * time.Millisecond)
+	start := time.Now()
+
+	// Half a frame, then silence
+	full := encodeFrame(t, CmdSetProfile, make([]byte, 20))
+	s.Push(full[:10], start)
+
+	if frames, errs := drain(s); len(frames) != 0 || len(errs) != 0 {
+		t.Fatalf("Expected partial frame to wait, got %v %v", frames, errs)
+	}
+	if s.Expire(start.Add(10 * time.Millisecond)) {
+		t.Error("Expire before timeout: expected false")
+	}
+	if !s.Expire(start.Add(60 * time.Millisecond)) {
+		t.Error("Expire after timeout: expected true")
+	}
+	if frames, errs := drain(s); len(frames) != 0 || len(errs) != 1 || errs[0] != ErrTimeout {
+		t.Errorf("Expected single ErrTimeout, got %v %v", frames, errs)
+	}
+	if s.Pending() != 0 {
+		t.Errorf("Expected partial frame to be dropped, %d bytes pending", s.Pending())
+	}
+
+	// The next frame is parsed normally
+	s.Push(encodeFrame(t, CmdPing, nil), start.Add(100*time.Millisecond))
+	frames, errs := drain(s)
+	if len(frames) != 1 || len(errs) != 0 {
+		t.Errorf("Expected clean frame after timeout, got %v %v", frames, errs)
+	}
+}
+
+func TestScannerTimeoutAfterCRCError(t *testing.T) {
+	s := NewScanner(50 * time.Millisecond)
+	start := time.Now()
+
+	// A corrupted frame whose payload holds a sync byte and a large length
+	// leaves a partial candidate behind. Expiry reports the CRC failure.
+	bad := encodeFrame(t, CmdSetProfile, []byte{SyncByte, CmdPing, 0x00, 0x01})
+	bad[1] ^= 0x01 // Corrupt the command byte
+	s.Push(bad, start)
+
+	if frames, errs := drain(s); len(frames) != 0 || len(errs) != 0 {
+		t.Fatalf("Expected scanner to wait on embedded candidate, got %v %v", frames, errs)
+	}
+	s.Expire(start.Add(time.Second))
+	if frames, errs := drain(s); len(frames) != 0 || len(errs) != 1 || errs[0] != ErrCRCMismatch {
+		t.Errorf("Expected single ErrCRCMismatch on expiry, got %v %v", frames, errs)
+	}
+}
+
+func TestScannerRandomNoise(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := NewScanner(0)
+	now := time.Now()
+
+	var stream []byte
+	var want []uint8
+	for i := 0; i < 200; i++ {
+		noise := make([]byte, rng.Intn(16))
+		rng.Read(noise)
+		stream = append(stream, noise...)
+
+		payload := make([]byte, rng.Intn(64))
+		rng.Read(payload)
+		cmd := uint8(i)
+		stream = append(stream, encodeFrame(t, cmd, payload)...)
+		want = append(want, cmd)
+	}
+	// Trailing filler completes any false candidate at the end of the stream
+	stream = append(stream, make([]byte, MaxPayload+6)...)
+
+	// Deliver in random chunk sizes
+	var got []uint8
+	for len(stream) > 0 {
+		n := 1 + rng.Intn(100)
+		if n > len(stream) {
+			n = len(stream)
+		}
+		s.Push(stream[:n], now)
+		stream = stream[n:]
+
+		frames, _ := drain(s)
+		for _, f := range frames {
+			got = append(got, f.Cmd)
+		}
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("Recovered %d of %d frames through noise", len(got), len(want))
+	}
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"encoding/binary"
+)
+
+// TLV is one [Type:1][Len:1][Value:Len] entry of an extensible payload.
+type TLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// AppendTLV appends a TLV entry to buf and returns the extended buffer.
+// Values longer than 255 bytes are truncated.
+func AppendTLV(buf []byte, typ uint8, value []byte) []byte {
+	if len(value) > 255 {
+		value = value[:255]
+	}
+	buf = append(buf, typ, uint8(len(value)))
+	return append(buf, value...)
+}
+
+// appendTLVUint16 appends a TLV entry holding a little-endian uint16.
+func appendTLVUint16(buf []byte, typ uint8, v uint16) []byte {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	return AppendTLV(buf, typ, b[:])
+}
+
+// appendTLVUint32 appends a TLV entry holding a little-endian uint32.
+func appendTLVUint32(buf []byte, typ uint8, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return AppendTLV(buf, typ, b[:])
+}
+
+// ParseTLV splits a payload into TLV entries.
+// Values alias the payload slice.
+func ParseTLV(payload []byte) ([]TLV, error) {
+	var entries []TLV
+	for len(payload) > 0 {
+		if len(payload) < 2 {
+			return nil, ErrInvalidFrame
+		}
+		n := int(payload[1])
+		if len(payload) < 2+n {
+			return nil, ErrInvalidFrame
+		}
+		entries = append(entries, TLV{
+			Type:  payload[0],
+			Value: payload[2 : 2+n],
+		})
+		payload = payload[2+n:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+)
+
+// MaxUpdateChunk is the most image data one CmdUpdateData frame carries.
+const MaxUpdateChunk = MaxPayload - 4
+
+// updateError maps a dfu error to a status and reason.
+func updateError(err error) *Response {
+	switch {
+	case errors.Is(err, dfu.ErrTooLarge):
+		return errorResponse(StatusNoSpace, ReasonNoSpace, 0, err.Error())
+	case errors.Is(err, dfu.ErrEmpty), errors.Is(err, dfu.ErrOverflow):
+		return errorResponse(StatusInvalidData, ReasonValue, 0, err.Error())
+	case errors.Is(err, dfu.ErrNotStarted), errors.Is(err, dfu.ErrNotVerified),
+		errors.Is(err, dfu.ErrIncomplete):
+		return errorResponse(StatusInvalidData, ReasonValue, NoOffset, err.Error())
+	case errors.Is(err, dfu.ErrChecksum):
+		return errorResponse(StatusInvalidData, ReasonCorrupt, NoOffset, err.Error())
+	default:
+		return errorResponse(StatusError, ReasonIO, NoOffset, err.Error())
+	}
+}
+
+// unsupportedUpdate is returned by the update commands in builds without
+// an updater.
+func unsupportedUpdate() *Response {
+	return errorResponse(StatusError, ReasonUnsupported, NoOffset, "firmware update not supported")
+}
+
+// handleUpdateBegin starts receiving a firmware image, dropping any update
+// in progress.
+// Payload: [Size:4][CRC32:4]
+// Response: [MaxChunk:2]
+func (h *Handler) handleUpdateBegin(payload []byte) *Response {
+	if len(payload) != 8 {
+		return lengthError(8)
+	}
+	if h.updater == nil {
+		return unsupportedUpdate()
+	}
+
+	size := binary.LittleEndian.Uint32(payload[0:])
+	crc := binary.LittleEndian.Uint32(payload[4:])
+	if err := h.updater.Begin(size, crc); err != nil {
+		return updateError(err)
+	}
+	return &Response{
+		Status:  StatusOK,
+		Payload: binary.LittleEndian.AppendUint16(nil, MaxUpdateChunk),
+	}
+}
+
+// handleUpdateData stores a chunk of the image. Chunks must arrive in
+// order; resending the last chunk is harmless.
+// Payload: [Offset:4][Data:N]
+// Response: [Received:4]
+func (h *Handler) handleUpdateData(payload []byte) *Response {
+	if len(payload) < 5 {
+		return shortError(5)
+	}
+	if h.updater == nil {
+		return unsupportedUpdate()
+	}
+
+	offset := binary.LittleEndian.Uint32(payload)
+	if err := h.updater.Write(offset, payload[4:]); err != nil {
+		if errors.Is(err, dfu.ErrOffset) {
+			_, _, written := h.updater.Status()
+			return errorResponse(StatusInvalidData, ReasonValue, 0, "expected offset "+strconv.FormatUint(uint64(written), 10))
+		}
+		return updateError(err)
+	}
+
+	_, _, written := h.updater.Status()
+	return &Response{
+		Status:  StatusOK,
+		Payload: binary.LittleEndian.AppendUint32(nil, written),
+	}
+}
+
+// handleUpdateVerify checks the received image against the size and CRC32
+// given to CmdUpdateBegin. A mismatch drops the update.
+func (h *Handler) handleUpdateVerify(_ []byte) *Response {
+	if h.updater == nil {
+		return unsupportedUpdate()
+	}
+	if err := h.updater.Verify(); err != nil {
+		return updateError(err)
+	}
+	return &Response{Status: StatusOK}
+}
+
+// handleUpdateCommit installs the verified image and reboots into it once
+// the response has been sent.
+func (h *Handler) handleUpdateCommit(_ []byte) *Response {
+	if h.updater == nil {
+		return unsupportedUpdate()
+	}
+	if h.rebooter == nil {
+		return errorResponse(StatusError, ReasonUnsupported, NoOffset, "reboot not supported")
+	}
+	if err := h.updater.Commit(); err != nil {
+		return updateError(err)
+	}
+
+	h.rebootMode = reboot.ModeNormal
+	h.rebootPending = true
+	return &Response{Status: StatusOK}
+}
+
+// handleUpdateStatus reports the progress of an update, so a host can
+// resume after a lost connection.
+// Response: [State:1][Size:4][Received:4][Capacity:4]
+func (h *Handler) handleUpdateStatus(_ []byte) *Response {
+	if h.updater == nil {
+		return unsupportedUpdate()
+	}
+
+	state, size, written := h.updater.Status()
+	buf := []byte{uint8(state)}
+	buf = binary.LittleEndian.AppendUint32(buf, size)
+	buf = binary.LittleEndian.AppendUint32(buf, written)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(h.updater.Capacity()))
+	return &Response{
+		Status:  StatusOK,
+		Payload: buf,
+	}
+}
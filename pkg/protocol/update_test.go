@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/dfu"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// fakeInstaller records installed images instead of flashing them.
+type fakeInstaller struct {
+	images [][]byte
+}
+
+func (f *fakeInstaller) Install(image io.ReaderAt, size int64) error {
+	buf := make([]byte, size)
+	if _, err := image.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	f.images = append(f.images, buf)
+	return nil
+}
+
+func beginPayload(img []byte) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(img)))
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(img))
+}
+
+func dataPayload(offset int, data []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(offset)), data...)
+}
+
+func TestFirmwareUpdate(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	img := bytes.Repeat([]byte("firmware"), 1500) // 12000 bytes, three chunks
+	resp := handler.Handle(&Frame{Cmd: CmdUpdateBegin, Payload: beginPayload(img)})
+	if resp.Status != StatusError || resp.Payload[0] != ReasonUnsupported {
+		t.Fatalf("Expected unsupported without an updater, got status 0x%x", resp.Status)
+	}
+
+	inst := &fakeInstaller{}
+	rebooter := &fakeRebooter{}
+	handler.SetUpdater(dfu.New(tinyfs.NewMemoryDevice(256, 4096, 8), inst))
+	handler.SetRebooter(rebooter)
+
+	resp = handler.Handle(&Frame{Cmd: CmdGetCapabilities})
+	entries, _ := ParseTLV(resp.Payload)
+	caps := make(map[uint8][]byte)
+	for _, e := range entries {
+		caps[e.Type] = e.Value
+	}
+	if v := caps[CapUpdateCapacity]; len(v) != 4 || binary.LittleEndian.Uint32(v) != 8*4096 {
+		t.Errorf("CapUpdateCapacity: unexpected value %v", v)
+	}
+
+	resp = handler.Handle(&Frame{Cmd: CmdUpdateBegin, Payload: beginPayload(img)})
+	if resp.Status != StatusOK || binary.LittleEndian.Uint16(resp.Payload) != MaxUpdateChunk {
+		t.Fatalf("UpdateBegin failed: status 0x%x %x", resp.Status, resp.Payload)
+	}
+	for off := 0; off < len(img); off += MaxUpdateChunk {
+		end := min(off+MaxUpdateChunk, len(img))
+		resp = handler.Handle(&Frame{Cmd: CmdUpdateData, Payload: dataPayload(off, img[off:end])})
+		if resp.Status != StatusOK || binary.LittleEndian.Uint32(resp.Payload) != uint32(end) {
+			t.Fatalf("UpdateData at %d failed: status 0x%x %x", off, resp.Status, resp.Payload)
+		}
+		if off == 0 {
+			// A skipped chunk is refused with the offset to resume at
+			resp = handler.Handle(&Frame{Cmd: CmdUpdateData, Payload: dataPayload(8000, img[8000:])})
+			var detail ErrorDetail
+			detail.UnmarshalBinary(resp.Payload)
+			if resp.Status != StatusInvalidData || detail.Message != "expected offset 4092" {
+				t.Errorf("Expected an offset error, got status 0x%x %q", resp.Status, detail.Message)
+			}
+		}
+	}
+
+	resp = handler.Handle(&Frame{Cmd: CmdUpdateStatus})
+	want := []byte{uint8(dfu.StateReceiving)}
+	want = binary.LittleEndian.AppendUint32(want, 12000)
+	want = binary.LittleEndian.AppendUint32(want, 12000)
+	want = binary.LittleEndian.AppendUint32(want, 8*4096)
+	if resp.Status != StatusOK || !bytes.Equal(resp.Payload, want) {
+		t.Errorf("UpdateStatus = %x, want %x", resp.Payload, want)
+	}
+
+	// Commit needs a verified image
+	resp = handler.Handle(&Frame{Cmd: CmdUpdateCommit})
+	if resp.Status != StatusInvalidData || len(inst.images) != 0 {
+		t.Fatalf("Commit before verify: status 0x%x, %d installs", resp.Status, len(inst.images))
+	}
+	if resp = handler.Handle(&Frame{Cmd: CmdUpdateVerify}); resp.Status != StatusOK {
+		t.Fatalf("UpdateVerify failed: status 0x%x", resp.Status)
+	}
+	if handler.RebootPending() {
+		t.Fatal("Reboot requested before commit")
+	}
+
+	if resp = handler.Handle(&Frame{Cmd: CmdUpdateCommit}); resp.Status != StatusOK {
+		t.Fatalf("UpdateCommit failed: status 0x%x", resp.Status)
+	}
+	if len(inst.images) != 1 || !bytes.Equal(inst.images[0], img) {
+		t.Error("Installed image differs from the one sent")
+	}
+	if !handler.RebootPending() {
+		t.Fatal("Expected a reboot after commit")
+	}
+	handler.Reboot()
+	if len(rebooter.modes) != 1 || rebooter.modes[0] != reboot.ModeNormal {
+		t.Errorf("Expected a normal reboot, got %v", rebooter.modes)
+	}
+}
+
+func TestFirmwareUpdateRejected(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	inst := &fakeInstaller{}
+	handler.SetUpdater(dfu.New(tinyfs.NewMemoryDevice(256, 4096, 2), inst))
+	handler.SetRebooter(&fakeRebooter{})
+
+	img := bytes.Repeat([]byte{0x5A}, 3000)
+	tests := []struct {
+		name   string
+		frame  *Frame
+		status uint8
+		reason uint8
+	}{
+		{"too large", &Frame{Cmd: CmdUpdateBegin, Payload: beginPayload(make([]byte, 3*4096))}, StatusNoSpace, ReasonNoSpace},
+		{"data before begin", &Frame{Cmd: CmdUpdateData, Payload: dataPayload(0, img)}, StatusInvalidData, ReasonValue},
+		{"short begin", &Frame{Cmd: CmdUpdateBegin, Payload: []byte{1, 2}}, StatusInvalidData, ReasonLength},
+		{"empty data", &Frame{Cmd: CmdUpdateData, Payload: []byte{0, 0, 0, 0}}, StatusInvalidData, ReasonLength},
+		{"begin", &Frame{Cmd: CmdUpdateBegin, Payload: append(beginPayload(img)[:4], 0, 0, 0, 0)}, StatusOK, 0},
+		{"incomplete", &Frame{Cmd: CmdUpdateVerify}, StatusInvalidData, ReasonValue},
+		{"data", &Frame{Cmd: CmdUpdateData, Payload: dataPayload(0, img)}, StatusOK, 0},
+		{"wrong CRC", &Frame{Cmd: CmdUpdateVerify}, StatusInvalidData, ReasonCorrupt},
+		{"commit", &Frame{Cmd: CmdUpdateCommit}, StatusInvalidData, ReasonValue},
+	}
+	for _, tt := range tests {
+		resp := handler.Handle(tt.frame)
+		if resp.Status != tt.status {
+			t.Errorf("%s: expected status 0x%x, got 0x%x", tt.name, tt.status, resp.Status)
+			continue
+		}
+		if tt.status != StatusOK && resp.Payload[0] != tt.reason {
+			t.Errorf("%s: expected reason 0x%x, got 0x%x", tt.name, tt.reason, resp.Payload[0])
+		}
+	}
+	if len(inst.images) != 0 || handler.RebootPending() {
+		t.Error("A rejected image was installed")
+	}
+}
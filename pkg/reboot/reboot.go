@@ -0,0 +1,31 @@
+// Package reboot restarts the device normally, into the RP2040 USB
+// bootloader, or into safe mode.
+// The hardware implementation is only built for rp2040 targets; everything
+// else depends on the Rebooter interface so it can be faked in tests.
+package reboot
+
+import "errors"
+
+// Mode selects what the device does after the reset.
+type Mode uint8
+
+const (
+	ModeNormal     Mode = iota // Regular boot
+	ModeBootloader             // RP2040 USB mass-storage bootloader (BOOTSEL)
+	ModeSafe                   // Boot without applying stored profiles
+)
+
+var (
+	ErrInvalidMode = errors.New("invalid reboot mode")
+)
+
+// Rebooter resets the device.
+// On hardware Reboot does not return unless the mode is invalid.
+type Rebooter interface {
+	Reboot(mode Mode) error
+}
+
+// Valid reports whether m is a known mode.
+func (m Mode) Valid() bool {
+	return m <= ModeSafe
+}
@@ -0,0 +1,42 @@
+//go:build rp2040
+
+package reboot
+
+import (
+	"device/arm"
+	"device/rp"
+	"machine"
+)
+
+// safeModeMagic marks a safe mode boot in watchdog scratch register 0.
+// The scratch registers survive a system reset but not a power cycle,
+// so unplugging the pad always returns to a normal boot.
+const safeModeMagic = 0x5AFE3D0E
+
+// Device resets the RP2040.
+type Device struct{}
+
+// Reboot resets the chip into the given mode.
+func (Device) Reboot(mode Mode) error {
+	switch mode {
+	case ModeNormal:
+		rp.WATCHDOG.SCRATCH0.Set(0)
+	case ModeSafe:
+		rp.WATCHDOG.SCRATCH0.Set(safeModeMagic)
+	case ModeBootloader:
+		rp.WATCHDOG.SCRATCH0.Set(0)
+		machine.EnterBootloader()
+	default:
+		return ErrInvalidMode
+	}
+	arm.SystemReset()
+	return nil
+}
+
+// SafeModeRequested reports whether this boot was requested as safe mode.
+// The request is cleared, so the next reset boots normally again.
+func SafeModeRequested() bool {
+	requested := rp.WATCHDOG.SCRATCH0.Get() == safeModeMagic
+	rp.WATCHDOG.SCRATCH0.Set(0)
+	return requested
+}
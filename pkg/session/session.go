@@ -0,0 +1,281 @@
+// Package session runs the device side of the serial protocol over any
+// io.ReadWriter: frame scanning, the text console, command dispatch and
+// response writing.
+//
+// The firmware wraps USB CDC in a non-blocking reader; host tools and tests
+// drive the same loop over pipes, ptys or TCP connections.
+package session
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/console"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+)
+
+const (
+	// DefaultFrameTimeout is the default inter-byte timeout after which a
+	// partially received frame is abandoned.
+	DefaultFrameTimeout = 100 * time.Millisecond
+
+	// dtrTimeout bounds the wait for the host to assert DTR.
+	dtrTimeout = 2 * time.Second
+
+	// settleDelay is the wait after DTR before processing commands.
+	settleDelay = 100 * time.Millisecond
+
+	// pollInterval is how long an idle loop sleeps, or how long a read
+	// blocks on transports with read deadlines.
+	pollInterval = time.Millisecond
+
+	// rebootDelay gives the host time to collect the last response before
+	// the device resets and disappears from the bus.
+	rebootDelay = 50 * time.Millisecond
+)
+
+// LineState reports the state of the serial control lines.
+// machine.USBCDC implements this.
+type LineState interface {
+	DTR() bool
+}
+
+// Observer receives session events, e.g. for the debug display.
+// Methods are called from the session goroutine and must not block.
+type Observer interface {
+	Incoming(frame *protocol.Frame)
+	Outgoing(resp *protocol.Response)
+	ConsoleLine(line string)
+	Error(err error)
+}
+
+// Session serves protocol requests over a byte stream.
+type Session struct {
+	rw       io.ReadWriter
+	handler  *protocol.Handler
+	console  *console.Console
+	lines    console.LineReader
+	scanner  *protocol.Scanner
+	line     LineState
+	observer Observer
+
+	frameTimeout time.Duration
+}
+
+// New creates a session serving handler over rw.
+//
+// If rw returns (0, nil) from Read when no data is available, the session
+// polls. If it has a SetReadDeadline method (net.Conn, *os.File), reads are
+// bounded by a short deadline so partial frames still time out. Otherwise a
+// stale partial frame is dropped when the next bytes arrive.
+func New(rw io.ReadWriter, handler *protocol.Handler) *Session {
+	return &Session{
+		rw:           rw,
+		handler:      handler,
+		console:      console.New(handler),
+		frameTimeout: DefaultFrameTimeout,
+	}
+}
+
+// SetLineState makes Run wait for DTR before serving requests.
+// TinyGo's USB CDC drops writes until the host has opened the port.
+func (s *Session) SetLineState(ls LineState) {
+	s.line = ls
+}
+
+// SetObserver sets the receiver of session events.
+func (s *Session) SetObserver(o Observer) {
+	s.observer = o
+}
+
+// SetFrameTimeout sets the inter-byte timeout for partial frames.
+// Call this before Run. Zero disables the timeout.
+func (s *Session) SetFrameTimeout(d time.Duration) {
+	s.frameTimeout = d
+}
+
+// flusher is implemented by transports that buffer writes.
+type flusher interface {
+	Flush() error
+}
+
+// deadliner is implemented by transports with read deadlines.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Run serves requests until reading fails, e.g. when a host-side
+// connection is closed. The firmware transport never fails, so on the
+// device Run does not return. The handler's session ends when Run returns
+// and, with a line state, whenever the host drops DTR.
+func (s *Session) Run() error {
+	s.scanner = protocol.NewScanner(s.frameTimeout)
+	buf := make([]byte, 64)
+	defer s.handler.EndSession()
+
+	if s.line != nil {
+		// Wait for DTR to be asserted before processing commands.
+		// TinyGo's USB CDC drops writes if DTR is not set, which causes
+		// PC apps to receive no response (frame too short: 0 bytes).
+		s.waitForDTR(dtrTimeout)
+
+		// After DTR is asserted, wait a bit more for the USB CDC data endpoints
+		// to be fully ready. The host may send data immediately after setting DTR,
+		// but we need time for the USB enumeration to complete on our end.
+		time.Sleep(settleDelay)
+	}
+
+	dl, hasDeadline := s.rw.(deadliner)
+	open := true
+
+	for {
+		if s.line != nil {
+			// The host closed the port; the next program starts locked
+			if dtr := s.line.DTR(); open && !dtr {
+				s.handler.EndSession()
+				open = false
+			} else if dtr {
+				open = true
+			}
+		}
+		if hasDeadline {
+			dl.SetReadDeadline(time.Now().Add(pollInterval))
+		}
+		n, err := s.rw.Read(buf)
+		now := time.Now()
+
+		if n > 0 {
+			// Drop a partial frame that went stale while the reader blocked
+			if s.scanner.Expire(now) {
+				s.drain()
+			}
+			s.process(buf[:n], now)
+		}
+
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		if n == 0 {
+			// Nothing received - abandon a partial frame once it times out
+			if s.scanner.Expire(now) {
+				s.drain()
+			}
+			if !hasDeadline {
+				time.Sleep(pollInterval)
+			}
+		}
+	}
+}
+
+// waitForDTR blocks until DTR is asserted or timeout.
+// This ensures the host serial port is fully open before we send responses.
+func (s *Session) waitForDTR(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s.line.DTR() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// process routes received bytes to the text console or the frame scanner.
+// Text is only recognized while no binary frame is in progress, so a frame
+// payload that happens to contain printable bytes is never misread.
+func (s *Session) process(data []byte, now time.Time) {
+	if s.scanner.Pending() == 0 {
+		n := s.lines.Write(data)
+		for {
+			line, ok := s.lines.Next()
+			if !ok {
+				break
+			}
+			s.runConsole(line)
+		}
+		data = data[n:]
+	}
+
+	if len(data) > 0 {
+		s.scanner.Push(data, now)
+		s.drain()
+	}
+}
+
+// runConsole executes a console line and writes the text reply.
+func (s *Session) runConsole(line string) {
+	if s.observer != nil {
+		s.observer.ConsoleLine(line)
+	}
+	out := s.console.Execute(line)
+	if out == "" {
+		return
+	}
+	if _, err := io.WriteString(s.rw, out); err != nil {
+		metrics.Inc(metrics.ResponseWriteErrors)
+		s.reportError(err)
+	}
+}
+
+// drain processes every complete frame the scanner holds.
+func (s *Session) drain() {
+	for {
+		frame, err := s.scanner.Next()
+		if err != nil {
+			// Frame error - the scanner has already resynchronized
+			s.reportError(err)
+			if err == protocol.ErrCRCMismatch {
+				// Tell the host its request was corrupted so it can retry
+				s.respond(&protocol.Response{Status: protocol.StatusCRCError})
+			}
+			continue
+		}
+		if frame == nil {
+			return
+		}
+
+		if s.observer != nil {
+			s.observer.Incoming(frame)
+		}
+
+		resp := s.handler.Handle(frame)
+
+		if s.observer != nil {
+			s.observer.Outgoing(resp)
+		}
+
+		s.respond(resp)
+
+		if s.handler.RebootPending() {
+			s.flush()
+			if err := s.handler.Reboot(); err != nil {
+				s.reportError(err)
+			}
+		}
+	}
+}
+
+// respond sends a response frame to the host.
+func (s *Session) respond(resp *protocol.Response) {
+	if err := protocol.WriteResponse(s.rw, resp); err != nil {
+		// Write error - continue and try to handle next frame
+		s.reportError(err)
+	}
+}
+
+// flush pushes any buffered output to the host and waits for it to be read.
+func (s *Session) flush() {
+	if f, ok := s.rw.(flusher); ok {
+		f.Flush()
+	}
+	time.Sleep(rebootDelay)
+}
+
+func (s *Session) reportError(err error) {
+	if s.observer != nil {
+		s.observer.Error(err)
+	}
+}
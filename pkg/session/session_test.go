@@ -0,0 +1,332 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/protocol"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/reboot"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/storage"
+
+	"tinygo.org/x/tinyfs"
+)
+
+func newTestHandler(t *testing.T) (*protocol.Handler, *storage.Manager) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := storage.New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	return protocol.NewHandler(mgr), mgr
+}
+
+// startSession serves a session over net.Pipe and returns the host end.
+func startSession(t *testing.T, handler *protocol.Handler, setup func(*Session)) (net.Conn, chan error) {
+	host, device := net.Pipe()
+	s := New(device, handler)
+	if setup != nil {
+		setup(s)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+	t.Cleanup(func() {
+		host.Close()
+		device.Close()
+	})
+	return host, done
+}
+
+// exchange sends a request and reads the response.
+func exchange(t *testing.T, conn net.Conn, frame *protocol.Frame) *protocol.Frame {
+	t.Helper()
+	if err := protocol.WriteFrame(conn, frame); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+	return readResponse(t, conn)
+}
+
+func readResponse(t *testing.T, conn net.Conn) *protocol.Frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := protocol.ReadFrame(conn)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+	return resp
+}
+
+func TestPing(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	conn, _ := startSession(t, handler, nil)
+
+	resp := exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdPing, Payload: []byte("hi")})
+	if resp.Cmd != protocol.StatusOK || string(resp.Payload) != "hi" {
+		t.Errorf("Unexpected response: status 0x%x payload %q", resp.Cmd, resp.Payload)
+	}
+}
+
+func TestRunReturnsOnClose(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	conn, done := startSession(t, handler, nil)
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error from a closed transport")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after the transport closed")
+	}
+}
+
+func TestConsole(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	conn, _ := startSession(t, handler, nil)
+
+	go io.WriteString(conn, "areyouatuffpad?\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Reading console reply failed: %v", err)
+	}
+	if line != "areyouatuffpad?yes\r\n" {
+		t.Errorf("Unexpected console reply %q", line)
+	}
+
+	// Binary requests keep working after console use
+	resp := exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdPing})
+	if resp.Cmd != protocol.StatusOK {
+		t.Errorf("Ping after console failed: status 0x%x", resp.Cmd)
+	}
+}
+
+func TestCRCErrorResponse(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	conn, _ := startSession(t, handler, nil)
+
+	var buf bytes.Buffer
+	protocol.WriteFrame(&buf, &protocol.Frame{Cmd: protocol.CmdPing, Payload: []byte{0x10, 0x20}})
+	bad := buf.Bytes()
+	bad[len(bad)-1] ^= 0xFF
+
+	go conn.Write(bad)
+	if resp := readResponse(t, conn); resp.Cmd != protocol.StatusCRCError {
+		t.Errorf("Expected StatusCRCError, got 0x%x", resp.Cmd)
+	}
+}
+
+func TestPartialFrameTimeout(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	conn, _ := startSession(t, handler, func(s *Session) {
+		s.SetFrameTimeout(20 * time.Millisecond)
+	})
+
+	// Half a frame, then silence longer than the timeout
+	var buf bytes.Buffer
+	protocol.WriteFrame(&buf, &protocol.Frame{Cmd: protocol.CmdPing, Payload: []byte{1, 2, 3}})
+	conn.Write(buf.Bytes()[:5])
+	time.Sleep(60 * time.Millisecond)
+
+	// The next request is not swallowed by the partial frame
+	resp := exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdPing, Payload: []byte{9}})
+	if resp.Cmd != protocol.StatusOK || !bytes.Equal(resp.Payload, []byte{9}) {
+		t.Errorf("Unexpected response: status 0x%x payload %v", resp.Cmd, resp.Payload)
+	}
+}
+
+// pipeRW joins the halves of two io.Pipes; it has no read deadlines, so
+// reads block like a plain stream.
+type pipeRW struct {
+	io.Reader
+	io.Writer
+}
+
+func TestPartialFrameTimeoutBlockingReader(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	defer reqW.Close()
+	defer respR.Close()
+
+	s := New(pipeRW{reqR, respW}, handler)
+	s.SetFrameTimeout(20 * time.Millisecond)
+	go s.Run()
+
+	var buf bytes.Buffer
+	protocol.WriteFrame(&buf, &protocol.Frame{Cmd: protocol.CmdPing, Payload: []byte{1, 2, 3}})
+	reqW.Write(buf.Bytes()[:5])
+	time.Sleep(60 * time.Millisecond)
+
+	go protocol.WriteFrame(reqW, &protocol.Frame{Cmd: protocol.CmdPing, Payload: []byte{9}})
+	resp, err := protocol.ReadFrame(respR)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+	if resp.Cmd != protocol.StatusOK || !bytes.Equal(resp.Payload, []byte{9}) {
+		t.Errorf("Unexpected response: status 0x%x payload %v", resp.Cmd, resp.Payload)
+	}
+}
+
+// recordingTransport records writes and flushes in order.
+type recordingTransport struct {
+	mu     sync.Mutex
+	in     *bytes.Reader
+	events []string
+	out    bytes.Buffer
+}
+
+func (r *recordingTransport) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, _ := r.in.Read(p)
+	return n, nil // Never EOF: behaves like an idle port
+}
+
+func (r *recordingTransport) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "write")
+	return r.out.Write(p)
+}
+
+func (r *recordingTransport) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "flush")
+	return nil
+}
+
+func (r *recordingTransport) log(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordingTransport) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+type fakeRebooter struct {
+	transport *recordingTransport
+}
+
+func (f *fakeRebooter) Reboot(mode reboot.Mode) error {
+	f.transport.log("reboot")
+	return nil
+}
+
+func TestRebootAfterFlush(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	var req bytes.Buffer
+	protocol.WriteFrame(&req, &protocol.Frame{Cmd: protocol.CmdReboot, Payload: []byte{uint8(reboot.ModeBootloader)}})
+	transport := &recordingTransport{in: bytes.NewReader(req.Bytes())}
+	handler.SetRebooter(&fakeRebooter{transport})
+
+	go New(transport, handler).Run()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(transport.snapshot()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	got := strings.Join(transport.snapshot(), ",")
+	if got != "write,flush,reboot" {
+		t.Errorf("Expected response written and flushed before reboot, got %s", got)
+	}
+}
+
+// fakeLine asserts DTR after a few polls.
+type fakeLine struct {
+	mu    sync.Mutex
+	polls int
+}
+
+func (f *fakeLine) DTR() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.polls++
+	return f.polls > 2
+}
+
+func TestWaitForDTR(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+
+	line := &fakeLine{}
+	conn, _ := startSession(t, handler, func(s *Session) {
+		s.SetLineState(line)
+	})
+
+	resp := exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdPing})
+	if resp.Cmd != protocol.StatusOK {
+		t.Errorf("Ping failed: status 0x%x", resp.Cmd)
+	}
+
+	line.mu.Lock()
+	defer line.mu.Unlock()
+	if line.polls < 3 {
+		t.Errorf("Expected the session to wait for DTR, polled %d times", line.polls)
+	}
+}
+
+// switchLine is a DTR line the test raises and drops.
+type switchLine struct {
+	mu  sync.Mutex
+	dtr bool
+}
+
+func (l *switchLine) DTR() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dtr
+}
+
+func (l *switchLine) set(dtr bool) {
+	l.mu.Lock()
+	l.dtr = dtr
+	l.mu.Unlock()
+}
+
+func TestDTRDropRelocks(t *testing.T) {
+	handler, mgr := newTestHandler(t)
+	defer mgr.Close()
+	line := &switchLine{dtr: true}
+	conn, _ := startSession(t, handler, func(s *Session) {
+		s.SetLineState(line)
+	})
+
+	exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdSetLock, Payload: []byte{1, 0x39, 0x05}})
+	exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdUnlock, Payload: []byte{0x39, 0x05}})
+
+	// The owner's tool closes the port, another program opens it
+	line.set(false)
+	time.Sleep(20 * time.Millisecond)
+	line.set(true)
+
+	resp := exchange(t, conn, &protocol.Frame{Cmd: protocol.CmdDeleteProfile, Payload: []byte{0}})
+	if resp.Cmd != protocol.StatusLocked {
+		t.Errorf("Expected StatusLocked after DTR dropped, got 0x%x", resp.Cmd)
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// TestConcurrentAccess hammers one manager from several goroutines, as the
+// serial handler, profile switching and lighting will. Run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	const (
+		workers = 8
+		rounds  = 25
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := uint8(w)          // Only this worker writes here
+			shared := uint8(workers) // Every worker writes here
+			for i := 0; i < rounds; i++ {
+				name := "w" + strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				p := config.Profile{BindingCount: uint8(i)}
+				p.SetName(name)
+				if err := mgr.SaveProfile(own, &p); err != nil {
+					errs <- err
+					return
+				}
+				if err := mgr.SaveProfile(shared, &p); err != nil {
+					errs <- err
+					return
+				}
+
+				var got config.Profile
+				if err := mgr.LoadProfile(own, &got); err != nil || got.GetName() != name {
+					errs <- errors.New("slot " + strconv.Itoa(int(own)) + " holds " + got.GetName() + ", want " + name)
+					return
+				}
+				// Another worker may have replaced it, but never torn it
+				if err := mgr.LoadProfile(shared, &got); err != nil || got.BindingCount > rounds {
+					errs <- errors.New("shared slot unreadable")
+					return
+				}
+
+				mgr.SaveDevice(&config.DeviceConfig{ActiveProfile: own})
+				mgr.LoadDevice(&config.DeviceConfig{})
+				mgr.ListProfiles()
+				mgr.GetStats()
+				mgr.ProfileHistory(own)
+				mgr.Damage()
+				if i%5 == 4 {
+					gens, _ := mgr.ProfileHistory(own)
+					if len(gens) > 0 {
+						if err := mgr.RestoreProfile(own, gens[0]); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	slots, err := mgr.ListProfiles()
+	if err != nil || len(slots) != workers+1 {
+		t.Errorf("ListProfiles = %v, %v", slots, err)
+	}
+	for _, slot := range slots {
+		var p config.Profile
+		if err := mgr.LoadProfile(slot, &p); err != nil {
+			t.Errorf("LoadProfile(%d) failed: %v", slot, err)
+		}
+	}
+	if d := mgr.Damage(); d.Any() {
+		t.Errorf("Damage after concurrent use: %+v", d)
+	}
+}
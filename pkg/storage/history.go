@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// History keeps the previous versions of each profile and of the device
+// config, so a bad upload can be rolled back. Before a record is replaced
+// or deleted, its current contents are copied to
+// /config/history/<slot>-<gen>.bin or device-<gen>.bin. Generation numbers
+// come from one counter shared by all records, so they also order
+// generations across records for pruning.
+//
+// History never makes the write it precedes fail: a generation is skipped
+// unless it fits along with that write, and archiving never removes other
+// generations. A live write that does not fit removes the oldest
+// generations of any record to make room.
+const (
+	historyDir   = "/config/history"
+	deviceRecord = "device" // Name of the device config in history files
+)
+
+// DefaultHistoryDepth is the number of generations kept per record unless
+// the device config sets another (config.DeviceConfig.HistoryDepth).
+const DefaultHistoryDepth = 3
+
+// historyDepth returns the number of generations cfg asks to keep.
+func historyDepth(cfg *config.DeviceConfig) int {
+	switch cfg.HistoryDepth {
+	case config.HistoryDefault:
+		return DefaultHistoryDepth
+	case config.HistoryOff:
+		return 0
+	default:
+		return int(min(cfg.HistoryDepth, config.MaxHistoryDepth))
+	}
+}
+
+// generation is one archived copy of a record.
+type generation struct {
+	record string // Slot number, or deviceRecord
+	gen    uint32
+}
+
+func (g generation) path() string {
+	return path.Join(historyDir, g.record+"-"+strconv.FormatUint(uint64(g.gen), 10)+profileSuffix)
+}
+
+// parseGeneration parses a history file name.
+func parseGeneration(name string) (generation, bool) {
+	base, ok := strings.CutSuffix(name, profileSuffix)
+	if !ok {
+		return generation{}, false // Also skips temp files
+	}
+	i := strings.LastIndexByte(base, '-')
+	if i <= 0 {
+		return generation{}, false
+	}
+	gen, err := strconv.ParseUint(base[i+1:], 10, 32)
+	if err != nil {
+		return generation{}, false
+	}
+	return generation{record: base[:i], gen: uint32(gen)}, true
+}
+
+func slotRecord(slot uint8) string {
+	return strconv.Itoa(int(slot))
+}
+
+// generations returns the archived generations of record, oldest first.
+// An empty record returns those of all records.
+func (m *Manager) generations(record string) ([]generation, error) {
+	entries, err := m.readDir(historyDir)
+	if err != nil {
+		if err = mapError(err, os.ErrNotExist); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var gens []generation
+	for _, entry := range entries {
+		g, ok := parseGeneration(entry.Name())
+		if ok && (record == "" || g.record == record) {
+			gens = append(gens, g)
+		}
+	}
+	slices.SortFunc(gens, func(a, b generation) int { return cmp.Compare(a.gen, b.gen) })
+	return gens, nil
+}
+
+// loadHistory finds the last generation number in use.
+func (m *Manager) loadHistory() error {
+	gens, err := m.generations("")
+	if err != nil {
+		return err
+	}
+	if len(gens) > 0 {
+		m.lastGen = gens[len(gens)-1].gen
+	}
+	return nil
+}
+
+// archive copies the record in file p to history before it is replaced by
+// next (nil when deleted), then prunes the record to the history depth.
+// Errors are ignored; see the history notes above.
+func (m *Manager) archive(record, p string, next []byte) {
+	if m.historyDepth == 0 {
+		return
+	}
+	data, err := m.readFile(p)
+	if err != nil || bytes.Equal(data, next) {
+		return // Nothing stored yet, or an unchanged save
+	}
+	if _, _, err := unseal(recordType(record), data); err != nil {
+		return // Not worth restoring
+	}
+	// Unlike a live write, a generation never prunes others to fit, and it
+	// is taken back if the write it precedes no longer fits.
+	if err := m.checkFit(len(data)); err != nil {
+		return
+	}
+	if err := m.fs.Mkdir(historyDir, 0755); err != nil && !isExist(err) {
+		return
+	}
+	g := generation{record: record, gen: m.lastGen + 1}
+	if err := m.writeFile(g.path(), data); err != nil {
+		m.fs.Remove(historyDir) // Only if empty
+		return
+	}
+	if next != nil && m.checkFit(len(next)) != nil {
+		m.fs.Remove(g.path())
+		m.fs.Remove(historyDir)
+		return
+	}
+	m.lastGen = g.gen
+	m.prune(record, m.historyDepth)
+}
+
+// pruneAll prunes every record to the history depth.
+func (m *Manager) pruneAll() {
+	gens, err := m.generations("")
+	if err != nil {
+		return
+	}
+	records := make(map[string]bool)
+	for _, g := range gens {
+		records[g.record] = true
+	}
+	for record := range records {
+		m.prune(record, m.historyDepth)
+	}
+	if m.historyDepth == 0 {
+		m.fs.Remove(historyDir)
+	}
+}
+
+// prune removes the oldest generations of record beyond keep.
+func (m *Manager) prune(record string, keep int) {
+	gens, err := m.generations(record)
+	if err != nil {
+		return
+	}
+	for _, g := range gens[:max(len(gens)-keep, 0)] {
+		m.fs.Remove(g.path())
+	}
+}
+
+// makeRoom removes the oldest generations until a record of size bytes
+// fits, see checkFit. The history directory goes too once it is empty, as
+// its metadata blocks are only freed then.
+func (m *Manager) makeRoom(size int) error {
+	err := m.checkFit(size)
+	if !errors.Is(err, ErrFlashFull) {
+		return err
+	}
+	gens, gerr := m.generations("")
+	if gerr != nil || len(gens) == 0 {
+		return err
+	}
+	for _, g := range gens {
+		if m.fs.Remove(g.path()) != nil {
+			return err
+		}
+		if err = m.checkFit(size); !errors.Is(err, ErrFlashFull) {
+			return err
+		}
+	}
+	m.fs.Remove(historyDir)
+	return m.checkFit(size)
+}
+
+// SetHistoryDepth sets the number of generations kept per record; 0 turns
+// history off. Records with more generations are pruned on their next save.
+// It lasts until the device config is saved, which sets the depth from its
+// HistoryDepth; New takes it from the stored device config.
+func (m *Manager) SetHistoryDepth(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.historyDepth = max(n, 0)
+}
+
+// HistoryDepth returns the number of generations kept per record.
+func (m *Manager) HistoryDepth() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.historyDepth
+}
+
+// ProfileHistory returns the generations kept for a slot, newest first.
+func (m *Manager) ProfileHistory(slot uint8) ([]uint32, error) {
+	return m.history(slotRecord(slot))
+}
+
+// DeviceHistory returns the generations kept for the device config,
+// newest first.
+func (m *Manager) DeviceHistory() ([]uint32, error) {
+	return m.history(deviceRecord)
+}
+
+func (m *Manager) history(record string) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gens, err := m.generations(record)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint32, len(gens))
+	for i, g := range gens {
+		out[len(gens)-1-i] = g.gen
+	}
+	return out, nil
+}
+
+// LoadProfileGeneration loads a generation of a slot, upgraded to the
+// current config version. Returns ErrProfileNotFound for an unknown
+// generation.
+func (m *Manager) LoadProfileGeneration(slot uint8, gen uint32, profile *config.Profile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.readGeneration(config.RecordProfile, generation{slotRecord(slot), gen}, ErrProfileNotFound)
+	if err != nil {
+		return err
+	}
+	return profile.UnmarshalBinary(data)
+}
+
+// LoadDeviceGeneration loads a generation of the device config, upgraded
+// to the current config version. Returns ErrDeviceNotFound for an unknown
+// generation.
+func (m *Manager) LoadDeviceGeneration(gen uint32, cfg *config.DeviceConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.readGeneration(config.RecordDevice, generation{deviceRecord, gen}, ErrDeviceNotFound)
+	if err != nil {
+		return err
+	}
+	return cfg.UnmarshalBinary(data)
+}
+
+// readGeneration reads an archived record. History is not migrated or
+// sealed at boot, so older records are upgraded here.
+func (m *Manager) readGeneration(rec config.Record, g generation, notFound error) ([]byte, error) {
+	data, err := m.readFile(g.path())
+	if err != nil {
+		return nil, mapError(err, notFound)
+	}
+	data, _, err = unseal(rec, data)
+	if err != nil {
+		return nil, err
+	}
+	if v, err := config.RecordVersion(data); err == nil && v == migrations.Target() {
+		if len(data) != rec.Size() {
+			return nil, ErrInvalidProfile
+		}
+		return data, nil
+	}
+
+	out, err := migrations.Migrate(rec, data)
+	if err != nil {
+		return nil, ErrVersionMismatch
+	}
+	if len(out) != rec.Size() {
+		return nil, ErrInvalidProfile
+	}
+	return out, nil
+}
+
+// RestoreProfile makes a generation the slot's current profile. The profile
+// it replaces is archived in turn, so a restore can be undone.
+func (m *Manager) RestoreProfile(slot uint8, gen uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.readGeneration(config.RecordProfile, generation{slotRecord(slot), gen}, ErrProfileNotFound)
+	if err != nil {
+		return err
+	}
+	var profile config.Profile
+	if err := profile.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	return m.saveProfile(slot, &profile)
+}
+
+// RestoreDevice makes a generation the current device config. The config
+// it replaces is archived in turn. The write lock flag and PIN are kept as
+// they are, so a restore cannot bring back an old PIN or clear the lock; if
+// the current config is damaged, the lock settings are unknown and the
+// restore fails with ErrRecordCorrupt.
+func (m *Manager) RestoreDevice(gen uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.readGeneration(config.RecordDevice, generation{deviceRecord, gen}, ErrDeviceNotFound)
+	if err != nil {
+		return err
+	}
+	var cfg config.DeviceConfig
+	if err := cfg.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	var current config.DeviceConfig
+	data, err = m.loadRecord(config.RecordDevice, deviceRecord, deviceFile, ErrDeviceNotFound)
+	switch {
+	case err == nil:
+		if err := current.UnmarshalBinary(data); err != nil {
+			return err
+		}
+	case !errors.Is(err, ErrDeviceNotFound):
+		return err
+	}
+	cfg.Flags = cfg.Flags&^config.DeviceFlagLocked | current.Flags&config.DeviceFlagLocked
+	cfg.LockPIN = current.LockPIN
+	return m.saveDevice(&cfg)
+}
+
+// wipeHistory removes all generations.
+func (m *Manager) wipeHistory() {
+	gens, _ := m.generations("")
+	for _, g := range gens {
+		m.fs.Remove(g.path())
+	}
+	m.fs.Remove(historyDir)
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+
+	"tinygo.org/x/tinyfs"
+)
+
+func saveNamed(t *testing.T, mgr *Manager, slot uint8, name string) {
+	t.Helper()
+	p := config.Profile{}
+	p.SetName(name)
+	if err := mgr.SaveProfile(slot, &p); err != nil {
+		t.Fatalf("SaveProfile(%d, %q) failed: %v", slot, name, err)
+	}
+}
+
+func profileName(t *testing.T, mgr *Manager, slot uint8, gen uint32) string {
+	t.Helper()
+	var p config.Profile
+	var err error
+	if gen == 0 {
+		err = mgr.LoadProfile(slot, &p)
+	} else {
+		err = mgr.LoadProfileGeneration(slot, gen, &p)
+	}
+	if err != nil {
+		t.Fatalf("Loading slot %d generation %d failed: %v", slot, gen, err)
+	}
+	return p.GetName()
+}
+
+func TestProfileHistory(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		saveNamed(t, mgr, 1, name)
+	}
+	saveNamed(t, mgr, 1, "E") // Unchanged, no new generation
+	saveNamed(t, mgr, 2, "Other")
+
+	gens, err := mgr.ProfileHistory(1)
+	if err != nil {
+		t.Fatalf("ProfileHistory failed: %v", err)
+	}
+	if len(gens) != DefaultHistoryDepth {
+		t.Fatalf("Expected %d generations, got %v", DefaultHistoryDepth, gens)
+	}
+	for i, want := range []string{"D", "C", "B"} {
+		if got := profileName(t, mgr, 1, gens[i]); got != want {
+			t.Errorf("Generation %d is %q, want %q", gens[i], got, want)
+		}
+	}
+	if gens, _ := mgr.ProfileHistory(2); len(gens) != 0 {
+		t.Errorf("Slot 2 has history %v", gens)
+	}
+
+	// Roll back to "C"; "E" becomes the newest generation
+	if err := mgr.RestoreProfile(1, gens[1]); err != nil {
+		t.Fatalf("RestoreProfile failed: %v", err)
+	}
+	if got := profileName(t, mgr, 1, 0); got != "C" {
+		t.Errorf("Restored profile is %q", got)
+	}
+	gens, _ = mgr.ProfileHistory(1)
+	if got := profileName(t, mgr, 1, gens[0]); got != "E" {
+		t.Errorf("Newest generation is %q, want the replaced profile", got)
+	}
+
+	// A deleted profile can be restored
+	if err := mgr.DeleteProfile(1); err != nil {
+		t.Fatalf("DeleteProfile failed: %v", err)
+	}
+	gens, _ = mgr.ProfileHistory(1)
+	if err := mgr.RestoreProfile(1, gens[0]); err != nil {
+		t.Fatalf("RestoreProfile after delete failed: %v", err)
+	}
+	if got := profileName(t, mgr, 1, 0); got != "C" {
+		t.Errorf("Restored profile is %q", got)
+	}
+
+	if err := mgr.RestoreProfile(1, 999); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Expected ErrProfileNotFound for an unknown generation, got %v", err)
+	}
+	if err := mgr.RestoreProfile(2, gens[0]); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Expected ErrProfileNotFound for another slot's generation, got %v", err)
+	}
+}
+
+func TestDeviceHistory(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	for _, b := range []uint8{10, 20, 30} {
+		if err := mgr.SaveDevice(&config.DeviceConfig{Brightness: b}); err != nil {
+			t.Fatalf("SaveDevice failed: %v", err)
+		}
+	}
+	gens, err := mgr.DeviceHistory()
+	if err != nil || len(gens) != 2 {
+		t.Fatalf("DeviceHistory = %v, %v", gens, err)
+	}
+	if err := mgr.RestoreDevice(gens[1]); err != nil {
+		t.Fatalf("RestoreDevice failed: %v", err)
+	}
+	var cfg config.DeviceConfig
+	if err := mgr.LoadDevice(&cfg); err != nil || cfg.Brightness != 10 {
+		t.Errorf("Restored device config %+v, %v", cfg, err)
+	}
+	if err := mgr.RestoreDevice(999); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Expected ErrDeviceNotFound, got %v", err)
+	}
+}
+
+func TestRestoreDeviceKeepsLock(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	// An old generation locked with another PIN, one without the lock,
+	// and the current config locked with PIN 2222
+	mgr.SaveDevice(&config.DeviceConfig{Brightness: 10, Flags: config.DeviceFlagLocked, LockPIN: 1111})
+	mgr.SaveDevice(&config.DeviceConfig{Brightness: 20})
+	mgr.SaveDevice(&config.DeviceConfig{Brightness: 30, Flags: config.DeviceFlagLocked, LockPIN: 2222})
+	gens, _ := mgr.DeviceHistory()
+	if len(gens) != 2 {
+		t.Fatalf("DeviceHistory = %v", gens)
+	}
+
+	for _, gen := range gens {
+		if err := mgr.RestoreDevice(gen); err != nil {
+			t.Fatalf("RestoreDevice failed: %v", err)
+		}
+		var cfg config.DeviceConfig
+		mgr.LoadDevice(&cfg)
+		if !cfg.Locked() || cfg.LockPIN != 2222 {
+			t.Errorf("Restoring generation %d changed the lock: %+v", gen, cfg)
+		}
+	}
+
+	// Unknown lock settings: refuse rather than guess
+	damage(t, mgr, deviceFile)
+	if err := mgr.RestoreDevice(gens[0]); !errors.Is(err, ErrRecordCorrupt) {
+		t.Errorf("Expected ErrRecordCorrupt, got %v", err)
+	}
+}
+
+func TestHistoryDepth(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	mgr.SetHistoryDepth(0)
+	saveNamed(t, mgr, 0, "A")
+	saveNamed(t, mgr, 0, "B")
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 0 {
+		t.Errorf("History kept with depth 0: %v", gens)
+	}
+
+	mgr.SetHistoryDepth(1)
+	saveNamed(t, mgr, 0, "C")
+	saveNamed(t, mgr, 0, "D")
+	gens, _ := mgr.ProfileHistory(0)
+	if len(gens) != 1 || profileName(t, mgr, 0, gens[0]) != "C" {
+		t.Errorf("Unexpected history with depth 1: %v", gens)
+	}
+}
+
+func TestHistoryDepthFromDeviceConfig(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	for _, name := range []string{"A", "B", "C", "D"} {
+		saveNamed(t, mgr, 0, name)
+	}
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != DefaultHistoryDepth {
+		t.Fatalf("Expected the default depth, got %v", gens)
+	}
+
+	// Lowering the depth prunes every record at once
+	mgr.SaveDevice(&config.DeviceConfig{HistoryDepth: 1})
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 1 || profileName(t, mgr, 0, gens[0]) != "C" {
+		t.Errorf("Unexpected history with depth 1: %v", gens)
+	}
+	mgr.Close()
+
+	// The stored depth applies after a reboot
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer mgr.Close()
+	if mgr.HistoryDepth() != 1 {
+		t.Errorf("HistoryDepth after reboot = %d", mgr.HistoryDepth())
+	}
+
+	mgr.SaveDevice(&config.DeviceConfig{HistoryDepth: config.HistoryOff})
+	saveNamed(t, mgr, 0, "E")
+	if gens, _ := mgr.DeviceHistory(); len(gens) != 0 {
+		t.Errorf("Device history kept with history off: %v", gens)
+	}
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 0 {
+		t.Errorf("Profile history kept with history off: %v", gens)
+	}
+}
+
+func TestHistoryAcrossReboot(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	saveNamed(t, mgr, 0, "A")
+	saveNamed(t, mgr, 0, "B")
+	before, _ := mgr.ProfileHistory(0)
+	mgr.Close()
+
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer mgr.Close()
+	saveNamed(t, mgr, 0, "C")
+	after, _ := mgr.ProfileHistory(0)
+	if len(after) != 2 || after[1] != before[0] || after[0] <= before[0] {
+		t.Errorf("Generations %v after reboot, %v before", after, before)
+	}
+
+	// Factory reset clears history
+	if err := mgr.ForceWipe(); err != nil {
+		t.Fatal(err)
+	}
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 0 {
+		t.Errorf("History survived a wipe: %v", gens)
+	}
+}
+
+func TestHistoryOldVersion(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	// A generation archived by firmware with config version 1
+	mgr.SetHistoryDepth(1)
+	writeFixture(t, mgr, mgr.profilePath(0), fixtureProfile(1, "Old"))
+	saveNamed(t, mgr, 0, "New")
+	gens, _ := mgr.ProfileHistory(0)
+
+	var steps int
+	withMigrations(t, migrationsV2(&steps))
+	var p config.Profile
+	if err := mgr.LoadProfileGeneration(0, gens[0], &p); err != nil {
+		t.Fatalf("LoadProfileGeneration failed: %v", err)
+	}
+	if p.Version != 2 || p.RGBColor != 0x332211 || p.GetName() != "Old" || steps != 1 {
+		t.Errorf("Generation not migrated: %+v", p)
+	}
+}
+
+func TestHistoryPrunedWhenFull(t *testing.T) {
+	mgr, err := New(tinyfs.NewMemoryDevice(256, 4096, 12), true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer mgr.Close()
+
+	saveNamed(t, mgr, 0, "A")
+	saveNamed(t, mgr, 0, "B")
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 1 {
+		t.Fatalf("Expected one generation, got %v", gens)
+	}
+
+	// History gives way to new profiles
+	var saved int
+	for ; saved < 256; saved++ {
+		p := config.Profile{}
+		if err = mgr.SaveProfile(uint8(1+saved), &p); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrFlashFull) {
+		t.Fatalf("Expected ErrFlashFull, got %v", err)
+	}
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 0 {
+		t.Errorf("History not pruned on a full flash: %v", gens)
+	}
+
+	// Without history the same flash holds about as many profiles. LittleFS
+	// splits a directory depending on how full the flash is at the time, so
+	// the two layouts can differ by a few profiles.
+	bare, err := New(tinyfs.NewMemoryDevice(256, 4096, 12), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bare.Close()
+	var bareSaved int
+	for ; bareSaved < 256; bareSaved++ {
+		p := config.Profile{}
+		if bare.SaveProfile(uint8(bareSaved), &p) != nil {
+			break
+		}
+	}
+	if saved+1 < bareSaved*3/4 {
+		t.Errorf("History cost profiles: %d+1 saved, %d without history", saved, bareSaved)
+	}
+}
+
+func TestArchiveDoesNotPrune(t *testing.T) {
+	mgr, err := New(tinyfs.NewMemoryDevice(256, 4096, 16), true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer mgr.Close()
+	saveNamed(t, mgr, 0, "A")
+	saveNamed(t, mgr, 0, "B")
+	saveNamed(t, mgr, 1, "A")
+	for slot := 2; mgr.CanFitProfile(); slot++ {
+		saveNamed(t, mgr, uint8(slot), "Filler")
+	}
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 1 {
+		t.Fatalf("Expected slot 0 to keep one generation, got %v", gens)
+	}
+
+	// Deleting slot 1 on the full flash skips its history instead of
+	// pruning slot 0's to make room
+	if err := mgr.DeleteProfile(1); err != nil {
+		t.Fatal(err)
+	}
+	if gens, _ := mgr.ProfileHistory(0); len(gens) != 1 {
+		t.Errorf("Archiving slot 1 pruned slot 0's history: %v", gens)
+	}
+	if gens, _ := mgr.ProfileHistory(1); len(gens) != 0 {
+		t.Errorf("Slot 1 archived without room: %v", gens)
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// The name of the LittleFS superblock entry, lfsMagic, sits at byte
+// magicOffset of both blocks of the superblock pair.
+const magicOffset = 8
+
+var lfsMagic = []byte("littlefs")
+
+// Open mounts the filesystem in the partition.Storage area of flash, which
+// maps the flash from offset base on like machine.Flash. On a blank area
+// it looks for a filesystem kept by firmware from before the fixed layout
+// (see FindOld) and moves it with Relocate. If that fails, Open returns the
+// error without formatting, so the records can still be recovered by later
+// firmware; with nothing to move, it formats the area.
+func Open(flash tinyfs.BlockDevice, base int64) (*Manager, error) {
+	dev, err := partition.Storage(flash, base)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := New(dev, false); err == nil {
+		return m, nil
+	}
+	if old := FindOld(flash, partition.StorageStart-base); old != nil {
+		if err := Relocate(old, dev); err != nil {
+			return nil, fmt.Errorf("moving the old filesystem: %w", err)
+		}
+		return New(dev, false)
+	}
+	return New(dev, true)
+}
+
+// FindOld returns the filesystem that firmware from before the fixed flash
+// layout kept in machine.Flash, from the first erase block after that
+// firmware to the end of flash, or nil if there is none. That firmware may
+// have been smaller, so the superblock is looked for in every erase block
+// of the first limit bytes of flash; a candidate counts if it mounts, which
+// LittleFS only allows with the block count it was formatted with. limit
+// must leave the superblock pair outside the new filesystem.
+func FindOld(flash tinyfs.BlockDevice, limit int64) tinyfs.BlockDevice {
+	ebs := flash.EraseBlockSize()
+	magic := make([]byte, len(lfsMagic))
+	for off := int64(0); off+2*ebs <= limit; off += ebs {
+		if _, err := flash.ReadAt(magic, off+magicOffset); err != nil || !bytes.Equal(magic, lfsMagic) {
+			continue
+		}
+		old, err := partition.New(flash, off, flash.Size()-off)
+		if err != nil {
+			continue
+		}
+		if lfs, err := mount(old, false); err == nil {
+			lfs.Unmount()
+			return old
+		}
+	}
+	return nil
+}
+
+// Relocate moves the records of the filesystem on old, as found by
+// FindOld, to blockDev, which overlaps it. LittleFS cannot move or shrink a
+// filesystem, so the device config and profiles are read into memory,
+// blockDev is formatted and they are written back as they were. History is
+// dropped. Last, the superblock pair of old is erased so it is not found
+// again; it must lie outside blockDev.
+//
+// Any error reading old returns before the flash is touched. A power loss
+// or error while the records are written back loses those not yet written,
+// as old is partly overwritten by then.
+func Relocate(old, blockDev tinyfs.BlockDevice) error {
+	lfs, err := mount(old, false)
+	if err != nil {
+		return err
+	}
+	src := &Manager{fs: lfs, blockDev: old, mounted: true}
+	files, err := src.records()
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	lfs = newLFS(blockDev)
+	if err := lfs.Format(); err != nil {
+		return mapError(err, ErrFilesystem)
+	}
+	if err := lfs.Mount(); err != nil {
+		return mapError(err, ErrFilesystem)
+	}
+	dst := &Manager{fs: lfs, blockDev: blockDev, mounted: true}
+	defer dst.Close()
+	if err := dst.ensureDirs(); err != nil {
+		return mapError(err, ErrFilesystem)
+	}
+	for p, data := range files {
+		if err := dst.writeFile(p, data); err != nil {
+			return mapError(err, ErrFilesystem)
+		}
+	}
+	return old.EraseBlocks(0, 2)
+}
+
+// records reads the device config and profile files, as stored.
+func (m *Manager) records() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	data, err := m.readFile(deviceFile)
+	switch err = mapError(err, ErrDeviceNotFound); {
+	case err == nil:
+		files[deviceFile] = data
+	case !errors.Is(err, ErrDeviceNotFound):
+		return nil, err
+	}
+	slots, err := m.listProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		p := m.profilePath(slot)
+		data, err := m.readFile(p)
+		if err != nil {
+			return nil, mapError(err, ErrProfileNotFound)
+		}
+		files[p] = data
+	}
+	return files, nil
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// DefaultWriteDelay is how long a Queue holds a save before writing it.
+const DefaultWriteDelay = 5 * time.Second
+
+// Queue defers and coalesces saves made at runtime, such as cycling
+// profiles or adjusting brightness, so a burst of changes costs one flash
+// write per record instead of one per change. A save is written once it
+// has been pending for the queue's delay; later saves of the same record
+// replace it without moving that deadline. Loads through the queue see
+// pending saves, and a save that matches the stored record is dropped
+// without writing.
+//
+// Runtime code should change records with UpdateDevice and UpdateProfile,
+// which edit the current record, rather than save a copy it loaded
+// earlier: the PC may have written the record since. The write lock flag
+// and PIN are never taken from a queued device config; only the protocol's
+// lock commands change them.
+//
+// Nothing is written in the background: the owner calls FlushDue
+// periodically and Flush before the device restarts. Queue is safe for
+// concurrent use.
+type Queue struct {
+	mgr   *Manager
+	delay time.Duration
+	now   func() time.Time
+
+	mu       sync.Mutex
+	device   *pendingDevice
+	profiles map[uint8]*pendingProfile
+}
+
+type pendingDevice struct {
+	cfg config.DeviceConfig
+	due time.Time
+}
+
+type pendingProfile struct {
+	profile config.Profile
+	due     time.Time
+}
+
+// PendingWrites describes the saves a Queue has not written yet.
+type PendingWrites struct {
+	Device   bool      // The device config
+	Profiles []uint8   // Profile slots in ascending order
+	Due      time.Time // When the earliest is written; zero if none
+}
+
+// Any reports whether any save is pending.
+func (p PendingWrites) Any() bool {
+	return p.Device || len(p.Profiles) > 0
+}
+
+// NewQueue creates a queue writing to mgr after delay.
+func NewQueue(mgr *Manager, delay time.Duration) *Queue {
+	return &Queue{
+		mgr:      mgr,
+		delay:    delay,
+		now:      time.Now,
+		profiles: make(map[uint8]*pendingProfile),
+	}
+}
+
+// SaveDevice queues a save of the device configuration.
+func (q *Queue) SaveDevice(cfg *config.DeviceConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.device == nil {
+		q.device = &pendingDevice{due: q.now().Add(q.delay)}
+	}
+	q.device.cfg = *cfg
+}
+
+// SaveProfile queues a save of the profile in slot.
+func (q *Queue) SaveProfile(slot uint8, profile *config.Profile) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.profiles[slot]
+	if p == nil {
+		p = &pendingProfile{due: q.now().Add(q.delay)}
+		q.profiles[slot] = p
+	}
+	p.profile = *profile
+}
+
+// UpdateDevice queues an edit of the current device configuration: fn
+// changes the pending config, or a copy of the stored one. A missing config
+// starts from defaults.
+func (q *Queue) UpdateDevice(fn func(cfg *config.DeviceConfig)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.device == nil {
+		var cfg config.DeviceConfig
+		if err := q.mgr.LoadDevice(&cfg); err != nil && !errors.Is(err, ErrDeviceNotFound) {
+			return err
+		}
+		q.device = &pendingDevice{cfg: cfg, due: q.now().Add(q.delay)}
+	}
+	fn(&q.device.cfg)
+	return nil
+}
+
+// UpdateProfile queues an edit of the current profile in slot, like
+// UpdateDevice. Returns ErrProfileNotFound for an empty slot.
+func (q *Queue) UpdateProfile(slot uint8, fn func(profile *config.Profile)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.profiles[slot]
+	if p == nil {
+		var profile config.Profile
+		if err := q.mgr.LoadProfile(slot, &profile); err != nil {
+			return err
+		}
+		p = &pendingProfile{profile: profile, due: q.now().Add(q.delay)}
+		q.profiles[slot] = p
+	}
+	fn(&p.profile)
+	return nil
+}
+
+// LoadDevice loads the pending device configuration, or the stored one.
+func (q *Queue) LoadDevice(cfg *config.DeviceConfig) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.device != nil {
+		*cfg = q.device.cfg
+		return nil
+	}
+	return q.mgr.LoadDevice(cfg)
+}
+
+// LoadProfile loads the pending profile in slot, or the stored one.
+func (q *Queue) LoadProfile(slot uint8, profile *config.Profile) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if p := q.profiles[slot]; p != nil {
+		*profile = p.profile
+		return nil
+	}
+	return q.mgr.LoadProfile(slot, profile)
+}
+
+// DeleteProfile drops a pending save of slot and deletes the stored
+// profile right away.
+func (q *Queue) DeleteProfile(slot uint8) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.profiles, slot)
+	return q.mgr.DeleteProfile(slot)
+}
+
+// Pending returns the saves not written yet.
+func (q *Queue) Pending() PendingWrites {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var p PendingWrites
+	if q.device != nil {
+		p.Device = true
+		p.Due = q.device.due
+	}
+	p.Profiles = slices.Sorted(maps.Keys(q.profiles))
+	for _, slot := range p.Profiles {
+		if due := q.profiles[slot].due; p.Due.IsZero() || due.Before(p.Due) {
+			p.Due = due
+		}
+	}
+	return p
+}
+
+// FlushDue writes the saves that have been pending for the delay.
+func (q *Queue) FlushDue() error {
+	return q.flush(false)
+}
+
+// Flush writes every pending save, for example before a reboot.
+func (q *Queue) Flush() error {
+	return q.flush(true)
+}
+
+// flush writes the due saves, or all of them. A save that fails stays
+// queued and is retried after another delay; the first error is returned.
+// A device save over a damaged stored config is dropped instead, see
+// writeDevice: retrying cannot succeed until the PC writes the config.
+func (q *Queue) flush(all bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	due := func(t time.Time) bool { return all || !t.After(now) }
+	var firstErr error
+	fail := func(err error) bool {
+		if err == nil {
+			return false
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		return true
+	}
+
+	if q.device != nil && due(q.device.due) {
+		err := q.writeDevice(&q.device.cfg)
+		if fail(err) && !errors.Is(err, ErrRecordCorrupt) {
+			q.device.due = now.Add(q.delay)
+		} else {
+			q.device = nil
+		}
+	}
+	for _, slot := range slices.Sorted(maps.Keys(q.profiles)) {
+		p := q.profiles[slot]
+		if !due(p.due) {
+			continue
+		}
+		if fail(q.writeProfile(slot, &p.profile)) {
+			p.due = now.Add(q.delay)
+		} else {
+			delete(q.profiles, slot)
+		}
+	}
+	return firstErr
+}
+
+// writeDevice saves cfg with the stored lock settings, unless it then
+// matches the stored config. If the stored config is damaged, the lock
+// settings are unknown and it fails with ErrRecordCorrupt: writing would
+// either unlock the pad or lock it with a PIN nobody knows.
+func (q *Queue) writeDevice(cfg *config.DeviceConfig) error {
+	cfg.Version = config.CurrentVersion
+	var stored config.DeviceConfig
+	err := q.mgr.LoadDevice(&stored)
+	if err != nil && !errors.Is(err, ErrDeviceNotFound) {
+		return err // Damaged: the lock settings are unknown
+	}
+	cfg.Flags = cfg.Flags&^config.DeviceFlagLocked | stored.Flags&config.DeviceFlagLocked
+	cfg.LockPIN = stored.LockPIN
+	if err == nil && stored == *cfg {
+		return nil
+	}
+	return q.mgr.SaveDevice(cfg)
+}
+
+// writeProfile saves profile unless it matches the stored profile.
+func (q *Queue) writeProfile(slot uint8, profile *config.Profile) error {
+	profile.Version = config.CurrentVersion
+	var stored config.Profile
+	if q.mgr.LoadProfile(slot, &stored) == nil && stored == *profile {
+		return nil
+	}
+	return q.mgr.SaveProfile(slot, profile)
+}
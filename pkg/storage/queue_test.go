@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+
+	"tinygo.org/x/tinyfs"
+)
+
+// erasingDevice counts erased blocks, the unit of flash wear.
+type erasingDevice struct {
+	*tinyfs.MemBlockDevice
+	erases int
+}
+
+func (d *erasingDevice) EraseBlocks(start, n int64) error {
+	d.erases += int(n)
+	return d.MemBlockDevice.EraseBlocks(start, n)
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestQueue(t *testing.T) (*Queue, *erasingDevice, *fakeClock) {
+	t.Helper()
+	dev := &erasingDevice{MemBlockDevice: tinyfs.NewMemoryDevice(256, 4096, 64)}
+	mgr, err := New(dev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { mgr.Close() })
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	q := NewQueue(mgr, DefaultWriteDelay)
+	q.now = clock.Now
+	return q, dev, clock
+}
+
+// erasesFor returns the blocks erased by fn.
+func erasesFor(dev *erasingDevice, fn func()) int {
+	before := dev.erases
+	fn()
+	return dev.erases - before
+}
+
+func TestQueueCoalesces(t *testing.T) {
+	q, dev, clock := newTestQueue(t)
+	q.SaveDevice(&config.DeviceConfig{Brightness: 10})
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Twenty brightness steps within the delay are written once
+	steps := erasesFor(dev, func() {
+		for b := uint8(11); b <= 30; b++ {
+			q.SaveDevice(&config.DeviceConfig{Brightness: b})
+			clock.Advance(100 * time.Millisecond)
+			if err := q.FlushDue(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if steps != 0 {
+		t.Errorf("Saves within the delay erased %d blocks", steps)
+	}
+	if p := q.Pending(); !p.Device || !p.Due.Equal(time.Unix(1000, 0).Add(DefaultWriteDelay)) {
+		t.Errorf("Unexpected pending writes: %+v", p)
+	}
+	var cfg config.DeviceConfig
+	if q.LoadDevice(&cfg); cfg.Brightness != 30 {
+		t.Errorf("LoadDevice does not see the pending save: %+v", cfg)
+	}
+	if q.mgr.LoadDevice(&cfg); cfg.Brightness != 10 {
+		t.Errorf("Save written before its delay: %+v", cfg)
+	}
+
+	flushed := erasesFor(dev, func() {
+		clock.Advance(DefaultWriteDelay)
+		if err := q.FlushDue(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if p := q.Pending(); p.Any() {
+		t.Errorf("Still pending after the delay: %+v", p)
+	}
+	if q.mgr.LoadDevice(&cfg); cfg.Brightness != 30 {
+		t.Errorf("Stored device config %+v", cfg)
+	}
+
+	// The same twenty saves written straight through
+	direct := erasesFor(dev, func() {
+		for b := uint8(31); b <= 50; b++ {
+			q.mgr.SaveDevice(&config.DeviceConfig{Brightness: b})
+		}
+	})
+	if flushed >= direct {
+		t.Errorf("Coalesced save erased %d blocks, twenty direct saves %d", flushed, direct)
+	}
+}
+
+func TestQueueSkipsUnchanged(t *testing.T) {
+	q, dev, clock := newTestQueue(t)
+	profile := config.Profile{BindingCount: 2}
+	profile.SetName("Driving")
+	q.SaveProfile(3, &profile)
+	q.Flush()
+
+	// Cycling away from a profile and back before the delay writes nothing
+	erased := erasesFor(dev, func() {
+		other := profile
+		other.SetName("Flying")
+		q.SaveProfile(3, &other)
+		q.SaveProfile(3, &profile)
+		clock.Advance(DefaultWriteDelay)
+		if err := q.FlushDue(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if erased != 0 {
+		t.Errorf("Unchanged profile erased %d blocks", erased)
+	}
+	if gens, _ := q.mgr.ProfileHistory(3); len(gens) != 0 {
+		t.Errorf("Unchanged profile archived: %v", gens)
+	}
+}
+
+func TestQueueDeadlines(t *testing.T) {
+	q, _, clock := newTestQueue(t)
+	start := clock.Now()
+	q.SaveProfile(1, &config.Profile{})
+	clock.Advance(2 * time.Second)
+	q.SaveProfile(2, &config.Profile{})
+	q.SaveProfile(1, &config.Profile{RGBColor: 1}) // Keeps slot 1's deadline
+
+	p := q.Pending()
+	if len(p.Profiles) != 2 || p.Profiles[0] != 1 || p.Profiles[1] != 2 || !p.Due.Equal(start.Add(DefaultWriteDelay)) {
+		t.Fatalf("Unexpected pending writes: %+v", p)
+	}
+
+	clock.Advance(DefaultWriteDelay - 2*time.Second)
+	q.FlushDue()
+	if p := q.Pending(); len(p.Profiles) != 1 || p.Profiles[0] != 2 {
+		t.Errorf("Expected only slot 2 pending, got %+v", p)
+	}
+	var profile config.Profile
+	if err := q.mgr.LoadProfile(1, &profile); err != nil || profile.RGBColor != 1 {
+		t.Errorf("Slot 1 = %+v, %v", profile, err)
+	}
+
+	// Deleting drops the pending save
+	if err := q.DeleteProfile(2); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Expected ErrProfileNotFound for a never written slot, got %v", err)
+	}
+	clock.Advance(DefaultWriteDelay)
+	q.FlushDue()
+	if q.mgr.ProfileExists(2) || q.Pending().Any() {
+		t.Error("Deleted profile was written")
+	}
+}
+
+func TestQueueRetriesFailedWrite(t *testing.T) {
+	dev := &erasingDevice{MemBlockDevice: tinyfs.NewMemoryDevice(256, 4096, 12)}
+	mgr, err := New(dev, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Close()
+	var slot int
+	for ; mgr.SaveProfile(uint8(slot), &config.Profile{}) == nil; slot++ {
+	}
+
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	q := NewQueue(mgr, time.Second)
+	q.now = clock.Now
+	q.SaveProfile(uint8(slot), &config.Profile{})
+	if err := q.Flush(); !errors.Is(err, ErrFlashFull) {
+		t.Fatalf("Expected ErrFlashFull, got %v", err)
+	}
+	p := q.Pending()
+	if len(p.Profiles) != 1 || !p.Due.Equal(clock.Now().Add(time.Second)) {
+		t.Errorf("Failed save not requeued: %+v", p)
+	}
+
+	// Not retried before the delay, then retried
+	if err := q.FlushDue(); err != nil {
+		t.Errorf("Retried before the delay: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := q.FlushDue(); !errors.Is(err, ErrFlashFull) {
+		t.Errorf("Expected the retry to fail with ErrFlashFull, got %v", err)
+	}
+	if p := q.Pending(); !p.Due.Equal(clock.Now().Add(time.Second)) {
+		t.Errorf("Failed retry not requeued: %+v", p)
+	}
+}
+
+func TestQueueDropsSaveOverDamagedDevice(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	q.mgr.SaveDevice(&config.DeviceConfig{Flags: config.DeviceFlagLocked, LockPIN: 1234})
+	damage(t, q.mgr, deviceFile)
+
+	// Reported once, then dropped rather than retried forever
+	q.SaveDevice(&config.DeviceConfig{Brightness: 10})
+	if err := q.Flush(); !errors.Is(err, ErrRecordCorrupt) {
+		t.Fatalf("Expected ErrRecordCorrupt, got %v", err)
+	}
+	if p := q.Pending(); p.Any() {
+		t.Errorf("Save over a damaged config still queued: %+v", p)
+	}
+	if err := q.Flush(); err != nil {
+		t.Errorf("Second flush failed: %v", err)
+	}
+
+	// The PC rewriting the config makes saves work again
+	q.mgr.SaveDevice(&config.DeviceConfig{Brightness: 20})
+	q.SaveDevice(&config.DeviceConfig{Brightness: 30})
+	if err := q.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	var cfg config.DeviceConfig
+	if err := q.mgr.LoadDevice(&cfg); err != nil || cfg.Brightness != 30 {
+		t.Errorf("Stored config %+v, %v", cfg, err)
+	}
+}
+
+func TestQueueKeepsPCWrites(t *testing.T) {
+	q, _, clock := newTestQueue(t)
+
+	// A stale copy queued before the PC locked the pad
+	stale := config.DeviceConfig{Brightness: 10, DebounceMs: 5}
+	q.SaveDevice(&stale)
+	q.Flush()
+	q.SaveDevice(&config.DeviceConfig{Brightness: 11, DebounceMs: 5})
+	q.mgr.SaveDevice(&config.DeviceConfig{Flags: config.DeviceFlagLocked, LockPIN: 1234, Brightness: 10, DebounceMs: 8})
+	clock.Advance(DefaultWriteDelay)
+	if err := q.FlushDue(); err != nil {
+		t.Fatal(err)
+	}
+	var cfg config.DeviceConfig
+	q.mgr.LoadDevice(&cfg)
+	if !cfg.Locked() || cfg.LockPIN != 1234 || cfg.Brightness != 11 {
+		t.Errorf("Queued save replaced the lock: %+v", cfg)
+	}
+
+	// Updates edit the current record, so they keep the PC's other fields
+	q.mgr.SaveDevice(&config.DeviceConfig{Flags: config.DeviceFlagLocked, LockPIN: 1234, Brightness: 11, DebounceMs: 8})
+	for i := 0; i < 3; i++ {
+		if err := q.UpdateDevice(func(cfg *config.DeviceConfig) { cfg.Brightness++ }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.LoadDevice(&cfg); err != nil || cfg.Brightness != 14 || cfg.DebounceMs != 8 {
+		t.Errorf("Pending config %+v, %v", cfg, err)
+	}
+	q.Flush()
+	q.mgr.LoadDevice(&cfg)
+	if cfg.Brightness != 14 || cfg.DebounceMs != 8 || !cfg.Locked() {
+		t.Errorf("Stored config %+v", cfg)
+	}
+
+	// Profiles too; an empty slot cannot be edited
+	saveNamed(t, q.mgr, 2, "Driving")
+	if err := q.UpdateProfile(2, func(p *config.Profile) { p.RGBColor = 0xFF0000 }); err != nil {
+		t.Fatal(err)
+	}
+	q.Flush()
+	var p config.Profile
+	if q.mgr.LoadProfile(2, &p); p.RGBColor != 0xFF0000 || p.GetName() != "Driving" {
+		t.Errorf("Stored profile %+v", p)
+	}
+	if err := q.UpdateProfile(3, func(*config.Profile) {}); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Expected ErrProfileNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"strconv"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+)
+
+// Stored records are wrapped in an envelope, so bit rot or a half-erased
+// block is caught on load instead of decoding to garbage bindings:
+//
+//	[Magic:4][Type:1][Reserved:1][Length:2][Payload:Length][CRC32:4]
+//
+// Type is the config.Record, Length the payload size and CRC32 (IEEE) covers
+// everything before it. Files written before envelopes hold the bare
+// payload; they are still accepted and sealed at boot.
+
+const (
+	recordMagic    = 0x46465554 // "TUFF"
+	envelopeHeader = 8
+	envelopeSize   = envelopeHeader + 4 // Header and CRC
+)
+
+// seal wraps a record payload in an envelope.
+func seal(rec config.Record, payload []byte) []byte {
+	buf := make([]byte, envelopeHeader, len(payload)+envelopeSize)
+	binary.LittleEndian.PutUint32(buf[0:], recordMagic)
+	buf[4] = uint8(rec)
+	binary.LittleEndian.PutUint16(buf[6:], uint16(len(payload)))
+	buf = append(buf, payload...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// unseal checks the envelope of a stored rec and returns its payload.
+// legacy is true for a bare record from before envelopes, recognised by
+// its size. Anything else that does not check out is ErrRecordCorrupt.
+func unseal(rec config.Record, data []byte) (payload []byte, legacy bool, err error) {
+	if len(data) < envelopeSize || binary.LittleEndian.Uint32(data) != recordMagic {
+		if len(data) == rec.Size() {
+			return data, true, nil
+		}
+		return nil, false, ErrRecordCorrupt
+	}
+
+	n := int(binary.LittleEndian.Uint16(data[6:]))
+	if data[4] != uint8(rec) || len(data) != n+envelopeSize {
+		return nil, false, ErrRecordCorrupt
+	}
+	end := envelopeHeader + n
+	if crc32.ChecksumIEEE(data[:end]) != binary.LittleEndian.Uint32(data[end:]) {
+		return nil, false, ErrRecordCorrupt
+	}
+	return data[envelopeHeader:end], false, nil
+}
+
+// recordType returns the type of a history record name.
+func recordType(record string) config.Record {
+	if record == deviceRecord {
+		return config.RecordDevice
+	}
+	return config.RecordProfile
+}
+
+// Damage lists the stored records that failed their checksum.
+type Damage struct {
+	Device   bool    // The device config
+	Profiles []uint8 // Profile slots in ascending order
+}
+
+// Any reports whether any record is damaged.
+func (d Damage) Any() bool {
+	return d.Device || len(d.Profiles) > 0
+}
+
+// scan checks the envelope of every stored record. Damaged records are
+// counted in metrics.ConfigCorrupt and listed by Damage.
+func (m *Manager) scan() error {
+	check := func(record, p string) {
+		data, err := m.readFile(p)
+		if err != nil {
+			return // Missing, or reported when loaded
+		}
+		if _, _, err := unseal(recordType(record), data); err != nil {
+			m.damaged[record] = true
+			metrics.Inc(metrics.ConfigCorrupt)
+		}
+	}
+
+	check(deviceRecord, deviceFile)
+	slots, err := m.listProfiles()
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		check(slotRecord(slot), m.profilePath(slot))
+	}
+	return nil
+}
+
+// Damage returns the records found damaged at boot or on a later load.
+// Saving or deleting a record clears it.
+func (m *Manager) Damage() Damage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var d Damage
+	for record := range m.damaged {
+		if record == deviceRecord {
+			d.Device = true
+		} else if slot, err := strconv.ParseUint(record, 10, 8); err == nil {
+			d.Profiles = append(d.Profiles, uint8(slot))
+		}
+	}
+	slices.Sort(d.Profiles)
+	return d
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+
+	"tinygo.org/x/tinyfs"
+)
+
+func TestEnvelope(t *testing.T) {
+	payload := fixtureProfile(config.CurrentVersion, "Sealed")
+	sealed := seal(config.RecordProfile, payload)
+	if len(sealed) != len(payload)+envelopeSize {
+		t.Fatalf("Sealed record is %d bytes", len(sealed))
+	}
+
+	got, legacy, err := unseal(config.RecordProfile, sealed)
+	if err != nil || legacy || !bytes.Equal(got, payload) {
+		t.Errorf("unseal = %v, %v, %v", got, legacy, err)
+	}
+	got, legacy, err = unseal(config.RecordProfile, payload)
+	if err != nil || !legacy || !bytes.Equal(got, payload) {
+		t.Errorf("Bare record: unseal = %v, %v, %v", got, legacy, err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[100] ^= 0x04
+	tests := []struct {
+		name string
+		rec  config.Record
+		data []byte
+	}{
+		{"flipped bit", config.RecordProfile, flipped},
+		{"truncated", config.RecordProfile, sealed[:200]},
+		{"erased tail", config.RecordProfile, append(bytes.Clone(sealed[:200]), bytes.Repeat([]byte{0xFF}, len(sealed)-200)...)},
+		{"wrong type", config.RecordDevice, sealed},
+		{"empty", config.RecordDevice, nil},
+	}
+	for _, tt := range tests {
+		if _, _, err := unseal(tt.rec, tt.data); !errors.Is(err, ErrRecordCorrupt) {
+			t.Errorf("%s: expected ErrRecordCorrupt, got %v", tt.name, err)
+		}
+	}
+}
+
+// damage flips a bit in the middle of the file at p.
+func damage(t *testing.T, mgr *Manager, p string) {
+	t.Helper()
+	data, err := mgr.readFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0x10
+	writeFixture(t, mgr, p, data)
+}
+
+func TestCorruptRecord(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	for slot := uint8(0); slot < 3; slot++ {
+		saveNamed(t, mgr, slot, "Profile")
+	}
+	mgr.SaveDevice(&config.DeviceConfig{Brightness: 50})
+	damage(t, mgr, mgr.profilePath(1))
+	damage(t, mgr, deviceFile)
+
+	var p config.Profile
+	if err := mgr.LoadProfile(1, &p); !errors.Is(err, ErrRecordCorrupt) {
+		t.Errorf("Expected ErrRecordCorrupt, got %v", err)
+	}
+	var cfg config.DeviceConfig
+	if err := mgr.LoadDevice(&cfg); !errors.Is(err, ErrRecordCorrupt) {
+		t.Errorf("Expected ErrRecordCorrupt for the device config, got %v", err)
+	}
+	mgr.Close()
+
+	// The boot scan finds both and leaves them in place
+	metrics.Reset()
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer mgr.Close()
+	d := mgr.Damage()
+	if !d.Device || len(d.Profiles) != 1 || d.Profiles[0] != 1 {
+		t.Errorf("Unexpected damage: %+v", d)
+	}
+	if got := metrics.Get(metrics.ConfigCorrupt); got != 2 {
+		t.Errorf("Expected 2 corrupt records, got %d", got)
+	}
+	if !mgr.ProfileExists(1) {
+		t.Error("Damaged profile was removed")
+	}
+	for _, slot := range []uint8{0, 2} {
+		if err := mgr.LoadProfile(slot, &p); err != nil {
+			t.Errorf("LoadProfile(%d) failed: %v", slot, err)
+		}
+	}
+
+	// Replacing or deleting a damaged record clears it
+	saveNamed(t, mgr, 1, "Fixed")
+	if err := mgr.SaveDevice(&config.DeviceConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if d := mgr.Damage(); d.Any() {
+		t.Errorf("Damage after saving: %+v", d)
+	}
+	damage(t, mgr, mgr.profilePath(2))
+	if err := mgr.LoadProfile(2, &p); !errors.Is(err, ErrRecordCorrupt) {
+		t.Errorf("Expected ErrRecordCorrupt, got %v", err)
+	}
+	if d := mgr.Damage(); len(d.Profiles) != 1 || d.Profiles[0] != 2 {
+		t.Errorf("Damage found on load not listed: %+v", d)
+	}
+	if err := mgr.DeleteProfile(2); err != nil {
+		t.Fatal(err)
+	}
+	if d := mgr.Damage(); d.Any() {
+		t.Errorf("Damage after deleting: %+v", d)
+	}
+
+	// The damaged profile was not archived when deleted
+	if gens, _ := mgr.ProfileHistory(2); len(gens) != 0 {
+		t.Errorf("Damaged profile kept in history: %v", gens)
+	}
+}
+
+func TestLegacyRecordsSealed(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	writeFixture(t, mgr, mgr.profilePath(0), fixtureProfile(config.CurrentVersion, "Bare"))
+	mgr.Close()
+
+	metrics.Reset()
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer mgr.Close()
+
+	if size, _ := mgr.ProfileSize(0); size != profileSize+envelopeSize {
+		t.Errorf("Record not sealed at boot: %d bytes", size)
+	}
+	if name := profileName(t, mgr, 0, 0); name != "Bare" {
+		t.Errorf("Sealed profile is %q", name)
+	}
+	if metrics.Get(metrics.ConfigMigrated) != 0 || mgr.Damage().Any() {
+		t.Error("Sealing counted as a migration or damage")
+	}
+}
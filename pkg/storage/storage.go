@@ -1,15 +1,20 @@
 // Package storage provides persistent configuration storage using LittleFS.
-// It handles atomic writes, version checking, and cleanup of temporary files.
+// It handles atomic writes, version migration, and cleanup of temporary files.
 package storage
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
 
 	"tinygo.org/x/tinyfs"
 	"tinygo.org/x/tinyfs/littlefs"
@@ -22,28 +27,52 @@ const (
 	tempSuffix    = ".tmp"
 	profilePrefix = ""
 	profileSuffix = ".bin"
+	profileSize   = 286 // Encoded config.Profile, without the envelope
 )
 
 var (
 	ErrProfileNotFound = errors.New("profile not found")
+	ErrDeviceNotFound  = errors.New("device config not found")
 	ErrFlashFull       = errors.New("insufficient flash space")
 	ErrInvalidProfile  = errors.New("invalid profile data")
 	ErrVersionMismatch = errors.New("config version mismatch")
 	ErrFilesystem      = errors.New("filesystem error")
+	ErrIO              = errors.New("flash I/O error")
+	ErrCorrupted       = errors.New("filesystem corrupted")
+	ErrRecordCorrupt   = errors.New("stored record corrupted")
 )
 
-// Manager handles config persistence using LittleFS.
+// LittleFS error codes (see lfs.h). The littlefs package does not export them.
+const (
+	lfsErrIO      littlefs.Error = -5
+	lfsErrCorrupt littlefs.Error = -84
+	lfsErrNoEntry littlefs.Error = -2
+	lfsErrNoSpace littlefs.Error = -28
+)
+
+// Manager handles config persistence using LittleFS. It is safe for
+// concurrent use; LittleFS is not reentrant, so operations are serialized.
 type Manager struct {
+	mu       sync.Mutex
 	fs       *littlefs.LFS
 	blockDev tinyfs.BlockDevice
 	mounted  bool
+
+	historyDepth int    // Generations kept per record
+	lastGen      uint32 // Last history generation number used
+
+	damaged map[string]bool // Records that failed their checksum, by history record name
 }
 
-// Stats provides information about storage usage.
+// Stats provides information about storage usage. LittleFS allocates
+// whole erase blocks, so the byte counts are multiples of BlockSize.
 type Stats struct {
 	TotalSpace     int64
 	UsedSpace      int64
 	FreeSpace      int64
+	BlockSize      int64 // Erase block size, the allocation unit
+	BlockCount     int   // Blocks in the filesystem
+	UsedBlocks     int   // Blocks allocated, including metadata
 	ProfileCount   int
 	NeedsMigration bool // true if config version mismatch detected
 }
@@ -52,34 +81,17 @@ type Stats struct {
 // It mounts the filesystem and performs boot-time cleanup.
 // If format is true and mount fails, it will format the filesystem.
 func New(blockDev tinyfs.BlockDevice, format bool) (*Manager, error) {
-	lfs := littlefs.New(blockDev)
-
-	// Configure LittleFS for RP2040 flash
-	// These are conservative settings for reliability
-	lfs.Configure(&littlefs.Config{
-		CacheSize:     512,
-		LookaheadSize: 128,
-	})
-
-	// Try to mount existing filesystem
-	err := lfs.Mount()
+	lfs, err := mount(blockDev, format)
 	if err != nil {
-		if !format {
-			return nil, err
-		}
-		// Format and try again
-		if err := lfs.Format(); err != nil {
-			return nil, err
-		}
-		if err := lfs.Mount(); err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
 
 	m := &Manager{
-		fs:       lfs,
-		blockDev: blockDev,
-		mounted:  true,
+		fs:           lfs,
+		blockDev:     blockDev,
+		mounted:      true,
+		historyDepth: DefaultHistoryDepth,
+		damaged:      make(map[string]bool),
 	}
 
 	// Perform boot-time cleanup
@@ -88,26 +100,71 @@ func New(blockDev tinyfs.BlockDevice, format bool) (*Manager, error) {
 		// TODO: logging
 	}
 
-	// Check version and handle migration
-	needsWipe, err := m.checkVersion()
-	if err != nil {
-		// No device config yet or error reading - that's ok for first boot
-		needsWipe = false
+	// Bring records from older firmware up to the current version. A record
+	// that fails to migrate is left as is and retried on the next boot.
+	if err := m.migrate(); err != nil {
+		// TODO: logging
 	}
 
-	if needsWipe {
-		// Version mismatch - wipe all configs
-		// This is intentional - user must restore from PC app after firmware update
-		if err := m.wipeAll(); err != nil {
-			return nil, err
+	// The device config chooses the history depth
+	if data, err := m.loadRecord(config.RecordDevice, deviceRecord, deviceFile, ErrDeviceNotFound); err == nil {
+		var cfg config.DeviceConfig
+		if cfg.UnmarshalBinary(data) == nil {
+			m.historyDepth = historyDepth(&cfg)
 		}
 	}
 
+	if err := m.loadHistory(); err != nil {
+		// TODO: logging
+	}
+
+	// Note damaged records so the user can be told, see Damage
+	if err := m.scan(); err != nil {
+		// TODO: logging
+	}
+
 	return m, nil
 }
 
+// mount mounts the filesystem on blockDev, formatting it first if format
+// is true and the mount fails.
+func mount(blockDev tinyfs.BlockDevice, format bool) (*littlefs.LFS, error) {
+	lfs := newLFS(blockDev)
+
+	// Try to mount existing filesystem
+	err := lfs.Mount()
+	if err != nil {
+		if !format {
+			return nil, err
+		}
+		// Format and try again
+		if err := lfs.Format(); err != nil {
+			return nil, err
+		}
+		if err := lfs.Mount(); err != nil {
+			return nil, err
+		}
+	}
+	return lfs, nil
+}
+
+// newLFS returns an unmounted filesystem on blockDev.
+func newLFS(blockDev tinyfs.BlockDevice) *littlefs.LFS {
+	lfs := littlefs.New(blockDev)
+
+	// Configure LittleFS for RP2040 flash
+	// These are conservative settings for reliability
+	lfs.Configure(&littlefs.Config{
+		CacheSize:     512,
+		LookaheadSize: 128,
+	})
+	return lfs
+}
+
 // Close unmounts the filesystem.
 func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.mounted {
 		m.mounted = false
 		return m.fs.Unmount()
@@ -117,42 +174,23 @@ func (m *Manager) Close() error {
 
 // bootCleanup removes temporary files left over from interrupted writes.
 func (m *Manager) bootCleanup() error {
-	// Clean up temp files in config dir
-	entries, err := m.readDir(configDir)
-	if err != nil {
-		// Config dir might not exist yet
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-
-	for _, entry := range entries {
-		name := entry.Name()
-		if strings.HasSuffix(name, tempSuffix) {
-			tempPath := path.Join(configDir, name)
-			m.fs.Remove(tempPath)
+	for _, dir := range []string{configDir, profilesDir, historyDir} {
+		entries, err := m.readDir(dir)
+		if err != nil {
+			// Directory might not exist yet
+			if err = mapError(err, os.ErrNotExist); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
 		}
-	}
 
-	// Clean up temp files in profiles dir
-	entries, err = m.readDir(profilesDir)
-	if err != nil {
-		// Profiles dir might not exist yet
-		if os.IsNotExist(err) {
-			return nil
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasSuffix(name, tempSuffix) {
+				m.fs.Remove(path.Join(dir, name))
+			}
 		}
-		return err
 	}
-
-	for _, entry := range entries {
-		name := entry.Name()
-		if strings.HasSuffix(name, tempSuffix) {
-			tempPath := path.Join(profilesDir, name)
-			m.fs.Remove(tempPath)
-		}
-	}
-
 	return nil
 }
 
@@ -171,34 +209,95 @@ func (m *Manager) readDir(dirPath string) ([]os.FileInfo, error) {
 	return f.Readdir(-1)
 }
 
-// checkVersion reads device config and checks if version matches.
-// Returns true if configs should be wiped (version mismatch).
-func (m *Manager) checkVersion() (bool, error) {
-	var deviceCfg config.DeviceConfig
-	if err := m.LoadDevice(&deviceCfg); err != nil {
-		if os.IsNotExist(err) {
-			// No device config yet - not a version mismatch, just first boot
-			return false, nil
+// migrations upgrades stored records at boot. Tests swap in a registry with
+// a different target version.
+var migrations = config.Migrations
+
+// migrate upgrades every stored record to the current config version. Each
+// record is rewritten atomically on its own, so a migration interrupted by a
+// power loss resumes on the next boot. Records with no migration path, such
+// as those written by newer firmware, are removed.
+func (m *Manager) migrate() error {
+	var firstErr error
+	try := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	try(m.migrateRecord(config.RecordDevice, deviceFile))
+
+	slots, err := m.listProfiles()
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		try(m.migrateRecord(config.RecordProfile, m.profilePath(slot)))
+	}
+	return firstErr
+}
+
+// migrateRecord upgrades the record in file p if it is not current, and
+// seals records written before envelopes. A damaged record is left in
+// place for the boot scan to report.
+func (m *Manager) migrateRecord(rec config.Record, p string) error {
+	data, err := m.readFile(p)
+	if err != nil {
+		if err = mapError(err, os.ErrNotExist); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, legacy, err := unseal(rec, data)
+	if err != nil {
+		return err
+	}
+	if v, err := config.RecordVersion(data); err == nil && v == migrations.Target() {
+		if !legacy {
+			return nil
 		}
-		return false, err
+		return mapError(m.atomicWrite(p, seal(rec, data)), ErrFilesystem)
+	}
+
+	out, err := migrations.Migrate(rec, data)
+	if err == nil && len(out) != rec.Size() {
+		err = config.ErrRecordLength
 	}
+	if err != nil {
+		metrics.Inc(metrics.ConfigDropped)
+		return mapError(m.fs.Remove(p), nil)
+	}
+
+	metrics.Inc(metrics.ConfigMigrated)
+	return mapError(m.atomicWrite(p, seal(rec, out)), ErrFilesystem)
+}
 
-	return deviceCfg.Version != config.CurrentVersion, nil
+// readFile returns the whole contents of the file at p.
+func (m *Manager) readFile(p string) ([]byte, error) {
+	f, err := m.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
 }
 
 // wipeAll removes all configuration files.
 func (m *Manager) wipeAll() error {
 	// Remove all profiles
-	slots, err := m.ListProfiles()
+	slots, err := m.listProfiles()
 	if err == nil {
 		for _, slot := range slots {
-			m.DeleteProfile(slot)
+			m.deleteProfile(slot)
 		}
 	}
 
 	// Remove device config
 	m.fs.Remove(deviceFile)
 
+	m.wipeHistory()
+	clear(m.damaged)
+
 	return nil
 }
 
@@ -226,30 +325,67 @@ func isExist(err error) bool {
 	return strings.Contains(err.Error(), "already exists")
 }
 
-// LoadDevice loads the device configuration.
-func (m *Manager) LoadDevice(cfg *config.DeviceConfig) error {
-	f, err := m.fs.Open(deviceFile)
-	if err != nil {
-		return err
+// mapError translates a LittleFS error into one of the package's sentinel
+// errors so callers can tell a missing file from a full or failing flash.
+// notFound is returned for a missing entry. Unknown errors are wrapped in
+// ErrFilesystem; the original error stays available to errors.As.
+// Everything except a missing entry is counted in metrics.StorageErrors.
+func mapError(err error, notFound error) error {
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return notFound
+	}
+	if err == ErrFlashFull {
+		return err // Refused by atomicWrite; nothing was written
 	}
-	defer f.Close()
 
-	buf := make([]byte, 12)
-	n, err := f.Read(buf)
-	if err != nil {
+	var lfsErr littlefs.Error
+	isLFS := errors.As(err, &lfsErr)
+	if isLFS && lfsErr == lfsErrNoEntry {
+		return notFound
+	}
+
+	metrics.Inc(metrics.StorageErrors)
+	if !isLFS {
 		return err
 	}
-	if n != 12 {
-		return ErrInvalidProfile
+	switch lfsErr {
+	case lfsErrNoSpace:
+		return fmt.Errorf("%w: %w", ErrFlashFull, err)
+	case lfsErrIO:
+		return fmt.Errorf("%w: %w", ErrIO, err)
+	case lfsErrCorrupt:
+		return fmt.Errorf("%w: %w", ErrCorrupted, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrFilesystem, err)
 	}
+}
 
-	return cfg.UnmarshalBinary(buf)
+// LoadDevice loads the device configuration.
+// Returns ErrDeviceNotFound if no device config has been saved yet, and
+// ErrRecordCorrupt if the stored config fails its checksum.
+func (m *Manager) LoadDevice(cfg *config.DeviceConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.loadRecord(config.RecordDevice, deviceRecord, deviceFile, ErrDeviceNotFound)
+	if err != nil {
+		return err
+	}
+	return cfg.UnmarshalBinary(data)
 }
 
 // SaveDevice saves the device configuration atomically.
 func (m *Manager) SaveDevice(cfg *config.DeviceConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveDevice(cfg)
+}
+
+func (m *Manager) saveDevice(cfg *config.DeviceConfig) error {
 	if err := m.ensureDirs(); err != nil {
-		return err
+		return mapError(err, ErrFilesystem)
 	}
 
 	// Set version
@@ -260,42 +396,61 @@ func (m *Manager) SaveDevice(cfg *config.DeviceConfig) error {
 		return err
 	}
 
-	return m.atomicWrite(deviceFile, data)
+	data = seal(config.RecordDevice, data)
+	depth := m.historyDepth
+	m.historyDepth = historyDepth(cfg)
+	m.archive(deviceRecord, deviceFile, data)
+	if err := m.atomicWrite(deviceFile, data); err != nil {
+		m.historyDepth = depth
+		return mapError(err, ErrFilesystem)
+	}
+	if m.historyDepth < depth {
+		m.pruneAll()
+	}
+	delete(m.damaged, deviceRecord)
+	return nil
 }
 
 // LoadProfile loads a profile from the given slot.
+// Returns ErrRecordCorrupt if the stored profile fails its checksum.
 func (m *Manager) LoadProfile(slot uint8, profile *config.Profile) error {
-	profilePath := m.profilePath(slot)
-
-	f, err := m.fs.Open(profilePath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.loadRecord(config.RecordProfile, slotRecord(slot), m.profilePath(slot), ErrProfileNotFound)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return ErrProfileNotFound
-		}
-		// Check if it's a "no directory entry" error from littlefs
-		if strings.Contains(err.Error(), "No directory entry") {
-			return ErrProfileNotFound
-		}
 		return err
 	}
-	defer f.Close()
+	return profile.UnmarshalBinary(data)
+}
 
-	buf := make([]byte, 286)
-	n, err := f.Read(buf)
+// loadRecord reads the record in file p and checks its envelope and size.
+// A record failing its checksum is noted as damaged.
+func (m *Manager) loadRecord(rec config.Record, record, p string, notFound error) ([]byte, error) {
+	data, err := m.readFile(p)
 	if err != nil {
-		return err
+		return nil, mapError(err, notFound)
+	}
+	data, _, err = unseal(rec, data)
+	if err != nil {
+		m.damaged[record] = true
+		return nil, err
 	}
-	if n != 286 {
-		return ErrInvalidProfile
+	if len(data) != rec.Size() {
+		return nil, ErrInvalidProfile
 	}
-
-	return profile.UnmarshalBinary(buf)
+	return data, nil
 }
 
 // SaveProfile saves a profile to the given slot atomically.
 func (m *Manager) SaveProfile(slot uint8, profile *config.Profile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveProfile(slot, profile)
+}
+
+func (m *Manager) saveProfile(slot uint8, profile *config.Profile) error {
 	if err := m.ensureDirs(); err != nil {
-		return err
+		return mapError(err, ErrFilesystem)
 	}
 
 	// Set version
@@ -307,17 +462,37 @@ func (m *Manager) SaveProfile(slot uint8, profile *config.Profile) error {
 	}
 
 	profilePath := m.profilePath(slot)
-	return m.atomicWrite(profilePath, data)
+	data = seal(config.RecordProfile, data)
+	m.archive(slotRecord(slot), profilePath, data)
+	if err := m.atomicWrite(profilePath, data); err != nil {
+		return mapError(err, ErrFilesystem)
+	}
+	delete(m.damaged, slotRecord(slot))
+	return nil
 }
 
-// DeleteProfile removes a profile from the given slot.
+// DeleteProfile removes a profile from the given slot. The profile stays
+// in the slot's history and can be restored.
 func (m *Manager) DeleteProfile(slot uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteProfile(slot)
+}
+
+func (m *Manager) deleteProfile(slot uint8) error {
 	profilePath := m.profilePath(slot)
-	return m.fs.Remove(profilePath)
+	m.archive(slotRecord(slot), profilePath, nil)
+	if err := m.fs.Remove(profilePath); err != nil {
+		return mapError(err, ErrProfileNotFound)
+	}
+	delete(m.damaged, slotRecord(slot))
+	return nil
 }
 
 // ProfileExists checks if a profile exists in the given slot.
 func (m *Manager) ProfileExists(slot uint8) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	profilePath := m.profilePath(slot)
 	f, err := m.fs.Open(profilePath)
 	if err != nil {
@@ -327,11 +502,29 @@ func (m *Manager) ProfileExists(slot uint8) bool {
 	return true
 }
 
-// ListProfiles returns a list of occupied profile slots.
+// ProfileSize returns the size in bytes of the profile file in the given slot.
+func (m *Manager) ProfileSize(slot uint8) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, err := m.fs.Stat(m.profilePath(slot))
+	if err != nil {
+		return 0, mapError(err, ErrProfileNotFound)
+	}
+	return info.Size(), nil
+}
+
+// ListProfiles returns a list of occupied profile slots in ascending order.
 func (m *Manager) ListProfiles() ([]uint8, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.listProfiles()
+}
+
+func (m *Manager) listProfiles() ([]uint8, error) {
 	entries, err := m.readDir(profilesDir)
 	if err != nil {
-		if os.IsNotExist(err) {
+		// Profiles dir might not exist yet (no profiles saved)
+		if err = mapError(err, ErrProfileNotFound); errors.Is(err, ErrProfileNotFound) {
 			return []uint8{}, nil
 		}
 		return nil, err
@@ -356,50 +549,73 @@ func (m *Manager) ListProfiles() ([]uint8, error) {
 		}
 	}
 
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
 	return slots, nil
 }
 
-// GetStats returns storage statistics.
+// GetStats returns storage statistics. Used space is what LittleFS has
+// allocated, counted by walking the filesystem.
 func (m *Manager) GetStats() (*Stats, error) {
-	// LittleFS doesn't have a direct "free space" call
-	// We can estimate by trying to allocate or tracking usage
-
-	profiles, err := m.ListProfiles()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	profiles, err := m.listProfiles()
 	if err != nil {
-		// Directory might not exist yet (no profiles saved)
-		if strings.Contains(err.Error(), "No directory entry") {
-			profiles = []uint8{}
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
 
-	// Estimate space used
-	// Each profile: 286 bytes data + ~32 bytes LittleFS overhead = ~320 bytes
-	// Device config: 12 bytes + ~32 bytes overhead = ~44 bytes
-	// Plus directory entries
-	used := int64(len(profiles)*320 + 100)
-
-	// Total space is from the block device
-	total := m.blockDev.Size()
+	used, err := m.fs.Size()
+	if err != nil {
+		return nil, mapError(err, ErrFilesystem)
+	}
+	blockSize := m.blockDev.EraseBlockSize()
+	count := int(m.blockDev.Size() / blockSize)
+	used = min(used, count) // Size may count shared blocks twice
 
 	return &Stats{
-		TotalSpace:   total,
-		UsedSpace:    used,
-		FreeSpace:    total - used,
+		TotalSpace:   int64(count) * blockSize,
+		UsedSpace:    int64(used) * blockSize,
+		FreeSpace:    int64(count-used) * blockSize,
+		BlockSize:    blockSize,
+		BlockCount:   count,
+		UsedBlocks:   used,
 		ProfileCount: len(profiles),
 	}, nil
 }
 
-// CanFitProfile estimates if a new profile can be stored.
-// This is a conservative estimate.
-func (m *Manager) CanFitProfile() bool {
-	stats, err := m.GetStats()
+// blocksNeeded returns the free blocks an atomicWrite of size bytes needs.
+// The temp file is written while the old file still exists, so nothing is
+// freed first. Small files are stored inline in their directory, but
+// adding one can split the directory's metadata pair, so two blocks are
+// always kept for that on top of the data blocks.
+func (m *Manager) blocksNeeded(size int) int {
+	blockSize := int(m.blockDev.EraseBlockSize())
+	return 2 + (size+blockSize-1)/blockSize
+}
+
+// CanFit reports whether a record of size bytes can be written.
+func (m *Manager) CanFit(size int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkFit(size) == nil
+}
+
+// checkFit returns ErrFlashFull if a record of size bytes might not fit.
+func (m *Manager) checkFit(size int) error {
+	used, err := m.fs.Size()
 	if err != nil {
-		return false
+		return err
+	}
+	free := int(m.blockDev.Size()/m.blockDev.EraseBlockSize()) - used
+	if free < m.blocksNeeded(size) {
+		return ErrFlashFull
 	}
-	// Need space for profile + overhead + potential block alignment
-	return stats.FreeSpace > 512
+	return nil
+}
+
+// CanFitProfile reports whether a profile can be written.
+func (m *Manager) CanFitProfile() bool {
+	return m.CanFit(profileSize + envelopeSize)
 }
 
 // profilePath returns the filesystem path for a profile slot.
@@ -409,7 +625,18 @@ func (m *Manager) profilePath(slot uint8) string {
 
 // atomicWrite writes data to a temporary file, syncs it, then renames.
 // This ensures atomic updates - the original file is never in a partially written state.
+// When the temp file might not fit, the oldest history generations are
+// pruned; if that is not enough it fails with ErrFlashFull before touching
+// the flash.
 func (m *Manager) atomicWrite(filepath string, data []byte) error {
+	if err := m.makeRoom(len(data)); err != nil {
+		return err
+	}
+	return m.writeFile(filepath, data)
+}
+
+// writeFile is atomicWrite without making room; the caller checks the fit.
+func (m *Manager) writeFile(filepath string, data []byte) error {
 	tempPath := filepath + tempSuffix
 
 	// Remove temp file if it exists (from interrupted previous write)
@@ -456,5 +683,7 @@ func (m *Manager) atomicWrite(filepath string, data []byte) error {
 
 // ForceWipe completely erases all configuration (for testing/debugging).
 func (m *Manager) ForceWipe() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.wipeAll()
 }
@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/metrics"
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/partition"
 
 	"tinygo.org/x/tinyfs"
+	"tinygo.org/x/tinyfs/littlefs"
 )
 
 func newTestStorage(t *testing.T) (*Manager, *tinyfs.MemBlockDevice) {
@@ -264,6 +268,182 @@ func TestVersionMismatchWipe(t *testing.T) {
 	}
 }
 
+// withMigrations swaps the boot migrations for m until the test ends.
+func withMigrations(t *testing.T, m *config.Migrator) {
+	saved := migrations
+	migrations = m
+	t.Cleanup(func() { migrations = saved })
+}
+
+// writeFixture stores a raw record as older or newer firmware would have.
+func writeFixture(t *testing.T, mgr *Manager, p string, rec []byte) {
+	t.Helper()
+	if err := mgr.ensureDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.atomicWrite(p, rec); err != nil {
+		t.Fatalf("Writing fixture %s failed: %v", p, err)
+	}
+}
+
+func fixtureProfile(version uint16, name string) []byte {
+	p := config.Profile{Version: version, RGBColor: 0x112233, BindingCount: 1}
+	p.SetName(name)
+	data, _ := p.MarshalBinary()
+	return data
+}
+
+// migrationsV2 upgrades from version 1 to 2: device brightness moved from
+// a 0-127 to a 0-255 scale, profile colors from BGR to RGB.
+func migrationsV2(profileSteps *int) *config.Migrator {
+	m := config.NewMigrator(2)
+	m.Register(config.RecordDevice, 1, func(data []byte) ([]byte, error) {
+		data[7] *= 2
+		return data, nil
+	})
+	m.Register(config.RecordProfile, 1, func(data []byte) ([]byte, error) {
+		*profileSteps++
+		data[6], data[8] = data[8], data[6]
+		return data, nil
+	})
+	return m
+}
+
+func TestMigrateOnBoot(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	device, _ := (&config.DeviceConfig{Version: 1, Brightness: 100, ActiveProfile: 1}).MarshalBinary()
+	writeFixture(t, mgr, deviceFile, device)
+	writeFixture(t, mgr, mgr.profilePath(0), fixtureProfile(1, "Zero"))
+	writeFixture(t, mgr, mgr.profilePath(1), fixtureProfile(1, "One"))
+	writeFixture(t, mgr, mgr.profilePath(2), fixtureProfile(9, "Future"))
+	mgr.Close()
+
+	// Boot firmware with config version 2
+	var steps int
+	withMigrations(t, migrationsV2(&steps))
+	metrics.Reset()
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+
+	var cfg config.DeviceConfig
+	if err := mgr.LoadDevice(&cfg); err != nil {
+		t.Fatalf("LoadDevice failed: %v", err)
+	}
+	if cfg.Version != 2 || cfg.Brightness != 200 || cfg.ActiveProfile != 1 {
+		t.Errorf("Unexpected migrated device config: %+v", cfg)
+	}
+
+	for slot, name := range []string{"Zero", "One"} {
+		var p config.Profile
+		if err := mgr.LoadProfile(uint8(slot), &p); err != nil {
+			t.Fatalf("LoadProfile(%d) failed: %v", slot, err)
+		}
+		if p.Version != 2 || p.RGBColor != 0x332211 || p.GetName() != name {
+			t.Errorf("Unexpected migrated profile %d: %+v", slot, p)
+		}
+	}
+
+	// No path down from newer firmware
+	if mgr.ProfileExists(2) {
+		t.Error("Profile from newer firmware should be removed")
+	}
+
+	if got := metrics.Get(metrics.ConfigMigrated); got != 3 {
+		t.Errorf("Expected 3 migrated records, got %d", got)
+	}
+	if got := metrics.Get(metrics.ConfigDropped); got != 1 {
+		t.Errorf("Expected 1 dropped record, got %d", got)
+	}
+	mgr.Close()
+
+	// Migrated records are current on the next boot
+	mgr, _ = New(blockDev, false)
+	defer mgr.Close()
+	if steps != 2 || metrics.Get(metrics.ConfigMigrated) != 3 {
+		t.Errorf("Records migrated again: %d profile steps", steps)
+	}
+}
+
+func TestMigrateResumes(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	// Power lost while migrating slot 1: slot 0 is done, slot 1 still has
+	// its old record next to a partial temp file
+	writeFixture(t, mgr, mgr.profilePath(0), fixtureProfile(2, "Done"))
+	writeFixture(t, mgr, mgr.profilePath(1), fixtureProfile(1, "Pending"))
+	writeFixture(t, mgr, mgr.profilePath(1)+tempSuffix, []byte{2, 0, 0xFF})
+	mgr.Close()
+
+	var steps int
+	withMigrations(t, migrationsV2(&steps))
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer mgr.Close()
+
+	if steps != 1 {
+		t.Errorf("Expected only the pending profile to migrate, got %d steps", steps)
+	}
+	for slot, name := range []string{"Done", "Pending"} {
+		var p config.Profile
+		if err := mgr.LoadProfile(uint8(slot), &p); err != nil || p.Version != 2 || p.GetName() != name {
+			t.Errorf("Profile %d = %+v, %v", slot, p, err)
+		}
+	}
+	if _, err := mgr.fs.Stat(mgr.profilePath(1) + tempSuffix); err == nil {
+		t.Error("Temp file from the interrupted migration was not removed")
+	}
+}
+
+func TestMigrateFallsBackToWipe(t *testing.T) {
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 64)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	device, _ := (&config.DeviceConfig{Version: 1}).MarshalBinary()
+	writeFixture(t, mgr, deviceFile, device)
+	writeFixture(t, mgr, mgr.profilePath(0), fixtureProfile(1, "Kept"))
+	writeFixture(t, mgr, mgr.profilePath(1), fixtureProfile(1, "Truncated"))
+	mgr.Close()
+
+	// Profiles migrate, but the step truncates slot 1; there is no device
+	// config step at all
+	m := config.NewMigrator(2)
+	m.Register(config.RecordProfile, 1, func(data []byte) ([]byte, error) {
+		if data[14] == 'T' {
+			return data[:100], nil
+		}
+		return data, nil
+	})
+	withMigrations(t, m)
+
+	mgr, err = New(blockDev, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer mgr.Close()
+
+	var cfg config.DeviceConfig
+	if err := mgr.LoadDevice(&cfg); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Expected device config to be wiped, got %v", err)
+	}
+	if slots, _ := mgr.ListProfiles(); len(slots) != 1 || slots[0] != 0 {
+		t.Errorf("Expected only slot 0 to survive, got %v", slots)
+	}
+}
+
 func TestFactoryReset(t *testing.T) {
 	mgr, _ := newTestStorage(t)
 	defer mgr.Close()
@@ -290,6 +470,103 @@ func TestFactoryReset(t *testing.T) {
 	}
 }
 
+// newOldLayout returns a device like machine.Flash on a 2 MiB board whose
+// firmware ends at base, holding a filesystem as firmware from before the
+// fixed layout left it: from oldBase to the end of flash.
+func newOldLayout(t *testing.T, base, oldBase int64) (tinyfs.BlockDevice, *Manager) {
+	t.Helper()
+	flash := tinyfs.NewMemoryDevice(256, 4096, int(2<<20-base)/4096)
+	old, err := partition.New(flash, oldBase-base, flash.Size()-(oldBase-base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr, err := New(old, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.SaveDevice(&config.DeviceConfig{ActiveProfile: 3, Brightness: 40})
+	for _, slot := range []uint8{0, 3} {
+		profile := config.Profile{}
+		profile.SetName("Profile " + string('0'+slot))
+		mgr.SaveProfile(slot, &profile)
+	}
+	return flash, mgr
+}
+
+func TestOpenMovesOldFilesystem(t *testing.T) {
+	const base = 64 << 10
+	flash, mgr := newOldLayout(t, base, 96<<10) // Firmware grew since
+	mgr.Close()
+
+	for boot := 0; boot < 2; boot++ {
+		mgr, err := Open(flash, base)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		var device config.DeviceConfig
+		if err := mgr.LoadDevice(&device); err != nil || device.ActiveProfile != 3 || device.Brightness != 40 {
+			t.Errorf("device config after Open: %+v, %v", device, err)
+		}
+		var profile config.Profile
+		if err := mgr.LoadProfile(3, &profile); err != nil || profile.GetName() != "Profile 3" {
+			t.Errorf("profile 3 after Open: %q, %v", profile.GetName(), err)
+		}
+		if slots, _ := mgr.ListProfiles(); len(slots) != 2 {
+			t.Errorf("Expected 2 profiles, got %v", slots)
+		}
+		if stats, _ := mgr.GetStats(); stats.TotalSpace != 1<<20 {
+			t.Errorf("Filesystem of %d bytes, not at its fixed place", stats.TotalSpace)
+		}
+		mgr.Close()
+		if FindOld(flash, partition.StorageStart-base) != nil {
+			t.Error("Old filesystem still found after moving it")
+		}
+	}
+}
+
+func TestOpenBlankFlash(t *testing.T) {
+	const base = 64 << 10
+	flash := tinyfs.NewMemoryDevice(256, 4096, int(2<<20-base)/4096)
+	mgr, err := Open(flash, base)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer mgr.Close()
+	if slots, _ := mgr.ListProfiles(); len(slots) != 0 {
+		t.Errorf("Blank flash has profiles %v", slots)
+	}
+}
+
+func TestOpenKeepsOldFilesystemOnError(t *testing.T) {
+	const base = 64 << 10
+	flash, mgr := newOldLayout(t, base, base)
+	// A profile that cannot be read
+	if err := mgr.fs.Mkdir(mgr.profilePath(7), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mgr.Close()
+
+	if _, err := Open(flash, base); err == nil {
+		t.Fatal("Open succeeded with an unreadable profile")
+	}
+	dev, _ := partition.Storage(flash, base)
+	if _, err := New(dev, false); err == nil {
+		t.Error("Failed move formatted the filesystem area")
+	}
+	old := FindOld(flash, partition.StorageStart-base)
+	if old == nil {
+		t.Fatal("Failed move lost the old filesystem")
+	}
+	mgr, err := New(old, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.Close()
+	if !mgr.ProfileExists(3) {
+		t.Error("Failed move lost profile 3")
+	}
+}
+
 func TestStorageStats(t *testing.T) {
 	mgr, _ := newTestStorage(t)
 	defer mgr.Close()
@@ -303,6 +580,14 @@ func TestStorageStats(t *testing.T) {
 	if stats1.ProfileCount != 0 {
 		t.Errorf("Expected 0 profiles initially, got %d", stats1.ProfileCount)
 	}
+	if stats1.BlockSize != 4096 || stats1.BlockCount != 64 || stats1.TotalSpace != 64*4096 {
+		t.Errorf("Unexpected geometry: %+v", stats1)
+	}
+	// The superblock pair is always allocated
+	if stats1.UsedBlocks < 2 || stats1.UsedSpace != int64(stats1.UsedBlocks)*4096 ||
+		stats1.UsedSpace+stats1.FreeSpace != stats1.TotalSpace {
+		t.Errorf("Inconsistent usage: %+v", stats1)
+	}
 
 	// Add profiles
 	for i := 0; i < 5; i++ {
@@ -325,6 +610,58 @@ func TestStorageStats(t *testing.T) {
 	if !mgr.CanFitProfile() {
 		t.Error("CanFitProfile should return true with available space")
 	}
+	// The profile directories take metadata blocks of their own
+	if stats2.UsedBlocks <= stats1.UsedBlocks {
+		t.Errorf("Used blocks did not grow: %d -> %d", stats1.UsedBlocks, stats2.UsedBlocks)
+	}
+}
+
+func TestFlashFull(t *testing.T) {
+	mgr, err := New(tinyfs.NewMemoryDevice(256, 4096, 12), true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer mgr.Close()
+
+	// Fill the flash; the write that might not fit is refused up front
+	var saved int
+	for ; saved < 256; saved++ {
+		profile := config.Profile{}
+		profile.SetName("Filler")
+		err = mgr.SaveProfile(uint8(saved), &profile)
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrFlashFull) {
+		t.Fatalf("Expected ErrFlashFull, got %v after %d profiles", err, saved)
+	}
+	if saved == 0 || mgr.CanFitProfile() {
+		t.Errorf("Saved %d profiles, CanFitProfile = %v", saved, mgr.CanFitProfile())
+	}
+
+	// Replacing a profile also needs room for the temp file
+	var profile config.Profile
+	if err := mgr.LoadProfile(0, &profile); err != nil {
+		t.Fatalf("Failed to load profile 0: %v", err)
+	}
+	if err := mgr.SaveProfile(0, &profile); !errors.Is(err, ErrFlashFull) {
+		t.Errorf("Expected ErrFlashFull replacing a profile, got %v", err)
+	}
+
+	// Everything saved before stays readable
+	for slot := 0; slot < saved; slot++ {
+		if err := mgr.LoadProfile(uint8(slot), &profile); err != nil {
+			t.Errorf("Failed to load profile %d: %v", slot, err)
+		}
+	}
+	stats, err := mgr.GetStats()
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	if stats.ProfileCount != saved || stats.FreeSpace >= 3*stats.BlockSize {
+		t.Errorf("Unexpected stats when full: %+v", stats)
+	}
 }
 
 func BenchmarkProfileSave(b *testing.B) {
@@ -373,3 +710,66 @@ func BenchmarkProfileLoad(b *testing.B) {
 		mgr.LoadProfile(0, &loaded)
 	}
 }
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{lfsErrNoEntry, ErrProfileNotFound},
+		{lfsErrNoSpace, ErrFlashFull},
+		{lfsErrIO, ErrIO},
+		{lfsErrCorrupt, ErrCorrupted},
+		{littlefs.Error(-22), ErrFilesystem},
+	}
+
+	metrics.Reset()
+	for _, tt := range tests {
+		got := mapError(tt.err, ErrProfileNotFound)
+		if !errors.Is(got, tt.want) {
+			t.Errorf("mapError(%v): expected %v, got %v", tt.err, tt.want, got)
+		}
+	}
+
+	// Missing entries are not counted as storage errors
+	if got := metrics.Get(metrics.StorageErrors); got != uint32(len(tests)-1) {
+		t.Errorf("Expected %d storage errors, got %d", len(tests)-1, got)
+	}
+
+	if mapError(nil, ErrProfileNotFound) != nil {
+		t.Error("mapError(nil) should be nil")
+	}
+}
+
+func TestFlashFullError(t *testing.T) {
+	// Small device so it fills quickly
+	blockDev := tinyfs.NewMemoryDevice(256, 4096, 16)
+	mgr, err := New(blockDev, true)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer mgr.Close()
+
+	for slot := 0; slot < 256; slot++ {
+		err = mgr.SaveProfile(uint8(slot), &config.Profile{})
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrFlashFull) {
+		t.Errorf("Expected ErrFlashFull, got %v", err)
+	}
+}
+
+func TestDeviceNotFound(t *testing.T) {
+	mgr, _ := newTestStorage(t)
+	defer mgr.Close()
+
+	var device config.DeviceConfig
+	if err := mgr.LoadDevice(&device); err != ErrDeviceNotFound {
+		t.Errorf("Expected ErrDeviceNotFound, got %v", err)
+	}
+	if err := mgr.DeleteProfile(3); err != ErrProfileNotFound {
+		t.Errorf("Expected ErrProfileNotFound, got %v", err)
+	}
+}
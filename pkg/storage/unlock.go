@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/tuffrabit/tinygo-narwhal-rp2040/pkg/config"
+)
+
+// The count of wrong unlock PINs lives in flash, so restarting the pad does
+// not reset the protocol's unlock backoff. It is only written when a PIN is
+// wrong or after a successful unlock, both rate limited by that backoff.
+const (
+	unlockFile   = "/config/unlock.bin"
+	recordUnlock = config.Record(0x80) // Envelope type, not a config record
+)
+
+// UnlockFailures returns the number of wrong PINs stored by
+// SetUnlockFailures, 0 if none. A damaged count returns ErrRecordCorrupt;
+// callers should then assume the worst.
+func (m *Manager) UnlockFailures() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := m.readFile(unlockFile)
+	if err != nil {
+		if err = mapError(err, os.ErrNotExist); errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	payload, _, err := unseal(recordUnlock, data)
+	if err != nil || len(payload) != 4 {
+		return 0, ErrRecordCorrupt
+	}
+	return int(binary.LittleEndian.Uint32(payload)), nil
+}
+
+// SetUnlockFailures stores the number of wrong PINs; 0 removes the count.
+func (m *Manager) SetUnlockFailures(n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n <= 0 {
+		err := m.fs.Remove(unlockFile)
+		if err = mapError(err, os.ErrNotExist); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := m.ensureDirs(); err != nil {
+		return mapError(err, ErrFilesystem)
+	}
+	data := seal(recordUnlock, binary.LittleEndian.AppendUint32(nil, uint32(n)))
+	return mapError(m.atomicWrite(unlockFile, data), ErrFilesystem)
+}